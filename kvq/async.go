@@ -0,0 +1,75 @@
+package kvq
+
+// CommitAsync commits the transaction in the background, returning
+// immediately, and calls `fn` with the result once the commit has been
+// written to storage, or has failed. Commits are written in the order they
+// were made. This suits producers that can tolerate slightly deferred
+// durability, but cannot wait for each write to be synced to disk. If the
+// commit fails, the transaction is discarded as if closed. The Txn itself is
+// reset, and may be used for further puts and takes straight away, unless it
+// belongs to a MultiTxn, which must not be used until `fn` has been called.
+func (txn *Txn) CommitAsync(fn func(error)) {
+	if fn == nil {
+		fn = func(error) {}
+	}
+	if m := txn.multi; m != nil {
+		txn.queue.enqueue(func() {
+			err := m.Commit()
+			if err != nil {
+				m.Close()
+			}
+			fn(err)
+		})
+		return
+	}
+
+	txn.mutex.Lock()
+	if txn.timedOut {
+		txn.timedOut = false
+		txn.Reset()
+		txn.mutex.Unlock()
+		txn.queue.enqueue(func() { fn(ErrTxnTimeout) })
+		return
+	}
+	held := txn.detach()
+	txn.mutex.Unlock()
+
+	txn.queue.enqueue(func() {
+		err := held.Commit()
+		if err != nil {
+			held.Close()
+		}
+		fn(err)
+	})
+}
+
+// enqueue arranges for `fn` to be called in the background, after any
+// functions enqueued before it.
+func (q *Queue) enqueue(fn func()) {
+	q.mutex.Lock()
+	q.asyncWrites = append(q.asyncWrites, fn)
+	start := !q.asyncWriting
+	q.asyncWriting = true
+	q.mutex.Unlock()
+
+	if start {
+		go q.writeAsync()
+	}
+}
+
+// writeAsync calls each enqueued function in turn, until none remain.
+func (q *Queue) writeAsync() {
+	for {
+		q.mutex.Lock()
+		if len(q.asyncWrites) == 0 {
+			q.asyncWriting = false
+			q.mutex.Unlock()
+			return
+		}
+		fn := q.asyncWrites[0]
+		q.asyncWrites = q.asyncWrites[1:]
+		q.mutex.Unlock()
+
+		fn()
+	}
+}
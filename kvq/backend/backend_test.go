@@ -1,12 +1,30 @@
 package backend_test
 
 import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	. "github.com/johnsto/go-kvq/kvq/backend"
 	"github.com/johnsto/go-kvq/kvq/backend/bolt"
+	"github.com/johnsto/go-kvq/kvq/backend/compress"
+	"github.com/johnsto/go-kvq/kvq/backend/dynamodb"
+	"github.com/johnsto/go-kvq/kvq/backend/encrypt"
+	"github.com/johnsto/go-kvq/kvq/backend/etcd"
 	"github.com/johnsto/go-kvq/kvq/backend/goleveldb"
 	"github.com/johnsto/go-kvq/kvq/backend/levigo"
+	"github.com/johnsto/go-kvq/kvq/backend/mem"
+	"github.com/johnsto/go-kvq/kvq/backend/pebble"
+	"github.com/johnsto/go-kvq/kvq/backend/postgres"
+	"github.com/johnsto/go-kvq/kvq/backend/redis"
+	"github.com/johnsto/go-kvq/kvq/backend/s3"
+	"github.com/johnsto/go-kvq/kvq/backend/seglog"
+	"github.com/johnsto/go-kvq/kvq/backend/sqlite"
+	"github.com/johnsto/go-kvq/kvq/backend/tiered"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,6 +33,13 @@ func TestGoLevelDB(t *testing.T) {
 	db, err := goleveldb.Open("test.db")
 	assert.NoError(t, err, "opening goleveldb should not error")
 	testBucket(t, db)
+	testCapabilities(t, db)
+	db.Close()
+
+	db, err = goleveldb.OpenReadOnly("test.db")
+	assert.NoError(t, err, "opening goleveldb read-only should not error")
+	testReadOnly(t, db)
+	db.Close()
 }
 
 func TestLevigo(t *testing.T) {
@@ -29,6 +54,452 @@ func TestBolt(t *testing.T) {
 	db, err := bolt.Open("test.db")
 	assert.NoError(t, err, "opening bolt should not error")
 	testBucket(t, db)
+	testCapabilities(t, db)
+	db.Close()
+
+	db, err = bolt.OpenReadOnly("test.db")
+	assert.NoError(t, err, "opening bolt read-only should not error")
+	testReadOnly(t, db)
+	db.Close()
+}
+
+func TestPebble(t *testing.T) {
+	pebble.Destroy("test.db")
+	db, err := pebble.Open("test.db")
+	assert.NoError(t, err, "opening pebble should not error")
+	testBucket(t, db)
+	testCapabilities(t, db)
+	db.Close()
+
+	db, err = pebble.OpenReadOnly("test.db")
+	assert.NoError(t, err, "opening pebble read-only should not error")
+	testReadOnly(t, db)
+	db.Close()
+}
+
+func TestSQLite(t *testing.T) {
+	sqlite.Destroy("test.sqlite")
+	db, err := sqlite.Open("test.sqlite")
+	assert.NoError(t, err, "opening sqlite should not error")
+	testBucket(t, db)
+	testCapabilities(t, db)
+	db.Close()
+
+	db, err = sqlite.OpenReadOnly("test.sqlite")
+	assert.NoError(t, err, "opening sqlite read-only should not error")
+	testReadOnly(t, db)
+	db.Close()
+}
+
+func TestMem(t *testing.T) {
+	db := mem.New()
+	testBucket(t, db)
+	testCapabilities(t, db)
+}
+
+func TestSegLog(t *testing.T) {
+	seglog.Destroy("test.log")
+	db, err := seglog.Open("test.log")
+	assert.NoError(t, err, "opening seglog should not error")
+	testBucket(t, db)
+	db.Close()
+
+	// Ensure log is replayed correctly upon reopening
+	db, err = seglog.Open("test.log")
+	assert.NoError(t, err, "reopening seglog should not error")
+	bucket, err := db.Bucket("test")
+	assert.NoError(t, err, "getting test bucket should not error")
+	v3, err := bucket.Get([]byte("k3"))
+	assert.NoError(t, err, "getting a key after reopening should not fail")
+	assert.Equal(t, []byte("v3"), v3, "the got value should match")
+	v2, err := bucket.Get([]byte("k2"))
+	assert.Equal(t, ErrKeyNotFound, err, "deleted key should remain deleted")
+	assert.Nil(t, v2, "get value should be nil")
+	db.Close()
+
+	// Append a torn header claiming a huge record, as after a crash
+	segments, err := filepath.Glob(filepath.Join("test.log",
+		hex.EncodeToString([]byte("test")), "*.log"))
+	assert.NoError(t, err, "finding segments should not error")
+	assert.NotEmpty(t, segments, "segments should exist")
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err, "opening segment should not error")
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0})
+	assert.NoError(t, err, "writing torn header should not error")
+	f.Close()
+
+	// The torn record is discarded, and the log can be written again
+	db, err = seglog.Open("test.log")
+	assert.NoError(t, err, "reopening seglog should not error")
+	bucket, err = db.Bucket("test")
+	assert.NoError(t, err, "getting test bucket should not error")
+	v3, err = bucket.Get([]byte("k3"))
+	assert.NoError(t, err, "getting a key after a torn write should not fail")
+	assert.Equal(t, []byte("v3"), v3, "the got value should match")
+	assert.NoError(t, bucket.Batch(func(b Batch) error {
+		return b.Put([]byte("k4"), []byte("v4"))
+	}), "writing after a torn write should not error")
+	v4, err := bucket.Get([]byte("k4"))
+	assert.NoError(t, err, "getting a new key should not fail")
+	assert.Equal(t, []byte("v4"), v4, "the got value should match")
+	db.Close()
+}
+
+func TestTiered(t *testing.T) {
+	// Memory tier only
+	testBucket(t, tiered.Wrap(mem.New(), 10))
+
+	// Memory tier that spills to the persistent tier
+	cold := mem.New()
+	testBucket(t, tiered.Wrap(cold, 1))
+	bucket, err := cold.Bucket("test")
+	assert.NoError(t, err, "getting persistent bucket should not error")
+	v3, err := bucket.Get([]byte("k3"))
+	assert.NoError(t, err, "spilled value should be persisted")
+	assert.Equal(t, []byte("v3"), v3, "persisted value should match")
+}
+
+func TestCompress(t *testing.T) {
+	for _, codec := range []compress.Codec{compress.None, compress.Snappy, compress.Zstd} {
+		plain := mem.New()
+		db := compress.Wrap(plain, codec)
+		testBucket(t, db)
+
+		// Ensure compressible values are compressed and restored
+		v := []byte(strings.Repeat("compressible ", 100))
+		bucket, err := db.Bucket("test")
+		assert.NoError(t, err, "getting test bucket should not error")
+		assert.NoError(t, bucket.Batch(func(b Batch) error {
+			return b.Put([]byte("big"), v)
+		}), "putting key in batch should not error")
+		act, err := bucket.Get([]byte("big"))
+		assert.NoError(t, err, "getting a value after put should not error")
+		assert.Equal(t, v, act, "get value should match put value")
+
+		raw, err := plain.Bucket("test")
+		assert.NoError(t, err, "getting raw bucket should not error")
+		stored, err := raw.Get([]byte("big"))
+		assert.NoError(t, err, "getting raw value should not error")
+		if codec != compress.None {
+			assert.True(t, len(stored) < len(v), "value should be compressed")
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	key := encrypt.StaticKey("0123456789abcdef")
+	plain := mem.New()
+	testBucket(t, encrypt.Wrap(plain, key, nil))
+
+	// Ensure nothing is stored in plaintext
+	db := encrypt.Wrap(plain, key, &encrypt.Options{EncryptKeys: true})
+	bucket, err := db.Bucket("secret")
+	assert.NoError(t, err, "getting secret bucket should not error")
+	assert.NoError(t, bucket.Batch(func(b Batch) error {
+		return b.Put([]byte("k1"), []byte("v1"))
+	}), "putting key in batch should not error")
+	v1, err := bucket.Get([]byte("k1"))
+	assert.NoError(t, err, "getting a value after put should not error")
+	assert.Equal(t, []byte("v1"), v1, "get value should match put value")
+
+	raw, err := plain.Bucket("secret")
+	assert.NoError(t, err, "getting raw bucket should not error")
+	raw.ForEach(func(k, v []byte) error {
+		assert.NotEqual(t, []byte("k1"), k, "key should be encrypted")
+		assert.NotContains(t, string(v), "v1", "value should be encrypted")
+		return nil
+	})
+}
+
+func TestEncryptRotate(t *testing.T) {
+	// Bolt and SQLite hold a transaction open while a batch is written
+	backends := map[string]func() (DB, error){
+		"mem": func() (DB, error) { return mem.New(), nil },
+		"bolt": func() (DB, error) {
+			bolt.Destroy("test-rotate.db")
+			return bolt.Open("test-rotate.db")
+		},
+		"sqlite": func() (DB, error) {
+			sqlite.Destroy("test-rotate.sqlite")
+			return sqlite.Open("test-rotate.sqlite")
+		},
+	}
+	for name, open := range backends {
+		for _, encryptKeys := range []bool{false, true} {
+			plain, err := open()
+			assert.NoError(t, err, "opening %s should not error", name)
+			testEncryptRotate(t, plain, encryptKeys)
+			plain.Close()
+		}
+	}
+	bolt.Destroy("test-rotate.db")
+	sqlite.Destroy("test-rotate.sqlite")
+}
+
+// testEncryptRotate rotates the key of values written to `plain`, with keys
+// encrypted if `encryptKeys` is set, and re-encrypts them.
+func testEncryptRotate(t *testing.T, plain DB, encryptKeys bool) {
+	oldKey := encrypt.StaticKey("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+	db := encrypt.Wrap(plain, oldKey, &encrypt.Options{EncryptKeys: encryptKeys})
+	bucket, err := db.Bucket("secret")
+	assert.NoError(t, err, "getting bucket should not error")
+	assert.NoError(t, bucket.Batch(func(b Batch) error {
+		b.Put([]byte("k1"), []byte("v1"))
+		return b.Put([]byte("k2"), []byte("v2"))
+	}), "putting keys should not error")
+
+	r := db.(KeyRotator)
+	assert.NoError(t, r.Rotate(newKey), "rotating key should not error")
+	v1, err := bucket.Get([]byte("k1"))
+	assert.NoError(t, err, "getting value written with old key should not error")
+	assert.Equal(t, []byte("v1"), v1)
+	assert.NoError(t, bucket.Batch(func(b Batch) error {
+		return b.Put([]byte("k2"), []byte("v2b"))
+	}), "replacing key should not error")
+
+	// Only the new key is needed once re-encrypted
+	stale := encrypt.Wrap(plain, encrypt.StaticKey(newKey),
+		&encrypt.Options{EncryptKeys: encryptKeys})
+	staleBucket, err := stale.Bucket("secret")
+	assert.NoError(t, err, "getting bucket should not error")
+	_, err = staleBucket.Get([]byte("k1"))
+	assert.Error(t, err, "value should need old key before re-encrypting")
+
+	assert.NoError(t, r.Reencrypt("secret"), "re-encrypting should not error")
+	values := map[string]string{}
+	assert.NoError(t, staleBucket.ForEach(func(k, v []byte) error {
+		values[string(k)] = string(v)
+		return nil
+	}), "iterating with new key should not error")
+	assert.Equal(t, map[string]string{"k1": "v1", "k2": "v2b"}, values)
+
+	// Old keys can be supplied when wrapping
+	old := encrypt.Wrap(plain, oldKey, &encrypt.Options{
+		EncryptKeys: encryptKeys,
+		OldKeys:     [][]byte{newKey},
+	})
+	oldBucket, err := old.Bucket("secret")
+	assert.NoError(t, err, "getting bucket should not error")
+	v1, err = oldBucket.Get([]byte("k1"))
+	assert.NoError(t, err, "getting value with old key should not error")
+	assert.Equal(t, []byte("v1"), v1)
+}
+
+// mapStore is an in-memory s3.Store.
+type mapStore struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *mapStore) Put(key string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *mapStore) Get(key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.objects[key], nil
+}
+
+func (s *mapStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func TestS3(t *testing.T) {
+	store := &mapStore{objects: map[string][]byte{}}
+	testBucket(t, s3.Wrap(mem.New(), store, 0))
+	assert.Len(t, store.objects, 1, "only remaining value should be stored")
+}
+
+// failDB wraps a DB, failing every batch written to its buckets while `fail`
+// is set.
+type failDB struct {
+	DB
+	fail bool
+}
+
+func (db *failDB) Bucket(name string) (Bucket, error) {
+	b, err := db.DB.Bucket(name)
+	return &failBucket{Bucket: b, db: db}, err
+}
+
+type failBucket struct {
+	Bucket
+	db *failDB
+}
+
+var errBatchFailed = errors.New("batch failed")
+
+func (b *failBucket) Batch(fn func(Batch) error) error {
+	if b.db.fail {
+		return errBatchFailed
+	}
+	return b.Bucket.Batch(fn)
+}
+
+// TestS3Failure tests that a failed write never loses or leaks the objects
+// holding offloaded values.
+func TestS3Failure(t *testing.T) {
+	store := &mapStore{objects: map[string][]byte{}}
+	fdb := &failDB{DB: mem.New()}
+	bucket, err := s3.Wrap(fdb, store, 0).Bucket("test")
+	assert.NoError(t, err)
+	put := func(k, v string) error {
+		return bucket.Batch(func(b Batch) error {
+			return b.Put([]byte(k), []byte(v))
+		})
+	}
+
+	assert.NoError(t, put("a", "v1"))
+
+	// A failed rewrite leaves the committed value intact
+	fdb.fail = true
+	assert.Equal(t, errBatchFailed, put("a", "v2"))
+	fdb.fail = false
+	v, err := bucket.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), v)
+	assert.Len(t, store.objects, 1, "failed upload should be removed")
+
+	// A successful rewrite removes the object it replaces
+	assert.NoError(t, put("a", "v2"))
+	v, err = bucket.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v)
+	assert.Len(t, store.objects, 1, "replaced object should be removed")
+
+	// A key put and deleted in one batch is never uploaded
+	assert.NoError(t, bucket.Batch(func(b Batch) error {
+		b.Put([]byte("b"), []byte("v3"))
+		return b.Delete([]byte("b"))
+	}))
+	assert.Len(t, store.objects, 1, "deleted value should not be stored")
+
+	assert.NoError(t, bucket.Batch(func(b Batch) error {
+		return b.Delete([]byte("a"))
+	}))
+	assert.Empty(t, store.objects)
+}
+
+// TestRedis requires a running Redis server, specified by the KVQ_REDIS_URL
+// environment variable (e.g. "redis://localhost:6379/15").
+func TestRedis(t *testing.T) {
+	url := os.Getenv("KVQ_REDIS_URL")
+	if url == "" {
+		t.Skip("KVQ_REDIS_URL not set")
+	}
+	db, err := redis.Open(url)
+	assert.NoError(t, err, "opening redis should not error")
+	clearBucket(t, db, "test")
+	testBucket(t, db)
+}
+
+// TestPostgres requires a running PostgreSQL server, specified by the
+// KVQ_POSTGRES_DSN environment variable.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("KVQ_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("KVQ_POSTGRES_DSN not set")
+	}
+	db, err := postgres.Open(dsn)
+	assert.NoError(t, err, "opening postgres should not error")
+	clearBucket(t, db, "test")
+	testBucket(t, db)
+	testPostgresTake(t, db)
+}
+
+// testPostgresTake tests that concurrent takes claim different rows, and that
+// rows are left in place if a take fails.
+func testPostgresTake(t *testing.T, db DB) {
+	clearBucket(t, db, "take")
+	b, err := db.Bucket("take")
+	assert.NoError(t, err, "getting bucket should not error")
+	assert.NoError(t, b.Batch(func(batch Batch) error {
+		for _, k := range []string{"a", "b", "c", "d"} {
+			batch.Put([]byte(k), []byte(k))
+		}
+		return nil
+	}), "putting keys should not error")
+	bucket := b.(*postgres.Bucket)
+
+	// Hold two rows while another take claims the rest
+	held := make(chan struct{})
+	release := make(chan struct{})
+	first := []string{}
+	done := make(chan error)
+	go func() {
+		done <- bucket.Take(2, func(k, v []byte) error {
+			first = append(first, string(k))
+			if len(first) == 2 {
+				close(held)
+				<-release
+			}
+			return nil
+		})
+	}()
+	<-held
+	second := []string{}
+	assert.NoError(t, bucket.Take(2, func(k, v []byte) error {
+		second = append(second, string(k))
+		return nil
+	}), "concurrent take should not error")
+	close(release)
+	assert.NoError(t, <-done, "take should not error")
+	assert.Equal(t, []string{"a", "b"}, first)
+	assert.Equal(t, []string{"c", "d"}, second)
+
+	// A failed take returns its rows
+	assert.NoError(t, b.Batch(func(batch Batch) error {
+		return batch.Put([]byte("e"), []byte("e"))
+	}), "putting key should not error")
+	errTake := errors.New("take failed")
+	assert.Equal(t, errTake, bucket.Take(1, func(k, v []byte) error {
+		return errTake
+	}))
+	v, err := b.Get([]byte("e"))
+	assert.NoError(t, err, "failed take should leave row in place")
+	assert.Equal(t, []byte("e"), v)
+}
+
+// TestDynamoDB requires AWS credentials and an existing table, specified by
+// the KVQ_DYNAMODB_TABLE environment variable.
+func TestDynamoDB(t *testing.T) {
+	table := os.Getenv("KVQ_DYNAMODB_TABLE")
+	if table == "" {
+		t.Skip("KVQ_DYNAMODB_TABLE not set")
+	}
+	db, err := dynamodb.Open(table)
+	assert.NoError(t, err, "opening dynamodb should not error")
+	clearBucket(t, db, "test")
+	testBucket(t, db)
+}
+
+// TestEtcd requires a running etcd cluster, specified by the
+// KVQ_ETCD_ENDPOINTS environment variable (e.g. "localhost:2379").
+func TestEtcd(t *testing.T) {
+	endpoints := os.Getenv("KVQ_ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("KVQ_ETCD_ENDPOINTS not set")
+	}
+	db, err := etcd.Open(endpoints)
+	assert.NoError(t, err, "opening etcd should not error")
+	clearBucket(t, db, "test")
+	testBucket(t, db)
+}
+
+// clearBucket empties the named bucket, for backends where data persists
+// outside of the test's control.
+func clearBucket(t *testing.T, db DB, name string) {
+	bucket, err := db.Bucket(name)
+	assert.NoError(t, err, "getting bucket should not error")
+	assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
 }
 
 func testBucket(t *testing.T, db DB) {
@@ -124,3 +595,198 @@ func testBucket(t *testing.T, db DB) {
 	assert.Equal(t, []byte("v3"), v3, "the got value should match")
 
 }
+
+// testCapabilities tests each of the optional features advertised by the
+// "caps" bucket of the given DB.
+func testCapabilities(t *testing.T, db DB) {
+	bucket, err := db.Bucket("caps")
+	assert.NoError(t, err, "getting caps bucket should not error")
+	assert.NoError(t, bucket.Clear(), "clearing caps bucket should not error")
+	caps := Capabilities(bucket)
+
+	put := func(keys ...string) {
+		assert.NoError(t, bucket.Batch(func(b Batch) error {
+			for _, k := range keys {
+				if err := b.Put([]byte(k), []byte(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}), "putting keys should not error")
+	}
+	keys := func() []string {
+		ks := []string{}
+		bucket.ForEach(func(k, v []byte) error {
+			ks = append(ks, string(k))
+			return nil
+		})
+		return ks
+	}
+
+	if caps.Has(CapRangeDelete) {
+		rd := bucket.(RangeDeleter)
+		put("a", "b", "c", "d")
+		assert.NoError(t, rd.DeleteRange([]byte("b"), []byte("d")),
+			"deleting range should not error")
+		assert.Equal(t, []string{"a", "d"}, keys(),
+			"only keys within range should be deleted")
+		assert.NoError(t, rd.DeleteRange(nil, nil),
+			"deleting unbounded range should not error")
+		assert.Empty(t, keys(), "all keys should be deleted")
+	}
+
+	if caps.Has(CapSnapshot) {
+		put("a")
+		snap, err := bucket.(Snapshotter).Snapshot()
+		assert.NoError(t, err, "taking snapshot should not error")
+		put("b")
+		v, err := snap.Get([]byte("a"))
+		assert.NoError(t, err, "getting snapshot key should not error")
+		assert.Equal(t, []byte("a"), v, "snapshot value should match")
+		_, err = snap.Get([]byte("b"))
+		assert.Equal(t, ErrKeyNotFound, err,
+			"keys put after snapshot should not be visible")
+		n := 0
+		assert.NoError(t, snap.ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}), "iterating snapshot should not error")
+		assert.Equal(t, 1, n, "snapshot should contain one key")
+		snap.Close()
+		assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
+	}
+
+	if caps.Has(CapCounter) {
+		c := bucket.(Counter)
+		n, err := c.Increment([]byte("n"), 2)
+		assert.NoError(t, err, "incrementing counter should not error")
+		assert.Equal(t, int64(2), n, "new counter should start at zero")
+		n, err = c.Increment([]byte("n"), -3)
+		assert.NoError(t, err, "decrementing counter should not error")
+		assert.Equal(t, int64(-1), n, "counter should be decremented")
+		put("x")
+		_, err = c.Increment([]byte("x"), 1)
+		assert.Equal(t, ErrNotCounter, err,
+			"incrementing a non-counter should fail")
+		assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
+	}
+
+	if caps.Has(CapSizeEstimate) {
+		put("a", "b", "c")
+		n, err := bucket.(SizeEstimator).EstimateSize()
+		assert.NoError(t, err, "estimating size should not error")
+		assert.True(t, n >= 0, "estimated size should not be negative")
+		assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
+	}
+
+	if caps.Has(CapMultiBatch) {
+		other, err := db.Bucket("caps-other")
+		assert.NoError(t, err, "getting other bucket should not error")
+		assert.NoError(t, other.Clear(), "clearing other bucket should not error")
+		third, err := db.Bucket("caps-third")
+		assert.NoError(t, err, "getting third bucket should not error")
+		assert.NoError(t, third.Clear(), "clearing third bucket should not error")
+		put("a")
+		assert.NoError(t, bucket.(MultiBatcher).BatchWith([]Bucket{other, third},
+			func(b Batch, o []Batch) error {
+				if err := b.Delete([]byte("a")); err != nil {
+					return err
+				}
+				if err := o[0].Put([]byte("a"), []byte("a")); err != nil {
+					return err
+				}
+				return o[1].Put([]byte("b"), []byte("b"))
+			}), "batch across buckets should not error")
+		assert.Empty(t, keys(), "key should be deleted from bucket")
+		v, err := other.Get([]byte("a"))
+		assert.NoError(t, err, "getting moved key should not error")
+		assert.Equal(t, []byte("a"), v, "key should be put in other bucket")
+		v, err = third.Get([]byte("b"))
+		assert.NoError(t, err, "getting put key should not error")
+		assert.Equal(t, []byte("b"), v, "key should be put in third bucket")
+		assert.NoError(t, other.Clear(), "clearing other bucket should not error")
+		assert.NoError(t, third.Clear(), "clearing third bucket should not error")
+	}
+
+	if caps.Has(CapCompact) {
+		put("a", "b", "c")
+		assert.NoError(t, bucket.Batch(func(b Batch) error {
+			return b.Delete([]byte("b"))
+		}), "deleting key should not error")
+		assert.NoError(t, bucket.(Compactor).Compact(),
+			"compacting bucket should not error")
+		assert.Equal(t, []string{"a", "c"}, keys(),
+			"compaction should not affect live keys")
+		assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
+	}
+
+	if caps.Has(CapNoSync) {
+		assert.NoError(t, bucket.(NoSyncBatcher).BatchNoSync(func(b Batch) error {
+			return b.Put([]byte("a"), []byte("a"))
+		}), "unsynced batch should not error")
+		assert.Equal(t, []string{"a"}, keys(),
+			"unsynced batch should be visible")
+		assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
+	}
+
+	if caps.Has(CapSeek) {
+		put("a", "b", "c")
+		seen := []string{}
+		assert.NoError(t, bucket.(Seeker).ForEachFrom([]byte("b"), func(k, v []byte) error {
+			seen = append(seen, string(k))
+			return nil
+		}), "iterating from key should not error")
+		assert.Equal(t, []string{"b", "c"}, seen,
+			"iteration should start from the given key")
+		assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
+	}
+
+	if s, ok := db.(DBSnapshotter); ok {
+		other, err := db.Bucket("caps-other")
+		assert.NoError(t, err, "getting other bucket should not error")
+		assert.NoError(t, other.Clear(), "clearing other bucket should not error")
+		put("a")
+		snap, err := s.SnapshotDB()
+		assert.NoError(t, err, "taking DB snapshot should not error")
+		put("b")
+		assert.NoError(t, other.Batch(func(b Batch) error {
+			return b.Put([]byte("c"), []byte("c"))
+		}), "putting key in other bucket should not error")
+		view, err := snap.Bucket("caps")
+		assert.NoError(t, err, "viewing snapshot bucket should not error")
+		v, err := view.Get([]byte("a"))
+		assert.NoError(t, err, "getting snapshot key should not error")
+		assert.Equal(t, []byte("a"), v, "snapshot value should match")
+		_, err = view.Get([]byte("b"))
+		assert.Equal(t, ErrKeyNotFound, err,
+			"keys put after snapshot should not be visible")
+		view, err = snap.Bucket("caps-other")
+		assert.NoError(t, err, "viewing other snapshot bucket should not error")
+		_, err = view.Get([]byte("c"))
+		assert.Equal(t, ErrKeyNotFound, err,
+			"keys put in other buckets after snapshot should not be visible")
+		snap.Close()
+		assert.NoError(t, bucket.Clear(), "clearing bucket should not error")
+		assert.NoError(t, other.Clear(), "clearing other bucket should not error")
+	}
+}
+
+// testReadOnly tests that the "test" bucket of the given DB, as left by
+// testBucket, can be read but not modified.
+func testReadOnly(t *testing.T, db DB) {
+	bucket, err := db.Bucket("test")
+	assert.NoError(t, err, "getting test bucket should not error")
+
+	v3, err := bucket.Get([]byte("k3"))
+	assert.NoError(t, err, "getting a key should not fail")
+	assert.Equal(t, []byte("v3"), v3, "the got value should match")
+
+	assert.Equal(t, ErrReadOnly, bucket.Batch(func(b Batch) error {
+		return b.Put([]byte("k4"), []byte("v4"))
+	}), "batch should fail")
+	assert.Equal(t, ErrReadOnly, bucket.Clear(), "clear should fail")
+
+	v3, err = bucket.Get([]byte("k3"))
+	assert.NoError(t, err, "getting a key should not fail")
+	assert.Equal(t, []byte("v3"), v3, "the got value should match")
+}
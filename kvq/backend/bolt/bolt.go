@@ -1,17 +1,35 @@
 package bolt
 
 import (
-	"github.com/boltdb/bolt"
-	"github.com/johnsto/go-kvq/kvq"
-	"github.com/johnsto/go-kvq/kvq/backend"
+	"bytes"
+	"encoding/binary"
 	"os"
+	"sort"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	bolt "go.etcd.io/bbolt"
 )
 
-// DB encapsulates a Bolt DB instance.
+// ReadOnlyTimeout is the maximum time OpenReadOnly waits to acquire a shared
+// lock on the database file.
+const ReadOnlyTimeout = time.Second
+
+// DB encapsulates a Bolt DB instance. Each namespace is stored within its
+// own top-level Bolt bucket.
 type DB struct {
 	boltDB *bolt.DB
 }
 
+func init() {
+	backend.Register("bolt", backend.Driver{
+		Open:         Open,
+		OpenReadOnly: OpenReadOnly,
+		Destroy:      Destroy,
+		Local:        true,
+	})
+}
+
 // Destroy destroys the DB at the given path.
 func Destroy(path string) error {
 	return os.RemoveAll(path)
@@ -19,24 +37,42 @@ func Destroy(path string) error {
 
 // Open returns a DB instance from the Bolt database at the given path, using
 // default parameters.
-func Open(path string) (*kvq.DB, error) {
-	db, err := bolt.Open(path, 0777, nil)
+func Open(path string) (backend.DB, error) {
+	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
 	return New(db), nil
 }
 
+// OpenReadOnly opens the existing Bolt database at the given path in
+// read-only mode, allowing it to be shared with other read-only processes.
+// Bolt does not allow a database to be opened while a writer holds it, so
+// this fails after ReadOnlyTimeout if the database is in use elsewhere.
+func OpenReadOnly(path string) (backend.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		ReadOnly: true,
+		Timeout:  ReadOnlyTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return backend.ReadOnly(New(db)), nil
+}
+
 // New returns a DB from the given Bolt DB instance.
-func New(db *bolt.DB) *kvq.DB {
-	return kvq.NewDB(&DB{db})
+func New(db *bolt.DB) backend.DB {
+	return &DB{db}
 }
 
 // Bucket returns a queue in the given namespace.
 func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	if len(name) == 0 {
+		return nil, bolt.ErrBucketNameRequired
+	}
 	return &Bucket{
 		db:   db,
-		name: name,
+		name: []byte(name),
 	}, nil
 }
 
@@ -45,32 +81,53 @@ func (db *DB) Close() {
 	db.boltDB.Close()
 }
 
-// Bucket represents a set of keys within a DB.
+// Bucket represents a set of keys within a DB, mapped directly onto a Bolt
+// bucket of the same name. The Bolt bucket is created lazily upon first
+// write.
 type Bucket struct {
 	db   *DB
-	name string
+	name []byte
 }
 
 // ForEach iterates through keys in the bucket. If the iteration function
 // returns a non-nil error, iteration stops and the error is returned to
 // the caller.
 func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
-	return q.db.boltDB.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(q.name))
-		if err != nil {
-			return err
+	return q.db.boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(q.name)
+		if bucket == nil {
+			// Bucket has never been written to
+			return nil
 		}
 		return bucket.ForEach(fn)
 	})
 }
 
+// ForEachFrom iterates through keys in the queue from `start` onwards.
+func (q *Bucket) ForEachFrom(start []byte, fn func(k, v []byte) error) error {
+	return q.db.boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(q.name)
+		if bucket == nil {
+			// Bucket has never been written to
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Batch enacts a number of operations in one atomic go. If the batch
 // function returns a non-nil error, the batch is discarded and the error
 // is returned to the caller. If the batch function returns nil, the batch
 // is committed to the queue.
 func (q *Bucket) Batch(fn func(backend.Batch) error) error {
 	return q.db.boltDB.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(q.name))
+		bucket, err := tx.CreateBucketIfNotExists(q.name)
 		if err != nil {
 			return err
 		}
@@ -81,27 +138,155 @@ func (q *Bucket) Batch(fn func(backend.Batch) error) error {
 	})
 }
 
+// BatchWith enacts operations on this bucket and other buckets of the same
+// DB within a single Bolt transaction.
+func (q *Bucket) BatchWith(others []backend.Bucket, fn func(b backend.Batch, o []backend.Batch) error) error {
+	names := make([][]byte, len(others))
+	for i, other := range others {
+		o, ok := other.(*Bucket)
+		if !ok || o.db != q.db {
+			return backend.ErrForeignBucket
+		}
+		names[i] = o.name
+	}
+	return q.db.boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(q.name)
+		if err != nil {
+			return err
+		}
+		batches := make([]backend.Batch, len(names))
+		for i, name := range names {
+			otherBucket, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			batches[i] = &Batch{bucket: otherBucket}
+		}
+		return fn(&Batch{bucket: bucket}, batches)
+	})
+}
+
 // Get returns the value stored at key `k`.
 func (q *Bucket) Get(k []byte) ([]byte, error) {
 	var v []byte
-	return v, q.db.boltDB.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(q.name))
-		if err != nil {
-			return err
+	err := q.db.boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(q.name)
+		if bucket == nil {
+			return backend.ErrKeyNotFound
 		}
-		v = bucket.Get(k)
-		if v == nil {
+		bv := bucket.Get(k)
+		if bv == nil {
 			return backend.ErrKeyNotFound
 		}
+		// Values are only valid for the life of the transaction, so copy
+		v = append([]byte{}, bv...)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
 }
 
 // Clear removes all items from this bucket.
 func (q *Bucket) Clear() error {
 	return q.db.boltDB.Update(func(tx *bolt.Tx) error {
-		return tx.DeleteBucket([]byte(q.name))
+		err := tx.DeleteBucket(q.name)
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Increment atomically adds `delta` to the counter at key `k`.
+func (q *Bucket) Increment(k []byte, delta int64) (int64, error) {
+	var n int64
+	err := q.db.boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(q.name)
+		if err != nil {
+			return err
+		}
+		if v := bucket.Get(k); v != nil {
+			if len(v) != 8 {
+				return backend.ErrNotCounter
+			}
+			n = int64(binary.BigEndian.Uint64(v))
+		}
+		n += delta
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(n))
+		return bucket.Put(k, v)
 	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// EstimateSize returns the number of bytes allocated to the bucket's pages
+// within the database file.
+func (q *Bucket) EstimateSize() (int64, error) {
+	var n int64
+	err := q.db.boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(q.name)
+		if bucket == nil {
+			return nil
+		}
+		stats := bucket.Stats()
+		n = int64(stats.BranchAlloc + stats.LeafAlloc)
+		return nil
+	})
+	return n, err
+}
+
+// Snapshot returns a consistent, read-only copy of the bucket, read within a
+// single Bolt transaction. The copy is held in memory, as Bolt cannot grow the
+// database file while a read transaction remains open.
+func (q *Bucket) Snapshot() (backend.Snapshot, error) {
+	snapshot := &Snapshot{}
+	err := q.ForEach(func(k, v []byte) error {
+		snapshot.kvs = append(snapshot.kvs, [2][]byte{
+			append([]byte{}, k...),
+			append([]byte{}, v...),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Snapshot is a point-in-time copy of a Bucket.
+type Snapshot struct {
+	kvs [][2][]byte // sorted by key
+}
+
+// ForEach iterates through keys in the snapshot.
+func (s *Snapshot) ForEach(fn func(k, v []byte) error) error {
+	for _, kv := range s.kvs {
+		if err := fn(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the value stored at key `k`.
+func (s *Snapshot) Get(k []byte) ([]byte, error) {
+	i := sort.Search(len(s.kvs), func(i int) bool {
+		return bytes.Compare(s.kvs[i][0], k) >= 0
+	})
+	if i == len(s.kvs) || !bytes.Equal(s.kvs[i][0], k) {
+		return nil, backend.ErrKeyNotFound
+	}
+	return s.kvs[i][1], nil
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() {
+	s.kvs = nil
 }
 
 // Batch represents a set of put/delete operations to perform on a Queue.
@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotCounter is returned by Counter.Increment when the existing value
+	// is not an 8-byte counter.
+	ErrNotCounter = errors.New("value is not a counter")
+	// ErrForeignBucket is returned by MultiBatcher.BatchWith when another
+	// bucket does not belong to the same DB.
+	ErrForeignBucket = errors.New("bucket belongs to another database")
+)
+
+// Capability is a set of optional features supported by a bucket. Callers
+// should check for a capability before using the corresponding interface,
+// and fall back to the operations provided by Bucket otherwise.
+type Capability uint
+
+const (
+	// CapRangeDelete indicates the bucket implements RangeDeleter.
+	CapRangeDelete Capability = 1 << iota
+	// CapSnapshot indicates the bucket implements Snapshotter.
+	CapSnapshot
+	// CapCounter indicates the bucket implements Counter.
+	CapCounter
+	// CapTTL indicates the bucket implements Expirer.
+	CapTTL
+	// CapSizeEstimate indicates the bucket implements SizeEstimator.
+	CapSizeEstimate
+	// CapMultiBatch indicates the bucket implements MultiBatcher.
+	CapMultiBatch
+	// CapCompact indicates the bucket implements Compactor.
+	CapCompact
+	// CapNoSync indicates the bucket implements NoSyncBatcher.
+	CapNoSync
+	// CapSeek indicates the bucket implements Seeker.
+	CapSeek
+)
+
+// Has returns true if all the capabilities in `c2` are present in `c`.
+func (c Capability) Has(c2 Capability) bool {
+	return c&c2 == c2
+}
+
+// Capabilities returns the set of optional features supported by the given
+// bucket.
+func Capabilities(b Bucket) Capability {
+	var c Capability
+	if _, ok := b.(RangeDeleter); ok {
+		c |= CapRangeDelete
+	}
+	if _, ok := b.(Snapshotter); ok {
+		c |= CapSnapshot
+	}
+	if _, ok := b.(Counter); ok {
+		c |= CapCounter
+	}
+	if _, ok := b.(Expirer); ok {
+		c |= CapTTL
+	}
+	if _, ok := b.(SizeEstimator); ok {
+		c |= CapSizeEstimate
+	}
+	if _, ok := b.(MultiBatcher); ok {
+		c |= CapMultiBatch
+	}
+	if _, ok := b.(Compactor); ok {
+		c |= CapCompact
+	}
+	if _, ok := b.(NoSyncBatcher); ok {
+		c |= CapNoSync
+	}
+	if _, ok := b.(Seeker); ok {
+		c |= CapSeek
+	}
+	return c
+}
+
+// RangeDeleter is implemented by buckets that can delete a range of keys in a
+// single operation, without reading them first.
+type RangeDeleter interface {
+	// DeleteRange deletes all keys `k` in the bucket where
+	// `start <= k < end`. A nil `start` or `end` leaves that end of the
+	// range unbounded, so DeleteRange(nil, nil) deletes every key.
+	DeleteRange(start, end []byte) error
+}
+
+// Snapshotter is implemented by buckets that can provide a consistent,
+// point-in-time view of their contents.
+type Snapshotter interface {
+	// Snapshot returns a read-only view of the bucket as it is now. The
+	// snapshot must be closed when no longer required.
+	Snapshot() (Snapshot, error)
+}
+
+// Snapshot is a read-only, point-in-time view of a bucket. Writes to the
+// bucket made after the snapshot was taken are not visible through it.
+type Snapshot interface {
+	// ForEach iterates through keys in the snapshot. If the iteration
+	// function returns a non-nil error, iteration stops and the error is
+	// returned to the caller.
+	ForEach(fn func(k, v []byte) error) error
+	// Get returns the value stored at key `k`.
+	Get(k []byte) ([]byte, error)
+	// Close releases the snapshot.
+	Close()
+}
+
+// Counter is implemented by buckets that can atomically modify an integer
+// value. Counters are stored as 8-byte big-endian values.
+type Counter interface {
+	// Increment atomically adds `delta` to the counter at key `k`, creating
+	// it with a value of zero first if it doesn't exist, and returns the new
+	// value.
+	Increment(k []byte, delta int64) (int64, error)
+}
+
+// Expirer is implemented by buckets that can natively expire keys.
+type Expirer interface {
+	// PutTTL sets the key `k` to value `v`, after which the key is deleted
+	// automatically once `ttl` has elapsed. Expiry may not be exact.
+	PutTTL(k, v []byte, ttl time.Duration) error
+}
+
+// SizeEstimator is implemented by buckets that can cheaply estimate the
+// storage they consume, without reading every key.
+type SizeEstimator interface {
+	// EstimateSize returns the approximate number of bytes of storage used
+	// by the bucket. Recently written data may not yet be accounted for.
+	EstimateSize() (int64, error)
+}
+
+// MultiBatcher is implemented by buckets that can enact operations on
+// themselves and other buckets of the same DB in one atomic call.
+type MultiBatcher interface {
+	// BatchWith enacts operations on this bucket, via the first batch given
+	// to `fn`, and on each of the buckets `others`, via the corresponding
+	// batch of the second, in one atomic call, as with Bucket.Batch. If any
+	// of `others` does not belong to the same DB, ErrForeignBucket is
+	// returned.
+	BatchWith(others []Bucket, fn func(b Batch, o []Batch) error) error
+}
+
+// Seeker is implemented by buckets that iterate their keys in order and can
+// begin iterating part way through, without reading the keys before.
+type Seeker interface {
+	// ForEachFrom iterates through the keys `k` in the bucket where
+	// `start <= k`, in key order, as with Bucket.ForEach.
+	ForEachFrom(start []byte, fn func(k, v []byte) error) error
+}
+
+// Compactor is implemented by buckets whose storage retains deleted keys,
+// such as tombstones in a log-structured store, until they are compacted.
+type Compactor interface {
+	// Compact reclaims the space held by keys deleted from the bucket, such
+	// that subsequent iteration need not skip over them. It may block for
+	// some time on large buckets.
+	Compact() error
+}
+
+// NoSyncBatcher is implemented by buckets that sync each batch to disk before
+// returning, but can also write a batch without waiting for it to be synced.
+type NoSyncBatcher interface {
+	// BatchNoSync enacts a number of operations in one atomic call, as with
+	// Bucket.Batch, but returns without waiting for them to be synced to
+	// disk. The operations survive the process crashing, but may be lost if
+	// the machine crashes.
+	BatchNoSync(fn func(Batch) error) error
+}
+
+// MetricsReporter is implemented by databases that can report metrics
+// specific to their storage engine, such as the sizes of the levels of a
+// log-structured merge tree, or counts of compactions.
+type MetricsReporter interface {
+	// Metrics returns the database's metrics, by name.
+	Metrics() (map[string]int64, error)
+}
+
+// DBSnapshotter is implemented by databases that can provide a consistent,
+// point-in-time view of all of their buckets at once.
+type DBSnapshotter interface {
+	// SnapshotDB returns a read-only view of the database as it is now. The
+	// snapshot must be closed when no longer required.
+	SnapshotDB() (DBSnapshot, error)
+}
+
+// DBSnapshot is a read-only, point-in-time view of a database. Writes to the
+// database made after the snapshot was taken are not visible through it.
+type DBSnapshot interface {
+	// Bucket returns a view of the bucket in the given namespace, which is
+	// released when the DBSnapshot is closed.
+	Bucket(name string) (Snapshot, error)
+	// Close releases the snapshot.
+	Close()
+}
+
+// KeyRotator is implemented by databases that encrypt the data written to
+// them, allowing the key to be changed while in use.
+type KeyRotator interface {
+	// Rotate makes `key` the key used to encrypt data written from now on.
+	// Data written with earlier keys can still be read.
+	Rotate(key []byte) error
+	// Reencrypt rewrites the data of the bucket with the given name that
+	// was written with an earlier key, using the current key.
+	Reencrypt(name string) error
+}
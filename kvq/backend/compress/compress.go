@@ -0,0 +1,266 @@
+// Package compress provides a backend wrapper that compresses values before
+// they reach the wrapped backend.
+package compress
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ErrUnknownCodec is returned when a stored value was compressed with a
+	// codec that isn't known.
+	ErrUnknownCodec = errors.New("unknown compression codec")
+)
+
+// Codec compresses and decompresses values. Each codec has a unique ID, which
+// is stored as the first byte of each value it compresses so that values can
+// always be decompressed, even if the codec in use changes.
+type Codec interface {
+	// ID returns the unique identifier of the codec.
+	ID() byte
+	// Encode appends the compressed form of `src` to `dst`.
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode appends the decompressed form of `src` to `dst`.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+var (
+	// None stores values uncompressed.
+	None Codec = noneCodec{}
+	// Snappy compresses values with Snappy, which is very fast but compresses
+	// less well than Zstd.
+	Snappy Codec = snappyCodec{}
+	// Zstd compresses values with Zstandard at the default level.
+	Zstd Codec = &zstdCodec{}
+)
+
+// codecs holds all known codecs, indexed by ID.
+var codecs = map[byte]Codec{
+	None.ID():   None,
+	Snappy.ID(): Snappy,
+	Zstd.ID():   Zstd,
+}
+
+// codecNames holds the built-in codecs, indexed by name.
+var codecNames = map[string]Codec{
+	"none":   None,
+	"snappy": Snappy,
+	"zstd":   Zstd,
+}
+
+// CodecByName returns the built-in codec with the given name: "none",
+// "snappy" or "zstd".
+func CodecByName(name string) (Codec, error) {
+	codec, ok := codecNames[name]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+// CodecByID returns the codec with the given ID.
+func CodecByID(id byte) (Codec, error) {
+	codec, ok := codecs[id]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+// Encode compresses `v` with the given codec, prefixed with the codec's ID. If
+// compression doesn't reduce the size of the value, it is stored uncompressed.
+func Encode(codec Codec, v []byte) ([]byte, error) {
+	out, err := codec.Encode([]byte{codec.ID()}, v)
+	if err != nil {
+		return nil, err
+	}
+	if codec != None && len(out) > len(v) {
+		return None.Encode([]byte{None.ID()}, v)
+	}
+	return out, nil
+}
+
+// Decode decompresses a value produced by Encode.
+func Decode(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return nil, ErrUnknownCodec
+	}
+	codec, err := CodecByID(v[0])
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(nil, v[1:])
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() byte { return 0 }
+
+func (noneCodec) Encode(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCodec) Decode(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte { return 1 }
+
+func (snappyCodec) Encode(dst, src []byte) ([]byte, error) {
+	return append(dst, snappy.Encode(nil, src)...), nil
+}
+
+func (snappyCodec) Decode(dst, src []byte) ([]byte, error) {
+	v, err := snappy.Decode(nil, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, v...), nil
+}
+
+type zstdCodec struct {
+	once    sync.Once
+	err     error
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *zstdCodec) ID() byte { return 2 }
+
+// init lazily creates the shared encoder and decoder, which are safe for
+// concurrent use via EncodeAll and DecodeAll.
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil)
+		if c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) Encode(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(src, dst), nil
+}
+
+func (c *zstdCodec) Decode(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(src, dst)
+}
+
+// DB wraps a backend DB, compressing all values written to it.
+type DB struct {
+	db    backend.DB
+	codec Codec
+}
+
+// Wrap returns a DB that compresses values written to `db` using `codec`.
+// Values are decompressed with whichever codec was used to write them.
+func Wrap(db backend.DB, codec Codec) backend.DB {
+	return &DB{
+		db:    db,
+		codec: codec,
+	}
+}
+
+// Bucket returns a queue in the given namespace.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	bucket, err := db.db.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		bucket: bucket,
+		codec:  db.codec,
+	}, nil
+}
+
+// Close closes the wrapped database.
+func (db *DB) Close() {
+	db.db.Close()
+}
+
+// Bucket wraps a bucket of the underlying DB.
+type Bucket struct {
+	bucket backend.Bucket
+	codec  Codec
+}
+
+// ForEach iterates through keys in the bucket. If the iteration function
+// returns a non-nil error, iteration stops and the error is returned to
+// the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	return q.bucket.ForEach(func(k, v []byte) error {
+		v, err := Decode(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, v)
+	})
+}
+
+// Batch enacts a number of operations in one atomic go. If the batch
+// function returns a non-nil error, the batch is discarded and the error
+// is returned to the caller. If the batch function returns nil, the batch
+// is committed to the queue.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	return q.bucket.Batch(func(b backend.Batch) error {
+		return fn(&Batch{
+			batch: b,
+			codec: q.codec,
+		})
+	})
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	v, err := q.bucket.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(v)
+}
+
+// Clear removes all items from this bucket.
+func (q *Bucket) Clear() error {
+	return q.bucket.Clear()
+}
+
+// Batch compresses values before passing them to a batch of the wrapped
+// backend.
+type Batch struct {
+	batch backend.Batch
+	codec Codec
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	vv, err := Encode(b.codec, v)
+	if err != nil {
+		return err
+	}
+	return b.batch.Put(k, vv)
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	return b.batch.Delete(k)
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.batch.Close()
+}
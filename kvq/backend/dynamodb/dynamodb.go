@@ -0,0 +1,293 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+const (
+	// MaxBatchItems is the maximum number of distinct keys that may be
+	// written in a single batch, as imposed by DynamoDB's TransactWriteItems.
+	// Transactions must therefore put and take no more than this many items
+	// in total.
+	MaxBatchItems = 100
+
+	// maxDeleteItems is the maximum number of items per BatchWriteItem call.
+	maxDeleteItems = 25
+)
+
+var (
+	// ErrBatchTooLarge is returned when a batch contains more than
+	// MaxBatchItems operations.
+	ErrBatchTooLarge = errors.New("batch exceeds DynamoDB transaction limit")
+)
+
+// Attribute names used for items in the table. The table must have a string
+// partition key named "ns" and a binary sort key named "k".
+const (
+	attrNamespace = "ns"
+	attrKey       = "k"
+	attrValue     = "v"
+)
+
+// DB encapsulates a DynamoDB client and the table in which all buckets are
+// stored.
+type DB struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func init() {
+	// Registered URIs take the form dynamodb://table
+	backend.Register("dynamodb", backend.Driver{
+		Open:         Open,
+		OpenReadOnly: OpenReadOnly,
+	})
+}
+
+// Open returns a DB storing items in the named table, using the default AWS
+// configuration (environment variables, shared config files or instance
+// roles). The table must already exist.
+func Open(table string) (backend.DB, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return New(dynamodb.NewFromConfig(cfg), table), nil
+}
+
+// OpenReadOnly returns a DB reading items from the named table that cannot
+// modify any queue. Only read access to the table is required.
+func OpenReadOnly(table string) (backend.DB, error) {
+	db, err := Open(table)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ReadOnly(db), nil
+}
+
+// New returns a DB using the given client, storing items in the named table.
+func New(client *dynamodb.Client, table string) backend.DB {
+	return &DB{
+		client: client,
+		table:  table,
+	}
+}
+
+// Bucket returns a queue in the given namespace, where the namespace is used
+// as the partition key of each item.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	return &Bucket{
+		db: db,
+		ns: name,
+	}, nil
+}
+
+// Close releases any resources. DynamoDB clients hold no connections that
+// require closing.
+func (db *DB) Close() {
+}
+
+// Bucket represents the set of items in the table sharing a partition key.
+type Bucket struct {
+	db *DB
+	ns string
+}
+
+// itemKey returns the primary key attributes of the item at key `k`.
+func (q *Bucket) itemKey(k []byte) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		attrNamespace: &types.AttributeValueMemberS{Value: q.ns},
+		attrKey:       &types.AttributeValueMemberB{Value: k},
+	}
+}
+
+// query iterates through all items in the partition in key order, passing
+// each to fn. If `keysOnly` is true, values are not retrieved.
+func (q *Bucket) query(keysOnly bool, fn func(item map[string]types.AttributeValue) error) error {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(q.db.table),
+		KeyConditionExpression: aws.String("#ns = :ns"),
+		ExpressionAttributeNames: map[string]string{
+			"#ns": attrNamespace,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":ns": &types.AttributeValueMemberS{Value: q.ns},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	if keysOnly {
+		input.ProjectionExpression = aws.String("#ns, #k")
+		input.ExpressionAttributeNames["#k"] = attrKey
+	}
+
+	pages := dynamodb.NewQueryPaginator(q.db.client, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ForEach iterates through keys in the bucket in key order. If the iteration
+// function returns a non-nil error, iteration stops and the error is returned
+// to the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	return q.query(false, func(item map[string]types.AttributeValue) error {
+		return fn(attrBytes(item[attrKey]), attrBytes(item[attrValue]))
+	})
+}
+
+// Batch enacts a number of operations in one TransactWriteItems call. If the
+// batch function returns a non-nil error, the batch is discarded and the
+// error is returned to the caller. If the batch function returns nil, the
+// batch is committed to the queue.
+//
+// A batch may contain at most MaxBatchItems distinct keys, otherwise
+// ErrBatchTooLarge is returned and nothing is written.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	batch := &Batch{
+		bucket: q,
+		index:  map[string]int{},
+	}
+	defer batch.Close()
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+	if len(batch.items) == 0 {
+		return nil
+	}
+	if len(batch.items) > MaxBatchItems {
+		return ErrBatchTooLarge
+	}
+
+	_, err := q.db.client.TransactWriteItems(context.Background(),
+		&dynamodb.TransactWriteItemsInput{
+			TransactItems: batch.items,
+		})
+	return err
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	out, err := q.db.client.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName:      aws.String(q.db.table),
+		Key:            q.itemKey(k),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, backend.ErrKeyNotFound
+	}
+	return attrBytes(out.Item[attrValue]), nil
+}
+
+// Clear removes all items from this bucket. Items are deleted in a number of
+// separate requests, so the operation is not atomic.
+func (q *Bucket) Clear() error {
+	reqs := []types.WriteRequest{}
+	flush := func() error {
+		for len(reqs) > 0 {
+			out, err := q.db.client.BatchWriteItem(context.Background(),
+				&dynamodb.BatchWriteItemInput{
+					RequestItems: map[string][]types.WriteRequest{
+						q.db.table: reqs,
+					},
+				})
+			if err != nil {
+				return err
+			}
+			// Retry anything DynamoDB didn't get around to
+			reqs = out.UnprocessedItems[q.db.table]
+		}
+		return nil
+	}
+
+	err := q.query(true, func(item map[string]types.AttributeValue) error {
+		reqs = append(reqs, types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{Key: item},
+		})
+		if len(reqs) == maxDeleteItems {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Batch represents a set of put/delete operations to perform in a single
+// DynamoDB transaction.
+type Batch struct {
+	bucket *Bucket
+	items  []types.TransactWriteItem
+	index  map[string]int // key => position in items
+}
+
+// add stages an operation on key `k`, replacing any earlier operation on the
+// same key, as DynamoDB forbids multiple operations on one item.
+func (b *Batch) add(k []byte, item types.TransactWriteItem) {
+	if i, ok := b.index[string(k)]; ok {
+		b.items[i] = item
+		return
+	}
+	b.index[string(k)] = len(b.items)
+	b.items = append(b.items, item)
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	item := b.bucket.itemKey(k)
+	item[attrValue] = &types.AttributeValueMemberB{Value: v}
+	b.add(k, types.TransactWriteItem{
+		Put: &types.Put{
+			TableName: aws.String(b.bucket.db.table),
+			Item:      item,
+		},
+	})
+	return nil
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	b.add(k, types.TransactWriteItem{
+		Delete: &types.Delete{
+			TableName: aws.String(b.bucket.db.table),
+			Key:       b.bucket.itemKey(k),
+		},
+	})
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.items = nil
+	b.index = map[string]int{}
+}
+
+// attrBytes returns the value of a binary attribute, or nil if the attribute
+// is missing or not binary.
+func attrBytes(av types.AttributeValue) []byte {
+	if b, ok := av.(*types.AttributeValueMemberB); ok {
+		return b.Value
+	}
+	return nil
+}
@@ -0,0 +1,570 @@
+// Package encrypt provides a backend wrapper that transparently encrypts
+// values (and optionally keys) with AES-GCM before they reach the wrapped
+// backend.
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+const (
+	// formatV1 is the first byte of values encrypted by earlier versions,
+	// which do not record the key used.
+	formatV1 byte = 1
+	// formatV2 is the first byte of every encrypted value, identifying the
+	// encoding used. It is followed by the ID of the key used.
+	formatV2 byte = 2
+
+	// keyIDSize is the size of the key ID stored with each value.
+	keyIDSize = 4
+	// reencryptBatch is the number of values re-encrypted in each batch.
+	reencryptBatch = 100
+)
+
+var (
+	// ErrUnknownFormat is returned when a stored value was not written by
+	// this package, or by an incompatible version of it.
+	ErrUnknownFormat = errors.New("unknown encryption format")
+	// ErrCiphertextTooShort is returned when a stored value is too short to
+	// be decrypted.
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+	// ErrUnknownKey is returned when a stored value was encrypted with a key
+	// that is neither the current key nor one of Options.OldKeys.
+	ErrUnknownKey = errors.New("value encrypted with unknown key")
+)
+
+// KeyProvider supplies the AES key used for encryption. The key must be 16,
+// 24 or 32 bytes long, selecting AES-128, AES-192 or AES-256 respectively.
+type KeyProvider interface {
+	Key() ([]byte, error)
+}
+
+// StaticKey is a KeyProvider that always returns the same key.
+type StaticKey []byte
+
+// Key returns the key.
+func (k StaticKey) Key() ([]byte, error) {
+	return k, nil
+}
+
+// Options specifies how data is encrypted.
+type Options struct {
+	// EncryptKeys enables encryption of keys as well as values. Keys are
+	// encrypted deterministically so that they can still be looked up, but
+	// this means the wrapped backend no longer stores them in order.
+	EncryptKeys bool
+	// OldKeys are keys that were used before the current key, with which
+	// data written before the key was rotated can still be read. A key can
+	// be dropped once data written with it has been re-encrypted.
+	OldKeys [][]byte
+}
+
+// DB wraps a backend DB, encrypting all values written to it.
+type DB struct {
+	db   backend.DB
+	keys KeyProvider
+	opts Options
+
+	// mutex excludes writes while values are re-encrypted, and guards the
+	// fields below
+	mutex   sync.RWMutex
+	current []byte   // key set by Rotate, replacing that of the KeyProvider
+	old     [][]byte // keys that can only be used to decrypt
+}
+
+// Wrap returns a DB that encrypts data written to `db` with keys supplied by
+// `keys`. If `opts` is nil, only values are encrypted.
+func Wrap(db backend.DB, keys KeyProvider, opts *Options) backend.DB {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return &DB{
+		db:   db,
+		keys: keys,
+		opts: *opts,
+		old:  opts.OldKeys,
+	}
+}
+
+// Bucket returns a queue in the given namespace.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	bucket, err := db.db.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		db:     db,
+		bucket: bucket,
+		ns:     []byte(name),
+	}, nil
+}
+
+// Close closes the wrapped database.
+func (db *DB) Close() {
+	db.db.Close()
+}
+
+// Rotate makes `key` the key used to encrypt data written from now on, in
+// place of that supplied by the KeyProvider. Data written with the previous
+// key can still be read, and is rewritten with the new key by Reencrypt.
+// Until then, the previous key must be given in Options.OldKeys when the
+// database is next wrapped.
+func (db *DB) Rotate(key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	ring, err := db.keyringLocked()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ring.current, key) {
+		db.old = append([][]byte{ring.current}, db.old...)
+	}
+	db.current = key
+	return nil
+}
+
+// Reencrypt rewrites the values (and keys, if encrypted) of the bucket with
+// the given name that were written with a key other than the current key. It
+// works through the bucket in small batches while the bucket remains in use.
+func (db *DB) Reencrypt(name string) error {
+	b, err := db.Bucket(name)
+	if err != nil {
+		return err
+	}
+	q := b.(*Bucket)
+	ring, err := db.keyring()
+	if err != nil {
+		return err
+	}
+
+	// Find the stored keys of stale values
+	stale := [][]byte{}
+	err = q.bucket.ForEach(func(kk, v []byte) error {
+		if ring.stale(v) {
+			stale = append(stale, append([]byte{}, kk...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(stale) > 0 {
+		n := reencryptBatch
+		if n > len(stale) {
+			n = len(stale)
+		}
+		if err := q.reencrypt(stale[:n]); err != nil {
+			return err
+		}
+		stale = stale[n:]
+	}
+	return nil
+}
+
+// reencrypt rewrites the values at the given stored keys with the current
+// key, excluding other writes such that values deleted or replaced since they
+// were found are left alone. Values are read before the batch is begun, as
+// backends such as SQLite cannot read from a bucket while writing to it.
+func (q *Bucket) reencrypt(keys [][]byte) error {
+	q.db.mutex.Lock()
+	defer q.db.mutex.Unlock()
+	ring, err := q.db.keyringLocked()
+	if err != nil {
+		return err
+	}
+
+	type item struct {
+		kk, k, v []byte
+	}
+	items := make([]item, 0, len(keys))
+	for _, kk := range keys {
+		v, err := q.bucket.Get(kk)
+		if err == backend.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !ring.stale(v) {
+			continue
+		}
+		k, err := q.openKey(ring, kk)
+		if err != nil {
+			return err
+		}
+		v, err = q.openValue(ring, k, v)
+		if err != nil {
+			return err
+		}
+		items = append(items, item{kk, k, v})
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	return q.bucket.Batch(func(b backend.Batch) error {
+		eb := &Batch{ring: ring, bucket: q, batch: b}
+		for _, it := range items {
+			if err := b.Delete(it.kk); err != nil {
+				return err
+			}
+			if err := eb.put(it.k, it.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// keyring returns the keys currently in use.
+func (db *DB) keyring() (*keyring, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.keyringLocked()
+}
+
+// keyringLocked returns the keys currently in use. The caller must hold the
+// DB mutex.
+func (db *DB) keyringLocked() (*keyring, error) {
+	current := db.current
+	if current == nil {
+		key, err := db.keys.Key()
+		if err != nil {
+			return nil, err
+		}
+		current = key
+	}
+	return &keyring{current: current, old: db.old}, nil
+}
+
+// keyring holds the current key, with which data is encrypted, and the old
+// keys, with which data written earlier can be decrypted.
+type keyring struct {
+	current []byte
+	old     [][]byte
+}
+
+// all returns every key, starting with the current key.
+func (r *keyring) all() [][]byte {
+	return append([][]byte{r.current}, r.old...)
+}
+
+// find returns the key with the given ID.
+func (r *keyring) find(id []byte) ([]byte, error) {
+	for _, key := range r.all() {
+		if bytes.Equal(keyID(key), id) {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// stale returns true if stored value `v` was written with a key other than
+// the current key. Encrypted keys are always sealed with the same key as
+// their values.
+func (r *keyring) stale(v []byte) bool {
+	return len(v) < 1+keyIDSize || v[0] != formatV2 ||
+		!bytes.Equal(v[1:1+keyIDSize], keyID(r.current))
+}
+
+// keyID returns the ID of the key stored with each value encrypted with it,
+// from which the key cannot be recovered.
+func keyID(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kvq key id"))
+	return mac.Sum(nil)[:keyIDSize]
+}
+
+// newAEAD returns the cipher for the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Bucket wraps a bucket of the underlying DB.
+type Bucket struct {
+	db     *DB
+	bucket backend.Bucket
+	ns     []byte
+}
+
+// sealValue encrypts value `v` stored at (plaintext) key `k` with the current
+// key. The namespace and key are authenticated along with the value, so that
+// values cannot be moved between keys undetected.
+func (q *Bucket) sealValue(ring *keyring, k, v []byte) ([]byte, error) {
+	aead, err := newAEAD(ring.current)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 1+keyIDSize+aead.NonceSize()+len(v)+aead.Overhead())
+	out = append(out, formatV2)
+	out = append(out, keyID(ring.current)...)
+	nonce := out[len(out) : len(out)+aead.NonceSize()]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, v, q.additional(k)), nil
+}
+
+// openValue decrypts value `v` stored at (plaintext) key `k`, using the key
+// it records or, for values written by earlier versions, whichever key opens
+// it.
+func (q *Bucket) openValue(ring *keyring, k, v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return nil, ErrUnknownFormat
+	}
+	switch v[0] {
+	case formatV1:
+		var err error
+		for _, key := range ring.all() {
+			var out []byte
+			if out, err = q.open(key, k, v[1:]); err == nil {
+				return out, nil
+			}
+		}
+		return nil, err
+	case formatV2:
+		if len(v) < 1+keyIDSize {
+			return nil, ErrCiphertextTooShort
+		}
+		key, err := ring.find(v[1 : 1+keyIDSize])
+		if err != nil {
+			return nil, err
+		}
+		return q.open(key, k, v[1+keyIDSize:])
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// open decrypts the nonce and ciphertext `v` stored at (plaintext) key `k`
+// with the given key.
+func (q *Bucket) open(key, k, v []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) < aead.NonceSize() {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce, ciphertext := v[:aead.NonceSize()], v[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, q.additional(k))
+}
+
+// additional returns the additional authenticated data for key `k`.
+func (q *Bucket) additional(k []byte) []byte {
+	ad := make([]byte, 0, len(q.ns)+1+len(k))
+	ad = append(ad, q.ns...)
+	ad = append(ad, 0)
+	return append(ad, k...)
+}
+
+// sealKey returns the stored form of key `k` when encrypted with `key`. If
+// key encryption is enabled, the key is encrypted with a nonce derived from
+// the key itself, so that the same key always encrypts to the same value.
+func (q *Bucket) sealKey(key, k []byte) ([]byte, error) {
+	if !q.db.opts.EncryptKeys {
+		return k, nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kvq key nonce"))
+	mac.Write(k)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	return aead.Seal(nonce, nonce, k, q.ns), nil
+}
+
+// sealKeys returns the stored forms of key `k` under each key, starting with
+// the current key. If keys are not encrypted, only the plaintext key is
+// returned.
+func (q *Bucket) sealKeys(ring *keyring, k []byte) ([][]byte, error) {
+	if !q.db.opts.EncryptKeys {
+		return [][]byte{k}, nil
+	}
+	keys := [][]byte{}
+	for _, key := range ring.all() {
+		kk, err := q.sealKey(key, k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, kk)
+	}
+	return keys, nil
+}
+
+// openKey returns the plaintext form of stored key `kk`, using whichever key
+// opens it.
+func (q *Bucket) openKey(ring *keyring, kk []byte) ([]byte, error) {
+	if !q.db.opts.EncryptKeys {
+		return kk, nil
+	}
+	var err error
+	for _, key := range ring.all() {
+		var aead cipher.AEAD
+		if aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		if len(kk) < aead.NonceSize() {
+			return nil, ErrCiphertextTooShort
+		}
+		var k []byte
+		k, err = aead.Open(nil, kk[:aead.NonceSize()], kk[aead.NonceSize():], q.ns)
+		if err == nil {
+			return k, nil
+		}
+	}
+	return nil, err
+}
+
+// ForEach iterates through keys in the bucket. If the iteration function
+// returns a non-nil error, iteration stops and the error is returned to
+// the caller. If keys are encrypted, iteration is not in key order.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	ring, err := q.db.keyring()
+	if err != nil {
+		return err
+	}
+	return q.bucket.ForEach(func(k, v []byte) error {
+		k, err := q.openKey(ring, k)
+		if err != nil {
+			return err
+		}
+		v, err = q.openValue(ring, k, v)
+		if err != nil {
+			return err
+		}
+		return fn(k, v)
+	})
+}
+
+// Batch enacts a number of operations in one atomic go. If the batch
+// function returns a non-nil error, the batch is discarded and the error
+// is returned to the caller. If the batch function returns nil, the batch
+// is committed to the queue.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	q.db.mutex.RLock()
+	defer q.db.mutex.RUnlock()
+	ring, err := q.db.keyringLocked()
+	if err != nil {
+		return err
+	}
+	return q.bucket.Batch(func(b backend.Batch) error {
+		return fn(&Batch{
+			ring:   ring,
+			bucket: q,
+			batch:  b,
+		})
+	})
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	ring, err := q.db.keyring()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := q.sealKeys(ring, k)
+	if err != nil {
+		return nil, err
+	}
+	for _, kk := range keys {
+		v, err := q.bucket.Get(kk)
+		if err == backend.ErrKeyNotFound {
+			// May be sealed with an old key
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return q.openValue(ring, k, v)
+	}
+	return nil, backend.ErrKeyNotFound
+}
+
+// Clear removes all items from this bucket.
+func (q *Bucket) Clear() error {
+	return q.bucket.Clear()
+}
+
+// Batch encrypts operations before passing them to a batch of the wrapped
+// backend.
+type Batch struct {
+	ring   *keyring
+	bucket *Bucket
+	batch  backend.Batch
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	if err := b.deleteOld(k); err != nil {
+		return err
+	}
+	return b.put(k, v)
+}
+
+// put sets the key `k`, sealed with the current key, to value `v`.
+func (b *Batch) put(k, v []byte) error {
+	kk, err := b.bucket.sealKey(b.ring.current, k)
+	if err != nil {
+		return err
+	}
+	vv, err := b.bucket.sealValue(b.ring, k, v)
+	if err != nil {
+		return err
+	}
+	return b.batch.Put(kk, vv)
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	kk, err := b.bucket.sealKey(b.ring.current, k)
+	if err != nil {
+		return err
+	}
+	if err := b.deleteOld(k); err != nil {
+		return err
+	}
+	return b.batch.Delete(kk)
+}
+
+// deleteOld deletes the key `k` as sealed with each old key, which it may be
+// until re-encrypted.
+func (b *Batch) deleteOld(k []byte) error {
+	if !b.bucket.db.opts.EncryptKeys {
+		return nil
+	}
+	for _, key := range b.ring.old {
+		kk, err := b.bucket.sealKey(key, k)
+		if err != nil {
+			return err
+		}
+		if err := b.batch.Delete(kk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.batch.Close()
+}
@@ -0,0 +1,230 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DefaultPrefix is prepended to all etcd keys created by the backend.
+const DefaultPrefix = "kvq/"
+
+// pageSize is the number of keys read at a time when iterating a bucket.
+const pageSize = 1000
+
+// DB encapsulates an etcd client.
+type DB struct {
+	client *clientv3.Client
+	prefix string
+}
+
+func init() {
+	// Registered URIs take the form etcd://host:port[,host:port...]
+	backend.Register("etcd", backend.Driver{
+		Open:         Open,
+		OpenReadOnly: OpenReadOnly,
+	})
+}
+
+// Open connects to the etcd cluster at the given comma-separated list of
+// endpoints (e.g. "localhost:2379"), using the default key prefix.
+func Open(endpoints string) (backend.DB, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return New(client, DefaultPrefix), nil
+}
+
+// OpenReadOnly connects to the etcd cluster at the given endpoints, returning
+// a DB that cannot modify any queue.
+func OpenReadOnly(endpoints string) (backend.DB, error) {
+	db, err := Open(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ReadOnly(db), nil
+}
+
+// New returns a DB from the given etcd client. All keys are prefixed with
+// `prefix`, allowing several DBs to share a cluster.
+func New(client *clientv3.Client, prefix string) backend.DB {
+	return &DB{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Bucket returns a queue in the given namespace.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	// Prefix namespace with length to avoid conflicts between namespaces
+	// (e.g. "test" and "testing")
+	if len(name) > 0xff {
+		return nil, fmt.Errorf("namespace must be <255 chars")
+	}
+
+	return &Bucket{
+		db: db,
+		ns: db.prefix + string([]byte{byte(len(name))}) + name,
+	}, nil
+}
+
+// Close closes the etcd client and releases any resources.
+func (db *DB) Close() {
+	db.client.Close()
+}
+
+// Bucket represents a set of keys within a DB, where each key is prefixed by
+// the given namespace.
+type Bucket struct {
+	db *DB
+	ns string
+}
+
+// ForEach iterates through keys in the bucket in key order. If the iteration
+// function returns a non-nil error, iteration stops and the error is returned
+// to the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	ctx := context.Background()
+	end := clientv3.GetPrefixRangeEnd(q.ns)
+	from := q.ns
+	for {
+		resp, err := q.db.client.Get(ctx, from,
+			clientv3.WithRange(end),
+			clientv3.WithLimit(pageSize))
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			if err := fn(kv.Key[len(q.ns):], kv.Value); err != nil {
+				return err
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		// Continue from the key immediately following the last one read
+		from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// Batch enacts a number of operations in one etcd transaction. If the batch
+// function returns a non-nil error, the batch is discarded and the error is
+// returned to the caller. If the batch function returns nil, the transaction
+// is committed.
+//
+// Note that etcd limits the number of operations in a single transaction
+// (128 by default, configured by the server's --max-txn-ops flag).
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	batch := &Batch{
+		bucket: q,
+		index:  map[string]int{},
+	}
+	defer batch.Close()
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+	if len(batch.ops) == 0 {
+		return nil
+	}
+
+	_, err := q.db.client.Txn(context.Background()).Then(batch.ops...).Commit()
+	return err
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	resp, err := q.db.client.Get(context.Background(), q.ns+string(k))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Clear removes all items from this bucket.
+func (q *Bucket) Clear() error {
+	_, err := q.db.client.Delete(context.Background(), q.ns,
+		clientv3.WithPrefix())
+	return err
+}
+
+// DeleteRange deletes all keys `k` in the bucket where `start <= k < end`
+// in a single request. A nil `start` or `end` leaves that end of the range
+// unbounded.
+func (q *Bucket) DeleteRange(start, end []byte) error {
+	from, to := q.ns, clientv3.GetPrefixRangeEnd(q.ns)
+	if start != nil {
+		from = q.ns + string(start)
+	}
+	if end != nil {
+		to = q.ns + string(end)
+	}
+	_, err := q.db.client.Delete(context.Background(), from,
+		clientv3.WithRange(to))
+	return err
+}
+
+// PutTTL sets the key `k` to value `v`, attached to a new lease such that
+// etcd deletes the key once `ttl` has elapsed. etcd leases have a granularity
+// of one second, so `ttl` is rounded up to the nearest second.
+func (q *Bucket) PutTTL(k, v []byte, ttl time.Duration) error {
+	ctx := context.Background()
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	lease, err := q.db.client.Grant(ctx, secs)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.client.Put(ctx, q.ns+string(k), string(v),
+		clientv3.WithLease(lease.ID))
+	return err
+}
+
+// Batch represents a set of put/delete operations to perform within an etcd
+// transaction.
+type Batch struct {
+	bucket *Bucket
+	ops    []clientv3.Op
+	index  map[string]int // key => position in ops
+}
+
+// add stages an operation on key `k`, replacing any earlier operation on the
+// same key, as etcd rejects transactions that modify a key more than once.
+func (b *Batch) add(k string, op clientv3.Op) {
+	if i, ok := b.index[k]; ok {
+		b.ops[i] = op
+		return
+	}
+	b.index[k] = len(b.ops)
+	b.ops = append(b.ops, op)
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	kk := b.bucket.ns + string(k)
+	b.add(kk, clientv3.OpPut(kk, string(v)))
+	return nil
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	kk := b.bucket.ns + string(k)
+	b.add(kk, clientv3.OpDelete(kk))
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.ops = nil
+	b.index = map[string]int{}
+}
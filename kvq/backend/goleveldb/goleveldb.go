@@ -16,6 +16,15 @@ type DB struct {
 	levelDB *leveldb.DB
 }
 
+func init() {
+	backend.Register("goleveldb", backend.Driver{
+		Open:         Open,
+		OpenReadOnly: OpenReadOnly,
+		Destroy:      Destroy,
+		Local:        true,
+	})
+}
+
 // Open creates or opens an existing DB at the given path.
 func Open(path string) (backend.DB, error) {
 	levelDB, err := leveldb.OpenFile(path, nil)
@@ -25,6 +34,20 @@ func Open(path string) (backend.DB, error) {
 	return &DB{levelDB}, nil
 }
 
+// OpenReadOnly opens an existing DB at the given path in read-only mode. Note
+// that LevelDB permits only one process to open a database at a time, so this
+// fails while the database is open elsewhere.
+func OpenReadOnly(path string) (backend.DB, error) {
+	levelDB, err := leveldb.OpenFile(path, &opt.Options{
+		ErrorIfMissing: true,
+		ReadOnly:       true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return backend.ReadOnly(&DB{levelDB}), nil
+}
+
 // Destroy destroys the DB at the given path.
 func Destroy(path string) error {
 	return os.RemoveAll(path)
@@ -45,8 +68,44 @@ func NewMem() (backend.DB, error) {
 	return &DB{levelDB}, nil
 }
 
+// Metrics returns the LevelDB instance's statistics, including the size,
+// number of tables and compaction time of each level.
+func (db *DB) Metrics() (map[string]int64, error) {
+	var s leveldb.DBStats
+	if err := db.levelDB.Stats(&s); err != nil {
+		return nil, err
+	}
+	m := map[string]int64{
+		"write_delays":   int64(s.WriteDelayCount),
+		"io_read_bytes":  int64(s.IORead),
+		"io_write_bytes": int64(s.IOWrite),
+		"open_tables":    int64(s.OpenedTablesCount),
+		"snapshots":      int64(s.AliveSnapshots),
+		"iterators":      int64(s.AliveIterators),
+	}
+	for i := range s.LevelSizes {
+		level := fmt.Sprintf("level%d_", i)
+		m[level+"size_bytes"] = s.LevelSizes[i]
+		m[level+"tables"] = int64(s.LevelTablesCounts[i])
+		m[level+"compaction_ns"] = int64(s.LevelDurations[i])
+	}
+	return m, nil
+}
+
 // Bucket returns a queue in the given namespace.
 func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	ns, err := namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		db: db,
+		ns: ns,
+	}, nil
+}
+
+// namespace returns the prefix of the keys in the bucket with the given name.
+func namespace(name string) ([]byte, error) {
 	// Prefix namespace with length to avoid conflicts between namespaces
 	// (e.g. "test" and "testing")
 	if len(name) > 0xff {
@@ -54,12 +113,17 @@ func (db *DB) Bucket(name string) (backend.Bucket, error) {
 	}
 
 	n := byte(len(name))
-	ns := append([]byte{n}, []byte(name)...)
+	return append([]byte{n}, []byte(name)...), nil
+}
 
-	return &Bucket{
-		db: db,
-		ns: ns,
-	}, nil
+// SnapshotDB returns a consistent, read-only view of every bucket using a
+// single LevelDB snapshot.
+func (db *DB) SnapshotDB() (backend.DBSnapshot, error) {
+	snap, err := db.levelDB.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &DBSnapshot{snap: snap}, nil
 }
 
 // Close closes the database and releases any resources.
@@ -92,11 +156,39 @@ func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
 	return nil
 }
 
+// ForEachFrom iterates through keys in the queue from `start` onwards.
+func (q *Bucket) ForEachFrom(start []byte, fn func(k, v []byte) error) error {
+	keyRange := util.BytesPrefix(q.ns)
+	keyRange.Start = append(append([]byte{}, q.ns...), start...)
+	it := q.db.levelDB.NewIterator(keyRange, nil)
+	defer it.Release()
+
+	for it.Next() {
+		kk, v := it.Key(), it.Value()
+		if err := fn(kk[len(q.ns):], v); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
 // Batch enacts a number of operations in one atomic go. If the batch
 // function returns a non-nil error, the batch is discarded and the error
 // is returned to the caller. If the batch function returns nil, the batch
 // is committed to the queue.
 func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	return q.batch(fn, true)
+}
+
+// BatchNoSync enacts operations as with Batch, without waiting for them to be
+// synced to disk.
+func (q *Bucket) BatchNoSync(fn func(backend.Batch) error) error {
+	return q.batch(fn, false)
+}
+
+// batch enacts operations as with Batch, syncing them to disk if `sync` is
+// true.
+func (q *Bucket) batch(fn func(backend.Batch) error, sync bool) error {
 	b := &leveldb.Batch{}
 	batch := &Batch{
 		ns:         q.ns,
@@ -109,6 +201,38 @@ func (q *Bucket) Batch(fn func(backend.Batch) error) error {
 		return err
 	}
 
+	wo := &opt.WriteOptions{Sync: sync}
+	return q.db.levelDB.Write(b, wo)
+}
+
+// BatchWith enacts operations on this queue and other queues of the same DB
+// in a single LevelDB write.
+func (q *Bucket) BatchWith(others []backend.Bucket, fn func(b backend.Batch, o []backend.Batch) error) error {
+	b := &leveldb.Batch{}
+	batch := &Batch{
+		ns:         q.ns,
+		levelDB:    q.db.levelDB,
+		levelBatch: b,
+	}
+	defer batch.Close()
+
+	batches := make([]backend.Batch, len(others))
+	for i, other := range others {
+		o, ok := other.(*Bucket)
+		if !ok || o.db != q.db {
+			return backend.ErrForeignBucket
+		}
+		batches[i] = &Batch{
+			ns:         o.ns,
+			levelDB:    q.db.levelDB,
+			levelBatch: b,
+		}
+	}
+
+	if err := fn(batch, batches); err != nil {
+		return err
+	}
+
 	wo := &opt.WriteOptions{Sync: true}
 	return q.db.levelDB.Write(b, wo)
 }
@@ -128,18 +252,115 @@ func (q *Bucket) Clear() error {
 	keyRange := util.BytesPrefix(q.ns)
 	it := q.db.levelDB.NewIterator(keyRange, nil)
 
+	defer it.Release()
+
 	b := &leveldb.Batch{}
 
 	for it.Next() {
-		kk := it.Key()
-		k := kk[len(q.ns):]
-		b.Delete(k)
+		b.Delete(it.Key())
+	}
+	if err := it.Error(); err != nil {
+		return err
 	}
 
 	wo := &opt.WriteOptions{Sync: true}
 	return q.db.levelDB.Write(b, wo)
 }
 
+// EstimateSize returns the approximate size of the queue's data on disk.
+// Writes still held in the journal are not included.
+func (q *Bucket) EstimateSize() (int64, error) {
+	sizes, err := q.db.levelDB.SizeOf([]util.Range{*util.BytesPrefix(q.ns)})
+	if err != nil {
+		return 0, err
+	}
+	return sizes.Sum(), nil
+}
+
+// Compact compacts the queue's key range, discarding deleted keys and
+// overwritten values.
+func (q *Bucket) Compact() error {
+	return q.db.levelDB.CompactRange(*util.BytesPrefix(q.ns))
+}
+
+// Snapshot returns a consistent, read-only view of the queue using a LevelDB
+// snapshot.
+func (q *Bucket) Snapshot() (backend.Snapshot, error) {
+	snap, err := q.db.levelDB.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		ns:   q.ns,
+		snap: snap,
+	}, nil
+}
+
+// Snapshot is a point-in-time view of a Bucket.
+type Snapshot struct {
+	ns   []byte
+	snap *leveldb.Snapshot
+}
+
+// ForEach iterates through keys in the snapshot.
+func (s *Snapshot) ForEach(fn func(k, v []byte) error) error {
+	it := s.snap.NewIterator(util.BytesPrefix(s.ns), nil)
+	defer it.Release()
+
+	for it.Next() {
+		kk, v := it.Key(), it.Value()
+		if err := fn(kk[len(s.ns):], v); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// Get returns the value stored at key `k`.
+func (s *Snapshot) Get(k []byte) ([]byte, error) {
+	kk := make([]byte, 0, len(s.ns)+len(k))
+	kk = append(append(kk, s.ns...), k...)
+	vv, err := s.snap.Get(kk, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, backend.ErrKeyNotFound
+	}
+	return vv, err
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() {
+	s.snap.Release()
+}
+
+// DBSnapshot is a point-in-time view of a DB.
+type DBSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+// Bucket returns a view of the bucket in the given namespace.
+func (s *DBSnapshot) Bucket(name string) (backend.Snapshot, error) {
+	ns, err := namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketSnapshot{Snapshot{ns: ns, snap: s.snap}}, nil
+}
+
+// Close releases the snapshot.
+func (s *DBSnapshot) Close() {
+	s.snap.Release()
+}
+
+// bucketSnapshot is a view of a bucket within a DBSnapshot, which is released
+// along with the DBSnapshot rather than by itself.
+type bucketSnapshot struct {
+	Snapshot
+}
+
+// Close does nothing; the view is released by closing its DBSnapshot.
+func (s *bucketSnapshot) Close() {
+}
+
 // Batch represents a set of put/delete operations to perform on a Bucket.
 type Batch struct {
 	levelDB    *leveldb.DB
@@ -2,8 +2,9 @@ package levigo
 
 import (
 	"bytes"
+	"fmt"
+
 	"github.com/jmhodges/levigo"
-	"github.com/johnsto/go-kvq/kvq"
 	"github.com/johnsto/go-kvq/kvq/backend"
 )
 
@@ -11,7 +12,15 @@ type DB struct {
 	levigoDB *levigo.DB
 }
 
-func Open(path string) (*kvq.DB, error) {
+func init() {
+	backend.Register("levigo", backend.Driver{
+		Open:    Open,
+		Destroy: Destroy,
+		Local:   true,
+	})
+}
+
+func Open(path string) (backend.DB, error) {
 	opts := levigo.NewOptions()
 	opts.SetCreateIfMissing(true)
 	db, err := levigo.Open(path, opts)
@@ -26,14 +35,24 @@ func Destroy(path string) error {
 	return levigo.DestroyDatabase(path, levigo.NewOptions())
 }
 
-func New(db *levigo.DB) *kvq.DB {
-	return kvq.NewDB(&DB{db})
+func New(db *levigo.DB) backend.DB {
+	return &DB{db}
 }
 
 func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	// Prefix namespace with length to avoid conflicts between namespaces
+	// (e.g. "test" and "testing")
+	if len(name) > 0xff {
+		return nil, fmt.Errorf("namespace must be <255 chars")
+	}
+
+	ns := make([]byte, 0, len(name)+1)
+	ns = append(ns, byte(len(name)))
+	ns = append(ns, name...)
+
 	return &Bucket{
 		db: db,
-		ns: []byte(name),
+		ns: ns,
 	}, nil
 }
 
@@ -79,6 +98,15 @@ func (q *Bucket) Batch(fn func(backend.Batch) error) error {
 	return batch.Write()
 }
 
+func (q *Bucket) BatchNoSync(fn func(backend.Batch) error) error {
+	batch := NewBatch(q)
+	defer batch.Close()
+	if err := fn(batch); err != nil {
+		return err
+	}
+	return batch.write(false)
+}
+
 func (q *Bucket) Get(k []byte) ([]byte, error) {
 	ro := levigo.NewReadOptions()
 	defer ro.Close()
@@ -94,7 +122,7 @@ func (q *Bucket) Clear() error {
 	wb := levigo.NewWriteBatch()
 	defer wb.Close()
 	err := q.ForEach(func(k, _ []byte) error {
-		wb.Delete(k)
+		wb.Delete(append(q.ns[:], k...))
 		return nil
 	})
 	if err != nil {
@@ -134,8 +162,12 @@ func (b *Batch) Delete(k []byte) error {
 }
 
 func (b *Batch) Write() error {
+	return b.write(true)
+}
+
+func (b *Batch) write(sync bool) error {
 	wo := levigo.NewWriteOptions()
-	wo.SetSync(true)
+	wo.SetSync(sync)
 	defer wo.Close()
 	return b.levigoDB.Write(wo, b.levigoWriteBatch)
 }
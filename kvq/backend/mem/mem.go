@@ -0,0 +1,372 @@
+package mem
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// DB is a non-persistent, in-memory set of buckets. It has no dependencies
+// beyond the standard library, making it suitable for tests and ephemeral
+// queues.
+type DB struct {
+	mutex   sync.Mutex
+	buckets map[string]*Bucket
+}
+
+func init() {
+	backend.Register("mem", backend.Driver{
+		Open: func(string) (backend.DB, error) {
+			return New(), nil
+		},
+	})
+}
+
+// New returns a new, empty in-memory DB.
+func New() backend.DB {
+	return &DB{
+		buckets: map[string]*Bucket{},
+	}
+}
+
+// Bucket returns a queue in the given namespace. Repeated calls with the same
+// name return the same bucket.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[name]
+	if !ok {
+		bucket = &Bucket{
+			db:   db,
+			data: map[string][]byte{},
+		}
+		db.buckets[name] = bucket
+	}
+	return bucket, nil
+}
+
+// SnapshotDB returns a copy of the current contents of every bucket, taken
+// while no batch can be applied to any of them.
+func (db *DB) SnapshotDB() (backend.DBSnapshot, error) {
+	multiBatchMutex.Lock()
+	defer multiBatchMutex.Unlock()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, bucket := range db.buckets {
+		bucket.mutex.RLock()
+		defer bucket.mutex.RUnlock()
+	}
+	snapshot := &DBSnapshot{buckets: make(map[string]*Bucket, len(db.buckets))}
+	for name, bucket := range db.buckets {
+		snapshot.buckets[name] = bucket.copy()
+	}
+	return snapshot, nil
+}
+
+// Close releases all data held by the database.
+func (db *DB) Close() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.buckets = map[string]*Bucket{}
+}
+
+// multiBatchMutex serialises batches spanning several buckets, so that their
+// bucket locks are never acquired in conflicting orders.
+var multiBatchMutex sync.Mutex
+
+// Bucket represents a set of keys held in memory. Values are held in a map,
+// with a sorted index of keys maintained to provide ordered iteration.
+type Bucket struct {
+	db    *DB
+	mutex sync.RWMutex
+	data  map[string][]byte
+	keys  []string // sorted
+}
+
+// ForEach iterates through keys in the bucket in key order. If the iteration
+// function returns a non-nil error, iteration stops and the error is returned
+// to the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	return q.ForEachFrom(nil, fn)
+}
+
+// ForEachFrom iterates through keys in the bucket from `start` onwards, in
+// key order.
+func (q *Bucket) ForEachFrom(start []byte, fn func(k, v []byte) error) error {
+	// Iterate over a copy of the index so the iteration function can modify
+	// the bucket without deadlocking.
+	q.mutex.RLock()
+	i := sort.SearchStrings(q.keys, string(start))
+	keys := make([]string, len(q.keys)-i)
+	copy(keys, q.keys[i:])
+	q.mutex.RUnlock()
+
+	for _, k := range keys {
+		q.mutex.RLock()
+		v, ok := q.data[k]
+		q.mutex.RUnlock()
+		if !ok {
+			// Deleted since iteration began
+			continue
+		}
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch enacts a number of operations in one atomic go. If the batch
+// function returns a non-nil error, the batch is discarded and the error
+// is returned to the caller. If the batch function returns nil, the batch
+// is committed to the queue.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	batch := &Batch{}
+	defer batch.Close()
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.apply(batch)
+	return nil
+}
+
+// BatchWith enacts operations on this bucket and other buckets of the same
+// DB in one atomic go.
+func (q *Bucket) BatchWith(others []backend.Bucket, fn func(b backend.Batch, o []backend.Batch) error) error {
+	buckets := make([]*Bucket, len(others))
+	for i, other := range others {
+		o, ok := other.(*Bucket)
+		if !ok || o.db != q.db || q.db == nil {
+			return backend.ErrForeignBucket
+		}
+		buckets[i] = o
+	}
+
+	batch := &Batch{}
+	defer batch.Close()
+	otherBatches := make([]*Batch, len(others))
+	batches := make([]backend.Batch, len(others))
+	for i := range others {
+		otherBatches[i] = &Batch{}
+		defer otherBatches[i].Close()
+		batches[i] = otherBatches[i]
+	}
+
+	if err := fn(batch, batches); err != nil {
+		return err
+	}
+
+	multiBatchMutex.Lock()
+	defer multiBatchMutex.Unlock()
+	locked := map[*Bucket]bool{q: true}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, o := range buckets {
+		if !locked[o] {
+			locked[o] = true
+			o.mutex.Lock()
+			defer o.mutex.Unlock()
+		}
+	}
+	q.apply(batch)
+	for i, o := range buckets {
+		o.apply(otherBatches[i])
+	}
+	return nil
+}
+
+// apply enacts the operations staged in the batch. The caller must hold the
+// bucket mutex.
+func (q *Bucket) apply(batch *Batch) {
+	for _, op := range batch.ops {
+		if op.delete {
+			q.delete(op.k)
+		} else {
+			q.put(op.k, op.v)
+		}
+	}
+}
+
+// put sets key `k` to value `v`, updating the key index if necessary.
+func (q *Bucket) put(k string, v []byte) {
+	if _, ok := q.data[k]; !ok {
+		i := sort.SearchStrings(q.keys, k)
+		q.keys = append(q.keys, "")
+		copy(q.keys[i+1:], q.keys[i:])
+		q.keys[i] = k
+	}
+	q.data[k] = v
+}
+
+// delete removes key `k`, updating the key index if necessary.
+func (q *Bucket) delete(k string) {
+	if _, ok := q.data[k]; !ok {
+		return
+	}
+	delete(q.data, k)
+	i := sort.SearchStrings(q.keys, k)
+	q.keys = append(q.keys[:i], q.keys[i+1:]...)
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	v, ok := q.data[string(k)]
+	if !ok {
+		return nil, backend.ErrKeyNotFound
+	}
+	return v, nil
+}
+
+// Clear removes all items from this bucket.
+func (q *Bucket) Clear() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.data = map[string][]byte{}
+	q.keys = nil
+	return nil
+}
+
+// DeleteRange deletes all keys `k` in the bucket where `start <= k < end`.
+// A nil `start` or `end` leaves that end of the range unbounded.
+func (q *Bucket) DeleteRange(start, end []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i, j := 0, len(q.keys)
+	if start != nil {
+		i = sort.SearchStrings(q.keys, string(start))
+	}
+	if end != nil {
+		j = sort.SearchStrings(q.keys, string(end))
+	}
+	if i >= j {
+		return nil
+	}
+	for _, k := range q.keys[i:j] {
+		delete(q.data, k)
+	}
+	q.keys = append(q.keys[:i], q.keys[j:]...)
+	return nil
+}
+
+// Snapshot returns a copy of the bucket's current contents.
+func (q *Bucket) Snapshot() (backend.Snapshot, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	return &Snapshot{bucket: q.copy()}, nil
+}
+
+// copy returns a copy of the bucket's current contents. The caller must hold
+// the bucket mutex.
+func (q *Bucket) copy() *Bucket {
+	// Stored values are never modified in place, so only the map and index
+	// need copying.
+	c := &Bucket{
+		data: make(map[string][]byte, len(q.data)),
+		keys: make([]string, len(q.keys)),
+	}
+	for k, v := range q.data {
+		c.data[k] = v
+	}
+	copy(c.keys, q.keys)
+	return c
+}
+
+// Increment atomically adds `delta` to the counter at key `k`.
+func (q *Bucket) Increment(k []byte, delta int64) (int64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var n int64
+	if v, ok := q.data[string(k)]; ok {
+		if len(v) != 8 {
+			return 0, backend.ErrNotCounter
+		}
+		n = int64(binary.BigEndian.Uint64(v))
+	}
+	n += delta
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(n))
+	q.put(string(k), v)
+	return n, nil
+}
+
+// Snapshot is a point-in-time copy of a Bucket.
+type Snapshot struct {
+	bucket *Bucket
+}
+
+// ForEach iterates through keys in the snapshot in key order.
+func (s *Snapshot) ForEach(fn func(k, v []byte) error) error {
+	return s.bucket.ForEach(fn)
+}
+
+// Get returns the value stored at key `k`.
+func (s *Snapshot) Get(k []byte) ([]byte, error) {
+	return s.bucket.Get(k)
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() {
+	s.bucket = &Bucket{}
+}
+
+// DBSnapshot is a point-in-time copy of a DB.
+type DBSnapshot struct {
+	buckets map[string]*Bucket
+}
+
+// Bucket returns a view of the bucket in the given namespace.
+func (s *DBSnapshot) Bucket(name string) (backend.Snapshot, error) {
+	bucket, ok := s.buckets[name]
+	if !ok {
+		bucket = &Bucket{data: map[string][]byte{}}
+	}
+	return &Snapshot{bucket: bucket}, nil
+}
+
+// Close releases the snapshot.
+func (s *DBSnapshot) Close() {
+	s.buckets = nil
+}
+
+// op is a single staged batch operation.
+type op struct {
+	k      string
+	v      []byte
+	delete bool
+}
+
+// Batch represents a set of put/delete operations to perform on a Bucket.
+// Operations are staged and applied in order when the batch is committed.
+type Batch struct {
+	ops []op
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	// Copy value, as the caller is free to reuse the slice
+	b.ops = append(b.ops, op{k: string(k), v: append([]byte{}, v...)})
+	return nil
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	b.ops = append(b.ops, op{k: string(k), delete: true})
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.ops = nil
+}
@@ -0,0 +1,416 @@
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// DB encapsulates a Pebble instance.
+type DB struct {
+	pebbleDB *pebble.DB
+}
+
+func init() {
+	backend.Register("pebble", backend.Driver{
+		Open:         Open,
+		OpenReadOnly: OpenReadOnly,
+		Destroy:      Destroy,
+		Local:        true,
+	})
+}
+
+// Open creates or opens an existing DB at the given path.
+func Open(path string) (backend.DB, error) {
+	pebbleDB, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{pebbleDB}, nil
+}
+
+// OpenReadOnly opens an existing DB at the given path in read-only mode.
+func OpenReadOnly(path string) (backend.DB, error) {
+	pebbleDB, err := pebble.Open(path, &pebble.Options{
+		ErrorIfNotExists: true,
+		ReadOnly:         true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return backend.ReadOnly(&DB{pebbleDB}), nil
+}
+
+// Destroy destroys the DB at the given path.
+func Destroy(path string) error {
+	return os.RemoveAll(path)
+}
+
+// New returns a DB from the given Pebble instance.
+func New(db *pebble.DB) backend.DB {
+	return &DB{db}
+}
+
+// Metrics returns the Pebble instance's metrics, including the size and
+// number of files of each level, and counts of compactions and flushes.
+func (db *DB) Metrics() (map[string]int64, error) {
+	pm := db.pebbleDB.Metrics()
+	m := map[string]int64{
+		"disk_usage_bytes": int64(pm.DiskSpaceUsage()),
+		"compactions":      pm.Compact.Count,
+		"flushes":          pm.Flush.Count,
+	}
+	for i, l := range pm.Levels {
+		level := fmt.Sprintf("level%d_", i)
+		m[level+"size_bytes"] = l.Size
+		m[level+"files"] = l.NumFiles
+	}
+	return m, nil
+}
+
+// Bucket returns a queue in the given namespace.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	// Prefix namespace with length to avoid conflicts between namespaces
+	// (e.g. "test" and "testing")
+	if len(name) > 0xff {
+		return nil, fmt.Errorf("namespace must be <255 chars")
+	}
+
+	ns := make([]byte, 0, len(name)+1)
+	ns = append(ns, byte(len(name)))
+	ns = append(ns, name...)
+
+	return &Bucket{
+		db: db,
+		ns: ns,
+	}, nil
+}
+
+// Close closes the database and releases any resources.
+func (db *DB) Close() {
+	db.pebbleDB.Close()
+}
+
+// Bucket represents a Pebble-backed queue, where each key is prefixed by
+// the given namespace. All batch writes are synced by default.
+type Bucket struct {
+	db *DB
+	ns []byte
+}
+
+// key returns the namespaced form of key `k`.
+func (q *Bucket) key(k []byte) []byte {
+	kk := make([]byte, 0, len(q.ns)+len(k))
+	kk = append(kk, q.ns...)
+	return append(kk, k...)
+}
+
+// bounds returns the key range covering the whole namespace.
+func (q *Bucket) bounds() (lower, upper []byte) {
+	lower = q.ns
+	upper = append([]byte{}, q.ns...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		upper[i]++
+		if upper[i] != 0 {
+			return lower, upper[:i+1]
+		}
+	}
+	return lower, nil
+}
+
+// ForEach iterates through keys in the queue. If the iteration function
+// returns a non-nil error, iteration stops and the error is returned to
+// the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	lower, upper := q.bounds()
+	it, err := q.db.pebbleDB.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.First(); it.Valid(); it.Next() {
+		kk, v := it.Key(), it.Value()
+		k := kk[len(q.ns):]
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+// ForEachFrom iterates through keys in the queue from `start` onwards.
+func (q *Bucket) ForEachFrom(start []byte, fn func(k, v []byte) error) error {
+	_, upper := q.bounds()
+	it, err := q.db.pebbleDB.NewIter(&pebble.IterOptions{
+		LowerBound: q.key(start),
+		UpperBound: upper,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.First(); it.Valid(); it.Next() {
+		if err := fn(it.Key()[len(q.ns):], it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// Batch enacts a number of operations in one atomic go. If the batch
+// function returns a non-nil error, the batch is discarded and the error
+// is returned to the caller. If the batch function returns nil, the batch
+// is committed to the queue.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	return q.batch(fn, pebble.Sync)
+}
+
+// BatchNoSync enacts operations as with Batch, without waiting for them to be
+// synced to disk.
+func (q *Bucket) BatchNoSync(fn func(backend.Batch) error) error {
+	return q.batch(fn, pebble.NoSync)
+}
+
+// batch enacts operations as with Batch, using the given write options.
+func (q *Bucket) batch(fn func(backend.Batch) error, wo *pebble.WriteOptions) error {
+	batch := &Batch{
+		bucket:      q,
+		pebbleBatch: q.db.pebbleDB.NewBatch(),
+	}
+	defer batch.Close()
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	return batch.pebbleBatch.Commit(wo)
+}
+
+// BatchWith enacts operations on this bucket and other buckets of the same
+// DB in a single Pebble batch.
+func (q *Bucket) BatchWith(others []backend.Bucket, fn func(b backend.Batch, o []backend.Batch) error) error {
+	pebbleBatch := q.db.pebbleDB.NewBatch()
+	batch := &Batch{
+		bucket:      q,
+		pebbleBatch: pebbleBatch,
+	}
+	defer batch.Close()
+
+	batches := make([]backend.Batch, len(others))
+	for i, other := range others {
+		o, ok := other.(*Bucket)
+		if !ok || o.db != q.db {
+			return backend.ErrForeignBucket
+		}
+		batches[i] = &Batch{bucket: o, pebbleBatch: pebbleBatch}
+	}
+
+	if err := fn(batch, batches); err != nil {
+		return err
+	}
+
+	return pebbleBatch.Commit(pebble.Sync)
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	vv, closer, err := q.db.pebbleDB.Get(q.key(k))
+	if err == pebble.ErrNotFound {
+		return nil, backend.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	// Value is only valid until the closer is closed, so copy
+	return append([]byte{}, vv...), nil
+}
+
+// Clear removes all items from this queue using a single range deletion.
+func (q *Bucket) Clear() error {
+	return q.DeleteRange(nil, nil)
+}
+
+// DeleteRange deletes all keys `k` in the queue where `start <= k < end`
+// using a single range deletion. A nil `start` or `end` leaves that end of
+// the range unbounded.
+func (q *Bucket) DeleteRange(start, end []byte) error {
+	lower, upper := q.bounds()
+	if start != nil {
+		lower = q.key(start)
+	}
+	if end != nil {
+		upper = q.key(end)
+	}
+	if upper != nil {
+		return q.db.pebbleDB.DeleteRange(lower, upper, pebble.Sync)
+	}
+
+	// Namespace is at the very end of the keyspace, so there is no exclusive
+	// upper bound; fall back to deleting keys individually.
+	it, err := q.db.pebbleDB.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	b := q.db.pebbleDB.NewBatch()
+	defer b.Close()
+	for it.First(); it.Valid(); it.Next() {
+		if err := b.Delete(it.Key(), nil); err != nil {
+			return err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return b.Commit(pebble.Sync)
+}
+
+// EstimateSize returns the approximate size of the queue's data on disk.
+// Writes still held in the memtable are not included.
+func (q *Bucket) EstimateSize() (int64, error) {
+	lower, upper := q.bounds()
+	if upper == nil {
+		// Namespace is at the very end of the keyspace; bound by the
+		// largest possible key within it instead.
+		upper = q.key(bytes.Repeat([]byte{0xff}, 64))
+	}
+	n, err := q.db.pebbleDB.EstimateDiskUsage(lower, upper)
+	return int64(n), err
+}
+
+// Compact compacts the queue's key range, discarding range deletions and
+// deleted keys.
+func (q *Bucket) Compact() error {
+	lower, upper := q.bounds()
+	if upper == nil {
+		upper = q.key(bytes.Repeat([]byte{0xff}, 64))
+	}
+	return q.db.pebbleDB.Compact(lower, upper, true)
+}
+
+// Snapshot returns a consistent, read-only view of the queue using a Pebble
+// snapshot.
+func (q *Bucket) Snapshot() (backend.Snapshot, error) {
+	return &Snapshot{
+		bucket: q,
+		snap:   q.db.pebbleDB.NewSnapshot(),
+	}, nil
+}
+
+// SnapshotDB returns a consistent, read-only view of every bucket using a
+// single Pebble snapshot.
+func (db *DB) SnapshotDB() (backend.DBSnapshot, error) {
+	return &DBSnapshot{
+		db:   db,
+		snap: db.pebbleDB.NewSnapshot(),
+	}, nil
+}
+
+// DBSnapshot is a point-in-time view of a DB.
+type DBSnapshot struct {
+	db   *DB
+	snap *pebble.Snapshot
+}
+
+// Bucket returns a view of the bucket in the given namespace.
+func (s *DBSnapshot) Bucket(name string) (backend.Snapshot, error) {
+	bucket, err := s.db.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketSnapshot{Snapshot{
+		bucket: bucket.(*Bucket),
+		snap:   s.snap,
+	}}, nil
+}
+
+// Close releases the snapshot.
+func (s *DBSnapshot) Close() {
+	s.snap.Close()
+}
+
+// bucketSnapshot is a view of a bucket within a DBSnapshot, which is released
+// along with the DBSnapshot rather than by itself.
+type bucketSnapshot struct {
+	Snapshot
+}
+
+// Close does nothing; the view is released by closing its DBSnapshot.
+func (s *bucketSnapshot) Close() {
+}
+
+// Snapshot is a point-in-time view of a Bucket.
+type Snapshot struct {
+	bucket *Bucket
+	snap   *pebble.Snapshot
+}
+
+// ForEach iterates through keys in the snapshot.
+func (s *Snapshot) ForEach(fn func(k, v []byte) error) error {
+	lower, upper := s.bucket.bounds()
+	it, err := s.snap.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.First(); it.Valid(); it.Next() {
+		if err := fn(it.Key()[len(s.bucket.ns):], it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// Get returns the value stored at key `k`.
+func (s *Snapshot) Get(k []byte) ([]byte, error) {
+	vv, closer, err := s.snap.Get(s.bucket.key(k))
+	if err == pebble.ErrNotFound {
+		return nil, backend.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return append([]byte{}, vv...), nil
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() {
+	s.snap.Close()
+}
+
+// Batch represents a set of put/delete operations to perform on a Bucket.
+type Batch struct {
+	bucket      *Bucket
+	pebbleBatch *pebble.Batch
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	return b.pebbleBatch.Set(b.bucket.key(k), v, nil)
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	return b.pebbleBatch.Delete(b.bucket.key(k), nil)
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.pebbleBatch.Close()
+}
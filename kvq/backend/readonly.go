@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"errors"
+)
+
+var (
+	// ErrReadOnly is returned when attempting to modify a read-only
+	// database.
+	ErrReadOnly = errors.New("database is read-only")
+)
+
+// ReadOnly wraps the given DB such that all attempts to modify its buckets
+// fail with ErrReadOnly. Reads are passed through to the wrapped DB.
+func ReadOnly(db DB) DB {
+	if IsReadOnly(db) {
+		return db
+	}
+	return &readOnlyDB{db}
+}
+
+// IsReadOnly returns true if the given DB was returned by ReadOnly.
+func IsReadOnly(db DB) bool {
+	_, ok := db.(*readOnlyDB)
+	return ok
+}
+
+// readOnlyDB is a DB whose buckets cannot be modified.
+type readOnlyDB struct {
+	db DB
+}
+
+// Bucket returns a read-only bucket in the given namespace.
+func (db *readOnlyDB) Bucket(name string) (Bucket, error) {
+	bucket, err := db.db.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyBucket{bucket}, nil
+}
+
+// Close closes the wrapped DB.
+func (db *readOnlyDB) Close() {
+	db.db.Close()
+}
+
+// readOnlyBucket is a Bucket that rejects all modifications.
+type readOnlyBucket struct {
+	bucket Bucket
+}
+
+// ForEach iterates through keys in the wrapped bucket.
+func (q *readOnlyBucket) ForEach(fn func(k, v []byte) error) error {
+	return q.bucket.ForEach(fn)
+}
+
+// Batch returns ErrReadOnly without calling the batch function.
+func (q *readOnlyBucket) Batch(fn func(Batch) error) error {
+	return ErrReadOnly
+}
+
+// Get returns the value stored at key `k` in the wrapped bucket.
+func (q *readOnlyBucket) Get(k []byte) ([]byte, error) {
+	return q.bucket.Get(k)
+}
+
+// Clear returns ErrReadOnly.
+func (q *readOnlyBucket) Clear() error {
+	return ErrReadOnly
+}
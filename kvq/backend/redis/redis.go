@@ -0,0 +1,203 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultPrefix is prepended to all Redis keys created by the backend.
+const DefaultPrefix = "kvq:"
+
+// pageSize is the number of keys read at a time when iterating a bucket.
+const pageSize = 1000
+
+// DB encapsulates a Redis client. Buckets are stored as a pair of Redis keys:
+// a hash containing values, and a sorted set indexing the keys in bytewise
+// order.
+type DB struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func init() {
+	// Registered URIs take the form redis://host:port/db
+	backend.Register("redis", backend.Driver{
+		Open: func(addr string) (backend.DB, error) {
+			return Open("redis://" + addr)
+		},
+		OpenReadOnly: func(addr string) (backend.DB, error) {
+			return OpenReadOnly("redis://" + addr)
+		},
+	})
+	backend.Register("rediss", backend.Driver{
+		Open: func(addr string) (backend.DB, error) {
+			return Open("rediss://" + addr)
+		},
+		OpenReadOnly: func(addr string) (backend.DB, error) {
+			return OpenReadOnly("rediss://" + addr)
+		},
+	})
+}
+
+// Open connects to the Redis server at the given URL (e.g.
+// "redis://localhost:6379/0"), using the default key prefix.
+func Open(url string) (backend.DB, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return New(client, DefaultPrefix), nil
+}
+
+// OpenReadOnly connects to the Redis server at the given URL, returning a DB
+// that cannot modify any queue.
+func OpenReadOnly(url string) (backend.DB, error) {
+	db, err := Open(url)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ReadOnly(db), nil
+}
+
+// New returns a DB from the given Redis client. All keys are prefixed with
+// `prefix`, allowing several DBs to share a Redis database.
+func New(client redis.UniversalClient, prefix string) backend.DB {
+	return &DB{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Bucket returns a queue in the given namespace.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	// Wrap the namespace in a hash tag so that both keys of the bucket are
+	// assigned to the same slot when using Redis Cluster, as required by
+	// MULTI/EXEC.
+	base := db.prefix + "{" + name + "}"
+	return &Bucket{
+		db:        db,
+		valuesKey: base + ":v",
+		indexKey:  base + ":k",
+	}, nil
+}
+
+// Close closes the Redis client and releases any resources.
+func (db *DB) Close() {
+	db.client.Close()
+}
+
+// Bucket represents a set of keys within a DB.
+type Bucket struct {
+	db        *DB
+	valuesKey string // hash of key => value
+	indexKey  string // sorted set of keys
+}
+
+// ForEach iterates through keys in the bucket in key order. If the iteration
+// function returns a non-nil error, iteration stops and the error is returned
+// to the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	ctx := context.Background()
+	min := "-"
+	for {
+		keys, err := q.db.client.ZRangeByLex(ctx, q.indexKey, &redis.ZRangeBy{
+			Min:   min,
+			Max:   "+",
+			Count: pageSize,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		values, err := q.db.client.HMGet(ctx, q.valuesKey, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			v, ok := values[i].(string)
+			if !ok {
+				// Deleted since the index was read
+				continue
+			}
+			if err := fn([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+
+		if len(keys) < pageSize {
+			return nil
+		}
+		min = "(" + keys[len(keys)-1]
+	}
+}
+
+// Batch enacts a number of operations in one MULTI/EXEC transaction. If the
+// batch function returns a non-nil error, the transaction is discarded and
+// the error is returned to the caller. If the batch function returns nil, the
+// transaction is executed.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	ctx := context.Background()
+	_, err := q.db.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return fn(&Batch{
+			ctx:    ctx,
+			bucket: q,
+			pipe:   pipe,
+		})
+	})
+	return err
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	v, err := q.db.client.HGet(context.Background(), q.valuesKey,
+		string(k)).Bytes()
+	if err == redis.Nil {
+		return nil, backend.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Clear removes all items from this bucket.
+func (q *Bucket) Clear() error {
+	return q.db.client.Del(context.Background(), q.valuesKey,
+		q.indexKey).Err()
+}
+
+// Batch represents a set of put/delete operations queued within a
+// MULTI/EXEC transaction.
+type Batch struct {
+	ctx    context.Context
+	bucket *Bucket
+	pipe   redis.Pipeliner
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	b.pipe.HSet(b.ctx, b.bucket.valuesKey, string(k), v)
+	b.pipe.ZAdd(b.ctx, b.bucket.indexKey, redis.Z{Member: string(k)})
+	return nil
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	b.pipe.HDel(b.ctx, b.bucket.valuesKey, string(k))
+	b.pipe.ZRem(b.ctx, b.bucket.indexKey, string(k))
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.pipe.Discard()
+}
@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Driver provides the functions required to open and destroy databases of a
+// particular backend. OpenReadOnly and Destroy may be nil if the backend does
+// not support them.
+type Driver struct {
+	Open         Open
+	OpenReadOnly Open
+	Destroy      Destroy
+	// Local is true if the path given to Open names a file or directory on
+	// the local filesystem, which is locked while open for writing such that
+	// no other process can open it for writing at the same time.
+	Local bool
+}
+
+var (
+	driversMutex sync.RWMutex
+	drivers      = map[string]Driver{}
+)
+
+// Register makes a driver available by the provided name. Backends typically
+// register themselves when imported. If Register is called twice with the
+// same name or if the driver's Open function is nil, it panics.
+func Register(name string, driver Driver) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	if driver.Open == nil {
+		panic("backend: Register driver Open is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("backend: Register called twice for driver " + name)
+	}
+	drivers[name] = driver
+}
+
+// Lookup returns the driver registered with the given name.
+func Lookup(name string) (Driver, error) {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	driver, ok := drivers[name]
+	if !ok {
+		return Driver{}, fmt.Errorf("unknown backend %q (forgotten import?)", name)
+	}
+	return driver, nil
+}
+
+// Drivers returns a sorted list of the names of the registered drivers.
+func Drivers() []string {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,331 @@
+// Package s3 provides a backend wrapper that offloads large values to
+// S3-compatible object storage, keeping only keys and object references in
+// the wrapped backend.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// DefaultThreshold is the default minimum size of a value, in bytes, for it
+// to be stored in object storage rather than inline.
+const DefaultThreshold = 4096
+
+// Value encodings, stored as the first byte of each value in the wrapped
+// backend.
+const (
+	tagInline byte = iota // remainder of value is the value itself
+	tagObject             // remainder of value is an object key
+)
+
+var (
+	// ErrCorruptValue is returned when a stored value has an unknown
+	// encoding.
+	ErrCorruptValue = errors.New("corrupt value")
+)
+
+// Store is a simple object store. It is implemented for S3 by ObjectStore,
+// but may be implemented for any other blob storage service.
+type Store interface {
+	// Put stores the data under the given key.
+	Put(key string, data []byte) error
+	// Get returns the data stored under the given key.
+	Get(key string) ([]byte, error)
+	// Delete deletes the data stored under the given key. Deleting a
+	// non-existent key is not an error.
+	Delete(key string) error
+}
+
+// ObjectStore is a Store that keeps objects in an S3 bucket.
+type ObjectStore struct {
+	client *awss3.Client
+	bucket string
+	prefix string
+}
+
+// NewObjectStore returns a Store keeping objects in the given S3 bucket, with
+// all object keys prefixed by `prefix`.
+func NewObjectStore(client *awss3.Client, bucket, prefix string) *ObjectStore {
+	return &ObjectStore{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+// Put stores the data under the given key.
+func (s *ObjectStore) Put(key string, data []byte) error {
+	_, err := s.client.PutObject(context.Background(), &awss3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// Get returns the data stored under the given key.
+func (s *ObjectStore) Get(key string) ([]byte, error) {
+	out, err := s.client.GetObject(context.Background(), &awss3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// Delete deletes the data stored under the given key.
+func (s *ObjectStore) Delete(key string) error {
+	_, err := s.client.DeleteObject(context.Background(), &awss3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	return err
+}
+
+// DB wraps a backend DB, storing values of at least Threshold bytes in a
+// Store and keeping only a reference to them in the wrapped DB.
+type DB struct {
+	db        backend.DB
+	store     Store
+	threshold int
+}
+
+// Wrap returns a DB that offloads values of `threshold` bytes or more from
+// `db` into `store`. A threshold of zero offloads every value.
+func Wrap(db backend.DB, store Store, threshold int) backend.DB {
+	return &DB{
+		db:        db,
+		store:     store,
+		threshold: threshold,
+	}
+}
+
+// Bucket returns a queue in the given namespace.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	bucket, err := db.db.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		db:     db,
+		bucket: bucket,
+		prefix: url.PathEscape(name) + "/",
+	}, nil
+}
+
+// Close closes the wrapped database.
+func (db *DB) Close() {
+	db.db.Close()
+}
+
+// Bucket wraps a bucket of the underlying DB.
+type Bucket struct {
+	db     *DB
+	bucket backend.Bucket
+	prefix string // prefix of object keys in this bucket
+}
+
+// objectKey returns a new, unique object key under which to store a value
+// for key `k`. Each upload has its own object, such that an upload never
+// replaces the object referenced by a committed value.
+func (q *Bucket) objectKey(k []byte) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return q.prefix + hex.EncodeToString(k) + "." + hex.EncodeToString(suffix), nil
+}
+
+// resolve returns the value represented by stored value `v`, fetching it from
+// the object store if necessary.
+func (q *Bucket) resolve(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return nil, ErrCorruptValue
+	}
+	switch v[0] {
+	case tagInline:
+		return v[1:], nil
+	case tagObject:
+		return q.db.store.Get(string(v[1:]))
+	}
+	return nil, ErrCorruptValue
+}
+
+// ForEach iterates through keys in the bucket. If the iteration function
+// returns a non-nil error, iteration stops and the error is returned to
+// the caller. Note that every offloaded value is fetched from the object
+// store during iteration.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	return q.bucket.ForEach(func(k, v []byte) error {
+		v, err := q.resolve(v)
+		if err != nil {
+			return err
+		}
+		return fn(k, v)
+	})
+}
+
+// Batch enacts a number of operations in one atomic go. If the batch
+// function returns a non-nil error, the batch is discarded and the error
+// is returned to the caller. If the batch function returns nil, the batch
+// is committed to the queue.
+//
+// Offloaded values are uploaded to new objects before the batch is written to
+// the wrapped backend, and removed again if the write fails. Objects
+// referenced by keys that are put or deleted are removed only once the batch
+// has been written.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	batch := &Batch{}
+	defer batch.Close()
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	// Only the last operation on each key takes effect, so earlier ones
+	// need not be uploaded or written
+	last := map[string]int{}
+	for i, op := range batch.ops {
+		last[string(op.k)] = i
+	}
+	ops := make([]op, 0, len(last))
+	for i, op := range batch.ops {
+		if last[string(op.k)] == i {
+			ops = append(ops, op)
+		}
+	}
+
+	// Find objects referenced by the keys being replaced or deleted
+	replaced := []string{}
+	for _, op := range ops {
+		v, err := q.bucket.Get(op.k)
+		if err == backend.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(v) > 0 && v[0] == tagObject {
+			replaced = append(replaced, string(v[1:]))
+		}
+	}
+
+	// Upload offloaded values, replacing them with references
+	uploaded := []string{}
+	discard := func() {
+		for _, key := range uploaded {
+			q.db.store.Delete(key)
+		}
+	}
+	for i, op := range ops {
+		if op.delete {
+			continue
+		}
+		if len(op.v) < q.db.threshold {
+			ops[i].v = append([]byte{tagInline}, op.v...)
+			continue
+		}
+		key, err := q.objectKey(op.k)
+		if err == nil {
+			err = q.db.store.Put(key, op.v)
+		}
+		if err != nil {
+			discard()
+			return err
+		}
+		uploaded = append(uploaded, key)
+		ops[i].v = append([]byte{tagObject}, key...)
+	}
+
+	err := q.bucket.Batch(func(b backend.Batch) error {
+		for _, op := range ops {
+			var err error
+			if op.delete {
+				err = b.Delete(op.k)
+			} else {
+				err = b.Put(op.k, op.v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		discard()
+		return err
+	}
+
+	// The batch is committed, so a failure to remove an object that is no
+	// longer referenced only leaks it
+	for _, key := range replaced {
+		q.db.store.Delete(key)
+	}
+	return nil
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	v, err := q.bucket.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return q.resolve(v)
+}
+
+// Clear removes all items from this bucket, including any offloaded values.
+func (q *Bucket) Clear() error {
+	err := q.bucket.ForEach(func(k, v []byte) error {
+		if len(v) > 0 && v[0] == tagObject {
+			return q.db.store.Delete(string(v[1:]))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return q.bucket.Clear()
+}
+
+// op is a single staged batch operation.
+type op struct {
+	k      []byte
+	v      []byte
+	delete bool
+}
+
+// Batch represents a set of put/delete operations to perform on a Bucket.
+// Operations are staged until the batch function returns, so that values can
+// be uploaded before anything is written to the wrapped backend.
+type Batch struct {
+	ops []op
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	b.ops = append(b.ops, op{k: k, v: v})
+	return nil
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	b.ops = append(b.ops, op{k: k, delete: true})
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.ops = nil
+}
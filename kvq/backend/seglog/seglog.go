@@ -0,0 +1,518 @@
+// Package seglog implements an append-only, segmented log backend.
+//
+// Each bucket is stored as a directory of numbered segment files. Every batch
+// is appended to the newest segment as a single checksummed record, and an
+// in-memory index maps each live key to the location of its value. Once every
+// value in the oldest segment has been deleted (as happens naturally when a
+// queue is consumed in FIFO order) the segment file is removed, so disk usage
+// tracks the unconsumed portion of the queue without any compaction.
+package seglog
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// DefaultSegmentSize is the size at which a new segment file is started.
+const DefaultSegmentSize = 64 << 20
+
+const (
+	segmentExt = ".log"
+	headerSize = 8 // record length (uint32) + CRC-32 (uint32)
+)
+
+// Operation types within a record.
+const (
+	opPut byte = iota
+	opDelete
+)
+
+var (
+	// ErrCorruptRecord is returned when a record cannot be decoded.
+	ErrCorruptRecord = errors.New("corrupt log record")
+)
+
+// DB is a directory containing one log per bucket.
+type DB struct {
+	path        string
+	segmentSize int64
+	mutex       sync.Mutex
+	buckets     map[string]*Bucket
+}
+
+func init() {
+	backend.Register("seglog", backend.Driver{
+		Open:    Open,
+		Destroy: Destroy,
+		Local:   true,
+	})
+}
+
+// Open creates or opens an existing log directory at the given path.
+func Open(path string) (backend.DB, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &DB{
+		path:        path,
+		segmentSize: DefaultSegmentSize,
+		buckets:     map[string]*Bucket{},
+	}, nil
+}
+
+// Destroy destroys the DB at the given path.
+func Destroy(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Bucket returns a queue in the given namespace, replaying its log if it has
+// not yet been opened.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if bucket, ok := db.buckets[name]; ok {
+		return bucket, nil
+	}
+
+	bucket := &Bucket{
+		dir:         filepath.Join(db.path, hex.EncodeToString([]byte(name))),
+		segmentSize: db.segmentSize,
+	}
+	if err := bucket.open(); err != nil {
+		return nil, err
+	}
+	db.buckets[name] = bucket
+	return bucket, nil
+}
+
+// Close closes all open segment files.
+func (db *DB) Close() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, bucket := range db.buckets {
+		bucket.close()
+	}
+	db.buckets = map[string]*Bucket{}
+}
+
+// location identifies a value within a segment.
+type location struct {
+	segment uint64
+	offset  int64
+	length  int
+}
+
+// segment is a single open log file.
+type segment struct {
+	id   uint64
+	file *os.File
+	size int64
+	live int // number of indexed values held in this segment
+}
+
+// Bucket is a single append-only log, split across a number of segments.
+type Bucket struct {
+	dir         string
+	segmentSize int64
+
+	mutex    sync.RWMutex
+	segments []*segment // ordered oldest first; last is active
+	index    map[string]location
+	keys     []string // sorted
+}
+
+// segmentPath returns the file path of the given segment.
+func (q *Bucket) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016x%s", id, segmentExt))
+}
+
+// open replays all segments in the bucket directory to rebuild the index.
+func (q *Bucket) open() error {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(q.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	q.index = map[string]location{}
+	q.keys = nil
+	for _, name := range names {
+		var id uint64
+		base := strings.TrimSuffix(filepath.Base(name), segmentExt)
+		if _, err := fmt.Sscanf(base, "%016x", &id); err != nil {
+			continue
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, file: f}
+		q.segments = append(q.segments, seg)
+		if err := q.replay(seg); err != nil {
+			return err
+		}
+	}
+
+	if len(q.segments) == 0 {
+		return q.rotate()
+	}
+	q.truncate()
+	return nil
+}
+
+// replay reads every record in the segment, applying it to the index. A
+// partially-written record at the end of the segment (e.g. due to a crash) is
+// discarded.
+func (q *Bucket) replay(seg *segment) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		if _, err := seg.file.ReadAt(header, offset); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(header[0:4]))
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if offset+headerSize+n > info.Size() {
+			// Torn header or record; don't trust its length
+			break
+		}
+		body := make([]byte, n)
+		if _, err := seg.file.ReadAt(body, offset+headerSize); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(body) != sum {
+			break
+		}
+		if err := q.apply(seg, offset+headerSize, body); err != nil {
+			return err
+		}
+		offset += headerSize + n
+	}
+
+	// Discard anything following the last valid record
+	if err := seg.file.Truncate(offset); err != nil {
+		return err
+	}
+	seg.size = offset
+	return nil
+}
+
+// apply updates the index with the operations in a record body, which was
+// written at `offset` within `seg`.
+func (q *Bucket) apply(seg *segment, offset int64, body []byte) error {
+	count, n := binary.Uvarint(body)
+	if n <= 0 {
+		return ErrCorruptRecord
+	}
+	pos := n
+	for i := uint64(0); i < count; i++ {
+		if pos >= len(body) {
+			return ErrCorruptRecord
+		}
+		op := body[pos]
+		pos++
+		klen, n := binary.Uvarint(body[pos:])
+		if n <= 0 {
+			return ErrCorruptRecord
+		}
+		pos += n
+		vlen, n := binary.Uvarint(body[pos:])
+		if n <= 0 {
+			return ErrCorruptRecord
+		}
+		pos += n
+		if pos+int(klen)+int(vlen) > len(body) {
+			return ErrCorruptRecord
+		}
+		k := string(body[pos : pos+int(klen)])
+		pos += int(klen)
+
+		switch op {
+		case opPut:
+			q.put(k, location{
+				segment: seg.id,
+				offset:  offset + int64(pos),
+				length:  int(vlen),
+			})
+		case opDelete:
+			q.delete(k)
+		default:
+			return ErrCorruptRecord
+		}
+		pos += int(vlen)
+	}
+	return nil
+}
+
+// segment returns the open segment with the given ID.
+func (q *Bucket) segment(id uint64) *segment {
+	i := sort.Search(len(q.segments), func(i int) bool {
+		return q.segments[i].id >= id
+	})
+	if i < len(q.segments) && q.segments[i].id == id {
+		return q.segments[i]
+	}
+	return nil
+}
+
+// put indexes key `k` at the given location.
+func (q *Bucket) put(k string, loc location) {
+	if old, ok := q.index[k]; ok {
+		if seg := q.segment(old.segment); seg != nil {
+			seg.live--
+		}
+	} else {
+		i := sort.SearchStrings(q.keys, k)
+		q.keys = append(q.keys, "")
+		copy(q.keys[i+1:], q.keys[i:])
+		q.keys[i] = k
+	}
+	q.index[k] = loc
+	if seg := q.segment(loc.segment); seg != nil {
+		seg.live++
+	}
+}
+
+// delete removes key `k` from the index.
+func (q *Bucket) delete(k string) {
+	old, ok := q.index[k]
+	if !ok {
+		return
+	}
+	if seg := q.segment(old.segment); seg != nil {
+		seg.live--
+	}
+	delete(q.index, k)
+	i := sort.SearchStrings(q.keys, k)
+	q.keys = append(q.keys[:i], q.keys[i+1:]...)
+}
+
+// rotate starts a new active segment.
+func (q *Bucket) rotate() error {
+	var id uint64
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1].id + 1
+	}
+	f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	q.segments = append(q.segments, &segment{id: id, file: f})
+	return nil
+}
+
+// truncate removes the oldest segments for as long as they contain no live
+// values. Only leading segments may be removed, as later segments may contain
+// deletions of values held in earlier ones.
+func (q *Bucket) truncate() {
+	for len(q.segments) > 1 && q.segments[0].live == 0 {
+		seg := q.segments[0]
+		seg.file.Close()
+		os.Remove(q.segmentPath(seg.id))
+		q.segments = q.segments[1:]
+	}
+}
+
+// close closes all segment files.
+func (q *Bucket) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, seg := range q.segments {
+		seg.file.Close()
+	}
+	q.segments = nil
+}
+
+// read returns the value at the given location.
+func (q *Bucket) read(loc location) ([]byte, error) {
+	seg := q.segment(loc.segment)
+	if seg == nil {
+		return nil, backend.ErrKeyNotFound
+	}
+	v := make([]byte, loc.length)
+	if _, err := seg.file.ReadAt(v, loc.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ForEach iterates through keys in the bucket in key order. If the iteration
+// function returns a non-nil error, iteration stops and the error is returned
+// to the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	q.mutex.RLock()
+	keys := make([]string, len(q.keys))
+	copy(keys, q.keys)
+	q.mutex.RUnlock()
+
+	for _, k := range keys {
+		q.mutex.RLock()
+		loc, ok := q.index[k]
+		var v []byte
+		var err error
+		if ok {
+			v, err = q.read(loc)
+		}
+		q.mutex.RUnlock()
+		if !ok {
+			// Deleted since iteration began
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch appends a number of operations to the log as a single record. If the
+// batch function returns a non-nil error, the batch is discarded and the
+// error is returned to the caller. If the batch function returns nil, the
+// record is appended and synced to disk.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	batch := &Batch{}
+	defer batch.Close()
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+	if batch.count == 0 {
+		return nil
+	}
+
+	// Assemble record body: op count followed by each operation
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(batch.count))
+	body := append(prefix[:n], batch.ops...)
+
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(body))
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Start a new segment if an earlier attempt to do so failed, appending
+	// to the full one if this attempt fails too
+	if q.segments[len(q.segments)-1].size >= q.segmentSize {
+		q.rotate()
+	}
+	seg := q.segments[len(q.segments)-1]
+	offset := seg.size
+	if _, err := seg.file.WriteAt(append(header, body...), offset); err != nil {
+		// Leave the segment as it was
+		seg.file.Truncate(offset)
+		return err
+	}
+	if err := seg.file.Sync(); err != nil {
+		return err
+	}
+	seg.size += int64(headerSize + len(body))
+
+	if err := q.apply(seg, offset+headerSize, body); err != nil {
+		return err
+	}
+	q.truncate()
+
+	// The record is durable, so a failure to start a new segment must not
+	// fail the batch; it is retried on the next write
+	if seg.size >= q.segmentSize {
+		q.rotate()
+	}
+	return nil
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	loc, ok := q.index[string(k)]
+	if !ok {
+		return nil, backend.ErrKeyNotFound
+	}
+	return q.read(loc)
+}
+
+// Clear removes all items from this bucket, deleting all segments.
+func (q *Bucket) Clear() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	next := q.segments[len(q.segments)-1].id + 1
+	for _, seg := range q.segments {
+		seg.file.Close()
+		if err := os.Remove(q.segmentPath(seg.id)); err != nil {
+			return err
+		}
+	}
+	q.segments = nil
+	q.index = map[string]location{}
+	q.keys = nil
+
+	f, err := os.OpenFile(q.segmentPath(next), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	q.segments = []*segment{{id: next, file: f}}
+	return nil
+}
+
+// Batch represents a set of put/delete operations to append to the log as a
+// single record.
+type Batch struct {
+	ops   []byte
+	count int
+}
+
+// add encodes an operation onto the batch.
+func (b *Batch) add(op byte, k, v []byte) {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64)
+	buf[0] = op
+	n := 1
+	n += binary.PutUvarint(buf[n:], uint64(len(k)))
+	n += binary.PutUvarint(buf[n:], uint64(len(v)))
+	b.ops = append(b.ops, buf[:n]...)
+	b.ops = append(b.ops, k...)
+	b.ops = append(b.ops, v...)
+	b.count++
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	b.add(opPut, k, v)
+	return nil
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	b.add(opDelete, k, nil)
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.ops = nil
+	b.count = 0
+}
@@ -0,0 +1,287 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"os"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TableName is the name of the table used to store queue entries. All
+// namespaces share the one table, with rows distinguished by the `ns` column.
+const TableName = "kvq"
+
+// pageSize is the number of rows read at a time when iterating a bucket.
+const pageSize = 1000
+
+// DB encapsulates a SQLite database.
+type DB struct {
+	sqlDB *sql.DB
+}
+
+func init() {
+	backend.Register("sqlite", backend.Driver{
+		Open:         Open,
+		OpenReadOnly: OpenReadOnly,
+		Destroy:      Destroy,
+		Local:        true,
+	})
+}
+
+// Open creates or opens an existing SQLite database at the given path.
+func Open(path string) (backend.DB, error) {
+	sqlDB, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only supports a single writer, so serialise access rather than
+	// contend for the database lock.
+	sqlDB.SetMaxOpenConns(1)
+	db, err := New(sqlDB)
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenReadOnly opens an existing SQLite database at the given path in
+// read-only mode. Unlike Open, the queue table is not created if it is
+// missing. SQLite allows readers alongside a writer, so this is safe to use
+// on a database that is in use.
+func OpenReadOnly(path string) (backend.DB, error) {
+	sqlDB, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return backend.ReadOnly(&DB{sqlDB}), nil
+}
+
+// Destroy destroys the database at the given path.
+func Destroy(path string) error {
+	return os.RemoveAll(path)
+}
+
+// New returns a DB from an existing SQLite database handle, creating the
+// queue table if it doesn't already exist. This allows queues to live
+// alongside an application's own tables.
+func New(sqlDB *sql.DB) (backend.DB, error) {
+	_, err := sqlDB.Exec(`CREATE TABLE IF NOT EXISTS ` + TableName + ` (
+		ns TEXT NOT NULL,
+		k  BLOB NOT NULL,
+		v  BLOB,
+		PRIMARY KEY (ns, k)
+	) WITHOUT ROWID`)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{sqlDB}, nil
+}
+
+// Bucket returns a queue in the given namespace.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	return &Bucket{
+		db: db,
+		ns: name,
+	}, nil
+}
+
+// Close closes the database and releases any resources.
+func (db *DB) Close() {
+	db.sqlDB.Close()
+}
+
+// Bucket represents the set of rows in the queue table belonging to a single
+// namespace.
+type Bucket struct {
+	db *DB
+	ns string
+}
+
+// ForEach iterates through keys in the bucket in key order. If the iteration
+// function returns a non-nil error, iteration stops and the error is returned
+// to the caller.
+//
+// Rows are read a page at a time so that no read cursor is held open while
+// the iteration function runs.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	var last []byte
+	for {
+		kvs, err := q.page(last)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if err := fn(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+		if len(kvs) < pageSize {
+			return nil
+		}
+		last = kvs[len(kvs)-1][0]
+	}
+}
+
+// page returns up to pageSize key/value pairs with keys following `after`.
+func (q *Bucket) page(after []byte) ([][2][]byte, error) {
+	var rows *sql.Rows
+	var err error
+	if after == nil {
+		rows, err = q.db.sqlDB.Query(`SELECT k, v FROM `+TableName+
+			` WHERE ns = ? ORDER BY k LIMIT ?`, q.ns, pageSize)
+	} else {
+		rows, err = q.db.sqlDB.Query(`SELECT k, v FROM `+TableName+
+			` WHERE ns = ? AND k > ? ORDER BY k LIMIT ?`, q.ns, after, pageSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	kvs := [][2][]byte{}
+	for rows.Next() {
+		var k, v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, [2][]byte{k, v})
+	}
+	return kvs, rows.Err()
+}
+
+// Batch enacts a number of operations in one SQLite transaction. If the batch
+// function returns a non-nil error, the transaction is rolled back and the
+// error is returned to the caller. If the batch function returns nil, the
+// transaction is committed.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	tx, err := q.db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	batch := &Batch{
+		tx: tx,
+		ns: q.ns,
+	}
+	if err := fn(batch); err != nil {
+		batch.Close()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	var v []byte
+	err := q.db.sqlDB.QueryRow(`SELECT v FROM `+TableName+
+		` WHERE ns = ? AND k = ?`, q.ns, k).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, backend.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Clear removes all items from this bucket.
+func (q *Bucket) Clear() error {
+	_, err := q.db.sqlDB.Exec(`DELETE FROM `+TableName+` WHERE ns = ?`, q.ns)
+	return err
+}
+
+// EstimateSize returns the total size of the keys and values in the bucket,
+// as calculated by the database. Table and index overheads are not included.
+func (q *Bucket) EstimateSize() (int64, error) {
+	var n int64
+	err := q.db.sqlDB.QueryRow(`SELECT COALESCE(SUM(LENGTH(k) + LENGTH(v)), 0)
+		FROM `+TableName+` WHERE ns = ?`, q.ns).Scan(&n)
+	return n, err
+}
+
+// Compact rebuilds the database file to reclaim the pages freed by deleted
+// rows. As all buckets share one table, the whole database is rebuilt.
+func (q *Bucket) Compact() error {
+	_, err := q.db.sqlDB.Exec(`VACUUM`)
+	return err
+}
+
+// DeleteRange deletes all keys `k` in the bucket where `start <= k < end`,
+// using a single statement. A nil `start` or `end` leaves that end of the
+// range unbounded.
+func (q *Bucket) DeleteRange(start, end []byte) error {
+	query := `DELETE FROM ` + TableName + ` WHERE ns = ?`
+	args := []interface{}{q.ns}
+	if start != nil {
+		query += ` AND k >= ?`
+		args = append(args, start)
+	}
+	if end != nil {
+		query += ` AND k < ?`
+		args = append(args, end)
+	}
+	_, err := q.db.sqlDB.Exec(query, args...)
+	return err
+}
+
+// Increment atomically adds `delta` to the counter at key `k`.
+func (q *Bucket) Increment(k []byte, delta int64) (int64, error) {
+	tx, err := q.db.sqlDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	var v []byte
+	err = tx.QueryRow(`SELECT v FROM `+TableName+
+		` WHERE ns = ? AND k = ?`, q.ns, k).Scan(&v)
+	if err == nil {
+		if len(v) != 8 {
+			return 0, backend.ErrNotCounter
+		}
+		n = int64(binary.BigEndian.Uint64(v))
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	n += delta
+	v = make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(n))
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO `+TableName+
+		` (ns, k, v) VALUES (?, ?, ?)`, q.ns, k, v); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// Batch represents a set of put/delete operations to perform within a SQLite
+// transaction.
+type Batch struct {
+	tx *sql.Tx
+	ns string
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	_, err := b.tx.Exec(`INSERT OR REPLACE INTO `+TableName+
+		` (ns, k, v) VALUES (?, ?, ?)`, b.ns, k, v)
+	return err
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	_, err := b.tx.Exec(`DELETE FROM `+TableName+
+		` WHERE ns = ? AND k = ?`, b.ns, k)
+	return err
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.tx.Rollback()
+}
@@ -0,0 +1,322 @@
+// Package tiered provides a backend that holds the head of each bucket in
+// memory, spilling any overflow to a persistent backend.
+//
+// New values are written to memory for as long as the in-memory tier has room
+// and nothing has spilled to disk. Once the memory tier is full, values are
+// written to the persistent tier instead. As the memory tier drains, values
+// are promoted from the persistent tier in key order, so that the values
+// about to be taken are served from memory.
+//
+// Values written only to the memory tier are NOT durable and will be lost if
+// the process exits. Values written to the persistent tier remain there (and
+// are merely cached in memory once promoted) until deleted, so bursts that
+// exceed the memory tier survive restarts.
+package tiered
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/backend/mem"
+)
+
+// DefaultSize is the default number of values held in memory per bucket.
+const DefaultSize = 10000
+
+// DB wraps a persistent backend DB with an in-memory tier.
+type DB struct {
+	hot     backend.DB
+	cold    backend.DB
+	size    int
+	mutex   sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// Wrap returns a DB that holds up to `size` values per bucket in memory,
+// spilling any overflow into `db`.
+func Wrap(db backend.DB, size int) backend.DB {
+	return &DB{
+		hot:     mem.New(),
+		cold:    db,
+		size:    size,
+		buckets: map[string]*Bucket{},
+	}
+}
+
+// Bucket returns a queue in the given namespace. Repeated calls with the same
+// name return the same bucket.
+func (db *DB) Bucket(name string) (backend.Bucket, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if bucket, ok := db.buckets[name]; ok {
+		return bucket, nil
+	}
+
+	hot, err := db.hot.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := db.cold.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	bucket := &Bucket{
+		hot:     hot,
+		cold:    cold,
+		size:    db.size,
+		entries: map[string]bool{},
+	}
+	if err := bucket.promote(); err != nil {
+		return nil, err
+	}
+	db.buckets[name] = bucket
+	return bucket, nil
+}
+
+// Close closes both tiers, discarding anything held only in memory.
+func (db *DB) Close() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.buckets = map[string]*Bucket{}
+	db.hot.Close()
+	db.cold.Close()
+}
+
+// Bucket is a pair of buckets, one in memory and one persistent.
+type Bucket struct {
+	mutex   sync.Mutex
+	hot     backend.Bucket
+	cold    backend.Bucket
+	size    int
+	entries map[string]bool // keys in memory => true if also persisted
+	spilled int             // number of keys persisted but not in memory
+}
+
+// promote fills the memory tier with values from the head of the persistent
+// tier.
+func (q *Bucket) promote() error {
+	if q.spilled == 0 && len(q.entries) > 0 {
+		return nil
+	}
+
+	q.spilled = 0
+	promoted := map[string][]byte{}
+	err := q.cold.ForEach(func(k, v []byte) error {
+		if _, ok := q.entries[string(k)]; ok {
+			return nil
+		}
+		if len(q.entries)+len(promoted) >= q.size {
+			q.spilled++
+			return nil
+		}
+		promoted[string(k)] = append([]byte{}, v...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return q.hot.Batch(func(b backend.Batch) error {
+		for k, v := range promoted {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+			q.entries[k] = true
+		}
+		return nil
+	})
+}
+
+// ForEach iterates through keys in the bucket in key order, merging both
+// tiers. If the iteration function returns a non-nil error, iteration stops
+// and the error is returned to the caller.
+func (q *Bucket) ForEach(fn func(k, v []byte) error) error {
+	hot := [][2][]byte{}
+	q.hot.ForEach(func(k, v []byte) error {
+		hot = append(hot, [2][]byte{k, v})
+		return nil
+	})
+
+	i := 0
+	err := q.cold.ForEach(func(k, v []byte) error {
+		// Emit memory-tier keys preceding this one
+		for ; i < len(hot); i++ {
+			c := bytes.Compare(hot[i][0], k)
+			if c > 0 {
+				break
+			}
+			if err := fn(hot[i][0], hot[i][1]); err != nil {
+				return err
+			}
+			if c == 0 {
+				// Promoted copy of this key, already emitted
+				i++
+				return nil
+			}
+		}
+		return fn(k, v)
+	})
+	if err != nil {
+		return err
+	}
+
+	for ; i < len(hot); i++ {
+		if err := fn(hot[i][0], hot[i][1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch enacts a number of operations in one go. Operations on the persistent
+// tier are committed atomically; operations on the memory tier are applied
+// only if that succeeds.
+func (q *Bucket) Batch(fn func(backend.Batch) error) error {
+	batch := &Batch{}
+	defer batch.Close()
+
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Decide which tier each operation applies to, recording the previous
+	// state of each key so it can be restored if the batch fails
+	hotOps, coldOps := []op{}, []op{}
+	type undo struct {
+		k         string
+		persisted bool
+		inMemory  bool
+	}
+	undos := []undo{}
+	spilled := q.spilled
+	for _, o := range batch.ops {
+		k := string(o.k)
+		persisted, inMemory := q.entries[k]
+		undos = append(undos, undo{k, persisted, inMemory})
+		if o.delete {
+			if inMemory {
+				hotOps = append(hotOps, o)
+				delete(q.entries, k)
+			}
+			if !inMemory || persisted {
+				coldOps = append(coldOps, o)
+				if !inMemory {
+					spilled--
+				}
+			}
+			continue
+		}
+		if inMemory && !persisted {
+			hotOps = append(hotOps, o)
+		} else if inMemory {
+			hotOps = append(hotOps, o)
+			coldOps = append(coldOps, o)
+		} else if spilled == 0 && len(q.entries) < q.size {
+			hotOps = append(hotOps, o)
+			q.entries[k] = false
+		} else {
+			coldOps = append(coldOps, o)
+			spilled++
+		}
+	}
+	if spilled < 0 {
+		// Deleted keys that didn't exist
+		spilled = 0
+	}
+
+	if len(coldOps) > 0 {
+		if err := q.cold.Batch(apply(coldOps)); err != nil {
+			for i := len(undos) - 1; i >= 0; i-- {
+				if u := undos[i]; u.inMemory {
+					q.entries[u.k] = u.persisted
+				} else {
+					delete(q.entries, u.k)
+				}
+			}
+			return err
+		}
+	}
+	if err := q.hot.Batch(apply(hotOps)); err != nil {
+		return err
+	}
+	q.spilled = spilled
+
+	// Refill memory tier once it has drained to half its size
+	if q.spilled > 0 && len(q.entries) <= q.size/2 {
+		return q.promote()
+	}
+	return nil
+}
+
+// Get returns the value stored at key `k`.
+func (q *Bucket) Get(k []byte) ([]byte, error) {
+	v, err := q.hot.Get(k)
+	if err == backend.ErrKeyNotFound {
+		return q.cold.Get(k)
+	}
+	return v, err
+}
+
+// Clear removes all items from both tiers.
+func (q *Bucket) Clear() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := q.cold.Clear(); err != nil {
+		return err
+	}
+	q.entries = map[string]bool{}
+	q.spilled = 0
+	return q.hot.Clear()
+}
+
+// op is a single staged batch operation.
+type op struct {
+	k      []byte
+	v      []byte
+	delete bool
+}
+
+// apply returns a batch function that performs the given operations.
+func apply(ops []op) func(backend.Batch) error {
+	return func(b backend.Batch) error {
+		for _, o := range ops {
+			var err error
+			if o.delete {
+				err = b.Delete(o.k)
+			} else {
+				err = b.Put(o.k, o.v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Batch represents a set of put/delete operations to perform on a Bucket.
+type Batch struct {
+	ops []op
+}
+
+// Put sets the key `k` to value `v`.
+func (b *Batch) Put(k, v []byte) error {
+	b.ops = append(b.ops, op{k: k, v: v})
+	return nil
+}
+
+// Delete deletes the key `k`.
+func (b *Batch) Delete(k []byte) error {
+	b.ops = append(b.ops, op{k: k, delete: true})
+	return nil
+}
+
+// Close discards this batch.
+func (b *Batch) Close() {
+	b.ops = nil
+}
@@ -0,0 +1,233 @@
+package kvq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// A backup, as written by DB.Backup, begins with backupMagic, followed by a
+// series of frames, each beginning with a frame type byte:
+//
+//	frameBucket: uvarint length, name     - starts the keys of a bucket
+//	frameKey:    uvarint length, key,
+//	             uvarint length, value    - a key of the current bucket
+//	frameEnd:                             - ends the backup
+//
+// The buckets of every queue listed by DB.Queues are included, along with
+// the list itself.
+const (
+	backupMagic = "kvqbackup1"
+
+	frameEnd    byte = 0
+	frameBucket byte = 1
+	frameKey    byte = 2
+
+	// maxFrameBytes is the largest key or value accepted from a backup.
+	maxFrameBytes = 1 << 30
+	// restoreBatchSize is the number of keys restored in each batch.
+	restoreBatchSize = 1000
+)
+
+var (
+	// ErrInvalidBackup is returned when restoring from a stream that is not
+	// a complete backup written by DB.Backup.
+	ErrInvalidBackup = errors.New("invalid backup")
+)
+
+// Backup writes a snapshot of the queues on the database to `w`, including
+// their metadata, ledgers, poison queues and consumer groups, while they
+// remain in use. The backup can be restored with Restore. Where the backend
+// supports snapshots of the whole database, the backup is consistent, giving
+// every queue as it was at one instant; otherwise, each bucket is read in
+// turn, and items committed while the backup is written may be missed, or
+// appear both where they were taken from and where they were put.
+func (db *DB) Backup(w io.Writer) error {
+	open := liveBuckets(db.DB)
+	if s, ok := db.DB.(backend.DBSnapshotter); ok {
+		snap, err := s.SnapshotDB()
+		if err != nil {
+			return err
+		}
+		defer snap.Close()
+		open = func(name string) (bucketReader, error) {
+			return snap.Bucket(name)
+		}
+	}
+
+	registry, err := open(queuesBucket)
+	if err != nil {
+		return err
+	}
+	names := []string{queuesBucket}
+	queues := []string{}
+	err = registry.ForEach(func(k, v []byte) error {
+		queues = append(queues, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, namespace := range queues {
+		qnames, err := namespaceBuckets(open, namespace)
+		if err != nil {
+			return err
+		}
+		names = append(names, qnames...)
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(backupMagic); err != nil {
+		return err
+	}
+	for _, name := range names {
+		bucket, err := open(name)
+		if err != nil {
+			return err
+		}
+		bw.WriteByte(frameBucket)
+		writeFrameBytes(bw, []byte(name))
+		err = bucket.ForEach(func(k, v []byte) error {
+			bw.WriteByte(frameKey)
+			writeFrameBytes(bw, k)
+			_, err := writeFrameBytes(bw, v)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	bw.WriteByte(frameEnd)
+	return bw.Flush()
+}
+
+// writeFrameBytes writes `b` to `w`, preceded by its length.
+func writeFrameBytes(w *bufio.Writer, b []byte) (int, error) {
+	n, err := w.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(b)
+	return n + m, err
+}
+
+// Restore rebuilds the queues of the database described by `uri`, as given to
+// Open, from a backup written by DB.Backup, as with DB.Restore.
+func Restore(r io.Reader, uri string) error {
+	db, err := Open(uri)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Restore(r)
+}
+
+// Restore rebuilds the queues in a backup written by DB.Backup, replacing any
+// existing contents of those queues. Other queues on the database are left
+// as they are. Instances of the restored queues open on this DB are closed,
+// such that the queues are rebuilt from the restored items when reopened;
+// items that were held by transactions when the backup was taken are
+// available again. The queues are restored in a series of batches, so if
+// restoring fails part way through, it should be retried.
+func (db *DB) Restore(r io.Reader) error {
+	if backend.IsReadOnly(db.DB) {
+		return ErrReadOnly
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != backupMagic {
+		return ErrInvalidBackup
+	}
+
+	var name string
+	var bucket backend.Bucket
+	pending := []kv{}
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		err := bucket.Batch(func(b backend.Batch) error {
+			for _, kv := range pending {
+				if err := b.Put(kv.k, kv.v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		pending = pending[:0]
+		return err
+	}
+
+	for {
+		t, err := br.ReadByte()
+		if err != nil {
+			return ErrInvalidBackup
+		}
+		switch t {
+		case frameEnd:
+			return flush()
+		case frameBucket:
+			if err := flush(); err != nil {
+				return err
+			}
+			b, err := readFrameBytes(br)
+			if err != nil {
+				return err
+			}
+			name = string(b)
+			if bucket, err = db.DB.Bucket(name); err != nil {
+				return err
+			}
+			// The list of queues is merged with that of the database
+			if name != queuesBucket {
+				if err := clearBucket(bucket); err != nil {
+					return err
+				}
+			}
+		case frameKey:
+			if bucket == nil {
+				return ErrInvalidBackup
+			}
+			k, err := readFrameBytes(br)
+			if err != nil {
+				return err
+			}
+			v, err := readFrameBytes(br)
+			if err != nil {
+				return err
+			}
+			// The list of queues precedes the queues themselves, so each
+			// queue is closed before it is restored
+			if name == queuesBucket {
+				if err := db.closeQueues(string(k)); err != nil {
+					return err
+				}
+			}
+			pending = append(pending, kv{k, v})
+			if len(pending) >= restoreBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		default:
+			return ErrInvalidBackup
+		}
+	}
+}
+
+// readFrameBytes reads bytes written by writeFrameBytes from `r`.
+func readFrameBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > maxFrameBytes {
+		return nil, ErrInvalidBackup
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrInvalidBackup
+	}
+	return b, nil
+}
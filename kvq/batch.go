@@ -0,0 +1,84 @@
+package kvq
+
+import (
+	"time"
+)
+
+// Item is a value to put into a queue with PutItem or PutItems, along with
+// the options to put it with. The zero value of each option is the default
+// used by Put.
+type Item struct {
+	// Value is the value to put.
+	Value []byte
+	// Priority is the priority to put the item with, as with PutPriority.
+	Priority uint8
+	// Headers are stored alongside the value, as with PutMessage.
+	Headers map[string]string
+	// Schema is the schema version to tag the item with, as with PutSchema.
+	Schema uint8
+	// At is the time at which the item becomes available, as with PutAt.
+	At time.Time
+	// Deadline is the time at which the item expires, as with PutUntil.
+	Deadline time.Time
+	// DedupKey is the deduplication key of the item, as with PutDedup.
+	DedupKey string
+	// Group is the message group of the item, as with PutGroup.
+	Group string
+}
+
+// PutAll inserts each of the values into the queue with the default (lowest)
+// priority, as with Put. Sequence numbers are reserved for all values at
+// once, making this much faster than calling Put for each when ingesting many
+// items. Either all values are put, or none are.
+func (txn *Txn) PutAll(values [][]byte) error {
+	rs := make([]*record, len(values))
+	for i, v := range values {
+		rs[i] = &record{value: v}
+	}
+	_, err := txn.putRecords(rs, make([]uint8, len(values)))
+	return err
+}
+
+// PutItems inserts each of the items into the queue with its own options, as
+// with PutAll. Duplicate items are ignored, as with PutDedup, unless the
+// queue rejects duplicates, in which case none of the items are put.
+func (txn *Txn) PutItems(items []Item) error {
+	rs := make([]*record, len(items))
+	priorities := make([]uint8, len(items))
+	for i, item := range items {
+		rs[i] = item.record()
+		priorities[i] = item.Priority
+	}
+	_, err := txn.putRecords(rs, priorities)
+	return err
+}
+
+// PutItem inserts the item into the queue with its own options, as with
+// PutItems, returning the ID assigned to it. The ID identifies the item once
+// the transaction is committed, such that it can be referred to later; it is
+// empty if the item was ignored as a duplicate, or has a nil value.
+func (txn *Txn) PutItem(item Item) (MessageID, error) {
+	ids, err := txn.putRecords([]*record{item.record()}, []uint8{item.Priority})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// record returns the record to store for the item.
+func (item Item) record() *record {
+	r := &record{
+		value:    item.Value,
+		headers:  item.Headers,
+		schema:   item.Schema,
+		dedupKey: item.DedupKey,
+		group:    item.Group,
+	}
+	if !item.At.IsZero() {
+		r.availableAt = item.At.UnixNano()
+	}
+	if !item.Deadline.IsZero() {
+		r.expiresAt = item.Deadline.UnixNano()
+	}
+	return r
+}
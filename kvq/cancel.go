@@ -0,0 +1,79 @@
+package kvq
+
+import (
+	"errors"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+var (
+	// ErrNotQueued is returned when cancelling an item that is not waiting in
+	// the queue, because it has already been taken, is being taken, or does
+	// not exist.
+	ErrNotQueued = errors.New("item not queued")
+)
+
+// Cancel withdraws the committed item with the given ID, as returned by
+// Txn.PutItem, removing it from storage such that it is never taken. Items
+// that are scheduled for the future, or waiting behind others of their
+// message group, may be cancelled, as may available items. Items that have
+// been taken cannot be cancelled, and return ErrNotQueued.
+func (q *Queue) Cancel(id MessageID) error {
+	if q.readOnly {
+		return ErrReadOnly
+	}
+	e, err := internal.KeyToEntry([]byte(id))
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.isClosed() {
+		return ErrClosed
+	}
+
+	// Remove the entry from wherever it waits, such that it can be restored
+	// if the item cannot be removed from storage
+	var restore func()
+	if s, ok := q.scheduled.Find(e); ok {
+		q.scheduled.Remove(e)
+		restore = func() { q.scheduled.PushScheduled(s) }
+	} else if q.msgGroups.Waiting(e) {
+		restore = func() {}
+	} else {
+		// Claim the entry's availability token before removing it, so that
+		// the number of tokens continues to match the number of entries.
+		select {
+		case <-q.c:
+		default:
+			// All available entries are being claimed by takers
+			return ErrNotQueued
+		}
+		if !q.ids.Remove(e) {
+			q.c <- struct{}{}
+			return ErrNotQueued
+		}
+		restore = func() {
+			q.ids.PushEntry(e)
+			q.c <- struct{}{}
+		}
+	}
+
+	err = q.bucket.Batch(func(b backend.Batch) error {
+		return b.Delete(e.Key())
+	})
+	if err != nil {
+		restore()
+		return err
+	}
+
+	q.expiring.Remove(e)
+	q.removed(e)
+	q.resetTimer()
+	q.resetSweeper()
+	q.signal()
+	return nil
+}
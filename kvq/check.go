@@ -0,0 +1,415 @@
+package kvq
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+var (
+	// ErrInvalidKey is reported by DB.Check for a stored key that is not
+	// the key of an item.
+	ErrInvalidKey = errors.New("invalid item key")
+	// ErrSeqBehind is reported by DB.Check when a queue's sequence would
+	// give new items the IDs of items already stored.
+	ErrSeqBehind = errors.New("sequence behind stored items")
+	// ErrMissingItem is reported by DB.Check for an item that an open queue
+	// holds in memory but is not stored.
+	ErrMissingItem = errors.New("item missing from storage")
+	// ErrUntrackedItem is reported by DB.Check for a stored item that an
+	// open queue does not hold in memory, such that it would never be taken.
+	ErrUntrackedItem = errors.New("item not tracked by queue")
+	// ErrLengthMismatch is reported by DB.Check when an open queue's length
+	// does not match the number of items stored.
+	ErrLengthMismatch = errors.New("queue length does not match storage")
+)
+
+// CheckOptions specifies how DB.Check treats the problems it finds.
+type CheckOptions struct {
+	// Repair fixes the problems found: stored items that cannot be read are
+	// removed, sequences are advanced past stored items, and the state of
+	// open queues is brought in line with what is stored.
+	Repair bool
+}
+
+// CheckReport describes the problems found by DB.Check.
+type CheckReport struct {
+	// Queues is the number of queues checked, including consumer groups and
+	// poison queues.
+	Queues int
+	// Items is the number of stored items checked.
+	Items int
+	// Problems are the problems found, in the order found.
+	Problems []Problem
+}
+
+// Problem is an inconsistency found by DB.Check.
+type Problem struct {
+	// Queue is the namespace of the queue with the problem.
+	Queue string
+	// ID identifies the item concerned, if any. For an item with an invalid
+	// key, it is the stored key.
+	ID MessageID
+	// Err describes the problem: one of ErrInvalidKey, ErrCorruptRecord,
+	// ErrSeqBehind, ErrMissingItem, ErrUntrackedItem or ErrLengthMismatch.
+	Err error
+	// Repaired is true if the problem was repaired.
+	Repaired bool
+}
+
+// Check scans the items stored by every queue listed by Queues, including
+// their consumer groups and poison queues, checking that each key and record
+// can be read and that each queue's sequence follows its items. The state
+// held in memory by queues open on this DB is checked against what is stored,
+// for which the queues should be idle, as items being put or taken at the
+// time may be reported as inconsistent. This is worth running after an
+// unclean shutdown. If opts.Repair is set, the problems are also repaired.
+// If opts is nil, problems are only reported.
+func (db *DB) Check(opts *CheckOptions) (*CheckReport, error) {
+	if opts == nil {
+		opts = &CheckOptions{}
+	}
+	if opts.Repair && backend.IsReadOnly(db.DB) {
+		return nil, ErrReadOnly
+	}
+
+	namespaces, err := db.Queues()
+	if err != nil {
+		return nil, err
+	}
+	open := db.openInstances()
+	report := &CheckReport{}
+	for len(namespaces) > 0 {
+		namespace := namespaces[0]
+		namespaces = namespaces[1:]
+
+		meta, err := db.DB.Bucket(namespace + metaSuffix)
+		if err != nil {
+			return nil, err
+		}
+		groups, err := groupNames(meta)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			namespaces = append(namespaces, namespace+groupInfix+group)
+		}
+		if !strings.HasSuffix(namespace, poisonSuffix) {
+			namespaces = append(namespaces, namespace+poisonSuffix)
+		}
+
+		c := &checker{
+			db:        db,
+			namespace: namespace,
+			meta:      meta,
+			open:      open[namespace],
+			repair:    opts.Repair,
+			report:    report,
+		}
+		if err := c.check(); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// openInstances returns the queues open on the DB, including their consumer
+// groups and poison queues, by namespace.
+func (db *DB) openInstances() map[string][]*Queue {
+	db.mutex.Lock()
+	queues := make([]*Queue, 0, len(db.queues))
+	for q := range db.queues {
+		queues = append(queues, q)
+	}
+	db.mutex.Unlock()
+
+	open := map[string][]*Queue{}
+	for len(queues) > 0 {
+		q := queues[0]
+		queues = queues[1:]
+		open[q.namespace] = append(open[q.namespace], q)
+
+		q.mutex.Lock()
+		for _, g := range q.groups {
+			queues = append(queues, g)
+		}
+		if q.poison != nil {
+			queues = append(queues, q.poison)
+		}
+		q.mutex.Unlock()
+	}
+	return open
+}
+
+// checker checks a single queue for DB.Check.
+type checker struct {
+	db        *DB
+	namespace string
+	meta      backend.Bucket
+	open      []*Queue // open instances of the queue
+	repair    bool
+	report    *CheckReport
+
+	stored map[internal.Entry]record // readable stored items, without values
+	sizes  map[internal.Entry]int    // sizes of the readable stored items
+	count  int                       // number of items stored once checked
+	maxID  internal.ID               // highest ID of the stored items
+}
+
+// problem reports a problem with the queue.
+func (c *checker) problem(id MessageID, err error, repaired bool) {
+	c.report.Problems = append(c.report.Problems, Problem{
+		Queue:    c.namespace,
+		ID:       id,
+		Err:      err,
+		Repaired: repaired,
+	})
+}
+
+// check checks the queue.
+func (c *checker) check() error {
+	c.report.Queues++
+	if err := c.checkItems(); err != nil {
+		return err
+	}
+	if err := c.checkSeq(); err != nil {
+		return err
+	}
+	for _, q := range c.open {
+		c.checkOpen(q)
+	}
+	return nil
+}
+
+// checkItems reads each stored item, removing those that cannot be read if
+// repairing.
+func (c *checker) checkItems() error {
+	bucket, err := c.db.DB.Bucket(c.namespace)
+	if err != nil {
+		return err
+	}
+
+	c.stored = map[internal.Entry]record{}
+	c.sizes = map[internal.Entry]int{}
+	type unreadable struct {
+		k     []byte
+		err   error
+		entry *internal.Entry // nil if the key is invalid
+	}
+	bad := []unreadable{}
+	err = bucket.ForEach(func(k, v []byte) error {
+		c.report.Items++
+		e, err := internal.KeyToEntry(k)
+		if err != nil {
+			bad = append(bad, unreadable{append([]byte{}, k...), ErrInvalidKey, nil})
+			return nil
+		}
+		r := record{value: v}
+		if !e.Legacy() {
+			if r, err = decodeRecord(v); err != nil {
+				bad = append(bad, unreadable{append([]byte{}, k...), ErrCorruptRecord, &e})
+				return nil
+			}
+		}
+		r.value = nil
+		c.stored[e] = r
+		c.sizes[e] = len(v)
+		if e.ID > c.maxID {
+			c.maxID = e.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.repair && len(bad) > 0 {
+		err := bucket.Batch(func(b backend.Batch) error {
+			for _, u := range bad {
+				if err := b.Delete(u.k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.count = len(c.stored)
+	for _, u := range bad {
+		if u.entry != nil && !c.repair {
+			c.count++
+		}
+		if u.entry != nil {
+			if e := *u.entry; e.ID > c.maxID {
+				c.maxID = e.ID
+			}
+			if c.repair {
+				// Forget the removed item in open queues
+				for _, q := range c.open {
+					q.drop(*u.entry)
+				}
+			}
+		}
+		c.problem(MessageID(u.k), u.err, c.repair)
+	}
+	return nil
+}
+
+// checkSeq checks that the queue's sequence follows the stored items,
+// advancing it if repairing.
+func (c *checker) checkSeq() error {
+	if len(c.open) > 0 {
+		for _, q := range c.open {
+			q.mutex.Lock()
+			behind := q.seq <= c.maxID
+			q.mutex.Unlock()
+			if !behind {
+				continue
+			}
+			if c.repair {
+				if err := q.skipPast(c.maxID); err != nil {
+					return err
+				}
+			}
+			c.problem("", ErrSeqBehind, c.repair)
+		}
+		return nil
+	}
+
+	// Unless open, the queue resumes its sequence from its metadata, or
+	// from its items if it has none
+	v, err := c.meta.Get([]byte(seqKey))
+	if err == backend.ErrKeyNotFound || (err == nil && len(v) != 8) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if internal.ID(binary.BigEndian.Uint64(v)) > c.maxID {
+		return nil
+	}
+	if c.repair {
+		v := binary.BigEndian.AppendUint64(nil, uint64(c.maxID+1))
+		err := c.meta.Batch(func(b backend.Batch) error {
+			return b.Put([]byte(seqKey), v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.problem("", ErrSeqBehind, c.repair)
+	return nil
+}
+
+// checkOpen checks the state held by an open instance of the queue against
+// the stored items, bringing it in line if repairing.
+func (c *checker) checkOpen(q *Queue) {
+	q.mutex.Lock()
+	if q.loading() {
+		// Items not yet loaded would appear untracked
+		q.mutex.Unlock()
+		return
+	}
+	tracked := map[internal.Entry]bool{}
+	for _, e := range q.ids.All() {
+		tracked[e] = true
+	}
+	for _, s := range q.scheduled {
+		tracked[s.Entry] = true
+	}
+	missing := []internal.Entry{}
+	for e := range tracked {
+		if _, ok := c.stored[e]; !ok {
+			missing = append(missing, e)
+		}
+	}
+	untracked := []internal.Entry{}
+	for e := range c.stored {
+		if !tracked[e] && q.holders[e] == nil && !q.msgGroups.Waiting(e) {
+			untracked = append(untracked, e)
+		}
+	}
+	q.mutex.Unlock()
+
+	sortEntries(missing)
+	for _, e := range missing {
+		if c.repair {
+			q.drop(e)
+		}
+		c.problem(MessageID(e.Key()), ErrMissingItem, c.repair)
+	}
+	sortEntries(untracked)
+	for _, e := range untracked {
+		repaired := c.repair && q.track(e, c.stored[e], c.sizes[e])
+		c.problem(MessageID(e.Key()), ErrUntrackedItem, repaired)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.length != c.count {
+		if c.repair {
+			q.length = c.count
+			q.checkDrained()
+		}
+		c.problem("", ErrLengthMismatch, c.repair)
+	}
+}
+
+// sortEntries sorts the entries by ID.
+func sortEntries(entries []internal.Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+}
+
+// drop forgets an entry that is available or scheduled, for an item that is
+// no longer stored.
+func (q *Queue) drop(e internal.Entry) {
+	if !q.claim(e) && !q.unschedule(e) {
+		return
+	}
+	q.mutex.Lock()
+	q.expiring.Remove(e)
+	q.mutex.Unlock()
+	q.forget(e)
+}
+
+// track makes a stored entry available or scheduled, as when the queue is
+// opened, given its record and stored size. Returns false if the queue has no
+// room for it.
+func (q *Queue) track(e internal.Entry, r record, size int) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.free() < 1 {
+		return false
+	}
+
+	q.length++
+	if q.sizes != nil {
+		q.sizes[e] = size
+		q.bytes += int64(size)
+	}
+	if r.dedupKey != "" {
+		q.dedup.Add(r.dedupKey, e)
+	}
+	if r.group != "" {
+		q.msgGroups.Add(e, r.group)
+	}
+	if r.expiresAt != 0 {
+		q.expiring.PushScheduled(internal.Scheduled{Entry: e, At: r.expiresAt})
+		q.resetSweeper()
+	}
+	if !r.available(time.Now()) {
+		q.scheduled.PushScheduled(internal.Scheduled{Entry: e, At: r.availableAt})
+		q.resetTimer()
+		return true
+	}
+	q.push(e)
+	return true
+}
@@ -0,0 +1,108 @@
+package kvq
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// Close closes the queue, releasing its resources. Takes waiting for items
+// return ErrClosed, as do commits waiting for room, and any further puts,
+// takes and commits. Background work, such as expiring items and running
+// recurring jobs, is stopped, and the queue's consumer groups and poison
+// queue are closed with it. Items held by open transactions remain in
+// storage, and are available again when the queue is reopened. Closing a
+// closed queue does nothing.
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	if q.isClosed() {
+		q.mutex.Unlock()
+		return nil
+	}
+	close(q.closed)
+	for _, t := range []*time.Timer{q.timer, q.sweeper, q.cronTimer, q.compactTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	q.signal()
+
+	children := make([]*Queue, 0, len(q.groups)+1)
+	for _, g := range q.groups {
+		children = append(children, g)
+	}
+	if q.poison != nil {
+		children = append(children, q.poison)
+	}
+	seq := q.seq
+	q.mutex.Unlock()
+
+	var first error
+	for _, c := range children {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	// Release the unused sequence numbers reserved by the queue
+	if !q.readOnly {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(seq))
+		err := q.meta.Batch(func(b backend.Batch) error {
+			return b.Put([]byte(seqKey), v)
+		})
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	if q.owner != nil {
+		q.owner.untrack(q)
+	}
+	return first
+}
+
+// Closed returns true if the queue has been closed.
+func (q *Queue) Closed() bool {
+	return q.isClosed()
+}
+
+// isClosed returns true if the queue has been closed.
+func (q *Queue) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// closedErr returns ErrClosed if the queue has been closed, or nil otherwise.
+func (q *Queue) closedErr() error {
+	if q.isClosed() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// closing returns a channel that is closed when either `done` or the queue is
+// closed, for waits that should stop when the queue is closed. The returned
+// function must be called once the wait is over.
+func (q *Queue) closing(done <-chan struct{}) (<-chan struct{}, func()) {
+	if done == nil {
+		return q.closed, func() {}
+	}
+	merged := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			close(merged)
+		case <-q.closed:
+			close(merged)
+		case <-stop:
+		}
+	}()
+	return merged, func() { close(stop) }
+}
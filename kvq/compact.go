@@ -0,0 +1,111 @@
+package kvq
+
+import (
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// Compact compacts the queue's storage, reclaiming the space held by items
+// that have been removed. Long-lived queues with many puts and takes can
+// otherwise accumulate deleted keys that slow the scan made when the queue is
+// opened. Compact does nothing if the backend does not support compaction;
+// see backend.CapCompact.
+func (q *Queue) Compact() error {
+	if q.readOnly {
+		return ErrReadOnly
+	}
+	c, ok := q.bucket.(backend.Compactor)
+	if !ok {
+		return nil
+	}
+
+	q.mutex.Lock()
+	n := q.removals
+	q.removals = 0
+	q.mutex.Unlock()
+
+	if err := c.Compact(); err != nil {
+		q.mutex.Lock()
+		q.removals += n
+		q.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Compact compacts the storage of every queue listed by Queues, including
+// their metadata, ledgers, poison queues and consumer groups, reclaiming the
+// space held by removed items, such as after a mass deletion. As with
+// Queue.Compact, it does nothing if the backend does not support compaction.
+func (db *DB) Compact() error {
+	if backend.IsReadOnly(db.DB) {
+		return ErrReadOnly
+	}
+	namespaces, err := db.Queues()
+	if err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		open := db.openQueues(namespace)
+		for _, q := range open {
+			if err := q.Compact(); err != nil {
+				return err
+			}
+		}
+
+		names, err := namespaceBuckets(liveBuckets(db.DB), namespace)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if name == namespace && len(open) > 0 {
+				// Compacted above
+				continue
+			}
+			bucket, err := db.DB.Bucket(name)
+			if err != nil {
+				return err
+			}
+			if c, ok := bucket.(backend.Compactor); ok {
+				if err := c.Compact(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// initCompaction starts compacting the queue in the background, if it was
+// opened with a CompactInterval and the backend supports compaction.
+func (q *Queue) initCompaction() {
+	if q.opts.CompactInterval <= 0 || q.readOnly {
+		return
+	}
+	if _, ok := q.bucket.(backend.Compactor); !ok {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.compactTimer = time.AfterFunc(q.opts.CompactInterval, q.autoCompact)
+}
+
+// autoCompact compacts the queue if enough items have been removed since it
+// was last compacted, then waits for the next interval.
+func (q *Queue) autoCompact() {
+	q.mutex.Lock()
+	due := q.removals > 0 && q.removals >= q.opts.CompactThreshold
+	q.mutex.Unlock()
+
+	if due {
+		// Failures are retried at the next interval
+		q.Compact()
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.isClosed() {
+		q.compactTimer.Reset(q.opts.CompactInterval)
+	}
+}
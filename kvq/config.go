@@ -0,0 +1,115 @@
+package kvq
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/backend/compress"
+)
+
+const (
+	// configKey is the metadata key under which a queue's stored
+	// configuration is recorded.
+	configKey = "config"
+)
+
+// Config is the queue-level configuration that can be stored in a queue's
+// metadata with DB.SetConfig, such that every process opening the queue
+// behaves consistently, and the configuration survives restarts. Each field
+// corresponds to the field of QueueOptions with the same name.
+type Config struct {
+	NoSync      bool           `json:"no_sync,omitempty"`
+	MaxQueue    int            `json:"max_queue,omitempty"`
+	MaxBytes    int64          `json:"max_bytes,omitempty"`
+	Overflow    OverflowPolicy `json:"overflow,omitempty"`
+	MaxAttempts int            `json:"max_attempts,omitempty"`
+	TxnTimeout  time.Duration  `json:"txn_timeout,omitempty"`
+	// DeadLetter is the namespace of the dead-letter queue, if any, which is
+	// opened on the same DB along with the queue. Dead-letter queues must not
+	// lead back to the queue through their own configuration.
+	DeadLetter string `json:"dead_letter,omitempty"`
+	// Compression is the name of the codec with which values are compressed:
+	// "none", "snappy" or "zstd". If empty, values are stored uncompressed.
+	Compression string `json:"compression,omitempty"`
+}
+
+// SetConfig stores the configuration of the queue with the given namespace.
+// When the queue is next opened with Queue or QueueWithOptions, the stored
+// configuration takes the place of the corresponding options given. Queues
+// already open are unaffected until reopened.
+func (db *DB) SetConfig(namespace string, c Config) error {
+	if backend.IsReadOnly(db.DB) {
+		return ErrReadOnly
+	}
+	if c.Compression != "" {
+		if _, err := compress.CodecByName(c.Compression); err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	meta, err := db.DB.Bucket(namespace + metaSuffix)
+	if err != nil {
+		return err
+	}
+	return meta.Batch(func(b backend.Batch) error {
+		return b.Put([]byte(configKey), v)
+	})
+}
+
+// Config returns the stored configuration of the queue with the given
+// namespace, and false if it has none.
+func (db *DB) Config(namespace string) (Config, bool, error) {
+	meta, err := db.DB.Bucket(namespace + metaSuffix)
+	if err != nil {
+		return Config{}, false, err
+	}
+	v, err := meta.Get([]byte(configKey))
+	if err == backend.ErrKeyNotFound {
+		return Config{}, false, nil
+	} else if err != nil {
+		return Config{}, false, err
+	}
+	var c Config
+	if err := json.Unmarshal(v, &c); err != nil {
+		return Config{}, false, ErrCorruptRecord
+	}
+	return c, true, nil
+}
+
+// configure returns the given options with the stored configuration of the
+// queue with the given namespace applied, if it has any, opening its
+// dead-letter queue.
+func (db *DB) configure(namespace string, opts *QueueOptions) (*QueueOptions, error) {
+	c, ok, err := db.Config(namespace)
+	if err != nil || !ok {
+		return opts, err
+	}
+
+	configured := DefaultOptions
+	if opts != nil {
+		configured = *opts
+	}
+	configured.NoSync = c.NoSync
+	configured.MaxQueue = c.MaxQueue
+	configured.MaxBytes = c.MaxBytes
+	configured.Overflow = c.Overflow
+	configured.MaxAttempts = c.MaxAttempts
+	configured.TxnTimeout = c.TxnTimeout
+	configured.Compression = nil
+	if c.Compression != "" {
+		if configured.Compression, err = compress.CodecByName(c.Compression); err != nil {
+			return nil, err
+		}
+	}
+	configured.DeadLetter = nil
+	if c.DeadLetter != "" {
+		if configured.DeadLetter, err = db.Queue(c.DeadLetter); err != nil {
+			return nil, err
+		}
+	}
+	return &configured, nil
+}
@@ -0,0 +1,76 @@
+package kvq
+
+import (
+	"errors"
+
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+var (
+	// ErrConflict is returned when committing a transaction, or acknowledging
+	// its items, if items it took are no longer held by it, such as when the
+	// queue has been cleared since. The conflicting items are dropped from
+	// the transaction, which may be committed again without them.
+	ErrConflict = errors.New("transaction conflicts with another")
+)
+
+// own records the entries as being held by the transaction that took them.
+func (q *Queue) own(txn *Txn, entries []internal.Entry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.holders == nil {
+		q.holders = map[internal.Entry]*Txn{}
+	}
+	for _, e := range entries {
+		q.holders[e] = txn
+	}
+}
+
+// disown forgets the transaction holding each of the entries, which are no
+// longer taken.
+func (q *Queue) disown(entries ...internal.Entry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, e := range entries {
+		delete(q.holders, e)
+	}
+}
+
+// heldBy returns those of the given entries, along with their records, that
+// are still held by the transaction.
+func (q *Queue) heldBy(txn *Txn, entries []internal.Entry, records []record) ([]internal.Entry, []record) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	held := entries[:0:0]
+	heldRecords := records[:0:0]
+	for i, e := range entries {
+		if q.holders[e] == txn {
+			held = append(held, e)
+			heldRecords = append(heldRecords, records[i])
+		}
+	}
+	return held, heldRecords
+}
+
+// checkConflicts drops the items taken by the transaction that it no longer
+// holds, returning ErrConflict if there were any. The caller must hold the
+// transaction mutex.
+func (txn *Txn) checkConflicts() error {
+	q := txn.queue
+	q.mutex.Lock()
+	ids := []MessageID{}
+	for _, kv := range txn.takeValues {
+		e, _ := internal.KeyToEntry(kv.k)
+		if q.holders[e] != txn {
+			ids = append(ids, MessageID(kv.k))
+		}
+	}
+	q.mutex.Unlock()
+
+	if len(ids) == 0 {
+		return nil
+	}
+	txn.release(ids)
+	return ErrConflict
+}
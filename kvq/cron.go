@@ -0,0 +1,221 @@
+package kvq
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+const (
+	// cronPrefix prefixes the metadata keys holding a queue's recurring jobs.
+	cronPrefix = "cron/"
+)
+
+// job is a recurring job that puts a value into a queue on a schedule.
+type job struct {
+	spec  string
+	cron  *internal.Cron
+	value []byte
+	next  time.Time // time of the next run
+}
+
+// encode returns the stored form of the job.
+func (j *job) encode() []byte {
+	b := make([]byte, 0, binary.MaxVarintLen64+len(j.spec)+8+len(j.value))
+	b = binary.AppendUvarint(b, uint64(len(j.spec)))
+	b = append(b, j.spec...)
+	next := int64(0)
+	if !j.next.IsZero() {
+		next = j.next.UnixNano()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(next))
+	return append(b, j.value...)
+}
+
+// decodeJob parses a job from its stored form.
+func decodeJob(b []byte) (*job, error) {
+	n, i := binary.Uvarint(b)
+	if i <= 0 || uint64(len(b)-i) < n+8 {
+		return nil, ErrCorruptRecord
+	}
+	spec := string(b[i : i+int(n)])
+	b = b[i+int(n):]
+	c, err := internal.ParseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		spec:  spec,
+		cron:  c,
+		value: append([]byte{}, b[8:]...),
+	}
+	if next := int64(binary.BigEndian.Uint64(b)); next != 0 {
+		j.next = time.Unix(0, next)
+	}
+	return j, nil
+}
+
+// AddRecurring adds a recurring job named `name` to the queue, which puts
+// value `v` into the queue at the times given by the cron expression `spec`
+// (e.g. "*/15 * * * *" for every 15 minutes, or "@daily"). An existing job
+// of the same name is replaced. Jobs are stored in the queue's metadata, so
+// continue to run when the queue is reopened; a run that was due while the
+// queue was closed happens as soon as it is reopened. Runs that cannot be put,
+// e.g. because the queue is full, are skipped.
+func (q *Queue) AddRecurring(name, spec string, v []byte) error {
+	if q.readOnly {
+		return ErrReadOnly
+	}
+	c, err := internal.ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	j := &job{
+		spec:  spec,
+		cron:  c,
+		value: v,
+		next:  c.Next(time.Now()),
+	}
+
+	err = q.meta.Batch(func(b backend.Batch) error {
+		return b.Put([]byte(cronPrefix+name), j.encode())
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.jobs == nil {
+		q.jobs = map[string]*job{}
+	}
+	q.jobs[name] = j
+	q.resetCron()
+	return nil
+}
+
+// RemoveRecurring removes the named recurring job from the queue.
+func (q *Queue) RemoveRecurring(name string) error {
+	if q.readOnly {
+		return ErrReadOnly
+	}
+	err := q.meta.Batch(func(b backend.Batch) error {
+		return b.Delete([]byte(cronPrefix + name))
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.jobs, name)
+	q.resetCron()
+	return nil
+}
+
+// Recurring returns the names of the queue's recurring jobs, in order.
+func (q *Queue) Recurring() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	names := make([]string, 0, len(q.jobs))
+	for name := range q.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// initCron loads the recurring jobs stored in the queue's metadata.
+func (q *Queue) initCron() error {
+	jobs := map[string]*job{}
+	err := q.meta.ForEach(func(k, v []byte) error {
+		name := string(k)
+		if !strings.HasPrefix(name, cronPrefix) {
+			return nil
+		}
+		j, err := decodeJob(v)
+		if err != nil {
+			return err
+		}
+		jobs[strings.TrimPrefix(name, cronPrefix)] = j
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.jobs = jobs
+	q.resetCron()
+	return nil
+}
+
+// resetCron arranges for runJobs to be called when the next recurring job is
+// due. Jobs do not run in read-only or closed queues. The caller must hold
+// the queue mutex.
+func (q *Queue) resetCron() {
+	var next time.Time
+	for _, j := range q.jobs {
+		if !j.next.IsZero() && (next.IsZero() || j.next.Before(next)) {
+			next = j.next
+		}
+	}
+	if next.IsZero() || q.readOnly || q.isClosed() {
+		if q.cronTimer != nil {
+			q.cronTimer.Stop()
+		}
+		return
+	}
+	d := time.Until(next)
+	if q.cronTimer == nil {
+		q.cronTimer = time.AfterFunc(d, q.runJobs)
+	} else {
+		q.cronTimer.Reset(d)
+	}
+}
+
+// runJobs puts the values of all recurring jobs that are due, and schedules
+// their next runs.
+func (q *Queue) runJobs() {
+	q.mutex.Lock()
+	now := time.Now()
+	due := map[string]*job{}
+	stored := map[string][]byte{}
+	for name, j := range q.jobs {
+		if !j.next.IsZero() && !j.next.After(now) {
+			j.next = j.cron.Next(now)
+			due[name] = j
+			stored[name] = j.encode()
+		}
+	}
+	q.resetCron()
+	q.mutex.Unlock()
+
+	for name, j := range due {
+		// Put before recording the next run, so that runs are repeated
+		// rather than lost if this is interrupted
+		txn := q.Transaction()
+		if err := txn.Put(j.value); err == nil {
+			if err := txn.Commit(); err != nil {
+				txn.Close()
+			}
+		}
+
+		q.mutex.Lock()
+		current := q.jobs[name] == j
+		q.mutex.Unlock()
+		if !current {
+			// Removed or replaced since
+			continue
+		}
+		q.meta.Batch(func(b backend.Batch) error {
+			return b.Put([]byte(cronPrefix+name), stored[name])
+		})
+	}
+}
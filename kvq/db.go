@@ -1,35 +1,182 @@
 package kvq
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
 	"github.com/johnsto/go-kvq/kvq/backend"
-	"github.com/johnsto/go-kvq/kvq/backend/goleveldb"
+	_ "github.com/johnsto/go-kvq/kvq/backend/goleveldb"
 )
 
+// DefaultBackend is the name of the backend used when Open or Destroy is
+// given a plain path rather than a URI.
+const DefaultBackend = "goleveldb"
+
 // DB wraps the backend being used.
 type DB struct {
 	backend.DB
+
+	mutex  sync.Mutex
+	queues map[*Queue]bool // open queues, closed with the DB
+	lock   *os.File        // locked while open for writing, if local
 }
 
-func Open(path string) (*DB, error) {
-	db, err := goleveldb.Open(path)
+// Register makes a backend available to Open and Destroy by the provided
+// name. It is typically called from the init function of a backend package,
+// so that importing the package is sufficient to make it available. If
+// Register is called twice with the same name, it panics.
+func Register(name string, driver backend.Driver) {
+	backend.Register(name, driver)
+}
+
+// Open opens the database described by `uri`, which takes the form
+// "name://path", where `name` is a registered backend and `path` is passed to
+// the backend to interpret (e.g. "bolt:///var/lib/queue.db"). A plain path
+// without a scheme opens a goleveldb database at that path. Databases on the
+// local filesystem are locked until closed, such that Open fails with
+// ErrLocked if the database is already open.
+func Open(uri string) (*DB, error) {
+	driver, path, err := lookup(uri)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	var f *os.File
+	if driver.Local {
+		if f, err = lock(path); err != nil {
+			return nil, err
+		}
+	}
+	db, err := driver.Open(path)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, err
+	}
+	return &DB{DB: db, lock: f}, nil
 }
 
-func Destroy(path string) error {
-	return goleveldb.Destroy(path)
+// OpenReadOnly opens the database described by `uri` in read-only mode, such
+// that no items can be put or taken from its queues. This allows monitoring
+// and inspection tools to safely read a live database. The database is not
+// locked, so backends that allow it, such as SQLite, can be opened read-only
+// while open for writing elsewhere. Not all backends support read-only mode.
+func OpenReadOnly(uri string) (*DB, error) {
+	driver, path, err := lookup(uri)
+	if err != nil {
+		return nil, err
+	}
+	if driver.OpenReadOnly == nil {
+		return nil, fmt.Errorf("backend for %q does not support read-only mode", uri)
+	}
+	db, err := driver.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: backend.ReadOnly(db)}, nil
+}
+
+// Destroy destroys the database described by `uri`, as given to Open.
+func Destroy(uri string) error {
+	driver, path, err := lookup(uri)
+	if err != nil {
+		return err
+	}
+	if driver.Destroy == nil {
+		return fmt.Errorf("backend for %q does not support Destroy", uri)
+	}
+	if err := driver.Destroy(path); err != nil {
+		return err
+	}
+	if driver.Local {
+		if err := os.Remove(path + lockSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the registered driver for the scheme of `uri`, along with
+// the remainder of the URI.
+func lookup(uri string) (backend.Driver, string, error) {
+	name, path := DefaultBackend, uri
+	if i := strings.Index(uri, "://"); i > 0 {
+		name, path = uri[:i], uri[i+len("://"):]
+	}
+	driver, err := backend.Lookup(name)
+	if err != nil {
+		return backend.Driver{}, "", err
+	}
+	return driver, path, nil
 }
 
 // NewDB creates a new DB instance from a backend database.
 func NewDB(db backend.DB) *DB {
-	return &DB{db}
+	return &DB{DB: db}
 }
 
 // Queue opens a queue within the given namespace (key prefix), whereby keys
 // are prefixed with the namespace value and a NUL byte, followed by the
 // ID of the queued item.
 func (db *DB) Queue(namespace string) (*Queue, error) {
-	return NewQueue(db.DB, namespace, nil)
+	return db.QueueWithOptions(namespace, nil)
+}
+
+// QueueWithOptions opens a queue within the given namespace, as with Queue,
+// using the provided options, except where overridden by the configuration
+// stored for the queue with SetConfig.
+func (db *DB) QueueWithOptions(namespace string, opts *QueueOptions) (*Queue, error) {
+	opts, err := db.configure(namespace, opts)
+	if err != nil {
+		return nil, err
+	}
+	q, err := NewQueue(db.DB, namespace, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.register(namespace); err != nil {
+		q.Close()
+		return nil, err
+	}
+	db.track(q)
+	return q, nil
+}
+
+// Close closes every queue opened with Queue or QueueWithOptions that is still
+// open, then closes the database.
+func (db *DB) Close() {
+	db.mutex.Lock()
+	queues := make([]*Queue, 0, len(db.queues))
+	for q := range db.queues {
+		queues = append(queues, q)
+	}
+	db.mutex.Unlock()
+
+	for _, q := range queues {
+		q.Close()
+	}
+	db.DB.Close()
+	if db.lock != nil {
+		db.lock.Close()
+	}
+}
+
+// track records the queue as open, such that it is closed with the DB.
+func (db *DB) track(q *Queue) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.queues == nil {
+		db.queues = map[*Queue]bool{}
+	}
+	q.owner = db
+	db.queues[q] = true
+}
+
+// untrack records the queue as closed.
+func (db *DB) untrack(q *Queue) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	delete(db.queues, q)
 }
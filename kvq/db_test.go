@@ -1,12 +1,27 @@
 package kvq
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"log"
+	"math"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/backend/compress"
+	"github.com/johnsto/go-kvq/kvq/backend/encrypt"
+	"github.com/johnsto/go-kvq/kvq/backend/mem"
+	"github.com/johnsto/go-kvq/kvq/internal"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,130 +82,3773 @@ func TestInit(t *testing.T) {
 	db.Close()
 }
 
+// TestOpenURI ensures databases can be opened by URI using registered
+// backends.
+func TestOpenURI(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Close())
+	db.Close()
+
+	// mem has no Destroy
+	assert.Error(t, Destroy("mem://"))
+
+	// Unknown backend
+	_, err = Open("nope://test.db")
+	assert.Error(t, err)
+
+	// Plain paths and explicit goleveldb URIs are equivalent
+	path := "test-open-uri.db"
+	assert.NoError(t, Destroy("goleveldb://"+path))
+	db, err = Open(path)
+	assert.NoError(t, err)
+	db.Close()
+	assert.NoError(t, Destroy(path))
+}
+
+// TestOpenReadOnly ensures queues in read-only databases can be inspected but
+// not modified.
+func TestOpenReadOnly(t *testing.T) {
+	path := "test-open-read-only.db"
+	assert.NoError(t, Destroy(path))
+
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+	db.Close()
+
+	db, err = OpenReadOnly(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.True(t, q.ReadOnly())
+	assert.Equal(t, 2, q.Size())
+
+	tx = q.Transaction()
+	assert.Equal(t, ErrReadOnly, tx.Put([]byte("c")))
+	v, err := tx.Take()
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Nil(t, v)
+	assert.Equal(t, ErrReadOnly, q.Clear())
+	assert.Equal(t, 2, q.Size())
+	assert.Equal(t, 2, q.Len())
+
+	// mem has no read-only mode
+	_, err = OpenReadOnly("mem://")
+	assert.Error(t, err)
+}
+
 // TestQueueSingle tests a batch of puts and takes in a single transaction
 func TestQueueSingle(t *testing.T) {
 	path := "test-queue-single.db"
 
-	err := Destroy(path)
+	err := Destroy(path)
+	db, err := Open(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	if err := q.Clear(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Create test data
+	table := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		table[k] = true
+	}
+
+	// Write data
+	tx := q.Transaction()
+	for k := range table {
+		tx.Put([]byte(k))
+	}
+	tx.Commit()
+
+	// Read data
+	rx := q.Transaction()
+	vs, err := rx.TakeN(50, 10*time.Second)
+	assert.NoError(t, err)
+	for _, v := range vs {
+		assert.True(t, table[string(v)])
+		delete(table, string(v))
+	}
+
+	for len(table) > 0 {
+		v, err := rx.Take()
+		assert.NoError(t, err)
+		assert.True(t, table[string(v)])
+		delete(table, string(v))
+	}
+	rx.Commit()
+
+	// Verify there are no more items in the queue
+	rx = q.Transaction()
+	defer rx.Close()
+	v, err := rx.Take()
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+// TestQueueMulti tests a series of puts/takes in a number of transactions
+func TestQueueMulti(t *testing.T) {
+	path := "test-queue-multi.db"
+
+	err := Destroy(path)
+	db, err := Open(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	if err := q.Clear(); err != nil {
+		log.Fatalln(err)
+	}
+
+	table := []string{"a", "b", "c"}
+
+	// Put values
+	for _, v := range table {
+		tx := q.Transaction()
+		tx.Put([]byte(v))
+		tx.Commit()
+	}
+
+	// Take values
+	for _, exp := range table {
+		rx := q.Transaction()
+		act, err := rx.Take()
+		assert.NoError(t, err)
+		assert.Equal(t, exp, string(act))
+		rx.Commit()
+	}
+}
+
+// TestQueueOrdered tests that items come out of the queue in the correct
+// order.
+func TestQueueOrdered(t *testing.T) {
+	path := "test-queue-ordered.db"
+
+	err := Destroy(path)
+	db, err := Open(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	if err := q.Clear(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Put values
+	tx := q.Transaction()
+	for i := byte(0); i < 100; i++ {
+		tx.Put([]byte{i})
+	}
+	tx.Commit()
+
+	// Take values
+	rx := q.Transaction()
+	for i := byte(0); i < 100; i++ {
+		act, err := rx.Take()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{i}, act)
+	}
+	rx.Commit()
+}
+
+// TestQueuePriority tests that higher priority items are taken first, and
+// that priorities are retained when the queue is reopened.
+func TestQueuePriority(t *testing.T) {
+	path := "test-queue-priority.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	// Write an item using the legacy key format, which should be taken
+	// with the default priority
+	bucket, err := db.Bucket("test")
+	assert.NoError(t, err)
+	legacy := make([]byte, 16)
+	binary.PutUvarint(legacy, 1)
+	assert.NoError(t, bucket.Batch(func(b backend.Batch) error {
+		return b.Put(legacy, []byte("legacy"))
+	}))
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutPriority([]byte("low"), 1))
+	assert.NoError(t, tx.Put([]byte("default")))
+	assert.NoError(t, tx.PutPriority([]byte("high"), 200))
+	assert.NoError(t, tx.PutPriority([]byte("mid"), 100))
+	assert.NoError(t, tx.Commit())
+	db.Close()
+
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+
+	rx := q.Transaction()
+	for _, exp := range []string{"high", "mid", "low", "legacy", "default"} {
+		v, err := rx.Take()
+		assert.NoError(t, err)
+		assert.Equal(t, exp, string(v))
+	}
+	assert.NoError(t, rx.Commit())
+	assert.Equal(t, 0, q.Size())
+}
+
+// TestQueueSequence tests that items are assigned increasing sequence
+// numbers, which continue from existing items when the queue is reopened.
+func TestQueueSequence(t *testing.T) {
+	path := "test-queue-sequence.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, tx.Put([]byte{byte(i)}))
+	}
+	assert.NoError(t, tx.Commit())
+	ms, err := tx.TakeMessages(3, 0)
+	assert.NoError(t, err)
+	assert.Len(t, ms, 3)
+	assert.Equal(t, ms[0].Seq+1, ms[1].Seq)
+	assert.Equal(t, ms[1].Seq+1, ms[2].Seq)
+	assert.NoError(t, tx.Commit())
+	last := ms[2].Seq
+
+	// Sequence should continue after reopening an empty queue
+	db.Close()
+	db, err = Open(path)
+	assert.NoError(t, err)
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	tx = q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.True(t, m.Seq > last)
+	assert.NoError(t, tx.Commit())
+
+	// Sequence should follow items with time-based IDs
+	db.Close()
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	bucket, err := db.Bucket("test")
+	assert.NoError(t, err)
+	old := internal.Entry{ID: 1 << 60}
+	assert.NoError(t, bucket.Batch(func(b backend.Batch) error {
+		return b.Put(old.Key(), (&record{value: []byte("old")}).encode())
+	}))
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	tx = q.Transaction()
+	assert.NoError(t, tx.Put([]byte("new")))
+	assert.NoError(t, tx.Commit())
+	vs, err := tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("old"), []byte("new")}, vs)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueDelay tests that delayed items only become available once their
+// delay has elapsed, including after the queue is reopened.
+func TestQueueDelay(t *testing.T) {
+	path := "test-queue-delay.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutDelay([]byte("later"), 100*time.Millisecond))
+	assert.NoError(t, tx.PutAt([]byte("past"), time.Now().Add(-time.Second)))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, 1, q.Scheduled())
+
+	rx := q.Transaction()
+	v, err := rx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "past", string(v))
+	v, err = rx.Take()
+	assert.NoError(t, err)
+	assert.Nil(t, v, "delayed item should not be available yet")
+	vs, err := rx.TakeN(1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("later")}, vs)
+	assert.NoError(t, rx.Commit())
+	assert.Equal(t, 0, q.Scheduled())
+
+	// Ensure schedule survives reopening
+	tx = q.Transaction()
+	assert.NoError(t, tx.PutDelay([]byte("reopened"), 200*time.Millisecond))
+	assert.NoError(t, tx.Commit())
+	db.Close()
+
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.Size())
+	assert.Equal(t, 1, q.Scheduled())
+
+	rx = q.Transaction()
+	vs, err = rx.TakeN(1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("reopened")}, vs)
+	assert.NoError(t, rx.Commit())
+}
+
+// TestQueueDelaySize tests that the number of available items can be read
+// while scheduled items are being released. Run with -race.
+func TestQueueDelaySize(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for i := 0; i < 20; i++ {
+		d := time.Duration(i) * time.Millisecond
+		assert.NoError(t, tx.PutDelay([]byte(strconv.Itoa(i)), d))
+	}
+	assert.NoError(t, tx.Commit())
+
+	deadline := time.Now().Add(time.Second)
+	for q.Size() < 20 && time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+	assert.Equal(t, 20, q.Size())
+	assert.Equal(t, 0, q.Scheduled())
+}
+
+// TestQueueTTL tests that items expire if not taken within their TTL, and
+// are moved to the dead-letter queue.
+func TestQueueTTL(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	dead, err := db.Queue("dead")
+	assert.NoError(t, err)
+	q, err := db.QueueWithOptions("test", &QueueOptions{DeadLetter: dead})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutTTL([]byte("held"), 50*time.Millisecond))
+	assert.NoError(t, tx.PutTTL([]byte("swept"), 50*time.Millisecond))
+	assert.NoError(t, tx.PutTTL([]byte("long"), time.Hour))
+	assert.NoError(t, tx.Put([]byte("forever")))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 4, q.Size())
+
+	// Hold an item in a transaction while it expires
+	rx := q.Transaction()
+	v, err := rx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "held", string(v))
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 2, q.Size(), "unheld expired item should be swept")
+	assert.Equal(t, 1, dead.Size())
+
+	// Returning the held item should see it expire on next take
+	assert.NoError(t, rx.Close())
+	vs, err := rx.TakeN(10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("long"), []byte("forever")}, vs)
+	assert.NoError(t, rx.Commit())
+	assert.Equal(t, 2, dead.Size())
+
+	rx = dead.Transaction()
+	vs, err = rx.TakeN(10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("swept"), []byte("held")}, vs)
+	assert.NoError(t, rx.Commit())
+}
+
+// TestQueuePutUntil tests that items expire if not taken before their
+// deadline.
+func TestQueuePutUntil(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	dead, err := db.Queue("dead")
+	assert.NoError(t, err)
+	q, err := db.QueueWithOptions("test", &QueueOptions{DeadLetter: dead})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutUntil([]byte("stale"), now.Add(-time.Second)))
+	assert.NoError(t, tx.PutUntil([]byte("soon"), now.Add(50*time.Millisecond)))
+	assert.NoError(t, tx.PutUntil([]byte("later"), now.Add(time.Hour)))
+	assert.NoError(t, tx.PutUntil([]byte("never"), time.Time{}))
+	assert.NoError(t, tx.Commit())
+
+	time.Sleep(150 * time.Millisecond)
+	vs, err := tx.TakeN(10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("later"), []byte("never")}, vs)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, dead.Size())
+}
+
+// TestQueueMaxAttempts tests that items are moved to the dead-letter queue
+// once they have been discarded too many times, including across reopens.
+func TestQueueMaxAttempts(t *testing.T) {
+	path := "test-queue-attempts.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	dead, err := db.Queue("dead")
+	assert.NoError(t, err)
+	opts := &QueueOptions{DeadLetter: dead, MaxAttempts: 2}
+	q, err := db.QueueWithOptions("test", opts)
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("poison")))
+	assert.NoError(t, tx.Commit())
+
+	// First failed attempt returns item to queue
+	rx := q.Transaction()
+	v, err := rx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "poison", string(v))
+	assert.NoError(t, rx.Close())
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, 0, dead.Size())
+
+	// Reopen DB and ensure attempt is remembered
+	db.Close()
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	dead, err = db.Queue("dead")
+	assert.NoError(t, err)
+	opts.DeadLetter = dead
+	q, err = db.QueueWithOptions("test", opts)
+	assert.NoError(t, err)
+
+	// Second failed attempt moves item to dead-letter queue
+	rx = q.Transaction()
+	v, err = rx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "poison", string(v))
+	assert.NoError(t, rx.Close())
+	assert.Equal(t, 0, q.Size())
+	assert.Equal(t, 1, dead.Size())
+
+	rx = dead.Transaction()
+	v, err = rx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "poison", string(v))
+	assert.NoError(t, rx.Commit())
+}
+
+// TestQueueLease tests that leased items are hidden until acknowledged or
+// their visibility timeout elapses, including after the queue is reopened.
+func TestQueueLease(t *testing.T) {
+	path := "test-queue-lease.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	assert.NoError(t, tx.Commit())
+
+	leases, err := q.Lease(2, 0, 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Len(t, leases, 2)
+	assert.Equal(t, "a", string(leases[0].Value))
+	assert.Equal(t, "b", string(leases[1].Value))
+	assert.Equal(t, 1, q.Size())
+	assert.NoError(t, leases[0].Ack())
+
+	// Unacknowledged lease should return to queue
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 2, q.Size())
+	assert.Equal(t, ErrLeaseExpired, leases[1].Ack())
+
+	// Nack should return item immediately
+	leases, err = q.Lease(1, 0, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(leases[0].Value))
+	assert.Equal(t, 1, q.Size())
+	assert.NoError(t, leases[0].Nack())
+	assert.Equal(t, 2, q.Size())
+
+	// Lease should survive reopening
+	leases, err = q.Lease(1, 0, 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(leases[0].Value))
+	db.Close()
+
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, 1, q.Scheduled())
+
+	rx := q.Transaction()
+	vs, err := rx.TakeN(2, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("c"), []byte("b")}, vs)
+	assert.NoError(t, rx.Commit())
+}
+
+// TestQueueAttempts tests that the number of attempts made to process an item
+// is exposed to consumers.
+func TestQueueAttempts(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+
+	for i := 0; i < 2; i++ {
+		m, err := tx.TakeMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(m.Value))
+		assert.Equal(t, i, m.Attempts)
+		assert.NoError(t, tx.Close())
+	}
+
+	// Expired lease should count as an attempt
+	leases, err := q.Lease(1, 0, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, leases[0].Attempts)
+	ms, err := tx.TakeMessages(1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, ms[0].Attempts)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueRetryDelay tests that discarded items are delayed according to
+// the queue's backoff schedule.
+func TestQueueRetryDelay(t *testing.T) {
+	backoff := ExponentialBackoff(50*time.Millisecond, 150*time.Millisecond)
+	assert.Equal(t, 50*time.Millisecond, backoff(1))
+	assert.Equal(t, 100*time.Millisecond, backoff(2))
+	assert.Equal(t, 150*time.Millisecond, backoff(3))
+	assert.Equal(t, 150*time.Millisecond, backoff(100))
+
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{RetryDelay: backoff})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("retry")))
+	assert.NoError(t, tx.Commit())
+
+	for i := 0; i < 2; i++ {
+		rx := q.Transaction()
+		v, err := rx.Take()
+		assert.NoError(t, err)
+		assert.Equal(t, "retry", string(v))
+		assert.NoError(t, rx.Close())
+		assert.Equal(t, 0, q.Size(), "discarded item should be delayed")
+		assert.Equal(t, 1, q.Scheduled())
+
+		vs, err := rx.TakeN(1, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("retry")}, vs)
+		assert.NoError(t, rx.Close())
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// TestQueueDedup tests that items put with a deduplication key already held
+// by an item in the queue are ignored or rejected.
+func TestQueueDedup(t *testing.T) {
+	path := "test-queue-dedup.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutDedup([]byte("a1"), "a"))
+	assert.NoError(t, tx.PutDedup([]byte("a2"), "a"))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Size())
+
+	// Concurrent transactions putting the same key
+	tx1, tx2 := q.Transaction(), q.Transaction()
+	assert.NoError(t, tx1.PutDedup([]byte("b1"), "b"))
+	assert.NoError(t, tx2.PutDedup([]byte("b2"), "b"))
+	assert.NoError(t, tx2.PutDedup([]byte("c"), "c"))
+	assert.NoError(t, tx1.Commit())
+	assert.NoError(t, tx2.Commit())
+	assert.Equal(t, 3, q.Size())
+
+	// Keys should be remembered after reopening
+	db.Close()
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.QueueWithOptions("test", &QueueOptions{RejectDuplicates: true})
+	assert.NoError(t, err)
+
+	tx = q.Transaction()
+	assert.Equal(t, ErrDuplicate, tx.PutDedup([]byte("a3"), "a"))
+	vs, err := tx.TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a1"), []byte("b1"), []byte("c")}, vs)
+
+	// Keys should be released once taken items are committed
+	assert.Equal(t, ErrDuplicate, tx.PutDedup([]byte("a3"), "a"))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.PutDedup([]byte("a3"), "a"))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Size())
+}
+
+// TestQueueOverflow tests each of the policies applied when a queue is full.
+func TestQueueOverflow(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Reject items exceeding byte limit
+	q, err := db.QueueWithOptions("reject", &QueueOptions{MaxBytes: 64})
+	assert.NoError(t, err)
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put(make([]byte, 40)))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Put(make([]byte, 40)))
+	assert.Equal(t, ErrInsufficientCapacity, tx.Commit())
+	assert.NoError(t, tx.Close())
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Put(make([]byte, 40)))
+	assert.NoError(t, tx.Commit(), "bytes should be freed once taken")
+
+	// Drop oldest items to make room
+	q, err = db.QueueWithOptions("drop", &QueueOptions{
+		MaxQueue: 2,
+		Overflow: OverflowDropOldest,
+	})
+	assert.NoError(t, err)
+	tx = q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.Commit())
+	vs, err := tx.TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, vs)
+	assert.NoError(t, tx.Commit())
+
+	// Block until room becomes available
+	q, err = db.QueueWithOptions("block", &QueueOptions{
+		MaxQueue: 1,
+		Overflow: OverflowBlock,
+	})
+	assert.NoError(t, err)
+	tx = q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	done := make(chan error)
+	go func() {
+		tx := q.Transaction()
+		tx.Put([]byte("b"))
+		done <- tx.Commit()
+	}()
+	select {
+	case <-done:
+		t.Fatal("commit should block while queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	assert.NoError(t, <-done)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Size())
+}
+
+// TestQueueLen tests that the number of stored items is tracked across puts,
+// takes and reopens.
+func TestQueueLen(t *testing.T) {
+	path := "test-queue-len.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.PutDelay([]byte("c"), time.Hour))
+	assert.Equal(t, 0, q.Len(), "uncommitted puts should not be counted")
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 3, q.Len())
+
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, q.Len(), "uncommitted takes should be counted")
+	assert.NoError(t, tx.Close())
+	assert.Equal(t, 3, q.Len())
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, q.Len())
+
+	db.Close()
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Len())
+}
+
+// TestQueueSizeBytes tests that the storage consumed by a queue is reported.
+func TestQueueSizeBytes(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	n, err := q.SizeBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put(make([]byte, 100)))
+	assert.NoError(t, tx.Commit())
+	n, err = q.SizeBytes()
+	assert.NoError(t, err)
+	assert.True(t, n > 100, "size should include key, value and metadata")
+}
+
+// TestQueuePause tests that takes (and optionally puts) wait while a queue is
+// paused.
+func TestQueuePause(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+
+	q.Pause()
+	assert.True(t, q.Paused())
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Nil(t, v, "take should return nothing while paused")
+	vs, err := tx.TakeN(1, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, vs, "waiting take should time out while paused")
+
+	// Puts should still be accepted
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+
+	// Waiting take should continue once resumed
+	done := make(chan [][]byte)
+	go func() {
+		rx := q.Transaction()
+		vs, _ := rx.TakeN(2, time.Second)
+		rx.Commit()
+		done <- vs
+	}()
+	select {
+	case <-done:
+		t.Fatal("take should wait while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Resume()
+	assert.False(t, q.Paused())
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, <-done)
+
+	// Pausing puts should cause commits to fail
+	q.PauseAll()
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.Equal(t, ErrPaused, tx.Commit())
+	q.Resume()
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Size())
+}
+
+// TestQueueDrain tests that draining queues reject puts and signal once
+// empty.
+func TestQueueDrain(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+
+	drained := q.Drain()
+	assert.True(t, q.Draining())
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.Equal(t, ErrDraining, tx.Commit())
+	assert.NoError(t, tx.Close())
+
+	isDrained := func() bool {
+		select {
+		case <-drained:
+			return true
+		default:
+			return false
+		}
+	}
+
+	vs, err := tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.Len(t, vs, 2)
+	assert.False(t, isDrained(), "queue should not be drained until commit")
+	assert.NoError(t, tx.Close())
+	assert.False(t, isDrained(), "discarded items should remain in queue")
+	_, err = tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.True(t, isDrained(), "queue should be drained once empty")
+	assert.Equal(t, drained, q.Drain())
+}
+
+// TestQueueDiscardDelay tests that items discarded with a delay only become
+// available again once the delay has elapsed.
+func TestQueueDiscardDelay(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	assert.NoError(t, tx.DiscardDelay(100*time.Millisecond))
+	assert.Equal(t, 0, q.Size())
+	assert.Equal(t, 1, q.Scheduled())
+
+	v, err = tx.Take()
+	assert.NoError(t, err)
+	assert.Nil(t, v, "discarded item should not be available yet")
+	vs, err := tx.TakeN(1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, vs)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueHeaders tests that message headers are stored with items, and are
+// retained when items are moved to the dead-letter queue.
+func TestQueueHeaders(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	dead, err := db.Queue("dead")
+	assert.NoError(t, err)
+	q, err := db.QueueWithOptions("test", &QueueOptions{
+		DeadLetter:  dead,
+		MaxAttempts: 1,
+	})
+	assert.NoError(t, err)
+
+	headers := map[string]string{"type": "email", "trace": "abc123"}
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutMessage(&Message{
+		Value:   []byte("hello"),
+		Headers: headers,
+	}))
+	assert.NoError(t, tx.Put([]byte("plain")))
+	assert.NoError(t, tx.Commit())
+
+	ms, err := tx.TakeMessages(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(ms[0].Value))
+	assert.Equal(t, headers, ms[0].Headers)
+	assert.Nil(t, ms[1].Headers)
+	assert.NoError(t, tx.Close())
+
+	m, err := dead.Transaction().TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(m.Value))
+	assert.Equal(t, headers, m.Headers)
+}
+
+// TestMessageID tests that taken messages are identified by unique IDs, which
+// survive conversion to and from strings.
+func TestMessageID(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.PutPriority([]byte("b"), 5))
+	assert.NoError(t, tx.Commit())
+
+	ms, err := tx.TakeMessages(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(5), ms[0].Priority)
+	assert.NotEqual(t, ms[0].ID, ms[1].ID)
+	for _, m := range ms {
+		id, err := ParseMessageID(m.ID.String())
+		assert.NoError(t, err)
+		assert.Equal(t, m.ID, id)
+	}
+	assert.NoError(t, tx.Commit())
+
+	_, err = ParseMessageID("zz")
+	assert.Error(t, err)
+	_, err = ParseMessageID("0102")
+	assert.Error(t, err)
+}
+
+// TestQueueTakeExactly tests that batch takes wait for a full batch, or take
+// nothing.
+func TestQueueTakeExactly(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+
+	// Partial batch should time out without taking anything
+	vs, err := tx.TakeExactly(2, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, vs)
+	assert.Equal(t, 1, q.Size(), "items should be returned on timeout")
+
+	// Batch should be completed when enough items arrive
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tx := q.Transaction()
+		tx.Put([]byte("b"))
+		tx.Put([]byte("c"))
+		tx.Commit()
+	}()
+	vs, err = tx.TakeExactly(2, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, vs)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Size())
+}
+
+// TestQueueGroups tests that items are delivered to each consumer group, and
+// to only one member of each group.
+func TestQueueGroups(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	a, err := q.Group("a")
+	assert.NoError(t, err)
+	b, err := q.Group("b")
+	assert.NoError(t, err)
+	same, err := q.Group("a")
+	assert.NoError(t, err)
+	assert.Equal(t, a, same, "existing group should be returned")
+	assert.Equal(t, []string{"a", "b"}, q.Groups())
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("x")))
+	assert.NoError(t, tx.PutPriority([]byte("y"), 1))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 0, q.Len(), "items should only be stored in groups")
+	assert.Equal(t, 2, a.Size())
+	assert.Equal(t, 2, b.Size())
+
+	// Each member of a group takes different items
+	m1, m2 := a.Transaction(), a.Transaction()
+	v, err := m1.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("y"), v, "priority should be retained")
+	v, err = m2.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), v)
+	assert.NoError(t, m1.Commit())
+	assert.NoError(t, m2.Commit())
+	assert.Equal(t, 0, a.Size())
+	assert.Equal(t, 2, b.Size(), "other groups should be unaffected")
+
+	// Groups are restored when the queue is reopened
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, q.Groups())
+	b, err = q.Group("b")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, b.Size())
+
+	assert.NoError(t, q.RemoveGroup("a"))
+	assert.Equal(t, []string{"b"}, q.Groups())
+	tx = q.Transaction()
+	assert.NoError(t, tx.Put([]byte("z")))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 3, b.Size())
+}
+
+// TestQueueFairDispatch tests that waiting consumers are served before
+// consumers that have just arrived.
+func TestQueueFairDispatch(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{FairDispatch: true})
+	assert.NoError(t, err)
+
+	c1, c2 := q.Consumer(), q.Consumer()
+	taken := make(chan []byte, 1)
+	go func() {
+		vs, _ := c2.Transaction().TakeN(1, time.Second)
+		if vs == nil {
+			taken <- nil
+			return
+		}
+		taken <- vs[0]
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	v, err := c1.Transaction().Take()
+	assert.NoError(t, err)
+	assert.Nil(t, v, "waiting consumer should be served first")
+	assert.Equal(t, []byte("a"), <-taken)
+
+	// Consumers are served immediately when no others are waiting
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+	v, err = c1.Transaction().Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), v)
+}
+
+// TestQueueTakeRate tests that takes wait for the queue's take rate limit.
+func TestQueueTakeRate(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{
+		TakeRate:  10,
+		TakeBurst: 2,
+	})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, tx.Put([]byte{byte(i)}))
+	}
+	assert.NoError(t, tx.Commit())
+
+	vs, err := tx.TakeN(5, 0)
+	assert.NoError(t, err)
+	assert.Len(t, vs, 2, "takes should be limited to burst")
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Nil(t, v, "takes should not exceed rate")
+
+	start := time.Now()
+	vs, err = tx.TakeN(1, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, vs, 1)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond,
+		"take should wait for rate limit")
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, q.Size())
+}
+
+// TestQueuePutRate tests that puts are limited by the queue's put rate, and
+// that PutWait waits for the rate limit and capacity.
+func TestQueuePutRate(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{
+		MaxQueue: 2,
+		PutRate:  10,
+		PutBurst: 1,
+	})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.Equal(t, ErrRateLimited, tx.Commit())
+	assert.NoError(t, tx.Close())
+
+	start := time.Now()
+	assert.NoError(t, q.PutWait([]byte("b"), time.Second))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond,
+		"put should wait for rate limit")
+	assert.Equal(t, 2, q.Size())
+
+	// Wait for capacity
+	assert.Equal(t, ErrInsufficientCapacity,
+		q.PutWait([]byte("c"), 200*time.Millisecond))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tx := q.Transaction()
+		tx.Take()
+		tx.Commit()
+	}()
+	assert.NoError(t, q.PutWait([]byte("c"), time.Second))
+	assert.Equal(t, 2, q.Size())
+}
+
+// TestQueueMoveTo tests that items can be moved between queues.
+func TestQueueMoveTo(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	src, err := db.Queue("src")
+	assert.NoError(t, err)
+	dst, err := db.Queue("dst")
+	assert.NoError(t, err)
+	other, err := db.Queue("other")
+	assert.NoError(t, err)
+
+	tx := src.Transaction()
+	assert.NoError(t, tx.PutMessage(&Message{
+		Value:   []byte("a"),
+		Headers: map[string]string{"k": "v"},
+	}))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.Commit())
+
+	n, err := src.MoveTo(dst, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 1, src.Size())
+	assert.Equal(t, 2, dst.Size())
+	m, err := dst.Transaction().TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), m.Value)
+	assert.Equal(t, map[string]string{"k": "v"}, m.Headers)
+
+	// Moves within a transaction only happen on commit
+	n, err = tx.MoveTo(dst, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = tx.MoveTo(other, 1, 0)
+	assert.Equal(t, ErrMoveDestination, err)
+	assert.Equal(t, 2, dst.Len())
+	assert.NoError(t, tx.Close())
+	assert.Equal(t, 1, src.Size(), "closed txn should not move items")
+	assert.Equal(t, 2, dst.Len())
+
+	n, err = tx.MoveTo(dst, 1, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 0, src.Len())
+	assert.Equal(t, 3, dst.Len())
+}
+
+// TestQueuePurgeFunc tests that only matching items are purged.
+func TestQueuePurgeFunc(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for _, v := range []string{"keep1", "drop1", "keep2", "drop2"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	assert.NoError(t, tx.PutDelay([]byte("drop3"), time.Hour))
+	assert.NoError(t, tx.Commit())
+
+	n, err := q.PurgeFunc(func(k, v []byte) bool {
+		return strings.HasPrefix(string(v), "drop")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n, "only available items should be purged")
+	assert.Equal(t, 2, q.Size())
+	assert.Equal(t, 3, q.Len())
+
+	vs, err := tx.TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("keep1"), []byte("keep2")}, vs)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueIterator tests that items are iterated in the order they would be
+// taken, without being taken.
+func TestQueueIterator(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.PutPriority([]byte("b"), 1))
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.Commit())
+
+	it, err := q.Iterator()
+	assert.NoError(t, err)
+
+	// Changes after the iterator is created are not visible
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), v)
+	assert.NoError(t, tx.Commit())
+
+	values := []string{}
+	for it.Next() {
+		values = append(values, string(it.Message().Value))
+	}
+	assert.NoError(t, it.Err())
+	it.Close()
+	assert.Equal(t, []string{"b", "a", "c"}, values)
+
+	values = []string{}
+	assert.NoError(t, q.ForEach(func(m *Message) error {
+		values = append(values, string(m.Value))
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "c"}, values)
+	assert.Equal(t, 2, q.Size(), "items should not be taken")
+}
+
+// TestQueueLIFO tests that the newest items are taken first from a LIFO
+// queue, subject to priority.
+func TestQueueLIFO(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{LIFO: true})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.PutPriority([]byte("b"), 1))
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.Put([]byte("d")))
+	assert.NoError(t, tx.Commit())
+
+	vs, err := tx.TakeN(4, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte("b"), []byte("d"), []byte("c"), []byte("a"),
+	}, vs)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueRecurring tests that recurring jobs put items on schedule, and are
+// restored when the queue is reopened.
+func TestQueueRecurring(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	// Weekdays every 15 minutes during working hours
+	c, err := internal.ParseCron("*/15 9-17 * * 1-5")
+	assert.NoError(t, err)
+	sat := time.Date(2024, 1, 6, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC), c.Next(sat))
+	mon := time.Date(2024, 1, 8, 9, 7, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 1, 8, 9, 15, 0, 0, time.UTC), c.Next(mon))
+
+	assert.Error(t, q.AddRecurring("bad", "60 * * * *", []byte("x")))
+	assert.NoError(t, q.AddRecurring("tick", "@hourly", []byte("tick")))
+	assert.NoError(t, q.AddRecurring("tock", "* * * * *", []byte("tock")))
+	assert.Equal(t, []string{"tick", "tock"}, q.Recurring())
+
+	// Bring the job forward rather than waiting for it
+	q.mutex.Lock()
+	q.jobs["tick"].next = time.Now()
+	q.resetCron()
+	q.mutex.Unlock()
+	for i := 0; i < 100 && q.Size() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	v, err := q.Transaction().Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("tick"), v)
+
+	assert.NoError(t, q.RemoveRecurring("tock"))
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tick"}, q.Recurring())
+	assert.True(t, q.jobs["tick"].next.After(time.Now()),
+		"next run should be restored")
+}
+
+// TestQueueMessageGroups tests that items of a message group are taken in
+// order, one at a time.
+func TestQueueMessageGroups(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutGroup([]byte("a1"), "a"))
+	assert.NoError(t, tx.PutGroup([]byte("a2"), "a"))
+	assert.NoError(t, tx.PutGroup([]byte("b1"), "b"))
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 3, q.Size(), "only the first item of each group is available")
+	assert.Equal(t, 4, q.Len())
+
+	vs, err := tx.TakeN(4, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a1"), []byte("b1"), []byte("c")}, vs)
+	assert.NoError(t, tx.Close())
+	vs, err = tx.TakeN(4, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a1"), []byte("b1"), []byte("c")}, vs,
+		"discarded items should hold their groups")
+	assert.Equal(t, 0, q.Size())
+	assert.NoError(t, tx.Commit())
+
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a2"), m.Value)
+	assert.Equal(t, "a", m.Group)
+	assert.NoError(t, tx.Commit())
+
+	// Groups are restored when the queue is reopened
+	assert.NoError(t, tx.PutGroup([]byte("a3"), "a"))
+	assert.NoError(t, tx.PutGroup([]byte("a4"), "a"))
+	assert.NoError(t, tx.Commit())
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, 2, q.Len())
+}
+
+// TestQueueCompact tests that queues are compacted in the background once
+// enough items have been removed.
+func TestQueueCompact(t *testing.T) {
+	path := "test-compact.db"
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	defer Destroy(path)
+	defer db.Close()
+
+	q, err := db.QueueWithOptions("test", &QueueOptions{
+		CompactInterval:  10 * time.Millisecond,
+		CompactThreshold: 3,
+	})
+	assert.NoError(t, err)
+	assert.True(t, q.Capabilities().Has(backend.CapCompact))
+
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	assert.NoError(t, tx.Commit())
+
+	_, err = tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	time.Sleep(50 * time.Millisecond)
+	q.mutex.Lock()
+	assert.Equal(t, 2, q.removals, "compaction should wait for threshold")
+	q.mutex.Unlock()
+
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	time.Sleep(50 * time.Millisecond)
+	q.mutex.Lock()
+	assert.Equal(t, 0, q.removals, "queue should have been compacted")
+	q.mutex.Unlock()
+
+	assert.Equal(t, 1, q.Len())
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("d"), v)
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, q.Compact())
+}
+
+// TestQueueSchema tests that schema versions are stored with items, and
+// survive items being discarded and taken again.
+func TestQueueSchema(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutSchema([]byte("v1"), 1))
+	assert.NoError(t, tx.PutMessage(&Message{
+		Value:   []byte("v2"),
+		Headers: map[string]string{"k": "v"},
+		Schema:  2,
+	}))
+	assert.NoError(t, tx.Put([]byte("none")))
+	assert.NoError(t, tx.Commit())
+
+	ms, err := tx.TakeMessages(3, 0)
+	assert.NoError(t, err)
+	assert.Len(t, ms, 3)
+	assert.Equal(t, uint8(1), ms[0].Schema)
+	assert.Equal(t, uint8(2), ms[1].Schema)
+	assert.Equal(t, map[string]string{"k": "v"}, ms[1].Headers)
+	assert.Equal(t, uint8(0), ms[2].Schema)
+	assert.NoError(t, tx.Close())
+
+	ms, err = tx.TakeMessages(3, 0)
+	assert.NoError(t, err)
+	assert.Len(t, ms, 3)
+	assert.Equal(t, uint8(1), ms[0].Schema)
+	assert.Equal(t, 1, ms[0].Attempts)
+	assert.Equal(t, uint8(2), ms[1].Schema)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueReceive tests that items received without a transaction are
+// removed when acknowledged, and returned to the queue when not.
+func TestQueueReceive(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	// Times out if no items are available
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	d, err := q.Receive(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, d)
+
+	// Waits for an item to be put
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		tx := q.Transaction()
+		tx.Put([]byte("a"))
+		tx.Put([]byte("b"))
+		tx.Commit()
+	}()
+	d, err = q.Receive(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), d.Value)
+	assert.NoError(t, d.Nack())
+	assert.Equal(t, 2, q.Size())
+
+	d, err = q.Receive(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), d.Value)
+	assert.Equal(t, 1, d.Attempts)
+	assert.NoError(t, d.Ack())
+	assert.Equal(t, 1, q.Len())
+
+	// Cancellation stops waiting
+	d, err = q.Receive(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), d.Value)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = q.Receive(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.NoError(t, d.Ack())
+	assert.Equal(t, 0, q.Len())
+}
+
+// TestQueueIdempotent tests that items already processed are skipped when
+// delivered again.
+func TestQueueIdempotent(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{Idempotent: true})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutDedup([]byte("a"), "order-1"))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+	ms, err := tx.TakeMessages(2, 0)
+	assert.NoError(t, err)
+	assert.Len(t, ms, 2)
+	assert.NoError(t, tx.Commit())
+
+	// A producer recovering from a crash puts the same item again
+	assert.NoError(t, tx.PutDedup([]byte("a"), "order-1"))
+	assert.NoError(t, tx.PutDedup([]byte("c"), "order-2"))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, q.Len())
+	v, err := tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("c")}, v, "processed item should be skipped")
+	assert.Equal(t, 1, q.Len())
+	assert.NoError(t, tx.Close())
+
+	// Discarded items are not recorded as processed
+	v, err = tx.TakeN(1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("c")}, v)
+	assert.NoError(t, tx.Commit())
+
+	// Acknowledged leases are recorded too
+	assert.NoError(t, tx.PutDedup([]byte("d"), "order-3"))
+	assert.NoError(t, tx.Commit())
+	ls, err := q.Lease(1, 0, time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, ls[0].Ack())
+	assert.NoError(t, tx.PutDedup([]byte("d"), "order-3"))
+	assert.NoError(t, tx.Commit())
+	v, err = tx.TakeN(1, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+	assert.Equal(t, 0, q.Len())
+
+	n, err := q.PruneLedger(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = q.PruneLedger(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+}
+
+// TestQueuePoison tests that undecodable items, and items exceeding the
+// maximum attempts, are quarantined in the poison queue.
+func TestQueuePoison(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	bucket, err := db.Bucket("test")
+	assert.NoError(t, err)
+	corrupt := func(k []byte) {
+		assert.NoError(t, bucket.Batch(func(b backend.Batch) error {
+			return b.Put(k, []byte{0xff})
+		}))
+	}
+	opts := &QueueOptions{Quarantine: true, MaxAttempts: 1}
+
+	// Corrupt items are quarantined when the queue is opened
+	corrupt(internal.Entry{ID: 1000}.Key())
+	q, err := db.QueueWithOptions("test", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, 1, q.Poison().Len())
+	ptx := q.Poison().Transaction()
+	m, err := ptx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff}, m.Value)
+	assert.Equal(t, "corrupt", m.Headers[PoisonReasonHeader])
+	assert.NoError(t, ptx.Commit())
+
+	// ...and when taken
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, q.ForEach(func(m *Message) error {
+		corrupt([]byte(m.ID))
+		return nil
+	}))
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, 1, q.Poison().Len())
+
+	// Items exceeding their attempts are quarantined, keeping their headers
+	assert.NoError(t, tx.PutMessage(&Message{
+		Value:   []byte("b"),
+		Headers: map[string]string{"k": "v"},
+	}))
+	assert.NoError(t, tx.Commit())
+	v, err = tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), v)
+	assert.NoError(t, tx.Close())
+	assert.Equal(t, 0, q.Len())
+	ms, err := ptx.TakeMessages(2, 0)
+	assert.NoError(t, err)
+	assert.Len(t, ms, 2)
+	assert.Equal(t, "corrupt", ms[0].Headers[PoisonReasonHeader])
+	assert.Equal(t, map[string]string{
+		PoisonReasonHeader: "max-attempts",
+		"k":                "v",
+	}, ms[1].Headers)
+}
+
+// TestTxnAck tests that items taken in a batch can be acknowledged and
+// returned individually.
+func TestTxnAck(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	assert.NoError(t, tx.Commit())
+
+	ms, err := tx.TakeMessages(3, 0)
+	assert.NoError(t, err)
+	assert.Len(t, ms, 3)
+	assert.NoError(t, tx.Ack(ms[0].ID))
+	assert.Equal(t, 2, q.Len())
+	assert.NoError(t, tx.Nack(ms[1].ID))
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, ErrNotTaken, tx.Ack(ms[0].ID, ms[2].ID),
+		"acknowledged items are no longer held")
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Len())
+
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), m.Value)
+	assert.Equal(t, 1, m.Attempts)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 0, q.Len())
+}
+
+// TestLeaseRenew tests that renewed leases keep items hidden beyond their
+// original deadline, including when the queue is reopened.
+func TestLeaseRenew(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+
+	leases, err := q.Lease(2, 0, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Len(t, leases, 2)
+	deadline := leases[0].Deadline()
+	assert.NoError(t, leases[0].Renew(time.Minute))
+	assert.True(t, leases[0].Deadline().After(deadline))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, q.Size(), "only the unrenewed item should return")
+	assert.Equal(t, ErrLeaseExpired, leases[1].Renew(time.Minute))
+
+	// Renewed deadline is stored
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, 1, q.Scheduled())
+
+	assert.NoError(t, q.ForEach(func(m *Message) error {
+		assert.Equal(t, 1, m.Attempts, "renewal should not count an attempt")
+		return nil
+	}))
+	assert.NoError(t, leases[0].Ack())
+}
+
+// TestTxnTakeWhere tests that only items matching a selector are taken,
+// leaving others in the queue.
+func TestTxnTakeWhere(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	put := func(v, typ string) {
+		tx := q.Transaction()
+		assert.NoError(t, tx.PutMessage(&Message{
+			Value:   []byte(v),
+			Headers: map[string]string{"type": typ},
+		}))
+		assert.NoError(t, tx.Commit())
+	}
+	email := func(h map[string]string) bool {
+		return h["type"] == "email"
+	}
+	put("a", "email")
+	put("b", "sms")
+	put("c", "email")
+
+	tx := q.Transaction()
+	m, err := tx.TakeWhere(email, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), m.Value)
+	m, err = tx.TakeWhere(email, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c"), m.Value)
+	m, err = tx.TakeWhere(email, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+	assert.Equal(t, 1, q.Size(), "other items should remain")
+	assert.NoError(t, tx.Commit())
+
+	// Waits for a matching item
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		put("d", "sms")
+		put("e", "email")
+	}()
+	m, err = tx.TakeWhere(email, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("e"), m.Value)
+	assert.NoError(t, tx.Commit())
+
+	vs, err := tx.TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("d")}, vs)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueSubscribe tests that subscribers acknowledge handled items,
+// retry failed items, and stop when cancelled.
+func TestQueueSubscribe(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, tx.Put([]byte(strconv.Itoa(i))))
+	}
+	assert.NoError(t, tx.Commit())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var mutex sync.Mutex
+	seen := map[string]int{}
+	handler := func(m *Message) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		v := string(m.Value)
+		seen[v]++
+		if len(seen) == 10 && seen["3"] == 2 {
+			cancel()
+		}
+		if v == "3" && m.Attempts == 0 {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	err = q.Subscribe(ctx, handler, &SubscribeOptions{Concurrency: 3})
+	assert.NoError(t, err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Len(t, seen, 10)
+	assert.Equal(t, 2, seen["3"], "failed item should be retried")
+	assert.Equal(t, 0, q.Len())
+}
+
+// TestQueueChan tests that items are delivered on a channel until the
+// context is cancelled.
+func TestQueueChan(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	assert.NoError(t, tx.Commit())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := q.Chan(ctx)
+	d := <-c
+	assert.Equal(t, []byte("a"), d.Value)
+	assert.NoError(t, d.Ack())
+	d = <-c
+	assert.Equal(t, []byte("b"), d.Value)
+	assert.NoError(t, d.Nack())
+
+	select {
+	case d = <-c:
+		assert.Equal(t, []byte("b"), d.Value)
+		assert.NoError(t, d.Ack())
+	case <-time.After(time.Second):
+		t.Fatal("item not delivered")
+	}
+
+	cancel()
+	for d := range c {
+		// Delivered as cancelled; return as if undelivered
+		assert.NoError(t, d.txn.untake())
+	}
+	assert.Equal(t, 1, q.Len())
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c"), m.Value)
+	assert.Equal(t, 0, m.Attempts, "undelivered item should not count an attempt")
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueMessages tests that items are acknowledged as iteration
+// continues, and returned when it stops.
+func TestQueueMessages(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	assert.NoError(t, tx.Commit())
+
+	ctx := context.Background()
+	values := []string{}
+	for m, err := range q.Messages(ctx) {
+		assert.NoError(t, err)
+		values = append(values, string(m.Value))
+		if len(values) == 2 {
+			break
+		}
+	}
+	assert.Equal(t, []string{"a", "b"}, values)
+	assert.Equal(t, 2, q.Len(), "item should be returned on break")
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	values = []string{}
+	for m, err := range q.Messages(ctx) {
+		assert.NoError(t, err)
+		values = append(values, string(m.Value))
+	}
+	assert.Equal(t, []string{"b", "c"}, values)
+	assert.Equal(t, 0, q.Len())
+}
+
+// TestTxnContext tests that blocking takes and commits stop waiting when
+// their context is done.
+func TestTxnContext(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{
+		MaxQueue: 1,
+		Overflow: OverflowBlock,
+	})
+	assert.NoError(t, err)
+
+	// Cancelled while waiting for items
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	tx := q.Transaction()
+	vs, err := tx.TakeNContext(ctx, 1)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, vs)
+	ls, err := q.LeaseContext(ctx, 1, time.Minute)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, ls)
+
+	// Items available before the deadline are returned
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.CommitContext(context.Background()))
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	vs, err = tx.TakeNContext(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, vs)
+	assert.NoError(t, tx.Close())
+
+	vs, err = tx.TakeExactlyContext(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, vs)
+	assert.NoError(t, tx.Close())
+
+	// Deadline passes while waiting for room in a full queue
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	tx2 := q.Transaction()
+	assert.NoError(t, tx2.Put([]byte("b")))
+	assert.Equal(t, context.DeadlineExceeded, tx2.CommitContext(ctx))
+	assert.Equal(t, 1, q.Len())
+	assert.NoError(t, tx2.Close())
+
+	ms, err := tx.TakeMessagesContext(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), ms[0].Value)
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueClose tests that closing a queue unblocks waiting takers, and that
+// closing the DB closes its queues.
+func TestQueueClose(t *testing.T) {
+	path := "test-close.db"
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	defer Destroy(path)
+
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+
+	// Close while a take is waiting
+	errs := make(chan error)
+	go func() {
+		_, err := q.Transaction().TakeExactly(2, time.Minute)
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, q.Close())
+	assert.Equal(t, ErrClosed, <-errs)
+	assert.True(t, q.Closed())
+	assert.NoError(t, q.Close())
+
+	_, err = q.Transaction().Take()
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, q.Transaction().Put([]byte("c")))
+	assert.Equal(t, ErrClosed, tx.Commit())
+
+	// Items remain, including those held when the queue was closed
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Size())
+	assert.NoError(t, q.Transaction().Put([]byte("c")))
+
+	db.Close()
+	assert.True(t, q.Closed())
+	_, err = q.Transaction().Take()
+	assert.Equal(t, ErrClosed, err)
+}
+
+// TestMultiTxn tests that transactions spanning queues are committed and
+// reverted as a whole.
+func TestMultiTxn(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	in, err := db.Queue("in")
+	assert.NoError(t, err)
+	out, err := db.QueueWithOptions("out", &QueueOptions{MaxQueue: 2})
+	assert.NoError(t, err)
+
+	tx := in.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+
+	// Take from one queue and put into another
+	mtx := db.Transaction()
+	v, err := mtx.Queue(in).Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+	assert.NoError(t, mtx.Queue(out).Put([]byte("A")))
+	assert.Equal(t, 0, out.Size())
+	assert.NoError(t, mtx.Commit())
+	assert.Equal(t, 1, in.Len())
+	assert.Equal(t, 1, out.Size())
+
+	// Nothing is taken if the other queue cannot accept the items put
+	assert.NoError(t, mtx.Queue(out).Put([]byte("B")))
+	n, err := mtx.Queue(in).MoveTo(out, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, ErrInsufficientCapacity, mtx.Queue(in).Commit())
+	assert.NoError(t, mtx.Close())
+	assert.Equal(t, 1, in.Size())
+	assert.Equal(t, 1, out.Size())
+
+	other, err := Open("mem://")
+	assert.NoError(t, err)
+	defer other.Close()
+	mtx = other.Transaction()
+	assert.NoError(t, mtx.Queue(in).Put([]byte("c")))
+	assert.Equal(t, ErrForeignQueue, mtx.Commit())
+}
+
+// TestTxnSavepoint tests that transactions can be partially rolled back.
+func TestTxnSavepoint(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	dst, err := db.Queue("dst")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	assert.NoError(t, tx.Commit())
+
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+	assert.NoError(t, tx.Put([]byte("x")))
+	sp := tx.Savepoint()
+
+	// Roll back a take, a move and a put made after the savepoint
+	v, err = tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), v)
+	n, err := tx.MoveTo(dst, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, tx.Put([]byte("y")))
+	later := tx.Savepoint()
+	assert.NoError(t, tx.RollbackTo(sp))
+	assert.Equal(t, 2, q.Size())
+	assert.Equal(t, ErrInvalidSavepoint, tx.RollbackTo(later))
+
+	// The savepoint may be rolled back to again
+	assert.NoError(t, tx.Put([]byte("z")))
+	assert.NoError(t, tx.RollbackTo(sp))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, ErrInvalidSavepoint, tx.RollbackTo(sp))
+
+	vs, err := tx.TakeN(10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c"), []byte("x")}, vs)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 0, dst.Len())
+}
+
+// TestTxnTimeout tests that transactions holding taken items for too long are
+// discarded.
+func TestTxnTimeout(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{
+		TxnTimeout: 50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+	assert.NoError(t, tx.Put([]byte("b")))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, ErrTxnTimeout, tx.Commit())
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Len())
+
+	// Items are retried as if the transaction had been closed
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, m.Attempts)
+
+	// Committing in time stops the timeout
+	assert.NoError(t, tx.Commit())
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, tx.Commit())
+
+	// Timeouts may be disabled
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.Commit())
+	tx.SetTimeout(0)
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, q.Size())
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 0, q.Len())
+}
+
+// TestTxnReadYourWrites tests that transactions can take the items they put.
+func TestTxnReadYourWrites(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("q")))
+	assert.NoError(t, tx.Commit())
+
+	// Puts are invisible unless enabled
+	assert.NoError(t, tx.Put([]byte("a")))
+	vs, err := tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("q")}, vs)
+	assert.NoError(t, tx.Close())
+
+	// Staged puts are taken first, and never written
+	tx.SetReadYourWrites(true)
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.PutPriority([]byte("b"), 1))
+	vs, err = tx.TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("a"), []byte("q")}, vs)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 0, q.Len())
+
+	// Staged puts are kept if not all items can be taken
+	assert.NoError(t, tx.Put([]byte("c")))
+	vs, err = tx.TakeExactly(2, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, vs)
+	sp := tx.Savepoint()
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c"), v)
+	assert.NoError(t, tx.RollbackTo(sp))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Len())
+}
+
+// TestTxnLimits tests that transactions cannot exceed their size limits.
+func TestTxnLimits(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{
+		TxnLimits: TxnLimits{MaxPuts: 3, MaxTakes: 2},
+	})
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+	}
+	err = tx.Put([]byte("d"))
+	assert.Equal(t, &TxnLimitError{Limit: "puts", Max: 3}, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 3, q.Len())
+
+	// Takes are capped at the limit
+	vs, err := tx.TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Len(t, vs, 2)
+	_, err = tx.Take()
+	assert.Equal(t, &TxnLimitError{Limit: "takes", Max: 2}, err)
+	assert.NoError(t, tx.Commit())
+	_, err = tx.TakeExactly(3, 0)
+	assert.Equal(t, &TxnLimitError{Limit: "takes", Max: 2}, err)
+
+	tx.SetLimits(TxnLimits{MaxBytes: 20})
+	assert.NoError(t, tx.Put(make([]byte, 10)))
+	err = tx.Put(make([]byte, 10))
+	assert.Equal(t, &TxnLimitError{Limit: "bytes", Max: 20}, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, q.Len())
+}
+
+// TestTxnPending tests that the items staged by a transaction are reported.
+func TestTxnPending(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.Equal(t, 0, tx.Pending().Puts)
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.PutDelay([]byte("b"), time.Hour))
+	p := tx.Pending()
+	assert.Equal(t, 2, p.Puts)
+	assert.Equal(t, 0, p.Takes)
+	assert.True(t, p.Bytes > 2)
+	assert.Len(t, p.PutIDs, 2)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, Pending{PutIDs: []MessageID{}, TakeIDs: []MessageID{}}, tx.Pending())
+
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	p = tx.Pending()
+	assert.Equal(t, 1, p.Takes)
+	assert.Equal(t, []MessageID{m.ID}, p.TakeIDs)
+	assert.NoError(t, tx.Close())
+}
+
+// TestTxnHooks tests that callbacks are made when transactions are committed
+// and discarded.
+func TestTxnHooks(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	veto := errors.New("veto")
+	var before, committed, discarded []int
+	tx := q.Transaction()
+	tx.BeforeCommit(func(p Pending) error {
+		before = append(before, p.Puts)
+		if p.Puts > 1 {
+			return veto
+		}
+		return nil
+	})
+	tx.OnCommit(func(p Pending) {
+		committed = append(committed, p.Puts+p.Takes)
+	})
+	tx.OnDiscard(func(p Pending) {
+		discarded = append(discarded, p.Puts+p.Takes)
+	})
+
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.Equal(t, veto, tx.Commit())
+	assert.Equal(t, 1, q.Len())
+	assert.NoError(t, tx.Close())
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Close())
+	assert.NoError(t, tx.Close())
+
+	assert.Equal(t, []int{1, 2}, before)
+	assert.Equal(t, []int{1}, committed)
+	assert.Equal(t, []int{2, 1}, discarded)
+	assert.Equal(t, 1, q.Size())
+}
+
+// TestTxnPrepare tests that prepared transactions can be committed or rolled
+// back, and survive the queue being reopened.
+func TestTxnPrepare(t *testing.T) {
+	path := "test-txn-prepare.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.Commit())
+
+	// Prepared puts are not visible until committed
+	committed := 0
+	tx.OnCommit(func(p Pending) { committed += p.Puts + p.Takes })
+	assert.NoError(t, tx.Put([]byte("c")))
+	token, err := tx.Prepare()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{token}, q.Prepared())
+	assert.Equal(t, 2, q.Size())
+	assert.NoError(t, q.CommitPrepared(token))
+	assert.Equal(t, ErrNotPrepared, q.CommitPrepared(token))
+	assert.Equal(t, 3, q.Size())
+	assert.Equal(t, 1, committed)
+
+	// Prepared takes hold items until rolled back
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	token, err = tx.Prepare()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Size())
+	assert.NoError(t, q.RollbackPrepared(token))
+	assert.Equal(t, ErrNotPrepared, q.RollbackPrepared(token))
+	assert.Equal(t, 3, q.Size())
+	assert.Empty(t, q.Prepared())
+
+	// Ensure prepared transactions survive reopening
+	v, err = tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	assert.NoError(t, tx.Put([]byte("d")))
+	token, err = tx.Prepare()
+	assert.NoError(t, err)
+	db.Close()
+
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{token}, q.Prepared())
+	assert.Equal(t, 2, q.Size())
+	assert.NoError(t, q.CommitPrepared(token))
+	assert.Empty(t, q.Prepared())
+
+	rx := q.Transaction()
+	vs, err := rx.TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c"), []byte("d")}, vs)
+	assert.NoError(t, rx.Commit())
+}
+
+// TestQueueUpdate tests that Update commits or discards its transaction
+// according to the result of the closure.
+func TestQueueUpdate(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	assert.NoError(t, q.Update(func(tx *Txn) error {
+		return tx.Put([]byte("a"))
+	}))
+	assert.Equal(t, 1, q.Size())
+
+	fail := errors.New("fail")
+	assert.Equal(t, fail, q.Update(func(tx *Txn) error {
+		v, err := tx.Take()
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(v))
+		assert.NoError(t, tx.Put([]byte("b")))
+		return fail
+	}))
+	assert.Equal(t, 1, q.Size())
+
+	assert.Panics(t, func() {
+		q.Update(func(tx *Txn) error {
+			tx.Take()
+			panic("oops")
+		})
+	})
+	assert.Equal(t, 1, q.Size())
+	assert.Equal(t, 1, q.Len())
+}
+
+// TestTxnPutAll tests that many items can be put at once, each with its own
+// options.
+func TestTxnPutAll(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{RejectDuplicates: true})
+	assert.NoError(t, err)
+
+	values := make([][]byte, 2500)
+	for i := range values {
+		values[i] = []byte(strconv.Itoa(i))
+	}
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutAll(values))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, len(values), q.Size())
+	vs, err := tx.TakeN(len(values), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, values, vs)
+	assert.NoError(t, tx.Commit())
+
+	assert.NoError(t, tx.PutItems([]Item{
+		{Value: []byte("low"), DedupKey: "a"},
+		{Value: []byte("high"), Priority: 1, Headers: map[string]string{"k": "v"}},
+		{Value: []byte("later"), At: time.Now().Add(time.Hour)},
+	}))
+	assert.Equal(t, ErrDuplicate, tx.PutItems([]Item{
+		{Value: []byte("b"), DedupKey: "b"},
+		{Value: []byte("a"), DedupKey: "a"},
+	}))
+	assert.Equal(t, 3, tx.Pending().Puts)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, q.Size())
+	assert.Equal(t, 1, q.Scheduled())
+
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "high", string(m.Value))
+	assert.Equal(t, "v", m.Headers["k"])
+}
+
+// TestTxnPutItem tests that the ID returned when putting an item identifies
+// it once taken.
+func TestTxnPutItem(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	id, err := tx.PutItem(Item{Value: []byte("a"), DedupKey: "a"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, []MessageID{id}, tx.Pending().PutIDs)
+	dup, err := tx.PutItem(Item{Value: []byte("b"), DedupKey: "a"})
+	assert.NoError(t, err)
+	assert.Empty(t, dup)
+	assert.NoError(t, tx.Commit())
+
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, id, m.ID)
+	assert.Equal(t, "a", string(m.Value))
+	assert.NoError(t, tx.Commit())
+}
+
+// TestQueueCancel tests that committed items can be withdrawn until taken.
+func TestQueueCancel(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	now, err := tx.PutItem(Item{Value: []byte("now"), DedupKey: "now"})
+	assert.NoError(t, err)
+	later, err := tx.PutItem(Item{Value: []byte("later"), At: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	first, err := tx.PutItem(Item{Value: []byte("first"), Group: "g"})
+	assert.NoError(t, err)
+	second, err := tx.PutItem(Item{Value: []byte("second"), Group: "g"})
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 4, q.Len())
+
+	assert.NoError(t, q.Cancel(now))
+	assert.NoError(t, q.Cancel(later))
+	assert.NoError(t, q.Cancel(second))
+	assert.Equal(t, ErrNotQueued, q.Cancel(now))
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, 0, q.Scheduled())
+
+	// Deduplication keys are released
+	assert.NoError(t, tx.PutDedup([]byte("again"), "now"))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 2, q.Size())
+
+	// Taken items cannot be cancelled
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, first, m.ID)
+	assert.Equal(t, ErrNotQueued, q.Cancel(first))
+	assert.NoError(t, tx.Close())
+	assert.NoError(t, q.Cancel(first))
+	assert.Equal(t, 1, q.Len())
+}
+
+// TestQueueDirect tests putting and taking items without a transaction.
+func TestQueueDirect(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	assert.NoError(t, q.Put([]byte("a")))
+	assert.NoError(t, q.Put([]byte("b")))
+	assert.Equal(t, 2, q.Len())
+
+	v, err := q.Take(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	assert.Equal(t, 1, q.Len())
+
+	tx := q.Transaction()
+	v, err = tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(v))
+	assert.NoError(t, tx.Commit())
+
+	v, err = q.Take(0)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Put([]byte("c"))
+	}()
+	v, err = q.Take(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(v))
+	assert.Equal(t, 0, q.Len())
+
+	assert.NoError(t, q.Close())
+	assert.Equal(t, ErrClosed, q.Put([]byte("d")))
+	_, err = q.Take(0)
+	assert.Equal(t, ErrClosed, err)
+}
+
+// TestTxnCommitAsync tests that transactions can be committed in the
+// background, in order.
+func TestTxnCommitAsync(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.QueueWithOptions("test", &QueueOptions{MaxQueue: 2})
+	assert.NoError(t, err)
+
+	results := make(chan error, 3)
+	tx := q.Transaction()
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, tx.Put([]byte(v)))
+		tx.CommitAsync(func(err error) {
+			results <- err
+		})
+		assert.Equal(t, 0, tx.Pending().Puts)
+	}
+	assert.NoError(t, <-results)
+	assert.NoError(t, <-results)
+	assert.Equal(t, ErrInsufficientCapacity, <-results)
+	assert.Equal(t, 2, q.Size())
+
+	// Failed commits return taken items to the queue
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	assert.NoError(t, tx.Put([]byte("d")))
+	assert.NoError(t, tx.Put([]byte("e")))
+	tx.CommitAsync(func(err error) {
+		results <- err
+	})
+	assert.Equal(t, ErrInsufficientCapacity, <-results)
+	assert.Equal(t, 2, q.Size())
+
+	vs, err := tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, vs)
+	tx.CommitAsync(nil)
+	assert.Eventually(t, func() bool {
+		return q.Len() == 0
+	}, time.Second, time.Millisecond)
+}
+
+// TestTxnDurability tests that commits may override the queue's durability.
+func TestTxnDurability(t *testing.T) {
+	path := "test-txn-durability.db"
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.QueueWithOptions("test", &QueueOptions{NoSync: true})
+	assert.NoError(t, err)
+	assert.True(t, q.Capabilities().Has(backend.CapNoSync))
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.NoError(t, tx.CommitSync())
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.CommitNoSync())
+	db.Close()
+
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.Queue("test")
+	assert.NoError(t, err)
+	vs, err := q.Transaction().TakeN(3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, vs)
+}
+
+// TestQueueJournalTakes tests that items taken when the queue is closed are
+// returned with an attempt counted when it is reopened.
+func TestQueueJournalTakes(t *testing.T) {
+	path := "test-queue-journal-takes.db"
+	opts := &QueueOptions{JournalTakes: true}
+
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	q, err := db.QueueWithOptions("test", opts)
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutAll([][]byte{[]byte("a"), []byte("b"), []byte("c")}))
+	assert.NoError(t, tx.Commit())
+	msgs, err := tx.TakeMessages(3, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Ack(msgs[0].ID))
+	assert.NoError(t, tx.Nack(msgs[1].ID))
+	ids, err := q.InFlight()
+	assert.NoError(t, err)
+	assert.Equal(t, []MessageID{msgs[2].ID}, ids)
+
+	// Abandon the transaction holding "c"
+	rx := q.Transaction()
+	m, err := rx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(m.Value))
+	assert.NoError(t, rx.Commit())
+	db.Close()
+
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err = db.QueueWithOptions("test", opts)
+	assert.NoError(t, err)
+	ids, err = q.InFlight()
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	rx = q.Transaction()
+	m, err = rx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(m.Value))
+	assert.Equal(t, 1, m.Attempts)
+	assert.NoError(t, rx.Commit())
+	assert.Equal(t, 0, q.Len())
+	ids, err = q.InFlight()
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+// TestQueueStats tests that the work done by transactions is counted.
+func TestQueueStats(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutAll([][]byte{[]byte("a"), []byte("b")}))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.NoError(t, tx.Close())
+	_, err = tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, q.Put([]byte("d")))
+
+	s := q.Stats()
+	assert.Equal(t, int64(3), s.Committed)
+	assert.Equal(t, int64(1), s.Discarded)
+	assert.Equal(t, int64(4), s.PutsStaged)
+	assert.Equal(t, int64(2), s.TakesStaged)
+	assert.Equal(t, int64(3), s.PutsCommitted)
+	assert.Equal(t, int64(2), s.TakesCommitted)
+	assert.True(t, s.CommitLatency > 0)
+	assert.True(t, s.CommitTime >= s.CommitLatency)
+	assert.Len(t, s.CommitBuckets, len(LatencyBuckets)+1)
+	n := int64(0)
+	for _, c := range s.CommitBuckets {
+		n += c
+	}
+	assert.Equal(t, s.Committed, n)
+	assert.Equal(t, int64(0), s.CommitErrors)
+
+	// Commits rejected for lack of room are counted as errors
+	full, err := db.QueueWithOptions("full", &QueueOptions{MaxQueue: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, full.Put([]byte("a")))
+	assert.Equal(t, ErrInsufficientCapacity, full.Put([]byte("b")))
+	tx = full.Transaction()
+	assert.NoError(t, tx.Put([]byte("c")))
+	assert.Equal(t, ErrInsufficientCapacity, tx.Commit())
+	assert.NoError(t, tx.Close())
+	assert.Equal(t, int64(2), full.Stats().CommitErrors)
+}
+
+func TestTxnConflict(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put([]byte("a")))
+
+	tx := q.Transaction()
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+
+	// Clearing the queue takes the item from under the transaction
+	assert.NoError(t, q.Clear())
+	assert.NoError(t, tx.Put([]byte("b")))
+	assert.Equal(t, ErrConflict, tx.Commit())
+
+	// The conflicting take is dropped, so the put can be committed alone
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 1, q.Len())
+
+	v, err = tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), v)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestDBQueues(t *testing.T) {
+	path := "test-db-queues.db"
+
+	err := Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	names, err := db.Queues()
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, err = db.Queue("orders")
+	assert.NoError(t, err)
+	_, err = db.Queue("emails")
+	assert.NoError(t, err)
+	_, err = db.Queue("orders")
+	assert.NoError(t, err)
+	db.Close()
+
+	// Queues are listed once reopened, without being opened again
+	db, err = Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	names, err = db.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"emails", "orders"}, names)
+}
+
+func TestDBDeleteQueue(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("jobs")
+	assert.NoError(t, err)
+	g, err := q.Group("workers")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put([]byte("a")))
+	assert.Equal(t, 1, g.Len())
+	other, err := db.Queue("other")
+	assert.NoError(t, err)
+	assert.NoError(t, other.Put([]byte("b")))
+
+	// Takes waiting on the queue are unblocked when it is deleted
+	done := make(chan error)
+	go func() {
+		_, err := q.Transaction().TakeN(1, time.Minute)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, db.DeleteQueue("jobs"))
+	assert.Equal(t, ErrClosed, <-done)
+	assert.True(t, q.Closed())
+	assert.True(t, g.Closed())
+
+	names, err := db.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other"}, names)
+
+	// Reopening the queue gives an empty queue without consumer groups
+	q, err = db.Queue("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+	assert.Empty(t, q.Groups())
+	assert.Equal(t, 1, other.Len())
+}
+
+func TestDBRenameQueue(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("old")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put([]byte("a")))
+	assert.NoError(t, q.Put([]byte("b")))
+	_, err = db.Queue("taken")
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrQueueExists, db.RenameQueue("old", "taken"))
+	assert.NoError(t, db.RenameQueue("old", "new"))
+	assert.True(t, q.Closed())
+
+	names, err := db.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new", "taken"}, names)
+
+	// The items are found in the renamed queue, in order
+	q, err = db.Queue("new")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Len())
+	v, err := q.Take(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+	v, err = q.Take(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), v)
+
+	q, err = db.Queue("old")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestDBQueueTree(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	queues := map[string]*Queue{}
+	for _, name := range []string{"emails", "emails/outbound", "emails/outbound/high", "emailsarchive", "sms"} {
+		q, err := db.Queue(name)
+		assert.NoError(t, err)
+		assert.NoError(t, q.Put([]byte(name)))
+		queues[name] = q
+	}
+
+	names, err := db.QueuesUnder("emails/outbound")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"emails/outbound", "emails/outbound/high"}, names)
+	names, err = db.QueuesUnder("emails/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"emails", "emails/outbound", "emails/outbound/high"}, names)
+
+	assert.NoError(t, db.ClearTree("emails"))
+	assert.Equal(t, 0, queues["emails"].Len())
+	assert.Equal(t, 0, queues["emails/outbound/high"].Len())
+	assert.Equal(t, 1, queues["emailsarchive"].Len())
+	assert.Equal(t, 1, queues["sms"].Len())
+
+	assert.NoError(t, db.DeleteTree("emails/outbound"))
+	assert.True(t, queues["emails/outbound"].Closed())
+	names, err = db.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"emails", "emailsarchive", "sms"}, names)
+}
+
+func TestDBSetConfig(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, ok, err := db.Config("jobs")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	c := Config{MaxQueue: 1, MaxAttempts: 1, DeadLetter: "dead"}
+	assert.NoError(t, db.SetConfig("jobs", c))
+	stored, ok, err := db.Config("jobs")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, c, stored)
+
+	// The stored configuration takes the place of the options given
+	q, err := db.QueueWithOptions("jobs", &QueueOptions{MaxQueue: 10})
+	assert.NoError(t, err)
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutAll([][]byte{[]byte("a"), []byte("b")}))
+	assert.Equal(t, ErrInsufficientCapacity, tx.Commit())
+	tx.Close()
+	assert.NoError(t, q.Put([]byte("a")))
+
+	// Exceeding the stored MaxAttempts moves the item to the stored
+	// dead-letter queue
+	tx = q.Transaction()
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Close())
+	assert.Equal(t, 0, q.Len())
+	dead, err := db.Queue("dead")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dead.Len())
+}
+
+func TestDBStats(t *testing.T) {
+	path := "test-db-stats.db"
+
+	err := Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	a, err := db.Queue("a")
+	assert.NoError(t, err)
+	b, err := db.Queue("b")
+	assert.NoError(t, err)
+	assert.NoError(t, a.Put([]byte("1")))
+	assert.NoError(t, a.Put([]byte("2")))
+	assert.NoError(t, b.Put([]byte("3")))
+
+	tx := a.Transaction()
+	defer tx.Close()
+	_, err = tx.Take()
+	assert.NoError(t, err)
+
+	s, err := db.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), s.Keys)
+	assert.Equal(t, 1, s.OpenTxns)
+	assert.Equal(t, 2, s.Queues["a"].Len)
+	assert.Equal(t, 1, s.Queues["a"].Available)
+	assert.Equal(t, 1, s.Queues["a"].OpenTxns)
+	assert.Equal(t, int64(2), s.Queues["a"].Committed)
+	assert.Equal(t, 1, s.Queues["b"].Len)
+	assert.Equal(t, 0, s.Queues["b"].OpenTxns)
+	assert.NotEmpty(t, s.Backend)
+}
+
+func TestDBBackup(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("jobs")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put([]byte("first")))
+	assert.NoError(t, q.Put([]byte("second")))
+
+	// Items held by open transactions are still backed up
+	tx := q.Transaction()
+	defer tx.Close()
+	_, err = tx.Take()
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, db.Backup(buf))
+	assert.True(t, bytes.HasPrefix(buf.Bytes(), []byte(backupMagic)))
+	assert.True(t, bytes.Contains(buf.Bytes(), []byte("jobs")))
+	assert.True(t, bytes.Contains(buf.Bytes(), []byte("first")))
+	assert.True(t, bytes.Contains(buf.Bytes(), []byte("second")))
+	assert.Equal(t, frameEnd, buf.Bytes()[buf.Len()-1])
+}
+
+func TestDBRestore(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("jobs")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Put([]byte("first")))
+	assert.NoError(t, q.Put([]byte("second")))
+	tx := q.Transaction()
+	defer tx.Close()
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	buf := &bytes.Buffer{}
+	assert.NoError(t, db.Backup(buf))
+
+	restored, err := Open("mem://")
+	assert.NoError(t, err)
+	defer restored.Close()
+	stale, err := restored.Queue("jobs")
+	assert.NoError(t, err)
+	assert.NoError(t, stale.Put([]byte("stale")))
+	assert.Equal(t, ErrInvalidBackup, restored.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-1])))
+	assert.NoError(t, restored.Restore(bytes.NewReader(buf.Bytes())))
+	assert.True(t, stale.Closed())
+
+	names, err := restored.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"jobs"}, names)
+
+	// The taken item is available again in the restored queue, and new items
+	// follow those restored
+	q, err = restored.Queue("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Len())
+	assert.NoError(t, q.Put([]byte("third")))
+	for _, want := range []string{"first", "second", "third"} {
+		v, err := q.Take(0)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(want), v)
+	}
+}
+
+func TestQueueExport(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	tx := q.Transaction()
+	_, err = tx.PutItem(Item{
+		Value:    []byte("urgent"),
+		Priority: 5,
+		Headers:  map[string]string{"content-type": "text/plain"},
+		DedupKey: "order-1",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Put([]byte("plain")))
+	assert.NoError(t, tx.Commit())
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, q.Export(buf))
+	b := buf.Bytes()
+	assert.True(t, bytes.HasPrefix(b, []byte(exportMagic)))
+	for _, s := range []string{"urgent", "plain", "content-type", "text/plain", "order-1"} {
+		assert.True(t, bytes.Contains(b, []byte(s)), s)
+	}
+	// Items are exported in the order they would be taken
+	assert.True(t, bytes.Index(b, []byte("urgent")) < bytes.Index(b, []byte("plain")))
+	assert.Equal(t, frameEnd, b[len(b)-1])
+	assert.Equal(t, 2, q.Len())
+}
+
+func TestQueueImport(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	src, err := db.Queue("src")
+	assert.NoError(t, err)
+
+	tx := src.Transaction()
+	assert.NoError(t, tx.Put([]byte("plain")))
+	_, err = tx.PutItem(Item{
+		Value:    []byte("urgent"),
+		Priority: 5,
+		Headers:  map[string]string{"content-type": "text/plain"},
+	})
+	assert.NoError(t, err)
+	_, err = tx.PutItem(Item{Value: []byte("later"), At: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	buf := &bytes.Buffer{}
+	assert.NoError(t, src.Export(buf))
+
+	// Imported items keep their properties, with new IDs
+	dst, err := db.Queue("dst")
+	assert.NoError(t, err)
+	assert.NoError(t, dst.Put([]byte("existing")))
+	n, err := dst.Import(bytes.NewReader(buf.Bytes()), &ImportOptions{BatchSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 4, dst.Len())
+	assert.Equal(t, 1, dst.Scheduled())
+	tx = dst.Transaction()
+	m, err := tx.TakeMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("urgent"), m.Value)
+	assert.Equal(t, "text/plain", m.Headers["content-type"])
+	values, err := tx.TakeN(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("existing"), []byte("plain")}, values)
+	assert.NoError(t, tx.Close())
+
+	// Preserved IDs are skipped when imported again, and new items follow
+	// them
+	same, err := db.Queue("same")
+	assert.NoError(t, err)
+	opts := &ImportOptions{PreserveIDs: true}
+	n, err = same.Import(bytes.NewReader(buf.Bytes()), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	n, err = same.Import(bytes.NewReader(buf.Bytes()), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, same.Put([]byte("new")))
+	ids := []MessageID{}
+	assert.NoError(t, same.ForEach(func(m *Message) error {
+		ids = append(ids, m.ID)
+		return nil
+	}))
+	srcIDs := []MessageID{}
+	assert.NoError(t, src.ForEach(func(m *Message) error {
+		srcIDs = append(srcIDs, m.ID)
+		return nil
+	}))
+	assert.Equal(t, 4, len(ids))
+	assert.Equal(t, srcIDs[:2], ids[:2])
+
+	_, err = same.Import(strings.NewReader("nonsense"), nil)
+	assert.Equal(t, ErrInvalidExport, err)
+}
+
+func TestDBCompact(t *testing.T) {
+	path := "test-db-compact.db"
+	Destroy(path)
+	db, err := Open(path)
+	assert.NoError(t, err)
+	defer Destroy(path)
+	defer db.Close()
+
+	q, err := db.Queue("open")
+	assert.NoError(t, err)
+	closed, err := db.Queue("closed")
+	assert.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, q.Put([]byte(v)))
+		assert.NoError(t, closed.Put([]byte(v)))
+	}
+	assert.NoError(t, closed.Close())
+	assert.NoError(t, q.Clear())
+	q.mutex.Lock()
+	assert.Equal(t, 3, q.removals)
+	q.mutex.Unlock()
+
+	assert.NoError(t, db.Compact())
+	q.mutex.Lock()
+	assert.Equal(t, 0, q.removals, "open queue should have been compacted")
+	q.mutex.Unlock()
+	assert.Equal(t, 0, q.Len())
+
+	closed, err = db.Queue("closed")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, closed.Len())
+}
+
+func TestDBCheck(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("jobs")
+	assert.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, q.Put([]byte(v)))
+	}
+	report, err := db.Check(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Queues)
+	assert.Equal(t, 3, report.Items)
+	assert.Empty(t, report.Problems)
+
+	// Damage the stored items behind the queue's back
+	entries := q.ids.All()
+	sortEntries(entries)
+	bucket, err := db.DB.Bucket("jobs")
+	assert.NoError(t, err)
+	untracked := internal.Entry{ID: entries[2].ID + 10}
+	corrupt := internal.Entry{ID: entries[2].ID + 20}
+	assert.NoError(t, bucket.Batch(func(b backend.Batch) error {
+		b.Delete(entries[0].Key())
+		b.Put(untracked.Key(), (&record{value: []byte("d")}).encode())
+		b.Put(corrupt.Key(), []byte("junk"))
+		return b.Put([]byte("bad"), []byte("e"))
+	}))
+
+	errs := func(report *CheckReport) []error {
+		errs := []error{}
+		for _, p := range report.Problems {
+			errs = append(errs, p.Err)
+		}
+		return errs
+	}
+	report, err = db.Check(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Items)
+	assert.Equal(t, []error{ErrInvalidKey, ErrCorruptRecord, ErrSeqBehind,
+		ErrMissingItem, ErrUntrackedItem, ErrLengthMismatch}, errs(report))
+	for _, p := range report.Problems {
+		assert.False(t, p.Repaired)
+	}
+
+	report, err = db.Check(&CheckOptions{Repair: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []error{ErrInvalidKey, ErrCorruptRecord, ErrSeqBehind,
+		ErrMissingItem, ErrUntrackedItem}, errs(report))
+	for _, p := range report.Problems {
+		assert.True(t, p.Repaired)
+	}
+	report, err = db.Check(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	// The queue continues with the stored items
+	assert.Equal(t, 3, q.Len())
+	for _, v := range []string{"b", "c", "d"} {
+		b, err := q.Take(0)
+		assert.NoError(t, err)
+		assert.Equal(t, v, string(b))
+	}
+	assert.NoError(t, q.Put([]byte("e")))
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestDBRotate(t *testing.T) {
+	plain := mem.New()
+	db := NewDB(encrypt.Wrap(plain, encrypt.StaticKey("0123456789abcdef"),
+		&encrypt.Options{EncryptKeys: true}))
+	defer db.Close()
+	q, err := db.Queue("jobs")
+	assert.NoError(t, err)
+	events, err := db.Queue("events")
+	assert.NoError(t, err)
+	g, err := events.Group("audit")
+	assert.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, q.Put([]byte(v)))
+		assert.NoError(t, events.Put([]byte(v)))
+	}
+	assert.Equal(t, 3, g.Len())
+
+	tx := q.Transaction()
+	defer tx.Close()
+	v, err := tx.Take()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+
+	key := []byte("fedcba9876543210")
+	assert.NoError(t, db.Rotate(key))
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, q.Put([]byte("d")))
+	assert.Equal(t, 3, q.Len())
+
+	// Everything can be read with only the new key
+	rotated := NewDB(encrypt.Wrap(plain, encrypt.StaticKey(key),
+		&encrypt.Options{EncryptKeys: true}))
+	names, err := rotated.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"events", "jobs"}, names)
+	rq, err := rotated.Queue("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, rq.Len())
+	revents, err := rotated.Queue("events")
+	assert.NoError(t, err)
+	rg, err := revents.Group("audit")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, rg.Len())
+
+	unencrypted, err := Open("mem://")
+	assert.NoError(t, err)
+	defer unencrypted.Close()
+	assert.Equal(t, ErrNotEncrypted, unencrypted.Rotate(key))
+}
+
+func TestQueueCompression(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, compress.ErrUnknownCodec,
+		db.SetConfig("zipped", Config{Compression: "lz4"}))
+	assert.NoError(t, db.SetConfig("zipped", Config{Compression: "zstd"}))
+
+	v := []byte(strings.Repeat("compressible ", 100))
+	stored := func(namespace string) int {
+		bucket, err := db.DB.Bucket(namespace)
+		assert.NoError(t, err)
+		n := 0
+		assert.NoError(t, bucket.ForEach(func(k, v []byte) error {
+			n += len(v)
+			return nil
+		}))
+		return n
+	}
+	zipped, err := db.Queue("zipped")
+	assert.NoError(t, err)
+	assert.NoError(t, zipped.Put(v))
+	plain, err := db.Queue("plain")
+	assert.NoError(t, err)
+	assert.NoError(t, plain.Put(v))
+	assert.True(t, stored("zipped") < stored("plain")/2)
+	assert.True(t, stored("plain") > len(v))
+
+	// Items put with another codec can still be taken
+	mixed, err := db.QueueWithOptions("mixed", &QueueOptions{
+		MaxQueue:    DefaultMaxQueue,
+		Compression: compress.Snappy,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mixed.Put(v))
+	assert.NoError(t, mixed.Close())
+	mixed, err = db.Queue("mixed")
+	assert.NoError(t, err)
+	assert.NoError(t, mixed.Put([]byte("short")))
+	for _, q := range []*Queue{zipped, plain, mixed} {
+		b, err := q.Take(0)
+		assert.NoError(t, err)
+		assert.Equal(t, v, b)
+	}
+	b, err := mixed.Take(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "short", string(b))
+}
+
+func TestDBLock(t *testing.T) {
+	path := "test-db-lock.db"
+	Destroy(path)
+	defer Destroy(path)
 	db, err := Open(path)
-	if err != nil {
-		log.Fatalln(err)
+	assert.NoError(t, err)
+
+	_, err = Open(path)
+	assert.Equal(t, ErrLocked, err)
+
+	// Databases that aren't local are not locked
+	mem1, err := Open("mem://")
+	assert.NoError(t, err)
+	defer mem1.Close()
+	mem2, err := Open("mem://")
+	assert.NoError(t, err)
+	defer mem2.Close()
+
+	db.Close()
+	db, err = Open(path)
+	assert.NoError(t, err)
+	db.Close()
+}
+
+func TestQueueQuota(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	action := QuotaReject
+	breaches := []QuotaBreach{}
+	q, err := db.QueueWithOptions("tenant", &QueueOptions{
+		MaxQueue: DefaultMaxQueue,
+		Quota: &Quota{
+			MaxItems: 3,
+			MaxBytes: 40,
+			OnBreach: func(b QuotaBreach) QuotaAction {
+				breaches = append(breaches, b)
+				return action
+			},
+		},
+	})
+	assert.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		assert.NoError(t, q.Put([]byte(v)))
+	}
+	assert.Equal(t, ErrQuotaExceeded, q.Put([]byte("d")))
+	assert.Len(t, breaches, 1)
+	assert.Equal(t, "tenant", breaches[0].Queue)
+	assert.Equal(t, 3, breaches[0].Quota.MaxItems)
+	assert.Equal(t, 1, breaches[0].Puts)
+	assert.Equal(t, 4, breaches[0].Items)
+	assert.Equal(t, 3, q.Len())
+
+	action = QuotaEvictOldest
+	assert.NoError(t, q.Put([]byte("d")))
+	assert.Equal(t, 3, q.Len())
+	assert.Equal(t, ErrQuotaExceeded, q.Put(make([]byte, 50)))
+	assert.Equal(t, 3, q.Len(), "nothing should be evicted for an item that can't fit")
+
+	action = QuotaAllow
+	assert.NoError(t, q.Put([]byte("e")))
+	assert.Equal(t, 4, q.Len())
+	for _, v := range []string{"b", "c", "d", "e"} {
+		b, err := q.Take(0)
+		assert.NoError(t, err)
+		assert.Equal(t, v, string(b))
 	}
+
+	// Without a policy, breaches are rejected
+	strict, err := db.QueueWithOptions("strict", &QueueOptions{
+		MaxQueue: DefaultMaxQueue,
+		Quota:    &Quota{MaxItems: 1},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, strict.Put([]byte("a")))
+	assert.Equal(t, ErrQuotaExceeded, strict.Put([]byte("b")))
+}
+
+func TestQueueLazyLoad(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
 	defer db.Close()
-	q, err := db.Queue("test")
+	q, err := db.Queue("big")
 	assert.NoError(t, err)
-	if err := q.Clear(); err != nil {
-		log.Fatalln(err)
+	for i := 0; i < 25; i++ {
+		assert.NoError(t, q.Put([]byte(strconv.Itoa(i))))
 	}
+	assert.NoError(t, q.Close())
 
-	// Create test data
-	table := map[string]bool{}
-	for i := 0; i < 100; i++ {
-		k := strconv.Itoa(i)
-		table[k] = true
+	// More items are stored than the queue can hold at once
+	q, err = db.QueueWithOptions("big", &QueueOptions{
+		MaxQueue:  10,
+		LazyLoad:  true,
+		LoadChunk: 4,
+	})
+	assert.NoError(t, err)
+	assert.True(t, q.Len() < 25, "items should be loaded lazily")
+	assert.NoError(t, q.Put([]byte("new")))
+
+	// Stored items are taken in order, though the new item may overtake
+	// those not yet loaded
+	taken := []string{}
+	for i := 0; i < 26; i++ {
+		v, err := q.Take(time.Second)
+		assert.NoError(t, err)
+		if string(v) != "new" {
+			taken = append(taken, string(v))
+		}
 	}
+	for i, v := range taken {
+		assert.Equal(t, strconv.Itoa(i), v)
+	}
+	assert.Len(t, taken, 25)
+	assert.Equal(t, 0, q.Len())
+	q.mutex.Lock()
+	assert.False(t, q.loading())
+	q.mutex.Unlock()
+	assert.NoError(t, q.Close())
 
-	// Write data
+	// Queues with a quota are loaded in full, so every item counts against it
+	q, err = db.QueueWithOptions("quota", &QueueOptions{
+		LazyLoad:  true,
+		LoadChunk: 4,
+	})
+	assert.NoError(t, err)
+	for i := 0; i < 25; i++ {
+		assert.NoError(t, q.Put([]byte(strconv.Itoa(i))))
+	}
+	assert.NoError(t, q.Close())
+	q, err = db.QueueWithOptions("quota", &QueueOptions{
+		LazyLoad:  true,
+		LoadChunk: 4,
+		Quota:     &Quota{MaxItems: 30},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 25, q.Len())
 	tx := q.Transaction()
-	for k := range table {
-		tx.Put([]byte(k))
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, tx.Put([]byte("new")))
 	}
-	tx.Commit()
+	assert.Equal(t, ErrQuotaExceeded, tx.Commit())
+	assert.NoError(t, tx.Close())
+	assert.Equal(t, 25, q.Len())
+}
 
-	// Read data
-	rx := q.Transaction()
-	vs, err := rx.TakeN(50, 10*time.Second)
+// TestShardedQueue puts items to a queue split across several DBs, and takes
+// them back from every shard.
+func TestShardedQueue(t *testing.T) {
+	dbs := []*DB{}
+	for i := 0; i < 3; i++ {
+		db, err := Open("mem://")
+		assert.NoError(t, err)
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+	_, err := OpenSharded(nil, "jobs", nil)
+	assert.Equal(t, ErrNoShards, err)
+
+	sq, err := OpenSharded(dbs, "jobs", nil)
 	assert.NoError(t, err)
-	for _, v := range vs {
-		assert.True(t, table[string(v)])
-		delete(table, string(v))
+	defer sq.Close()
+
+	// Items are spread over every shard
+	for i := 0; i < 9; i++ {
+		assert.NoError(t, sq.Put([]byte(strconv.Itoa(i))))
+	}
+	assert.Equal(t, 9, sq.Len())
+	for _, q := range sq.Shards() {
+		assert.Equal(t, 3, q.Len())
 	}
 
-	for len(table) > 0 {
-		v, err := rx.Take()
+	// Items with the same key go to the same shard, in order
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sq.PutKey([]byte("k"), []byte("k"+strconv.Itoa(i))))
+	}
+	assert.Equal(t, 12, sq.Len())
+
+	taken := map[string]bool{}
+	keyed := []string{}
+	for i := 0; i < 12; i++ {
+		v, err := sq.Take(time.Second)
 		assert.NoError(t, err)
-		assert.True(t, table[string(v)])
-		delete(table, string(v))
+		taken[string(v)] = true
+		if strings.HasPrefix(string(v), "k") {
+			keyed = append(keyed, string(v))
+		}
 	}
-	rx.Commit()
+	assert.Len(t, taken, 12)
+	assert.Equal(t, []string{"k0", "k1", "k2"}, keyed)
+	assert.Equal(t, 0, sq.Len())
 
-	// Verify there are no more items in the queue
-	rx = q.Transaction()
-	defer rx.Close()
-	v, err := rx.Take()
+	// Take waits for an item to be put to any shard
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sq.Shards()[2].Put([]byte("late"))
+	}()
+	v, err := sq.Take(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("late"), v)
+
+	v, err = sq.Take(10 * time.Millisecond)
 	assert.NoError(t, err)
 	assert.Nil(t, v)
 }
 
-// TestQueueMulti tests a series of puts/takes in a number of transactions
-func TestQueueMulti(t *testing.T) {
-	path := "test-queue-multi.db"
+// expvarRuns counts runs of TestDBPublishExpvar, such that each publishes a
+// new name when run repeatedly, as published names cannot be removed.
+var expvarRuns int64
 
-	err := Destroy(path)
-	db, err := Open(path)
-	if err != nil {
-		log.Fatalln(err)
-	}
+// TestDBPublishExpvar tests that the state of a DB is published with expvar.
+func TestDBPublishExpvar(t *testing.T) {
+	name := "kvq_test_" + strconv.FormatInt(atomic.AddInt64(&expvarRuns, 1), 10)
+	db, err := Open("mem://")
+	assert.NoError(t, err)
 	defer db.Close()
-	q, err := db.Queue("test")
+	q, err := db.Queue("jobs")
 	assert.NoError(t, err)
-	if err := q.Clear(); err != nil {
-		log.Fatalln(err)
+	assert.NoError(t, q.Put([]byte("a")))
+	assert.NoError(t, q.Put([]byte("b")))
+
+	db.PublishExpvar(name)
+	v := expvar.Get(name)
+	if !assert.NotNil(t, v) {
+		return
 	}
+	queues := map[string]struct {
+		Depth         int   `json:"depth"`
+		Puts          int64 `json:"puts"`
+		Commits       int64 `json:"commits"`
+		CommitLatency struct {
+			Count int64 `json:"count"`
+		} `json:"commit_latency"`
+	}{}
+	assert.NoError(t, json.Unmarshal([]byte(v.String()), &queues))
+	assert.Len(t, queues, 1)
+	assert.Equal(t, 2, queues["jobs"].Depth)
+	assert.Equal(t, int64(2), queues["jobs"].Puts)
+	assert.Equal(t, int64(2), queues["jobs"].Commits)
+	assert.Equal(t, int64(2), queues["jobs"].CommitLatency.Count)
 
-	table := []string{"a", "b", "c"}
+	// The depth is read afresh each time
+	_, err = q.Take(0)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal([]byte(v.String()), &queues))
+	assert.Equal(t, 1, queues["jobs"].Depth)
+	assert.Panics(t, func() { db.PublishExpvar(name) })
+}
 
-	// Put values
-	for _, v := range table {
-		tx := q.Transaction()
-		tx.Put([]byte(v))
-		tx.Commit()
+// TestQueueEvents tests that listeners are told of the lifecycle of items.
+func TestQueueEvents(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	dlq, err := db.Queue("dead")
+	assert.NoError(t, err)
+	q, err := db.QueueWithOptions("jobs", &QueueOptions{
+		DeadLetter:  dlq,
+		MaxAttempts: 1,
+	})
+	assert.NoError(t, err)
+
+	var mutex sync.Mutex
+	events := []Event{}
+	q.OnEvent(func(ev Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, ev)
+	})
+	next := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		types := []string{}
+		for _, ev := range events {
+			assert.Equal(t, q, ev.Queue)
+			types = append(types, ev.Type.String())
+		}
+		events = events[:0]
+		return types
 	}
 
-	// Take values
-	for _, exp := range table {
-		rx := q.Transaction()
-		act, err := rx.Take()
-		assert.NoError(t, err)
-		assert.Equal(t, exp, string(act))
-		rx.Commit()
+	tx := q.Transaction()
+	assert.NoError(t, tx.Put([]byte("a")))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, []string{"put", "commit"}, next())
+
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, []string{"take", "commit"}, next())
+
+	// Discarding the item takes its only attempt, so it is dead-lettered
+	assert.NoError(t, q.Put([]byte("b")))
+	assert.Equal(t, []string{"put", "commit"}, next())
+	_, err = tx.Take()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Close())
+	assert.Equal(t, []string{"take", "dead-letter", "discard"}, next())
+	assert.Equal(t, 1, dlq.Len())
+
+	// Expired items are dead-lettered too
+	assert.NoError(t, tx.PutTTL([]byte("c"), 10*time.Millisecond))
+	assert.NoError(t, tx.Commit())
+	mutex.Lock()
+	id := events[0].IDs[0]
+	mutex.Unlock()
+	assert.Equal(t, []string{"put", "commit"}, next())
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	assert.Len(t, events, 2)
+	for _, ev := range events {
+		assert.Equal(t, []MessageID{id}, ev.IDs)
 	}
+	mutex.Unlock()
+	assert.Equal(t, []string{"expire", "dead-letter"}, next())
+	assert.Equal(t, 2, dlq.Len())
 }
 
-// TestQueueOrdered tests that items come out of the queue in the correct
-// order.
-func TestQueueOrdered(t *testing.T) {
-	path := "test-queue-ordered.db"
+// TestQueueRates tests that rates of items put and taken are averaged over
+// time.
+func TestQueueRates(t *testing.T) {
+	m := meter{}
+	now := time.Now()
+	m.mark(0, now)
+	assert.Equal(t, Rates{}, m.read(now))
 
-	err := Destroy(path)
-	db, err := Open(path)
-	if err != nil {
-		log.Fatalln(err)
+	// A steady rate is reported once the first interval ends
+	for i := 0; i < 12; i++ {
+		m.mark(50, now)
+		now = now.Add(rateInterval)
 	}
+	r := m.read(now)
+	assert.InDelta(t, 10, r.M1, 0.001)
+	assert.InDelta(t, 10, r.M5, 0.001)
+	assert.InDelta(t, 10, r.M15, 0.001)
+
+	// Averages decay once items stop, the shortest fastest
+	r = m.read(now.Add(5 * time.Minute))
+	assert.True(t, r.M1 < r.M5 && r.M5 < r.M15)
+	assert.InDelta(t, 10*math.Exp(-5), r.M1, 0.1)
+
+	db, err := Open("mem://")
+	assert.NoError(t, err)
 	defer db.Close()
 	q, err := db.Queue("test")
 	assert.NoError(t, err)
-	if err := q.Clear(); err != nil {
-		log.Fatalln(err)
+	assert.NoError(t, q.Put([]byte("a")))
+	s := q.Stats()
+	assert.Equal(t, Rates{}, s.PutRate)
+	assert.Equal(t, Rates{}, s.TakeRate)
+}
+
+// TestQueueHistograms tests that the latencies of operations are recorded,
+// and that percentiles can be read from them.
+func TestQueueHistograms(t *testing.T) {
+	h := Histogram{}
+	assert.Equal(t, time.Duration(0), h.Quantile(0.99))
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
 	}
+	assert.Equal(t, int64(1000), h.Count())
+	assert.Equal(t, time.Second, h.Max())
+	assert.Equal(t, 500500*time.Microsecond, h.Mean())
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99} {
+		want := time.Duration(q*1000) * time.Millisecond
+		got := h.Quantile(q)
+		assert.True(t, got >= want && got <= want+want/30,
+			"quantile %v should be about %v, not %v", q, want, got)
+	}
+	assert.Equal(t, time.Second, h.Quantile(1))
 
-	// Put values
+	// Durations too short or long for the buckets are still counted
+	h = Histogram{}
+	h.record(-time.Second)
+	h.record(24 * 365 * time.Hour)
+	assert.Equal(t, int64(2), h.Count())
+	assert.Equal(t, time.Duration(0), h.Quantile(0.5))
+
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Put([]byte("a"))
+	}()
 	tx := q.Transaction()
-	for i := byte(0); i < 100; i++ {
-		tx.Put([]byte{i})
-		// Artificial sleep to guarantee new gosnow ID
-		time.Sleep(time.Millisecond * 2)
-	}
-	tx.Commit()
+	_, err = tx.TakeN(1, time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
 
-	// Take values
-	rx := q.Transaction()
-	for i := byte(0); i < 100; i++ {
-		act, err := rx.Take()
-		assert.NoError(t, err)
-		assert.Equal(t, []byte{i}, act)
-	}
-	rx.Commit()
+	s := q.Stats()
+	assert.Equal(t, s.Committed, s.Commits.Count())
+	assert.Equal(t, int64(1), s.TakeWaits.Count())
+	assert.True(t, s.TakeWaits.Max() >= 10*time.Millisecond)
+	assert.Equal(t, int64(2), s.Writes.Count())
+}
+
+// TestQueueClear tests that clearing a queue forgets every item held in
+// memory, such that the queue can be used again.
+func TestQueueClear(t *testing.T) {
+	db, err := Open("mem://")
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.NoError(t, err)
+
+	assert.NoError(t, q.Put([]byte("a")))
+	assert.NoError(t, q.Put([]byte("b")))
+	tx := q.Transaction()
+	assert.NoError(t, tx.PutDelay([]byte("c"), time.Hour))
+	assert.NoError(t, tx.PutTTL([]byte("d"), time.Hour))
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, 4, q.Len())
+	assert.Equal(t, 3, q.Size())
+	assert.Equal(t, 1, q.Scheduled())
+
+	assert.NoError(t, q.Clear())
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, 0, q.Size())
+	assert.Equal(t, 0, q.Scheduled())
+	v, err := q.Take(0)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	assert.NoError(t, q.Put([]byte("e")))
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, 1, q.Size())
+	v, err = q.Take(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("e"), v)
+	assert.Equal(t, 0, q.Len())
 }
 
 // TestQueueThreaded puts and takes items from a number of simultaneous
@@ -492,3 +4150,76 @@ func benchmarkTake(b *testing.B, q *Queue) {
 	rx.Commit()
 	b.StopTimer()
 }
+
+// BenchmarkPutDirect benchmarks the speed at which items can be put without a
+// transaction, for comparison with BenchmarkPuts1.
+func BenchmarkPutDirect(b *testing.B) {
+	path := "benchmark-put-direct.db"
+	Destroy(path)
+	db, err := Open(path)
+	assert.Nil(b, err)
+	defer db.Close()
+	q, err := db.Queue("test")
+	assert.Nil(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := q.Put([]byte(strconv.Itoa(i))); err != nil {
+			b.Fatal("error during put:", err)
+		}
+	}
+	b.StopTimer()
+}
+
+// BenchmarkTakeCommit benchmarks the speed at which items can be taken and
+// committed one at a time with a transaction.
+func BenchmarkTakeCommit(b *testing.B) {
+	q := benchmarkSeed(b, "benchmark-take-commit.db")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx := q.Transaction()
+		if _, err := tx.Take(); err != nil {
+			b.Fatal("error during take:", err)
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal("error during commit:", err)
+		}
+	}
+	b.StopTimer()
+}
+
+// BenchmarkTakeDirect benchmarks the speed at which items can be taken one at
+// a time without a transaction, for comparison with BenchmarkTakeCommit.
+func BenchmarkTakeDirect(b *testing.B) {
+	q := benchmarkSeed(b, "benchmark-take-direct.db")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := q.Take(0); err != nil {
+			b.Fatal("error during take:", err)
+		}
+	}
+	b.StopTimer()
+}
+
+// benchmarkSeed opens a queue at `path` holding b.N items to take.
+func benchmarkSeed(b *testing.B, path string) *Queue {
+	Destroy(path)
+	db, err := Open(path)
+	assert.Nil(b, err)
+	b.Cleanup(db.Close)
+	q, err := db.Queue("test")
+	assert.Nil(b, err)
+
+	values := make([][]byte, b.N)
+	for i := range values {
+		values[i] = []byte(strconv.Itoa(i))
+	}
+	tx := q.Transaction()
+	if err := tx.PutAll(values); err != nil {
+		b.Fatal("error during put:", err)
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal("error during commit:", err)
+	}
+	return q
+}
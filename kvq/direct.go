@@ -0,0 +1,119 @@
+package kvq
+
+import (
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+// Put inserts the data into the queue with the default (lowest) priority, and
+// commits it immediately, as with a transaction of its own. This avoids the
+// cost of a Txn for producers that put one item at a time.
+func (q *Queue) Put(v []byte) error {
+	if v == nil {
+		return nil
+	}
+	if q.readOnly {
+		return ErrReadOnly
+	}
+	start := time.Now()
+
+	id, err := q.nextID()
+	if err != nil {
+		return err
+	}
+	e := internal.Entry{ID: id}
+	puts := []kv{{e.Key(), (&record{value: v, codec: q.opts.Compression}).encode()}}
+
+	// Ensure the put is within the queue's rate limit
+	if err := q.limitPuts(1, 0, q.closed); err != nil {
+		if cerr := q.closedErr(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+
+	// Deliver the put to the queue's consumer groups, if any, in place of the
+	// queue itself
+	if ok, err := q.deliver(puts); ok || err != nil {
+		return err
+	}
+
+	if err := q.admit(puts, 0, nil); err != nil {
+		q.countError()
+		return err
+	}
+	if err := q.enact(puts, nil); err != nil {
+		q.unadmit(puts)
+		q.countError()
+		return err
+	}
+	q.add([]internal.Entry{e}, nil, nil)
+	q.staged(1, 0)
+	p := Pending{
+		Puts:   1,
+		Bytes:  int64(len(puts[0].v)),
+		PutIDs: []MessageID{MessageID(puts[0].k)},
+	}
+	q.countCommit(p, time.Since(start))
+	q.emitPending(EventCommit, p)
+	return nil
+}
+
+// Take takes an item from the queue, waiting at most `t` for one to become
+// available, and removes it from storage immediately, as with a transaction
+// of its own. Returns nil if no item became available. This avoids the cost
+// of a Txn for consumers that take one item at a time, but the item is lost
+// if the consumer fails to process it.
+func (q *Queue) Take(t time.Duration) ([]byte, error) {
+	if q.readOnly {
+		return nil, ErrReadOnly
+	}
+	if q.isClosed() {
+		return nil, ErrClosed
+	}
+
+	// Wait for an unregistered consumer's turn to take
+	if d := q.dispatcher; d != nil {
+		var ok bool
+		if t, ok = d.acquire(nil, t, q.closed); !ok {
+			return nil, q.closedErr()
+		}
+		defer d.release(nil)
+	}
+
+	// Wait for the rate limit to allow an item to be taken
+	var n int
+	if n, t = q.limitTakes(1, 1, t, q.closed); n == 0 {
+		return nil, q.closedErr()
+	}
+
+	ids, keys, records, err := q.take(1, t, q.closed)
+	q.unlimitTakes(1 - len(ids))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, q.closedErr()
+	}
+
+	// Remove the item from storage, returning it to the queue as it was if
+	// this fails
+	start := time.Now()
+	takes := []kv{{keys[0], records[0].value}}
+	err = q.recordProcessed(takes, records)
+	if err == nil {
+		err = q.enact(nil, takes)
+	}
+	if err != nil {
+		q.putKey(ids...)
+		q.countError()
+		return nil, err
+	}
+	q.forget(ids...)
+	q.staged(0, 1)
+	p := Pending{Takes: 1, TakeIDs: []MessageID{MessageID(keys[0])}}
+	q.countCommit(p, time.Since(start))
+	q.emitPending(EventCommit, p)
+	return records[0].value, nil
+}
@@ -7,6 +7,12 @@ To open a queue, first get a database instance, and then the queue itself. A DB
 	db, err := kvq.Open("db.db")
 	queue, err := db.Queue("tweets")
 
+Other backends are opened by URI once their package has been imported:
+
+	import _ "github.com/johnsto/go-kvq/kvq/backend/bolt"
+
+	db, err := kvq.Open("bolt://db.db")
+
 (Remember to Close() when finished)
 
 To push data onto a queue, start a transaction, add values, and then commit.
@@ -24,8 +30,18 @@ To take data from the queue, start a transaction, take values, and the commit.
 	value, err := t.Take()
 	err = t.Commit()
 
-Items on the queue are keyed by the time at which they were Put(), so the push
-order should generally match the pop order (barring any run-time pauses).
+Items on the queue are keyed by a sequence number assigned when they are Put(),
+so the push order matches the pop order. The sequence is persisted, so remains
+monotonic when the queue is reopened.
+
+Items may also be given a priority, in which case higher priority items are
+taken before any lower priority ones:
+
+	t.PutPriority([]byte("urgent"), 10)
+
+Delivery of an item can be deferred until a later time:
+
+	t.PutDelay([]byte("later"), time.Minute)
 
 To retrieve a certain number of items within a timeframe, use Txn.TakeN:
 
@@ -0,0 +1,31 @@
+package kvq
+
+import (
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// CommitSync writes the transaction to storage as with Commit, waiting for
+// it to be synced to disk before returning, even if the queue was opened
+// with NoSync. This suits critical items that must survive the machine
+// crashing.
+func (txn *Txn) CommitSync() error {
+	return txn.commit(txn.wait, nil, true)
+}
+
+// CommitNoSync writes the transaction to storage as with Commit, but returns
+// without waiting for it to be synced to disk, where the backend supports it.
+// The commit survives the process crashing, but may be lost if the machine
+// crashes. This suits bulk items that can be recovered by other means.
+func (txn *Txn) CommitNoSync() error {
+	return txn.commit(txn.wait, nil, false)
+}
+
+// batch enacts operations on the bucket as with Bucket.Batch, without waiting
+// for them to be synced to disk if `sync` is false and the bucket supports
+// it.
+func batch(bucket backend.Bucket, sync bool, fn func(backend.Batch) error) error {
+	if nb, ok := bucket.(backend.NoSyncBatcher); ok && !sync {
+		return nb.BatchNoSync(fn)
+	}
+	return bucket.Batch(fn)
+}
@@ -0,0 +1,125 @@
+package kvq
+
+import (
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+// EventType identifies what happened to a queue in an Event.
+type EventType int
+
+const (
+	// EventPut is emitted when items are committed to the queue, whether
+	// available immediately or scheduled.
+	EventPut EventType = iota
+	// EventTake is emitted when items are taken from the queue, whether by a
+	// transaction, lease or Queue.Take.
+	EventTake
+	// EventCommit is emitted when a transaction that put or took items is
+	// committed, or an item is put or taken with Queue.Put or Queue.Take.
+	EventCommit
+	// EventDiscard is emitted when a transaction is closed or discarded
+	// without being committed, returning any items it took to the queue.
+	EventDiscard
+	// EventExpire is emitted when items expire before being taken.
+	EventExpire
+	// EventDeadLetter is emitted when items are moved to the queue's
+	// dead-letter or poison queue.
+	EventDeadLetter
+)
+
+var eventNames = []string{
+	"put", "take", "commit", "discard", "expire", "dead-letter",
+}
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[t]
+}
+
+// Event describes something that happened to the items of a queue.
+type Event struct {
+	// Type identifies what happened.
+	Type EventType
+	// Queue is the queue the event happened to.
+	Queue *Queue
+	// IDs gives the IDs of the items concerned, or of the items put and then
+	// taken for EventCommit and EventDiscard.
+	IDs []MessageID
+	// Pending gives the items written or discarded, for EventCommit and
+	// EventDiscard only.
+	Pending Pending
+}
+
+// OnEvent registers `fn` to be called with each event emitted by the queue,
+// e.g. to maintain a cache, write an audit log or raise alerts. Listeners are
+// called in the order registered, in the goroutine that caused the event,
+// once the operation is complete; they should return quickly and must not
+// use the queue.
+func (q *Queue) OnEvent(fn func(Event)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.listeners = append(q.listeners, fn)
+}
+
+// emit calls the queue's listeners with an event of the given type
+// concerning the items with the given keys. The caller must not hold the
+// queue mutex.
+func (q *Queue) emit(t EventType, keys [][]byte) {
+	listeners := q.listening()
+	if len(listeners) == 0 || len(keys) == 0 {
+		return
+	}
+	ids := make([]MessageID, len(keys))
+	for i, k := range keys {
+		ids[i] = MessageID(k)
+	}
+	q.notify(listeners, Event{Type: t, IDs: ids})
+}
+
+// emitEntries calls the queue's listeners with an event of the given type
+// concerning the given entries. The caller must not hold the queue mutex.
+func (q *Queue) emitEntries(t EventType, entries []internal.Entry) {
+	listeners := q.listening()
+	if len(listeners) == 0 || len(entries) == 0 {
+		return
+	}
+	ids := make([]MessageID, len(entries))
+	for i, e := range entries {
+		ids[i] = MessageID(e.Key())
+	}
+	q.notify(listeners, Event{Type: t, IDs: ids})
+}
+
+// emitPending calls the queue's listeners with an event of the given type
+// concerning the items written or discarded. Items put are first announced
+// with EventPut if committed. The caller must not hold the queue mutex.
+func (q *Queue) emitPending(t EventType, p Pending) {
+	listeners := q.listening()
+	if len(listeners) == 0 {
+		return
+	}
+	if t == EventCommit && len(p.PutIDs) > 0 {
+		q.notify(listeners, Event{Type: EventPut, IDs: p.PutIDs})
+	}
+	ids := make([]MessageID, 0, len(p.PutIDs)+len(p.TakeIDs))
+	ids = append(append(ids, p.PutIDs...), p.TakeIDs...)
+	q.notify(listeners, Event{Type: t, IDs: ids, Pending: p})
+}
+
+// listening returns the queue's listeners.
+func (q *Queue) listening() []func(Event) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.listeners
+}
+
+// notify calls each of the listeners with the event.
+func (q *Queue) notify(listeners []func(Event), ev Event) {
+	ev.Queue = q
+	for _, fn := range listeners {
+		fn(ev)
+	}
+}
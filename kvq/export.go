@@ -0,0 +1,133 @@
+package kvq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// An export, as written by Queue.Export, begins with exportMagic, followed by
+// a series of frames, each beginning with a frame type byte:
+//
+//	frameMessage: uvarint length, fields - an item
+//	frameEnd:                            - ends the export
+//
+// The fields of an item each begin with a field tag byte, followed by the
+// uvarint length of the field's data and the data itself. Fields may appear
+// in any order, and fields with unknown tags should be skipped, such that
+// exports remain readable as fields are added:
+//
+//	fieldID:          the item's ID, as in Message.ID
+//	fieldValue:       the item's value
+//	fieldHeader:      uvarint length, header name, header value
+//	fieldPriority:    priority byte
+//	fieldGroup:       message group
+//	fieldSchema:      schema byte
+//	fieldAttempts:    uvarint attempt count
+//	fieldAvailableAt: 8-byte big-endian Unix nanoseconds
+//	fieldExpiresAt:   8-byte big-endian Unix nanoseconds
+//	fieldDedupKey:    deduplication key
+//
+// Only the ID and value are always present.
+const (
+	exportMagic = "kvqexport1"
+
+	frameMessage byte = 1
+)
+
+var (
+	// ErrInvalidExport is returned when importing from a stream that is not
+	// a complete export written by Queue.Export.
+	ErrInvalidExport = errors.New("invalid export")
+)
+
+// Field tags of the items in an export.
+const (
+	fieldID byte = iota + 1
+	fieldValue
+	fieldHeader
+	fieldPriority
+	fieldGroup
+	fieldSchema
+	fieldAttempts
+	fieldAvailableAt
+	fieldExpiresAt
+	fieldDedupKey
+)
+
+// Export writes every item stored in the queue to `w`, in the order in which
+// they would be taken, in a portable format independent of the backend and
+// of the version of this package, for Queue.Import to read. Each item's ID,
+// value, headers, priority, schedule and other properties are included. As
+// with Iterator, items are not taken, and the export is consistent where the
+// backend supports snapshots.
+func (q *Queue) Export(w io.Writer) error {
+	it, err := q.Iterator()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(exportMagic)
+	for it.Next() {
+		body := encodeExported(it.Message(), it.rec)
+		bw.WriteByte(frameMessage)
+		if _, err := writeFrameBytes(bw, body); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	bw.WriteByte(frameEnd)
+	return bw.Flush()
+}
+
+// encodeExported returns the fields of an exported item.
+func encodeExported(m *Message, r record) []byte {
+	b := []byte{}
+	field := func(tag byte, data []byte) {
+		b = append(b, tag)
+		b = binary.AppendUvarint(b, uint64(len(data)))
+		b = append(b, data...)
+	}
+	timestamp := func(tag byte, ns int64) {
+		if ns != 0 {
+			field(tag, binary.BigEndian.AppendUint64(nil, uint64(ns)))
+		}
+	}
+
+	field(fieldID, []byte(m.ID))
+	field(fieldValue, m.Value)
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := binary.AppendUvarint(nil, uint64(len(name)))
+		h = append(append(h, name...), m.Headers[name]...)
+		field(fieldHeader, h)
+	}
+	if m.Priority != 0 {
+		field(fieldPriority, []byte{m.Priority})
+	}
+	if m.Group != "" {
+		field(fieldGroup, []byte(m.Group))
+	}
+	if m.Schema != 0 {
+		field(fieldSchema, []byte{m.Schema})
+	}
+	if m.Attempts != 0 {
+		field(fieldAttempts, binary.AppendUvarint(nil, uint64(m.Attempts)))
+	}
+	timestamp(fieldAvailableAt, r.availableAt)
+	timestamp(fieldExpiresAt, r.expiresAt)
+	if r.dedupKey != "" {
+		field(fieldDedupKey, []byte(r.dedupKey))
+	}
+	return b
+}
@@ -0,0 +1,52 @@
+package kvq
+
+import (
+	"expvar"
+)
+
+// expvarQueue is the state of a queue as published by PublishExpvar.
+type expvarQueue struct {
+	Depth         int       `json:"depth"`
+	Available     int       `json:"available"`
+	Scheduled     int       `json:"scheduled"`
+	SizeBytes     int64     `json:"size_bytes"`
+	OpenTxns      int       `json:"open_txns"`
+	Puts          int64     `json:"puts"`
+	Takes         int64     `json:"takes"`
+	Commits       int64     `json:"commits"`
+	Discards      int64     `json:"discards"`
+	CommitErrors  int64     `json:"commit_errors"`
+	CommitLatency Histogram `json:"commit_latency"`
+}
+
+// PublishExpvar publishes the state of the queues open on the DB with the
+// expvar package, such that it is served at /debug/vars. The variable named
+// `prefix` maps the namespace of each open queue to its depth and counts of
+// the items put and taken and the transactions committed, discarded and
+// failed, read afresh each time it is served. As with expvar.Publish, it
+// panics if the name is already in use.
+func (db *DB) PublishExpvar(prefix string) {
+	expvar.Publish(prefix, expvar.Func(func() interface{} {
+		s, err := db.Stats()
+		if err != nil {
+			return map[string]string{"error": err.Error()}
+		}
+		queues := make(map[string]expvarQueue, len(s.Queues))
+		for name, qs := range s.Queues {
+			queues[name] = expvarQueue{
+				Depth:         qs.Len,
+				Available:     qs.Available,
+				Scheduled:     qs.Scheduled,
+				SizeBytes:     qs.SizeBytes,
+				OpenTxns:      qs.OpenTxns,
+				Puts:          qs.PutsCommitted,
+				Takes:         qs.TakesCommitted,
+				Commits:       qs.Committed,
+				Discards:      qs.Discarded,
+				CommitErrors:  qs.CommitErrors,
+				CommitLatency: qs.Commits,
+			}
+		}
+		return queues
+	}))
+}
@@ -0,0 +1,136 @@
+package kvq
+
+import (
+	"sync"
+	"time"
+)
+
+// Consumer identifies a consumer of a queue, such that a queue with
+// FairDispatch shares items between consumers in turn, however many
+// goroutines each consumer takes from.
+type Consumer struct {
+	queue  *Queue
+	served uint64 // dispatch ticket when the consumer last took its turn
+}
+
+// Consumer registers a new consumer of the queue. Takes made by the
+// consumer's transactions are dispatched fairly with respect to other
+// consumers if the queue was opened with FairDispatch. Takes made by
+// transactions from Queue.Transaction are each treated as a separate consumer.
+func (q *Queue) Consumer() *Consumer {
+	return &Consumer{queue: q}
+}
+
+// Transaction starts a transaction on the queue that takes items on behalf of
+// the consumer.
+func (c *Consumer) Transaction() *Txn {
+	txn := NewTxn(c.queue)
+	txn.consumer = c
+	return txn
+}
+
+// dispatcher decides which of several waiting takes may next take from a
+// queue, such that consumers that have taken recently wait for others.
+type dispatcher struct {
+	mutex   sync.Mutex
+	ticket  uint64  // incremented on each arrival and each turn taken
+	waiting []*turn // takes waiting for their turn
+	busy    bool    // true while a take holds the turn
+}
+
+// turn is a take waiting to be dispatched.
+type turn struct {
+	rank    uint64        // lower ranks are dispatched first
+	arrival uint64        // ticket on arrival, breaking ties
+	ready   chan struct{} // closed when dispatched
+}
+
+// acquire waits at most `t` for the consumer's turn to take from the queue,
+// returning the time remaining and true once it is the consumer's turn, or
+// false if it timed out or `done` was closed. A nil consumer is ranked by its
+// time of arrival.
+func (d *dispatcher) acquire(c *Consumer, t time.Duration, done <-chan struct{}) (time.Duration, bool) {
+	start := time.Now()
+
+	d.mutex.Lock()
+	d.ticket++
+	w := &turn{
+		rank:    d.ticket,
+		arrival: d.ticket,
+		ready:   make(chan struct{}),
+	}
+	if c != nil {
+		w.rank = c.served
+	}
+	d.waiting = append(d.waiting, w)
+	d.next()
+	d.mutex.Unlock()
+
+	timeout := time.NewTimer(t)
+	defer timeout.Stop()
+
+	select {
+	case <-w.ready:
+	case <-done:
+		if d.abandon(w) {
+			return 0, false
+		}
+	case <-timeout.C:
+		if d.abandon(w) {
+			return 0, false
+		}
+	}
+
+	if t -= time.Since(start); t < 0 {
+		t = 0
+	}
+	return t, true
+}
+
+// abandon removes the take from those waiting, returning false if it has
+// already been dispatched, in which case it holds the turn.
+func (d *dispatcher) abandon(w *turn) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, other := range d.waiting {
+		if other == w {
+			d.waiting = append(d.waiting[:i], d.waiting[i+1:]...)
+			return true
+		}
+	}
+	// Dispatched while abandoning
+	return false
+}
+
+// release ends the consumer's turn, allowing the next waiting take to
+// proceed.
+func (d *dispatcher) release(c *Consumer) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.ticket++
+	if c != nil {
+		c.served = d.ticket
+	}
+	d.busy = false
+	d.next()
+}
+
+// next dispatches the waiting take with the lowest rank, if no take holds
+// the turn. The caller must hold the dispatcher mutex.
+func (d *dispatcher) next() {
+	if d.busy || len(d.waiting) == 0 {
+		return
+	}
+	best := 0
+	for i, w := range d.waiting {
+		b := d.waiting[best]
+		if w.rank < b.rank || (w.rank == b.rank && w.arrival < b.arrival) {
+			best = i
+		}
+	}
+	w := d.waiting[best]
+	d.waiting = append(d.waiting[:best], d.waiting[best+1:]...)
+	d.busy = true
+	close(w.ready)
+}
@@ -0,0 +1,179 @@
+package kvq
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+const (
+	// groupPrefix prefixes the metadata keys recording a queue's consumer
+	// groups.
+	groupPrefix = "group/"
+	// groupInfix separates a queue's namespace from the name of a consumer
+	// group, giving the namespace in which the group's items are stored.
+	groupInfix = ".group."
+)
+
+// Group returns the named consumer group of the queue, creating it if it does
+// not yet exist. Once a queue has consumer groups, items committed to the
+// queue are delivered to every group rather than being stored in the queue
+// itself, and each item is taken by only one member of each group. Members
+// take items from the returned queue as they would any other. Groups are
+// recorded in the queue's metadata, so are restored when the queue is
+// reopened, and receive items from then on even if Group is not called again.
+func (q *Queue) Group(name string) (*Queue, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if g, ok := q.groups[name]; ok {
+		return g, nil
+	}
+	if q.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	err := q.meta.Batch(func(b backend.Batch) error {
+		return b.Put([]byte(groupPrefix+name), []byte{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.openGroup(name)
+}
+
+// Groups returns the names of the queue's consumer groups, in order.
+func (q *Queue) Groups() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	names := make([]string, 0, len(q.groups))
+	for name := range q.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RemoveGroup removes the named consumer group from the queue, discarding any
+// items it holds. Do not call if any transactions on the group are in
+// progress.
+func (q *Queue) RemoveGroup(name string) error {
+	q.mutex.Lock()
+	g, ok := q.groups[name]
+	q.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	if q.readOnly {
+		return ErrReadOnly
+	}
+
+	err := q.meta.Batch(func(b backend.Batch) error {
+		return b.Delete([]byte(groupPrefix + name))
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	delete(q.groups, name)
+	q.mutex.Unlock()
+	if err := g.Clear(); err != nil {
+		return err
+	}
+	return g.Close()
+}
+
+// initGroups opens the consumer groups recorded in the queue's metadata.
+func (q *Queue) initGroups() error {
+	names, err := groupNames(q.meta)
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, name := range names {
+		if _, err := q.openGroup(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupNames returns the names of the consumer groups recorded in a queue's
+// metadata.
+func groupNames(meta bucketReader) ([]string, error) {
+	var names []string
+	err := meta.ForEach(func(k, v []byte) error {
+		if name := string(k); strings.HasPrefix(name, groupPrefix) {
+			names = append(names, strings.TrimPrefix(name, groupPrefix))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// openGroup opens the queue holding the items of the named consumer group,
+// using the same options as this queue. Puts to the group are not rate limited,
+// having already been limited by this queue. The caller must hold the queue
+// mutex.
+func (q *Queue) openGroup(name string) (*Queue, error) {
+	opts := q.opts
+	opts.PutRate = 0
+	g, err := NewQueue(q.db, q.namespace+groupInfix+name, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if q.groups == nil {
+		q.groups = map[string]*Queue{}
+	}
+	q.groups[name] = g
+	return g, nil
+}
+
+// deliver puts copies of the given items into each of the queue's consumer
+// groups, returning false if the queue has no consumer groups. Delivery is
+// not atomic across groups; if it fails, some groups may have received the
+// items.
+func (q *Queue) deliver(puts []kv) (bool, error) {
+	q.mutex.Lock()
+	groups := make([]*Queue, 0, len(q.groups))
+	for _, g := range q.groups {
+		groups = append(groups, g)
+	}
+	draining, paused := q.drained != nil, q.putsPaused
+	q.mutex.Unlock()
+
+	if len(groups) == 0 || len(puts) == 0 {
+		return false, nil
+	}
+	if draining {
+		return true, ErrDraining
+	}
+	if paused {
+		return true, ErrPaused
+	}
+
+	for _, g := range groups {
+		txn := g.Transaction()
+		for _, kv := range puts {
+			e, _ := internal.KeyToEntry(kv.k)
+			r, err := decodeRecord(kv.v)
+			if err != nil {
+				return true, err
+			}
+			if err := txn.put(&r, e.Priority); err != nil {
+				return true, err
+			}
+		}
+		if err := txn.Commit(); err != nil {
+			txn.Close()
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,80 @@
+package kvq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// committer coalesces the writes of concurrent commits to a bucket into a
+// single batch, such that the cost of syncing the batch to disk is shared.
+type committer struct {
+	bucket  backend.Bucket
+	window  time.Duration // time to gather writes before writing
+	mutex   sync.Mutex
+	queued  []*groupWrite // writes gathered for the next batch
+	writing sync.Mutex    // held while a batch is written
+}
+
+// groupWrite is a write waiting to be coalesced into a batch.
+type groupWrite struct {
+	puts, takes []kv
+	sync        bool // true if the write must be synced to disk
+	done        chan error
+}
+
+// newCommitter returns a committer writing to `bucket`, gathering writes for
+// `window` before writing them.
+func newCommitter(bucket backend.Bucket, window time.Duration) *committer {
+	return &committer{
+		bucket: bucket,
+		window: window,
+	}
+}
+
+// write puts and takes the given key values to storage, along with those of
+// any other writes made within the committer's window. The first write of
+// each batch waits for the window to pass, and for the previous batch to be
+// written, before writing the batch on behalf of every write gathered. The
+// batch is synced to disk if any write in it requires `sync`. If the batch
+// fails, every write in it fails.
+func (c *committer) write(puts, takes []kv, sync bool) error {
+	w := &groupWrite{puts: puts, takes: takes, sync: sync, done: make(chan error, 1)}
+
+	c.mutex.Lock()
+	c.queued = append(c.queued, w)
+	leader := len(c.queued) == 1
+	c.mutex.Unlock()
+
+	if leader {
+		time.Sleep(c.window)
+		c.writing.Lock()
+		c.mutex.Lock()
+		writes := c.queued
+		c.queued = nil
+		c.mutex.Unlock()
+
+		synced := false
+		for _, w := range writes {
+			synced = synced || w.sync
+		}
+		err := batch(c.bucket, synced, func(b backend.Batch) error {
+			for _, w := range writes {
+				for _, kv := range w.puts {
+					b.Put(kv.k, kv.v)
+				}
+				for _, kv := range w.takes {
+					b.Delete(kv.k)
+				}
+			}
+			return nil
+		})
+		c.writing.Unlock()
+		for _, w := range writes {
+			w.done <- err
+		}
+	}
+
+	return <-w.done
+}
@@ -0,0 +1,154 @@
+package kvq
+
+import (
+	"encoding/json"
+	"math/bits"
+	"time"
+)
+
+// Histograms count durations in log-linear buckets, in the manner of HDR
+// histograms: durations below histLinear microseconds are counted exactly,
+// and each doubling above that is split into histSub buckets, so durations
+// are recorded to within about 3% however large they are.
+const (
+	histUnit    = time.Microsecond
+	histSubBits = 5
+	histSub     = 1 << histSubBits // buckets per doubling
+	histLinear  = 2 * histSub      // durations counted exactly, in histUnit
+	histShifts  = 35               // doublings above histLinear counted
+	histBuckets = histLinear + histShifts*histSub
+)
+
+// Histogram gives the distribution of the durations of an operation, such as
+// the time taken to commit, from which percentiles can be read. Durations are
+// recorded to the microsecond, to within about 3%.
+type Histogram struct {
+	counts []int64 // by bucket; nil until a duration is recorded
+	count  int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// histBucket returns the index of the bucket counting duration `d`.
+func histBucket(d time.Duration) int {
+	if d < 0 {
+		d = 0
+	}
+	v := uint64(d / histUnit)
+	if v < histLinear {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histSubBits - 1
+	if shift > histShifts {
+		return histBuckets - 1
+	}
+	top := v >> uint(shift)
+	return histLinear + (shift-1)*histSub + int(top-histSub)
+}
+
+// histUpper returns the largest duration counted by bucket `i`.
+func histUpper(i int) time.Duration {
+	if i < histLinear {
+		return time.Duration(i) * histUnit
+	}
+	shift := (i-histLinear)/histSub + 1
+	top := uint64((i-histLinear)%histSub + histSub)
+	return time.Duration((top+1)<<uint(shift)-1) * histUnit
+}
+
+// record counts duration `d`.
+func (h *Histogram) record(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, histBuckets)
+	}
+	h.counts[histBucket(d)]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// merge counts the durations counted by another histogram.
+func (h *Histogram) merge(o Histogram) {
+	if o.count == 0 {
+		return
+	}
+	if h.counts == nil {
+		h.counts = make([]int64, histBuckets)
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.count += o.count
+	h.sum += o.sum
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// clone returns a copy of the histogram that does not share its counts.
+func (h Histogram) clone() Histogram {
+	if h.counts != nil {
+		h.counts = append([]int64{}, h.counts...)
+	}
+	return h
+}
+
+// Count returns the number of durations recorded.
+func (h Histogram) Count() int64 {
+	return h.count
+}
+
+// Mean returns the average duration recorded, or zero if none were.
+func (h Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Max returns the longest duration recorded.
+func (h Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Quantile returns the duration below which the fraction `q` of the
+// durations recorded fall, e.g. 0.99 for the 99th percentile, or zero if none
+// were recorded.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var n int64
+	for i, c := range h.counts {
+		n += c
+		if n >= rank {
+			if d := histUpper(i); d < h.max {
+				return d
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+// MarshalJSON returns the number and total of the durations recorded, and
+// their 50th and 99th percentiles, in seconds.
+func (h Histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Count int64   `json:"count"`
+		Sum   float64 `json:"sum"`
+		P50   float64 `json:"p50"`
+		P99   float64 `json:"p99"`
+	}{
+		Count: h.count,
+		Sum:   h.sum.Seconds(),
+		P50:   h.Quantile(0.5).Seconds(),
+		P99:   h.Quantile(0.99).Seconds(),
+	})
+}
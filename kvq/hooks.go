@@ -0,0 +1,86 @@
+package kvq
+
+import (
+	"time"
+)
+
+// txnHooks holds the callbacks registered on a transaction.
+type txnHooks struct {
+	beforeCommit []func(p Pending) error
+	onCommit     []func(p Pending)
+	onDiscard    []func(p Pending)
+}
+
+// BeforeCommit registers `fn` to be called with the items staged by the
+// transaction each time it is about to be committed. If `fn` returns an
+// error, the commit is vetoed: nothing is written, the transaction is left as
+// it was, and the error is returned by Commit. Hooks are called in the order
+// registered, and remain registered after the transaction is committed or
+// closed.
+func (txn *Txn) BeforeCommit(fn func(p Pending) error) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	txn.hooks.beforeCommit = append(txn.hooks.beforeCommit, fn)
+}
+
+// OnCommit registers `fn` to be called with the items written each time the
+// transaction is committed successfully, e.g. to publish to an outbox or
+// invalidate a cache. Hooks are called once the commit is complete, so may use
+// the transaction.
+func (txn *Txn) OnCommit(fn func(p Pending)) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	txn.hooks.onCommit = append(txn.hooks.onCommit, fn)
+}
+
+// OnDiscard registers `fn` to be called with the items discarded each time
+// the transaction is closed, or discarded by its timeout, with items staged.
+func (txn *Txn) OnDiscard(fn func(p Pending)) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	txn.hooks.onDiscard = append(txn.hooks.onDiscard, fn)
+}
+
+// beforeCommit calls the transaction's BeforeCommit hooks if it has items
+// staged, returning the first error.
+func (txn *Txn) beforeCommit() error {
+	txn.mutex.Lock()
+	hooks := txn.hooks.beforeCommit
+	if len(hooks) == 0 || txn.empty() {
+		txn.mutex.Unlock()
+		return nil
+	}
+	p := txn.pending()
+	txn.mutex.Unlock()
+
+	for _, fn := range hooks {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// committed calls the transaction's OnCommit hooks with the items written.
+func (txn *Txn) committed(p Pending, start time.Time) {
+	txn.queue.countCommit(p, time.Since(start))
+	txn.queue.emitPending(EventCommit, p)
+	txn.mutex.Lock()
+	hooks := txn.hooks.onCommit
+	txn.mutex.Unlock()
+	for _, fn := range hooks {
+		fn(p)
+	}
+}
+
+// discarded calls the transaction's OnDiscard hooks with the items discarded.
+func (txn *Txn) discarded(p Pending) {
+	txn.queue.countDiscard()
+	txn.queue.emitPending(EventDiscard, p)
+	txn.mutex.Lock()
+	hooks := txn.hooks.onDiscard
+	txn.mutex.Unlock()
+	for _, fn := range hooks {
+		fn(p)
+	}
+}
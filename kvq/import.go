@@ -0,0 +1,213 @@
+package kvq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+const (
+	// DefaultImportBatch is the number of items committed in each
+	// transaction by Queue.Import, unless set in ImportOptions.
+	DefaultImportBatch = 1000
+)
+
+// ImportOptions specifies how items are imported by Queue.Import.
+type ImportOptions struct {
+	// PreserveIDs keeps the IDs the items were exported with, rather than
+	// assigning new IDs, such that items keep their place in the order in
+	// which items are taken. Items whose IDs are already stored in the queue
+	// are skipped, so an interrupted import may be repeated.
+	PreserveIDs bool
+	// BatchSize is the number of items committed in each transaction. If
+	// zero, DefaultImportBatch is used.
+	BatchSize int
+}
+
+// Import puts the items in an export written by Queue.Export into the queue,
+// returning the number of items put. Items keep their values, headers,
+// priorities, schedules and other properties, and are committed in batches;
+// if importing fails, the batches already committed remain in the queue.
+// Items are new to the queue, so are given new IDs unless opts.PreserveIDs is
+// set. If opts is nil, the defaults are used.
+func (q *Queue) Import(r io.Reader, opts *ImportOptions) (int, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	size := opts.BatchSize
+	if size <= 0 {
+		size = DefaultImportBatch
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != exportMagic {
+		return 0, ErrInvalidExport
+	}
+
+	txn := q.Transaction()
+	defer txn.Close()
+	imported, pending := 0, 0
+	commit := func() error {
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+		imported += pending
+		pending = 0
+		return nil
+	}
+
+	for {
+		t, err := br.ReadByte()
+		if err != nil {
+			return imported, ErrInvalidExport
+		}
+		switch t {
+		case frameEnd:
+			return imported, commit()
+		case frameMessage:
+			body, err := readFrameBytes(br)
+			if err != nil {
+				return imported, ErrInvalidExport
+			}
+			id, priority, rec, err := decodeExported(body)
+			if err != nil {
+				return imported, err
+			}
+			ok, err := q.importRecord(txn, id, priority, rec, opts.PreserveIDs)
+			if err != nil {
+				return imported, err
+			}
+			if ok {
+				pending++
+			}
+			if pending >= size {
+				if err := commit(); err != nil {
+					return imported, err
+				}
+			}
+		default:
+			return imported, ErrInvalidExport
+		}
+	}
+}
+
+// importRecord stages an imported item to be put by the transaction, keeping
+// its ID if `preserve` is set, unless the queue already stores an item with
+// the ID. Returns false if the item is skipped.
+func (q *Queue) importRecord(txn *Txn, id MessageID, priority uint8, r *record, preserve bool) (bool, error) {
+	if !preserve {
+		ids, err := txn.putRecords([]*record{r}, []uint8{priority})
+		if err != nil {
+			return false, err
+		}
+		return ids[0] != "", nil
+	}
+
+	if q.readOnly {
+		return false, ErrReadOnly
+	}
+	e, err := internal.KeyToEntry([]byte(id))
+	if err != nil || e.Legacy() {
+		return false, ErrInvalidExport
+	}
+	if r.available(time.Now()) {
+		r.availableAt = 0
+	}
+	if _, err := q.bucket.Get(e.Key()); err == nil {
+		return false, nil
+	} else if err != backend.ErrKeyNotFound {
+		return false, err
+	}
+	if err := q.skipPast(e.ID); err != nil {
+		return false, err
+	}
+	ids, err := txn.putEntries([]internal.Entry{e}, []*record{r})
+	if err != nil {
+		return false, err
+	}
+	return ids[0] != "", nil
+}
+
+// skipPast advances the queue's sequence past `id`, such that items put
+// later are not given it.
+func (q *Queue) skipPast(id internal.ID) error {
+	q.mutex.Lock()
+	n := int(id + 1 - q.seq)
+	q.mutex.Unlock()
+	if n <= 0 {
+		return nil
+	}
+	_, err := q.nextIDs(n)
+	return err
+}
+
+// decodeExported parses the fields of an exported item, returning its ID,
+// priority and record. Fields with unknown tags are skipped.
+func decodeExported(b []byte) (MessageID, uint8, *record, error) {
+	var id MessageID
+	var priority uint8
+	r := &record{}
+	for len(b) > 0 {
+		tag := b[0]
+		n, i := binary.Uvarint(b[1:])
+		if i <= 0 || uint64(len(b)-1-i) < n {
+			return "", 0, nil, ErrInvalidExport
+		}
+		data := append([]byte{}, b[1+i:1+i+int(n)]...)
+		b = b[1+i+int(n):]
+
+		switch tag {
+		case fieldID:
+			id = MessageID(data)
+		case fieldValue:
+			r.value = data
+		case fieldHeader:
+			n, i := binary.Uvarint(data)
+			if i <= 0 || uint64(len(data)-i) < n {
+				return "", 0, nil, ErrInvalidExport
+			}
+			if r.headers == nil {
+				r.headers = map[string]string{}
+			}
+			r.headers[string(data[i:i+int(n)])] = string(data[i+int(n):])
+		case fieldPriority, fieldSchema:
+			if len(data) != 1 {
+				return "", 0, nil, ErrInvalidExport
+			}
+			if tag == fieldPriority {
+				priority = data[0]
+			} else {
+				r.schema = data[0]
+			}
+		case fieldGroup:
+			r.group = string(data)
+		case fieldAttempts:
+			n, i := binary.Uvarint(data)
+			if i <= 0 {
+				return "", 0, nil, ErrInvalidExport
+			}
+			r.attempts = int(n)
+		case fieldAvailableAt, fieldExpiresAt:
+			if len(data) != 8 {
+				return "", 0, nil, ErrInvalidExport
+			}
+			ns := int64(binary.BigEndian.Uint64(data))
+			if tag == fieldAvailableAt {
+				r.availableAt = ns
+			} else {
+				r.expiresAt = ns
+			}
+		case fieldDedupKey:
+			r.dedupKey = string(data)
+		}
+	}
+	if r.value == nil {
+		return "", 0, nil, ErrInvalidExport
+	}
+	return id, priority, r, nil
+}
@@ -0,0 +1,136 @@
+package kvq
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+const (
+	// inFlightPrefix prefixes the metadata keys journalling the items taken
+	// by transactions that have not yet been committed or discarded.
+	inFlightPrefix = "inflight/"
+)
+
+// InFlight returns the IDs of the items taken by transactions on the queue
+// that have not yet been committed or discarded, in the order they would be
+// taken, as recorded in the queue's take journal. Returns nothing unless the
+// queue was opened with JournalTakes.
+func (q *Queue) InFlight() ([]MessageID, error) {
+	entries := []internal.Entry{}
+	err := q.meta.ForEach(func(k, v []byte) error {
+		if name := string(k); strings.HasPrefix(name, inFlightPrefix) {
+			e, err := internal.KeyToEntry([]byte(strings.TrimPrefix(name, inFlightPrefix)))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Before(entries[j])
+	})
+	ids := make([]MessageID, len(entries))
+	for i, e := range entries {
+		ids[i] = MessageID(e.Key())
+	}
+	return ids, nil
+}
+
+// journal records the items with the given keys as taken in the queue's take
+// journal, if it has one.
+func (q *Queue) journal(keys [][]byte) error {
+	if !q.opts.JournalTakes || len(keys) == 0 {
+		return nil
+	}
+	now := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	return q.meta.Batch(func(b backend.Batch) error {
+		for _, k := range keys {
+			if err := b.Put([]byte(inFlightPrefix+string(k)), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unjournal removes the given entries from the queue's take journal, if it
+// has one, once they are no longer taken.
+func (q *Queue) unjournal(entries ...internal.Entry) error {
+	if !q.opts.JournalTakes || len(entries) == 0 {
+		return nil
+	}
+	return q.meta.Batch(func(b backend.Batch) error {
+		for _, e := range entries {
+			if err := b.Delete([]byte(inFlightPrefix + string(e.Key()))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// initInFlight recovers the items that were taken when the queue was last
+// closed, as recorded in its take journal, returning them to the queue as if
+// the transactions taking them had been discarded, such that an attempt is
+// counted against each. Items held by prepared transactions remain taken.
+func (q *Queue) initInFlight() error {
+	if !q.opts.JournalTakes || q.readOnly {
+		return nil
+	}
+
+	keys := [][]byte{}
+	err := q.meta.ForEach(func(k, v []byte) error {
+		if name := string(k); strings.HasPrefix(name, inFlightPrefix) {
+			keys = append(keys, []byte(strings.TrimPrefix(name, inFlightPrefix)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entries := []internal.Entry{}
+	records := []record{}
+	gone := []internal.Entry{}
+	for _, k := range keys {
+		e, err := internal.KeyToEntry(k)
+		if err != nil {
+			return err
+		}
+		v, err := q.bucket.Get(k)
+		if err == backend.ErrKeyNotFound {
+			// Removed by a commit that failed to update the journal
+			gone = append(gone, e)
+			continue
+		} else if err != nil {
+			return err
+		}
+		r := record{value: v}
+		if !e.Legacy() {
+			if r, err = decodeRecord(v); err != nil {
+				return err
+			}
+		}
+		if !q.claim(e) && !q.unschedule(e) {
+			// Held by a prepared transaction
+			continue
+		}
+		entries = append(entries, e)
+		records = append(records, r)
+	}
+
+	if err := q.unjournal(gone...); err != nil {
+		return err
+	}
+	return q.discard(entries, records, 0)
+}
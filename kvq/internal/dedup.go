@@ -0,0 +1,43 @@
+package internal
+
+// DedupIndex maps deduplication keys to the entries that hold them. The zero
+// value is an empty index.
+type DedupIndex struct {
+	entries map[string]Entry
+	keys    map[Entry]string
+}
+
+// Len returns the number of keys in the index.
+func (d *DedupIndex) Len() int {
+	return len(d.entries)
+}
+
+// Has returns true if the given key is held by an entry.
+func (d *DedupIndex) Has(key string) bool {
+	_, ok := d.entries[key]
+	return ok
+}
+
+// Add records that the key is held by the given entry.
+func (d *DedupIndex) Add(key string, e Entry) {
+	if d.entries == nil {
+		d.entries = map[string]Entry{}
+		d.keys = map[Entry]string{}
+	}
+	d.entries[key] = e
+	d.keys[e] = key
+}
+
+// Remove removes the key held by the given entry, if any.
+func (d *DedupIndex) Remove(e Entry) {
+	if key, ok := d.keys[e]; ok {
+		delete(d.entries, key)
+		delete(d.keys, e)
+	}
+}
+
+// Reset removes all keys from the index.
+func (d *DedupIndex) Reset() {
+	d.entries = nil
+	d.keys = nil
+}
@@ -0,0 +1,96 @@
+package internal
+
+// MessageGroups tracks the message groups of entries, such that only one
+// entry of each group, its holder, is available or being taken at a time.
+// Other entries of the group wait behind the holder in the order in which
+// they should be taken. The zero value is empty.
+type MessageGroups struct {
+	groups  map[Entry]string     // message group of each entry
+	holders map[string]Entry     // entry holding each group
+	waiting map[string]EntryHeap // entries waiting behind each holder
+	blocked int                  // total number of waiting entries
+}
+
+// Add records that the entry belongs to the given message group.
+func (g *MessageGroups) Add(e Entry, group string) {
+	if g.groups == nil {
+		g.groups = map[Entry]string{}
+		g.holders = map[string]Entry{}
+		g.waiting = map[string]EntryHeap{}
+	}
+	g.groups[e] = group
+}
+
+// Hold returns true if the entry may be made available, in which case it
+// becomes the holder of its group. Entries not in a group may always be made
+// available. Otherwise, false is returned and the entry waits until the
+// entries before it have been removed.
+func (g *MessageGroups) Hold(e Entry) bool {
+	group, ok := g.groups[e]
+	if !ok {
+		return true
+	}
+	if holder, held := g.holders[group]; held && holder != e {
+		waiting := g.waiting[group]
+		waiting.PushEntry(e)
+		g.waiting[group] = waiting
+		g.blocked++
+		return false
+	}
+	g.holders[group] = e
+	return true
+}
+
+// Remove forgets the entry. If the entry held its group, the next waiting
+// entry of the group becomes the holder, and is returned along with true.
+func (g *MessageGroups) Remove(e Entry) (Entry, bool) {
+	group, ok := g.groups[e]
+	if !ok {
+		return Entry{}, false
+	}
+	delete(g.groups, e)
+
+	waiting := g.waiting[group]
+	if holder := g.holders[group]; holder != e {
+		// Removed while waiting
+		if waiting.Remove(e) {
+			g.blocked--
+		}
+		g.waiting[group] = waiting
+		return Entry{}, false
+	}
+	if len(waiting) == 0 {
+		delete(g.holders, group)
+		delete(g.waiting, group)
+		return Entry{}, false
+	}
+	next := waiting.PopEntry()
+	g.waiting[group] = waiting
+	g.holders[group] = next
+	g.blocked--
+	return next, true
+}
+
+// Waiting returns true if the entry is waiting behind its group's holder.
+func (g *MessageGroups) Waiting(e Entry) bool {
+	group, ok := g.groups[e]
+	if !ok || g.holders[group] == e {
+		return false
+	}
+	for _, w := range g.waiting[group] {
+		if w == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocked returns the number of entries waiting behind their group's holder.
+func (g *MessageGroups) Blocked() int {
+	return g.blocked
+}
+
+// Reset forgets all entries.
+func (g *MessageGroups) Reset() {
+	*g = MessageGroups{}
+}
@@ -4,62 +4,169 @@ import (
 	"container/heap"
 	"encoding/binary"
 	"fmt"
-	"log"
+)
+
+// ID is the sequence number of an item within a queue.
+type ID uint64
+
+const (
+	NilID ID = 0
+)
 
-	"github.com/sdming/gosnow"
+const (
+	// KeySize is the length of keys generated by Entry.Key.
+	KeySize = 9
+	// legacyKeySize is the length of keys written before priorities were
+	// introduced, consisting of a uvarint-encoded ID padded with zeroes.
+	legacyKeySize = 16
 )
 
-var snow *gosnow.SnowFlake
+// Entry identifies an item in a queue.
+type Entry struct {
+	ID       ID
+	Priority uint8
+
+	legacy bool // key uses the legacy encoding
+}
 
-func init() {
-	var err error
-	snow, err = gosnow.Default()
-	if err != nil {
-		log.Fatalln(err)
+// KeyToEntry converts a key to an Entry. Keys written by earlier versions,
+// which contain only an ID, are given the lowest priority.
+func KeyToEntry(k []byte) (Entry, error) {
+	switch len(k) {
+	case KeySize:
+		return Entry{
+			ID:       ID(binary.BigEndian.Uint64(k[1:])),
+			Priority: 0xff - k[0],
+		}, nil
+	case legacyKeySize:
+		id, n := binary.Uvarint(k)
+		if n <= 0 {
+			break
+		}
+		return Entry{ID: ID(id), legacy: true}, nil
 	}
+	return Entry{}, fmt.Errorf("couldn't parse key: %q", k)
 }
 
-type ID uint64
+// Legacy returns true if the entry's key uses the encoding written before
+// priorities were introduced. Values of legacy entries are stored as-is,
+// rather than as records.
+func (e Entry) Legacy() bool {
+	return e.legacy
+}
 
-const (
-	NilID ID = 0
-)
+// Key returns the byte representation of this entry. Keys consist of the
+// inverted priority followed by the big-endian ID, such that keys sort in the
+// order in which entries should be taken.
+func (e Entry) Key() []byte {
+	if e.legacy {
+		k := make([]byte, legacyKeySize)
+		binary.PutUvarint(k, uint64(e.ID))
+		return k
+	}
+	k := make([]byte, KeySize)
+	k[0] = 0xff - e.Priority
+	binary.BigEndian.PutUint64(k[1:], uint64(e.ID))
+	return k
+}
 
-// NewID generates an ID based on the current time.
-func NewID() ID {
-	id, err := snow.Next()
-	if err != nil {
-		panic(err)
+// Before returns true if this entry should be taken before entry `o`; that
+// is, if it has a higher priority, or has equal priority and a lower ID.
+func (e Entry) Before(o Entry) bool {
+	if e.Priority != o.Priority {
+		return e.Priority > o.Priority
 	}
-	return ID(id)
+	return e.ID < o.ID
+}
+
+// StackBefore returns true if this entry should be taken before entry `o`
+// from a StackHeap; that is, if it has a higher priority, or has equal
+// priority and a higher ID.
+func (e Entry) StackBefore(o Entry) bool {
+	if e.Priority != o.Priority {
+		return e.Priority > o.Priority
+	}
+	return e.ID > o.ID
+}
+
+// Entries is a sorted set of Entries from which the entry to be taken next
+// can be popped.
+type Entries interface {
+	Len() int
+	// PopEntry pops the first Entry from the set.
+	PopEntry() Entry
+	// PushEntry pushes an Entry onto the set.
+	PushEntry(e Entry)
+	// Remove removes the given Entry from the set, returning false if it was
+	// not present.
+	Remove(e Entry) bool
+	// All returns a copy of the Entries in the set, in no particular order.
+	All() []Entry
 }
 
-// KeyToID converts a key to an ID.
-func KeyToID(k []byte) (ID, error) {
-	id, n := binary.Uvarint(k)
-	if n <= 0 {
-		return NilID, fmt.Errorf("couldn't parse key: " + string(k))
+// EntryHeap is a sorted set of Entries, ordered such that the entry to be
+// taken next is at the top.
+type EntryHeap []Entry
+
+func (h EntryHeap) Len() int            { return len(h) }
+func (h EntryHeap) Less(i, j int) bool  { return h[i].Before(h[j]) }
+func (h EntryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *EntryHeap) Push(x interface{}) { *h = append(*h, x.(Entry)) }
+func (h *EntryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// PopEntry pops the first Entry from the heap.
+func (h *EntryHeap) PopEntry() Entry {
+	if len(*h) == 0 {
+		return Entry{}
 	}
-	return ID(id), nil
+	e := heap.Pop(h)
+	return e.(Entry)
 }
 
-// Key returns the byte representation of this ID.
-func (id ID) Key() []byte {
-	k := make([]byte, 16)
-	if binary.PutUvarint(k, uint64(id)) <= 0 {
-		panic("couldn't write key")
+// PushEntry pushes an Entry onto the heap.
+func (h *EntryHeap) PushEntry(e Entry) {
+	heap.Push(h, e)
+}
+
+// Remove removes the given Entry from the heap, returning false if it was not
+// present.
+func (h *EntryHeap) Remove(e Entry) bool {
+	for i := range *h {
+		if (*h)[i] == e {
+			heap.Remove(h, i)
+			return true
+		}
 	}
-	return k
+	return false
 }
 
-// IDHeap is a sorted set of IDs.
-type IDHeap []ID
+// All returns a copy of the Entries in the heap, in no particular order.
+func (h *EntryHeap) All() []Entry {
+	return append([]Entry{}, *h...)
+}
+
+// NewEntryHeap constructs a new Entry heap.
+func NewEntryHeap() *EntryHeap {
+	h := &EntryHeap{}
+	heap.Init(h)
+	return h
+}
+
+// StackHeap is a sorted set of Entries, ordered as an EntryHeap except that
+// entries of equal priority are ordered newest (highest ID) first.
+type StackHeap []Entry
 
-func (h IDHeap) Len() int            { return len(h) }
-func (h IDHeap) Less(i, j int) bool  { return h[i] < h[j] }
-func (h IDHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
-func (h *IDHeap) Push(x interface{}) { *h = append(*h, x.(ID)) }
-func (h *IDHeap) Pop() interface{} {
+func (h StackHeap) Len() int            { return len(h) }
+func (h StackHeap) Less(i, j int) bool  { return h[i].StackBefore(h[j]) }
+func (h StackHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *StackHeap) Push(x interface{}) { *h = append(*h, x.(Entry)) }
+func (h *StackHeap) Pop() interface{} {
 	old := *h
 	n := len(old)
 	x := old[n-1]
@@ -67,23 +174,40 @@ func (h *IDHeap) Pop() interface{} {
 	return x
 }
 
-// PopID pops the first ID from the heap.
-func (h *IDHeap) PopID() ID {
+// PopEntry pops the first Entry from the heap.
+func (h *StackHeap) PopEntry() Entry {
 	if len(*h) == 0 {
-		return NilID
+		return Entry{}
+	}
+	e := heap.Pop(h)
+	return e.(Entry)
+}
+
+// PushEntry pushes an Entry onto the heap.
+func (h *StackHeap) PushEntry(e Entry) {
+	heap.Push(h, e)
+}
+
+// Remove removes the given Entry from the heap, returning false if it was not
+// present.
+func (h *StackHeap) Remove(e Entry) bool {
+	for i := range *h {
+		if (*h)[i] == e {
+			heap.Remove(h, i)
+			return true
+		}
 	}
-	id := heap.Pop(h)
-	return id.(ID)
+	return false
 }
 
-// PushID pushes an ID onto the heap.
-func (h *IDHeap) PushID(id ID) {
-	heap.Push(h, id)
+// All returns a copy of the Entries in the heap, in no particular order.
+func (h *StackHeap) All() []Entry {
+	return append([]Entry{}, *h...)
 }
 
-// NewIDHeap constructs a new ID heap.
-func NewIDHeap() *IDHeap {
-	h := &IDHeap{}
+// NewStackHeap constructs a new, empty StackHeap.
+func NewStackHeap() *StackHeap {
+	h := &StackHeap{}
 	heap.Init(h)
 	return h
 }
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket rate limiter.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // maximum tokens held
+	tokens float64
+	last   time.Time // time tokens were last added
+}
+
+// NewLimiter returns a limiter allowing `rate` tokens per second, holding at
+// most `burst` tokens. If burst is less than one, it is the rate rounded up,
+// or one if greater.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait waits at most `t` for at least `min` tokens to become available, then
+// takes up to `max` tokens, returning the number taken. Zero is returned if
+// the tokens could not be taken in time, or if `done` is closed first.
+func (l *Limiter) Wait(min, max int, t time.Duration, done <-chan struct{}) int {
+	if float64(min) > l.burst {
+		// Can never be satisfied
+		return 0
+	}
+	deadline := time.Now().Add(t)
+	for {
+		l.mutex.Lock()
+		now := time.Now()
+		l.refill(now)
+		if l.tokens >= float64(min) {
+			n := int(math.Min(float64(max), math.Floor(l.tokens)))
+			l.tokens -= float64(n)
+			l.mutex.Unlock()
+			return n
+		}
+		wait := time.Duration((float64(min) - l.tokens) / l.rate * float64(time.Second))
+		l.mutex.Unlock()
+
+		if now.Add(wait).After(deadline) {
+			return 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return 0
+		}
+	}
+}
+
+// Return returns `n` unused tokens to the limiter.
+func (l *Limiter) Return(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+float64(n))
+}
+
+// refill adds the tokens accrued since they were last added. The caller must
+// hold the limiter mutex.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
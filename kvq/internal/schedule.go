@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"container/heap"
+)
+
+// Scheduled is an Entry that becomes available at a particular time.
+type Scheduled struct {
+	Entry
+	At int64 // Unix nanoseconds
+}
+
+// ScheduleHeap is a set of Scheduled entries, ordered such that the entry
+// due soonest is at the top. The zero value is an empty heap.
+type ScheduleHeap []Scheduled
+
+func (h ScheduleHeap) Len() int { return len(h) }
+func (h ScheduleHeap) Less(i, j int) bool {
+	if h[i].At != h[j].At {
+		return h[i].At < h[j].At
+	}
+	return h[i].Before(h[j].Entry)
+}
+func (h ScheduleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *ScheduleHeap) Push(x interface{}) { *h = append(*h, x.(Scheduled)) }
+func (h *ScheduleHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// Next returns the entry due soonest without removing it. The heap must not
+// be empty.
+func (h ScheduleHeap) Next() Scheduled {
+	return h[0]
+}
+
+// PopScheduled pops the entry due soonest from the heap.
+func (h *ScheduleHeap) PopScheduled() Scheduled {
+	return heap.Pop(h).(Scheduled)
+}
+
+// PushScheduled pushes a Scheduled entry onto the heap.
+func (h *ScheduleHeap) PushScheduled(s Scheduled) {
+	heap.Push(h, s)
+}
+
+// Find returns the Scheduled entry for the given Entry, returning false if it
+// is not present.
+func (h ScheduleHeap) Find(e Entry) (Scheduled, bool) {
+	for _, s := range h {
+		if s.Entry == e {
+			return s, true
+		}
+	}
+	return Scheduled{}, false
+}
+
+// Remove removes the Scheduled entry for the given Entry from the heap,
+// returning false if it was not present.
+func (h *ScheduleHeap) Remove(e Entry) bool {
+	for i := range *h {
+		if (*h)[i].Entry == e {
+			heap.Remove(h, i)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveScheduled removes the given Scheduled entry from the heap, returning
+// false if it was not present with the same time.
+func (h *ScheduleHeap) RemoveScheduled(s Scheduled) bool {
+	for i := range *h {
+		if (*h)[i] == s {
+			heap.Remove(h, i)
+			return true
+		}
+	}
+	return false
+}
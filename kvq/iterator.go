@@ -0,0 +1,134 @@
+package kvq
+
+import (
+	"sort"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+// view is a readable set of keys, either a bucket or a snapshot of one.
+type view interface {
+	ForEach(fn func(k, v []byte) error) error
+	Get(k []byte) ([]byte, error)
+}
+
+// Iterator iterates over the items stored in a queue in the order in which
+// they would be taken, without taking them. See Queue.Iterator.
+type Iterator struct {
+	view    view
+	snap    backend.Snapshot // nil if the backend can't take snapshots
+	entries []internal.Entry // entries remaining, in order
+	msg     *Message
+	rec     record // record of the current item
+	err     error
+}
+
+// Iterator returns an iterator over all items stored in the queue, including
+// those scheduled for the future and those being taken, in the order in which
+// they would be taken. Items are not taken or otherwise modified. Where the
+// backend supports snapshots, the iterator reads a consistent snapshot of the
+// queue; otherwise, items taken during iteration are skipped and items put
+// during iteration are not visited. The iterator must be closed when no
+// longer required.
+func (q *Queue) Iterator() (*Iterator, error) {
+	it := &Iterator{view: q.bucket}
+	if s, ok := q.bucket.(backend.Snapshotter); ok {
+		snap, err := s.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		it.view, it.snap = snap, snap
+	}
+
+	err := it.view.ForEach(func(k, v []byte) error {
+		e, err := internal.KeyToEntry(k)
+		if err != nil {
+			return err
+		}
+		it.entries = append(it.entries, e)
+		return nil
+	})
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	q.order(it.entries)
+	return it, nil
+}
+
+// order sorts the entries into the order in which they would be taken.
+func (q *Queue) order(entries []internal.Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if q.opts.LIFO {
+			return entries[i].StackBefore(entries[j])
+		}
+		return entries[i].Before(entries[j])
+	})
+}
+
+// ForEach calls `fn` for each item stored in the queue, in the order in which
+// they would be taken, as with Iterator. If `fn` returns a non-nil error,
+// iteration stops and the error is returned to the caller.
+func (q *Queue) ForEach(fn func(m *Message) error) error {
+	it, err := q.Iterator()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		if err := fn(it.Message()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// Next advances the iterator to the next item, returning false when there are
+// no more items or an error occurred.
+func (it *Iterator) Next() bool {
+	it.msg = nil
+	for it.err == nil && len(it.entries) > 0 {
+		e := it.entries[0]
+		it.entries = it.entries[1:]
+
+		v, err := it.view.Get(e.Key())
+		if err == backend.ErrKeyNotFound {
+			// Removed since iteration began
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+
+		r := record{value: v}
+		if !e.Legacy() {
+			if r, err = decodeRecord(v); err != nil {
+				it.err = err
+				return false
+			}
+		}
+		it.msg, it.rec = newMessage(e, r), r
+		return true
+	}
+	return false
+}
+
+// Message returns the current item.
+func (it *Iterator) Message() *Message {
+	return it.msg
+}
+
+// Err returns the error that stopped iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the resources held by the iterator.
+func (it *Iterator) Close() {
+	if it.snap != nil {
+		it.snap.Close()
+		it.snap = nil
+	}
+	it.entries = nil
+}
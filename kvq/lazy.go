@@ -0,0 +1,190 @@
+package kvq
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+// DefaultLoadChunk is the number of items loaded at a time by queues opened
+// with LazyLoad, unless QueueOptions.LoadChunk is given.
+const DefaultLoadChunk = 1000
+
+// loader tracks the progress of loading a queue's stored items lazily.
+type loader struct {
+	limit  internal.ID   // items from this ID on were put since opening
+	cursor []byte        // key of the last item loaded, or nil if none
+	done   bool          // true once every stored item has been loaded
+	gen    int           // incremented when the queue is cleared
+	c      chan struct{} // signals that more items should be loaded
+}
+
+// lazyLoads returns true if the queue should load its items lazily. This
+// requires the queue's sequence to have been stored, such that items put
+// later can be told apart from those yet to be loaded, and no transactions
+// to be restored that hold items. LIFO queues take the most recent items
+// first, and queues with a quota must count every item stored against it, so
+// both must load every item.
+func (q *Queue) lazyLoads(seqStored bool) (bool, error) {
+	if !q.opts.LazyLoad || !seqStored || q.opts.JournalTakes || q.opts.LIFO ||
+		q.opts.Quota != nil {
+		return false, nil
+	}
+	prepared := false
+	err := q.meta.ForEach(func(k, v []byte) error {
+		if strings.HasPrefix(string(k), preparedPrefix) {
+			prepared = true
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return false, err
+	}
+	return !prepared, nil
+}
+
+// initLoader prepares the queue to load its items lazily, loading the first
+// chunk of them.
+func (q *Queue) initLoader() error {
+	q.loader = &loader{
+		limit: q.seq,
+		c:     make(chan struct{}, 1),
+	}
+	return q.loadChunk()
+}
+
+// loadChunkSize returns the number of items loaded at a time.
+func (q *Queue) loadChunkSize() int {
+	if q.opts.LoadChunk > 0 {
+		return q.opts.LoadChunk
+	}
+	return DefaultLoadChunk
+}
+
+// loading returns true if the queue has stored items that are yet to be
+// loaded. The caller must hold the queue mutex.
+func (q *Queue) loading() bool {
+	return q.loader != nil && !q.loader.done
+}
+
+// wantLoad asks for more items to be loaded if few remain available for
+// taking. The caller must hold the queue mutex.
+func (q *Queue) wantLoad() {
+	if !q.loading() || len(q.c) >= q.loadChunkSize()/2 {
+		return
+	}
+	select {
+	case q.loader.c <- struct{}{}:
+	default:
+		// Already asked
+	}
+}
+
+// runLoader loads items when asked by wantLoad, until every stored item has
+// been loaded or the queue is closed. Failures are retried when next asked.
+func (q *Queue) runLoader() {
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-q.loader.c:
+		}
+		q.loadChunk()
+
+		q.mutex.Lock()
+		done := q.loader.done
+		q.mutex.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// loadChunk loads the stored items following those already loaded, in key
+// order, up to a chunk of them or as many as the queue has room for.
+func (q *Queue) loadChunk() error {
+	q.mutex.Lock()
+	l := q.loader
+	n := q.free()
+	if chunk := q.loadChunkSize(); n > chunk {
+		n = chunk
+	}
+	if l.done || n <= 0 {
+		q.mutex.Unlock()
+		return nil
+	}
+	cursor, gen := l.cursor, l.gen
+	q.mutex.Unlock()
+
+	items := []kv{}
+	exhausted := true
+	err := forEachFrom(q.bucket, cursor, func(k, v []byte) error {
+		if cursor != nil && bytes.Compare(k, cursor) <= 0 {
+			return nil
+		}
+		if len(items) == n {
+			exhausted = false
+			return errStop
+		}
+		items = append(items, kv{
+			append([]byte{}, k...),
+			append([]byte{}, v...),
+		})
+		return nil
+	})
+	if err != nil && err != errStop {
+		return err
+	}
+
+	q.mutex.Lock()
+	if l.gen != gen {
+		// Cleared while reading
+		q.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	corrupt := []kv{}
+	for _, kv := range items {
+		if q.free() < 1 {
+			// Filled by puts while reading
+			exhausted = false
+			break
+		}
+		e, err := internal.KeyToEntry(kv.k)
+		if err != nil {
+			q.mutex.Unlock()
+			return err
+		}
+		l.cursor = kv.k
+		if e.ID >= l.limit {
+			// Already added when put
+			continue
+		}
+		if err := q.addStored(e, kv.v, now); err == ErrCorruptRecord && q.poison != nil {
+			corrupt = append(corrupt, kv)
+		} else if err != nil {
+			q.mutex.Unlock()
+			return err
+		}
+	}
+	l.done = exhausted
+	q.resetTimer()
+	q.resetSweeper()
+	q.signal()
+	q.mutex.Unlock()
+
+	return q.quarantine(corrupt)
+}
+
+// forEachFrom iterates through the keys in the bucket from `start` onwards,
+// where the bucket supports it, or otherwise through every key.
+func forEachFrom(bucket backend.Bucket, start []byte, fn func(k, v []byte) error) error {
+	if s, ok := bucket.(backend.Seeker); ok && start != nil {
+		return s.ForEachFrom(start, fn)
+	}
+	return bucket.ForEach(fn)
+}
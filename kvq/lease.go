@@ -0,0 +1,218 @@
+package kvq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+var (
+	// ErrLeaseExpired is returned when acknowledging a lease whose visibility
+	// timeout has already elapsed, such that the item has been returned to the
+	// queue.
+	ErrLeaseExpired = errors.New("lease expired")
+)
+
+// Lease is an item taken from a queue with a visibility timeout. Until the
+// lease is acknowledged, the item is hidden from other takers; if it is not
+// acknowledged before the timeout elapses, it is returned to the queue.
+type Lease struct {
+	Message
+
+	queue  *Queue
+	s      internal.Scheduled
+	record record
+	mutex  *sync.Mutex
+}
+
+// Lease takes up to `n` items from the queue, waiting at most `t` for them to
+// become available, and hides them from other takers for the duration of
+// `visibility`. Unlike items taken by a Txn, the visibility deadline is stored
+// with each item, so items leased by a consumer that crashes are returned to
+// the queue once the timeout elapses, even if the queue is reopened. Items put
+// by versions prior to priorities being introduced are only hidden until the
+// queue is reopened.
+func (q *Queue) Lease(n int, t, visibility time.Duration) ([]*Lease, error) {
+	return q.lease(n, t, nil, visibility)
+}
+
+// LeaseContext leases up to `n` items from the queue as with Lease, waiting
+// until at least one becomes available or `ctx` is done, in which case the
+// context's error is returned.
+func (q *Queue) LeaseContext(ctx context.Context, n int, visibility time.Duration) ([]*Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	leases, err := q.lease(n, contextWait(ctx), ctx.Done(), visibility)
+	if leases == nil && err == nil {
+		err = contextErr(ctx)
+	}
+	return leases, err
+}
+
+// lease leases up to `n` items from the queue, waiting at most `t`, or until
+// `done` is closed, for them to become available.
+func (q *Queue) lease(n int, t time.Duration, done <-chan struct{}, visibility time.Duration) ([]*Lease, error) {
+	if q.readOnly {
+		return nil, ErrReadOnly
+	}
+	if q.isClosed() {
+		return nil, ErrClosed
+	}
+	done, stop := q.closing(done)
+	defer stop()
+
+	// Wait for turn to take
+	if d := q.dispatcher; d != nil {
+		var ok bool
+		if t, ok = d.acquire(nil, t, done); !ok {
+			return nil, q.closedErr()
+		}
+		defer d.release(nil)
+	}
+
+	// Wait for the rate limit to allow items to be taken
+	if n, t = q.limitTakes(1, n, t, done); n == 0 {
+		return nil, q.closedErr()
+	}
+
+	ids, keys, records, err := q.take(n, t, done)
+	q.unlimitTakes(n - len(ids))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, q.closedErr()
+	}
+
+	// Store the visibility deadline with each item, counting an attempt in
+	// case the lease is never acknowledged.
+	at := time.Now().Add(visibility).UnixNano()
+	updates := make([]kv, 0, len(ids))
+	for i, e := range ids {
+		if e.Legacy() {
+			continue
+		}
+		r := records[i]
+		r.availableAt = at
+		r.attempts++
+		updates = append(updates, kv{keys[i], r.encode()})
+	}
+	if err := q.enact(updates, nil); err != nil {
+		q.putKey(ids...)
+		return nil, err
+	}
+
+	// Return items to the queue when the deadline passes
+	leases := make([]*Lease, len(ids))
+	scheduled := make([]internal.Scheduled, len(ids))
+	for i, e := range ids {
+		scheduled[i] = internal.Scheduled{Entry: e, At: at}
+		leases[i] = &Lease{
+			Message: *newMessage(e, records[i]),
+			queue:   q,
+			s:       scheduled[i],
+			record:  records[i],
+			mutex:   &sync.Mutex{},
+		}
+	}
+	if _, err := q.schedule(scheduled...); err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
+
+// Ack acknowledges that the item has been processed, removing it from the
+// queue. Returns ErrLeaseExpired if the visibility timeout has elapsed.
+func (l *Lease) Ack() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.revoke() {
+		return ErrLeaseExpired
+	}
+	k := l.s.Key()
+	if err := l.queue.recordProcessed([]kv{{k: k}}, []record{l.record}); err != nil {
+		return err
+	}
+	err := l.queue.bucket.Batch(func(b backend.Batch) error {
+		return b.Delete(k)
+	})
+	if err != nil {
+		return err
+	}
+	l.queue.forget(l.s.Entry)
+	return nil
+}
+
+// Nack returns the item to the queue immediately, incrementing its attempt
+// count as if a transaction holding it had been closed. Returns
+// ErrLeaseExpired if the visibility timeout has elapsed.
+func (l *Lease) Nack() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.revoke() {
+		return ErrLeaseExpired
+	}
+	return l.queue.discard([]internal.Entry{l.s.Entry}, []record{l.record}, 0)
+}
+
+// Renew extends the lease such that the item remains hidden from other takers
+// until `visibility` from now, allowing long-running processing to send
+// periodic heartbeats rather than choosing a long visibility timeout up front.
+// As with the original deadline, the new deadline is stored with the item, so
+// survives the queue being reopened. Returns ErrLeaseExpired if the visibility
+// timeout has already elapsed. Renew may be called concurrently with Ack and
+// Nack.
+func (l *Lease) Renew(visibility time.Duration) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.revoke() {
+		return ErrLeaseExpired
+	}
+
+	s := internal.Scheduled{
+		Entry: l.s.Entry,
+		At:    time.Now().Add(visibility).UnixNano(),
+	}
+	if !s.Legacy() {
+		// Stored record already counts this attempt
+		r := l.record
+		r.availableAt = s.At
+		r.attempts++
+		if err := l.queue.enact([]kv{{s.Key(), r.encode()}}, nil); err != nil {
+			l.queue.schedule(l.s)
+			return err
+		}
+	}
+	if _, err := l.queue.schedule(s); err != nil {
+		return err
+	}
+	l.s = s
+	return nil
+}
+
+// Deadline returns the time at which the item is returned to the queue if the
+// lease is not acknowledged or renewed.
+func (l *Lease) Deadline() time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return time.Unix(0, l.s.At)
+}
+
+// revoke cancels the scheduled return of the item to the queue, returning
+// false if it has already been returned.
+func (l *Lease) revoke() bool {
+	q := l.queue
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.scheduled.RemoveScheduled(l.s) {
+		return false
+	}
+	q.resetTimer()
+	return true
+}
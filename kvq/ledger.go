@@ -0,0 +1,130 @@
+package kvq
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+const (
+	// ledgerSuffix is appended to a queue's namespace to give the namespace
+	// of its ledger of processed items.
+	ledgerSuffix = ".ledger"
+)
+
+// ledgerKey returns the key under which the processing of the item with key
+// `k` and record `r` is recorded in the ledger. Items put with a
+// deduplication key are identified by it, such that an item put again by a
+// producer recovering from a crash is recognised; other items are identified
+// by their ID.
+func ledgerKey(k []byte, r record) []byte {
+	if r.dedupKey != "" {
+		return append([]byte("d/"), r.dedupKey...)
+	}
+	return append([]byte("i/"), k...)
+}
+
+// initLedger opens the queue's ledger of processed items, if the queue was
+// opened with Idempotent set.
+func (q *Queue) initLedger() error {
+	if !q.opts.Idempotent {
+		return nil
+	}
+	ledger, err := q.db.Bucket(q.namespace + ledgerSuffix)
+	if err != nil {
+		return err
+	}
+	q.ledger = ledger
+	return nil
+}
+
+// recordProcessed records the taken items with the given keys and records as
+// processed in the ledger, if the queue has one. The ledger is written before
+// the items are removed, such that if removing them fails, they are skipped
+// rather than processed again when next taken.
+func (q *Queue) recordProcessed(takes []kv, records []record) error {
+	if q.ledger == nil || len(takes) == 0 {
+		return nil
+	}
+	now := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	return q.ledger.Batch(func(b backend.Batch) error {
+		for i, kv := range takes {
+			if err := b.Put(ledgerKey(kv.k, records[i]), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// processed returns true if the item with key `k` and record `r` has
+// already been recorded as processed in the ledger.
+func (q *Queue) processed(k []byte, r record) (bool, error) {
+	if q.ledger == nil {
+		return false, nil
+	}
+	_, err := q.ledger.Get(ledgerKey(k, r))
+	if err == backend.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// skip removes the given keys, which have already been processed, from the
+// queue.
+func (q *Queue) skip(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	takes := make([]kv, len(keys))
+	entries := make([]internal.Entry, len(keys))
+	for i, k := range keys {
+		takes[i] = kv{k: k}
+		entries[i], _ = internal.KeyToEntry(k)
+	}
+	if err := q.enact(nil, takes); err != nil {
+		return err
+	}
+	q.forget(entries...)
+	return nil
+}
+
+// PruneLedger removes items processed more than `age` ago from the ledger of
+// an Idempotent queue, returning the number removed. Redelivered duplicates of
+// pruned items are no longer detected, so `age` should comfortably exceed the
+// time taken to recover from a crash.
+func (q *Queue) PruneLedger(age time.Duration) (int, error) {
+	if q.ledger == nil {
+		return 0, nil
+	}
+	if q.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	before := time.Now().Add(-age).UnixNano()
+	keys := [][]byte{}
+	err := q.ledger.ForEach(func(k, v []byte) error {
+		if len(v) == 8 && int64(binary.BigEndian.Uint64(v)) < before {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	err = q.ledger.Batch(func(b backend.Batch) error {
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,73 @@
+package kvq
+
+import (
+	"fmt"
+)
+
+// TxnLimits bounds the size of a transaction, so that an unbounded
+// transaction cannot produce a commit large enough to stall the database.
+// Limits of zero are unbounded.
+type TxnLimits struct {
+	// MaxPuts is the maximum number of items a transaction may put.
+	MaxPuts int
+	// MaxTakes is the maximum number of items a transaction may take.
+	MaxTakes int
+	// MaxBytes is the maximum total size of the items a transaction may put.
+	MaxBytes int64
+}
+
+// TxnLimitError is returned when putting or taking items would exceed one of
+// a transaction's TxnLimits. Nothing is put or taken.
+type TxnLimitError struct {
+	// Limit names the limit that would be exceeded: "puts", "takes" or
+	// "bytes".
+	Limit string
+	// Max is the value of the limit.
+	Max int64
+}
+
+// Error returns a description of the limit exceeded.
+func (e *TxnLimitError) Error() string {
+	return fmt.Sprintf("transaction limit of %d %s exceeded", e.Max, e.Limit)
+}
+
+// SetLimits sets the limits on the size of the transaction, overriding the
+// queue's TxnLimits. Items already staged are unaffected.
+func (txn *Txn) SetLimits(limits TxnLimits) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	txn.limits = limits
+}
+
+// checkPut returns a TxnLimitError if putting another item of `size` bytes
+// would exceed the transaction's limits. The caller must hold the transaction
+// mutex.
+func (txn *Txn) checkPut(size int) error {
+	if max := txn.limits.MaxPuts; max > 0 && len(txn.putValues) >= max {
+		return &TxnLimitError{Limit: "puts", Max: int64(max)}
+	}
+	if max := txn.limits.MaxBytes; max > 0 && txn.putBytes+int64(size) > max {
+		return &TxnLimitError{Limit: "bytes", Max: max}
+	}
+	return nil
+}
+
+// capTakes returns the number of items the transaction may take of the `n`
+// requested, or a TxnLimitError if it may not take at least `min`.
+func (txn *Txn) capTakes(n, min int) (int, error) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+
+	max := txn.limits.MaxTakes
+	if max <= 0 {
+		return n, nil
+	}
+	left := max - len(txn.takeValues)
+	if left < min || left <= 0 {
+		return 0, &TxnLimitError{Limit: "takes", Max: int64(max)}
+	}
+	if n > left {
+		n = left
+	}
+	return n, nil
+}
@@ -0,0 +1,38 @@
+package kvq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// lockSuffix is appended to the path of a database on the local filesystem to
+// give the path of the file locked while the database is open for writing.
+const lockSuffix = ".lock"
+
+var (
+	// ErrLocked is returned by Open when the database is already open for
+	// writing, whether by another process or elsewhere in this one. Opening
+	// the same database twice for writing would corrupt it. Where the backend
+	// allows, OpenReadOnly can be used alongside the process that holds it.
+	ErrLocked = errors.New("database is locked by another process")
+)
+
+// lock locks the database at the given path on the local filesystem against
+// being opened for writing by others, returning the locked file, which is
+// unlocked when closed. The lock is advisory: it excludes only those that
+// open the database through this package.
+func lock(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+lockSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
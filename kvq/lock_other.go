@@ -0,0 +1,11 @@
+//go:build !unix
+
+package kvq
+
+import "os"
+
+// lockFile does nothing on platforms without flock, where databases are not
+// locked.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package kvq
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+// MessageID uniquely identifies an item within a queue. IDs are opaque, but
+// can be converted to and from strings for logging and correlation.
+type MessageID string
+
+// String returns a printable form of the ID, which can be converted back to
+// an ID with ParseMessageID.
+func (id MessageID) String() string {
+	return hex.EncodeToString([]byte(id))
+}
+
+// ParseMessageID parses an ID from the string returned by MessageID.String.
+func ParseMessageID(s string) (MessageID, error) {
+	k, err := hex.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid message ID %q: %v", s, err)
+	}
+	if _, err := internal.KeyToEntry(k); err != nil {
+		return "", fmt.Errorf("invalid message ID %q", s)
+	}
+	return MessageID(k), nil
+}
+
+// Message is an item in a queue, along with its metadata.
+type Message struct {
+	// ID identifies the item within its queue.
+	ID MessageID
+	// Value is the value of the item, as put.
+	Value []byte
+	// Headers are user-defined metadata stored alongside the value, such as
+	// content types or trace IDs.
+	Headers map[string]string
+	// Seq is the sequence number assigned to the item when it was put.
+	// Sequence numbers increase monotonically within a queue, and items of
+	// equal priority are taken in sequence order.
+	Seq uint64
+	// Priority is the priority the item was put with.
+	Priority uint8
+	// Attempts is the number of times the item has previously been taken
+	// and returned to the queue without being committed or acknowledged.
+	Attempts int
+	// Group is the message group the item was put with, if any.
+	Group string
+	// Schema is an application-defined version of the format of Value, as
+	// put. It allows consumers to choose how to decode values while
+	// producers migrate between formats. Zero means no version was given.
+	Schema uint8
+}
+
+// newMessage returns the Message for a stored entry and record.
+func newMessage(e internal.Entry, r record) *Message {
+	return &Message{
+		ID:       MessageID(e.Key()),
+		Value:    r.value,
+		Headers:  r.headers,
+		Seq:      uint64(e.ID),
+		Priority: e.Priority,
+		Attempts: r.attempts,
+		Group:    r.group,
+		Schema:   r.schema,
+	}
+}
@@ -0,0 +1,44 @@
+//go:build go1.23
+
+package kvq
+
+import (
+	"context"
+	"iter"
+)
+
+// Messages returns an iterator over items taken from the queue, for use with
+// range-over-func loops:
+//
+//	for msg, err := range q.Messages(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		process(msg.Value)
+//	}
+//
+// Each item is acknowledged when the loop body continues to the next
+// iteration, whereas breaking out of the loop returns the current item to the
+// queue as with Delivery.Nack. Iteration ends when `ctx` is done. If taking
+// or acknowledging an item fails, the error is yielded and iteration ends.
+func (q *Queue) Messages(ctx context.Context) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		for {
+			d, err := q.Receive(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					yield(Message{}, err)
+				}
+				return
+			}
+			if !yield(d.Message, nil) {
+				d.Nack()
+				return
+			}
+			if err := d.Ack(); err != nil {
+				yield(Message{}, err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package prometheus exports the state of kvq queues as Prometheus metrics.
+//
+// A Collector reads DB.Stats each time it is scraped, reporting the depth of
+// every queue open on the DB, counts of the items put and taken and the
+// transactions committed, discarded and failed, and a histogram of commit
+// latencies, each labelled with the queue's namespace:
+//
+//	prometheus.MustRegister(kvqprom.NewCollector(db, "kvq"))
+package prometheus
+
+import (
+	"github.com/johnsto/go-kvq/kvq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector reporting the state of the queues open
+// on a DB.
+type Collector struct {
+	db *kvq.DB
+
+	depth         *prometheus.Desc
+	available     *prometheus.Desc
+	scheduled     *prometheus.Desc
+	sizeBytes     *prometheus.Desc
+	openTxns      *prometheus.Desc
+	puts          *prometheus.Desc
+	takes         *prometheus.Desc
+	commits       *prometheus.Desc
+	discards      *prometheus.Desc
+	commitErrors  *prometheus.Desc
+	commitSeconds *prometheus.Desc
+}
+
+// NewCollector returns a Collector reporting the state of the queues open on
+// `db`, with metric names prefixed by `namespace`, if not empty.
+func NewCollector(db *kvq.DB, namespace string) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "queue", name),
+			help, []string{"queue"}, nil)
+	}
+	return &Collector{
+		db: db,
+		depth: desc("depth",
+			"Number of items stored in the queue, counting only those "+
+				"loaded so far if the queue loads lazily."),
+		available: desc("available",
+			"Number of items available to be taken."),
+		scheduled: desc("scheduled",
+			"Number of items scheduled to become available."),
+		sizeBytes: desc("size_bytes",
+			"Approximate storage consumed by the queue."),
+		openTxns: desc("open_txns",
+			"Number of transactions holding items taken from the queue."),
+		puts: desc("puts_total",
+			"Number of items put by committed transactions."),
+		takes: desc("takes_total",
+			"Number of items taken by committed transactions."),
+		commits: desc("commits_total",
+			"Number of transactions committed."),
+		discards: desc("discards_total",
+			"Number of transactions discarded without being committed."),
+		commitErrors: desc("commit_errors_total",
+			"Number of commits that failed."),
+		commitSeconds: desc("commit_duration_seconds",
+			"Time taken to commit transactions."),
+	}
+}
+
+// Describe sends the descriptors of the metrics reported to `ch`.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs() {
+		ch <- d
+	}
+}
+
+// Collect sends the current value of each metric, for each open queue, to
+// `ch`. If the state of the DB cannot be read, an invalid metric is sent
+// with the error in place of each.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s, err := c.db.Stats()
+	if err != nil {
+		for _, d := range c.descs() {
+			ch <- prometheus.NewInvalidMetric(d, err)
+		}
+		return
+	}
+
+	gauge, counter := prometheus.GaugeValue, prometheus.CounterValue
+	for name, qs := range s.Queues {
+		ch <- prometheus.MustNewConstMetric(c.depth, gauge, float64(qs.Len), name)
+		ch <- prometheus.MustNewConstMetric(c.available, gauge, float64(qs.Available), name)
+		ch <- prometheus.MustNewConstMetric(c.scheduled, gauge, float64(qs.Scheduled), name)
+		ch <- prometheus.MustNewConstMetric(c.sizeBytes, gauge, float64(qs.SizeBytes), name)
+		ch <- prometheus.MustNewConstMetric(c.openTxns, gauge, float64(qs.OpenTxns), name)
+		ch <- prometheus.MustNewConstMetric(c.puts, counter, float64(qs.PutsCommitted), name)
+		ch <- prometheus.MustNewConstMetric(c.takes, counter, float64(qs.TakesCommitted), name)
+		ch <- prometheus.MustNewConstMetric(c.commits, counter, float64(qs.Committed), name)
+		ch <- prometheus.MustNewConstMetric(c.discards, counter, float64(qs.Discarded), name)
+		ch <- prometheus.MustNewConstMetric(c.commitErrors, counter, float64(qs.CommitErrors), name)
+		ch <- prometheus.MustNewConstHistogram(c.commitSeconds,
+			uint64(qs.Committed), qs.CommitTime.Seconds(),
+			buckets(qs.CommitBuckets), name)
+	}
+}
+
+// descs returns the descriptors of every metric reported.
+func (c *Collector) descs() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		c.depth, c.available, c.scheduled, c.sizeBytes, c.openTxns,
+		c.puts, c.takes, c.commits, c.discards, c.commitErrors,
+		c.commitSeconds,
+	}
+}
+
+// buckets returns the cumulative counts of commits in each of
+// kvq.LatencyBuckets, keyed by upper bound in seconds, as given by
+// Stats.CommitBuckets.
+func buckets(counts []int64) map[float64]uint64 {
+	m := make(map[float64]uint64, len(kvq.LatencyBuckets))
+	var n uint64
+	for i, bound := range kvq.LatencyBuckets {
+		if i < len(counts) {
+			n += uint64(counts[i])
+		}
+		m[bound.Seconds()] = n
+	}
+	return m
+}
@@ -0,0 +1,206 @@
+package kvq
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+var (
+	// ErrForeignQueue is returned when committing a MultiTxn that spans a
+	// queue belonging to another DB.
+	ErrForeignQueue = errors.New("queue belongs to another database")
+)
+
+// MultiTxn is a transaction spanning several queues of the same DB. Items put
+// and taken from each queue within the transaction are committed together,
+// such that a pipeline stage can take an item from one queue and put its
+// result into another without either happening alone.
+type MultiTxn struct {
+	db    *DB
+	txns  []*Txn // transaction on each queue, in the order first used
+	mutex *sync.Mutex
+}
+
+// Transaction starts a new transaction spanning queues of the DB.
+func (db *DB) Transaction() *MultiTxn {
+	return &MultiTxn{
+		db:    db,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Queue returns the part of the transaction that operates on queue `q`,
+// through which items are put and taken as with any other Txn. Committing or
+// closing the returned Txn commits or closes the whole MultiTxn.
+func (m *MultiTxn) Queue(q *Queue) *Txn {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, txn := range m.txns {
+		if txn.queue == q {
+			return txn
+		}
+	}
+	txn := NewTxn(q)
+	txn.multi = m
+	m.txns = append(m.txns, txn)
+	return txn
+}
+
+// Commit writes the changes made to every queue to storage. Where the backend
+// supports it, all changes are written in a single atomic batch; otherwise,
+// items are put before any are removed, so may be duplicated if the commit
+// fails part way. Nothing is written if any queue cannot accept the items put
+// into it. The MultiTxn will remain valid for further use.
+func (m *MultiTxn) Commit() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	start := time.Now()
+	for _, txn := range m.txns {
+		if err := txn.beforeCommit(); err != nil {
+			return err
+		}
+	}
+
+	// Call OnCommit hooks once the transactions are unlocked
+	txns := make([]*Txn, 0, len(m.txns))
+	var written []Pending
+	defer func() {
+		for i, p := range written {
+			txns[i].committed(p, start)
+		}
+	}()
+
+	timedOut := false
+	for _, txn := range m.txns {
+		txn.mutex.Lock()
+		defer txn.mutex.Unlock()
+		timedOut = timedOut || txn.timedOut
+		if txn.empty() {
+			continue
+		}
+		if txn.queue.db != m.db.DB {
+			return ErrForeignQueue
+		}
+		if err := txn.checkConflicts(); err != nil {
+			return err
+		}
+		txns = append(txns, txn)
+	}
+
+	// Discard the whole transaction if any part of it timed out
+	if timedOut {
+		for _, txn := range m.txns {
+			txn.timedOut = false
+			txn.rollback(0)
+		}
+		return ErrTxnTimeout
+	}
+
+	// Ensure every queue has room for its items
+	pending := make([]Pending, len(txns))
+	for i, txn := range txns {
+		pending[i] = txn.pending()
+	}
+	for i, txn := range txns {
+		if err := txn.prepare(0, nil); err != nil {
+			for _, prepared := range txns[:i] {
+				prepared.abort()
+			}
+			return err
+		}
+	}
+
+	// Put/take keys from backend storage, recording taken items as
+	// processed first
+	var err error
+	for _, txn := range txns {
+		if err = txn.queue.recordProcessed(txn.takeValues, txn.takeRecords); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = enactAll(txns)
+	}
+	if err != nil {
+		for _, txn := range txns {
+			txn.abort()
+		}
+		return err
+	}
+
+	for _, txn := range txns {
+		txn.finish()
+	}
+	written = pending
+	return nil
+}
+
+// Close reverts the changes made to every queue, as with Txn.Close. The
+// MultiTxn will remain valid for further use.
+func (m *MultiTxn) Close() error {
+	return m.DiscardDelay(0)
+}
+
+// DiscardDelay reverts the changes made to every queue as with Close, but
+// taken items only become available again once `delay` has elapsed, as with
+// Txn.DiscardDelay.
+func (m *MultiTxn) DiscardDelay(delay time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var first error
+	for _, txn := range m.txns {
+		if err := txn.revert(delay); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// enactAll puts and takes the items of each transaction to the storage of its
+// queue, in a single batch where the backend supports it.
+func enactAll(txns []*Txn) error {
+	if len(txns) == 0 {
+		return nil
+	}
+
+	if mb, ok := txns[0].queue.bucket.(backend.MultiBatcher); ok {
+		others := make([]backend.Bucket, len(txns)-1)
+		for i, txn := range txns[1:] {
+			others[i] = txn.queue.bucket
+		}
+		err := mb.BatchWith(others, func(b backend.Batch, o []backend.Batch) error {
+			batches := append([]backend.Batch{b}, o...)
+			for i, txn := range txns {
+				for _, kv := range txn.putValues {
+					batches[i].Put(kv.k, kv.v)
+				}
+				for _, kv := range txn.takeValues {
+					batches[i].Delete(kv.k)
+				}
+			}
+			return nil
+		})
+		if err != backend.ErrForeignBucket {
+			return err
+		}
+	}
+
+	// Put items first, such that a failure duplicates rather than loses them
+	for _, txn := range txns {
+		if err := txn.queue.enact(txn.putValues, nil); err != nil {
+			return err
+		}
+	}
+	for _, txn := range txns {
+		if err := txn.queue.enact(nil, txn.takeValues); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package kvq
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+var (
+	// ErrQueueExists is returned when renaming a queue to the namespace of a
+	// queue that already exists.
+	ErrQueueExists = errors.New("queue already exists")
+	// errStop stops an iteration early.
+	errStop = errors.New("stop")
+)
+
+const (
+	// queuesBucket names the bucket recording the namespace of every queue
+	// opened on a DB, for Queues to list.
+	queuesBucket = ".queues"
+)
+
+// Queues returns the namespaces of the queues opened on the database with
+// Queue or QueueWithOptions, in order, such that tools can discover a
+// database's queues without knowing them in advance. Queues last opened by a
+// version of this package predating Queues are not listed until reopened.
+func (db *DB) Queues() ([]string, error) {
+	bucket, err := db.DB.Bucket(queuesBucket)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	err = bucket.ForEach(func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// register records the namespace of a queue opened on the database, if not
+// already recorded.
+func (db *DB) register(namespace string) error {
+	if backend.IsReadOnly(db.DB) {
+		return nil
+	}
+	bucket, err := db.DB.Bucket(queuesBucket)
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.Get([]byte(namespace)); err == nil {
+		return nil
+	} else if err != backend.ErrKeyNotFound {
+		return err
+	}
+	return bucket.Batch(func(b backend.Batch) error {
+		return b.Put([]byte(namespace), []byte{1})
+	})
+}
+
+// DeleteQueue removes the queue with the given namespace from the database,
+// along with its metadata, ledger, poison queue and consumer groups. Open
+// instances of the queue on this DB are closed first, such that takes waiting
+// for items, and any further use, return ErrClosed. Queues open on the same
+// database elsewhere, such as in another process, are not closed, and should
+// not be in use.
+func (db *DB) DeleteQueue(namespace string) error {
+	if backend.IsReadOnly(db.DB) {
+		return ErrReadOnly
+	}
+
+	if err := db.closeQueues(namespace); err != nil {
+		return err
+	}
+	if err := destroyNamespace(db.DB, namespace); err != nil {
+		return err
+	}
+	bucket, err := db.DB.Bucket(queuesBucket)
+	if err != nil {
+		return err
+	}
+	return bucket.Batch(func(b backend.Batch) error {
+		return b.Delete([]byte(namespace))
+	})
+}
+
+// RenameQueue renames the queue with namespace `from` to `to`, moving its
+// items, metadata, ledger, poison queue and consumer groups, so that queues
+// can be reorganised without draining them by hand. Where the backend supports
+// it, the queue is moved in a single atomic batch; otherwise, it is copied
+// before the original is removed, such that a failure duplicates rather than
+// loses items. Open instances of the queue on this DB are closed first, as
+// with DeleteQueue. Returns ErrQueueExists if a queue exists at `to`.
+func (db *DB) RenameQueue(from, to string) error {
+	if backend.IsReadOnly(db.DB) {
+		return ErrReadOnly
+	}
+	if from == to {
+		return nil
+	}
+	if exists, err := db.queueExists(to); err != nil {
+		return err
+	} else if exists {
+		return ErrQueueExists
+	}
+	if err := db.closeQueues(from); err != nil {
+		return err
+	}
+
+	names, err := namespaceBuckets(liveBuckets(db.DB), from)
+	if err != nil {
+		return err
+	}
+	src := make([]backend.Bucket, len(names))
+	dst := make([]backend.Bucket, len(names))
+	values := make([][]kv, len(names))
+	for i, name := range names {
+		if src[i], err = db.DB.Bucket(name); err != nil {
+			return err
+		}
+		if dst[i], err = db.DB.Bucket(to + strings.TrimPrefix(name, from)); err != nil {
+			return err
+		}
+		err = src[i].ForEach(func(k, v []byte) error {
+			values[i] = append(values[i], kv{
+				k: append([]byte{}, k...),
+				v: append([]byte{}, v...),
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Move the queue and update the registry in one batch, if possible
+	registry, err := db.DB.Bucket(queuesBucket)
+	if err != nil {
+		return err
+	}
+	if mb, ok := registry.(backend.MultiBatcher); ok {
+		others := append(append([]backend.Bucket{}, src...), dst...)
+		err := mb.BatchWith(others, func(b backend.Batch, o []backend.Batch) error {
+			for i := range names {
+				for _, kv := range values[i] {
+					if err := o[len(names)+i].Put(kv.k, kv.v); err != nil {
+						return err
+					}
+					if err := o[i].Delete(kv.k); err != nil {
+						return err
+					}
+				}
+			}
+			if err := b.Delete([]byte(from)); err != nil {
+				return err
+			}
+			return b.Put([]byte(to), []byte{1})
+		})
+		if err != backend.ErrForeignBucket {
+			return err
+		}
+	}
+
+	for i := range names {
+		if len(values[i]) == 0 {
+			continue
+		}
+		err := dst[i].Batch(func(b backend.Batch) error {
+			for _, kv := range values[i] {
+				if err := b.Put(kv.k, kv.v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := db.register(to); err != nil {
+		return err
+	}
+	return db.DeleteQueue(from)
+}
+
+// queueExists returns true if the queue with the given namespace has been
+// opened on the database, or holds any items or metadata.
+func (db *DB) queueExists(namespace string) (bool, error) {
+	registry, err := db.DB.Bucket(queuesBucket)
+	if err != nil {
+		return false, err
+	}
+	if _, err := registry.Get([]byte(namespace)); err == nil {
+		return true, nil
+	} else if err != backend.ErrKeyNotFound {
+		return false, err
+	}
+
+	for _, name := range []string{namespace, namespace + metaSuffix} {
+		bucket, err := db.DB.Bucket(name)
+		if err != nil {
+			return false, err
+		}
+		err = bucket.ForEach(func(k, v []byte) error {
+			return errStop
+		})
+		if err == errStop {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// openQueues returns the open queues on the database with the given
+// namespace.
+func (db *DB) openQueues(namespace string) []*Queue {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	open := []*Queue{}
+	for q := range db.queues {
+		if q.namespace == namespace {
+			open = append(open, q)
+		}
+	}
+	return open
+}
+
+// closeQueues closes the open queues on the database with the given
+// namespace.
+func (db *DB) closeQueues(namespace string) error {
+	for _, q := range db.openQueues(namespace) {
+		if err := q.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroyNamespace removes every bucket belonging to the queue with the given
+// namespace, including those of its consumer groups. Its metadata is removed
+// last, such that a failed removal can be retried.
+func destroyNamespace(db backend.DB, namespace string) error {
+	names, err := namespaceBuckets(liveBuckets(db), namespace)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		bucket, err := db.Bucket(name)
+		if err != nil {
+			return err
+		}
+		if err := clearBucket(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaceBuckets returns the names of the buckets belonging to the queue
+// with the given namespace, including those of its consumer groups, each of
+// which begins with the namespace. A queue's metadata, which records its
+// consumer groups, is given after its other buckets. The queue's metadata is
+// read from the buckets given by `open`.
+func namespaceBuckets(open bucketReaders, namespace string) ([]string, error) {
+	meta, err := open(namespace + metaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := groupNames(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, group := range groups {
+		gnames, err := namespaceBuckets(open, namespace+groupInfix+group)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, gnames...)
+	}
+	return append(names,
+		namespace+poisonSuffix,
+		namespace+poisonSuffix+metaSuffix,
+		namespace+ledgerSuffix,
+		namespace,
+		namespace+metaSuffix,
+	), nil
+}
+
+// bucketReader reads the keys of a bucket, or of a snapshot of one.
+type bucketReader interface {
+	ForEach(fn func(k, v []byte) error) error
+}
+
+// bucketReaders returns a reader of the bucket with the given name.
+type bucketReaders func(name string) (bucketReader, error)
+
+// liveBuckets returns readers of the buckets of the database as they are
+// written.
+func liveBuckets(db backend.DB) bucketReaders {
+	return func(name string) (bucketReader, error) {
+		return db.Bucket(name)
+	}
+}
+
+// clearBucket removes all keys from the bucket, using a range deletion where
+// the backend supports it.
+func clearBucket(bucket backend.Bucket) error {
+	if rd, ok := bucket.(backend.RangeDeleter); ok {
+		return rd.DeleteRange(nil, nil)
+	}
+	return bucket.Clear()
+}
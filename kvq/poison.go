@@ -0,0 +1,69 @@
+package kvq
+
+const (
+	// poisonSuffix is appended to a queue's namespace to give the namespace
+	// of its poison queue.
+	poisonSuffix = ".poison"
+	// PoisonReasonHeader is the header giving the reason an item was moved
+	// to a poison queue.
+	PoisonReasonHeader = "poison-reason"
+)
+
+// Reasons given in the PoisonReasonHeader of quarantined items.
+const (
+	poisonCorrupt     = "corrupt"
+	poisonMaxAttempts = "max-attempts"
+)
+
+// Poison returns the queue into which items that cannot be processed are
+// quarantined, or nil if the queue was not opened with Quarantine set.
+func (q *Queue) Poison() *Queue {
+	return q.poison
+}
+
+// initPoison opens the queue's poison queue, if the queue was opened with
+// Quarantine set.
+func (q *Queue) initPoison() error {
+	if !q.opts.Quarantine {
+		return nil
+	}
+	poison, err := NewQueue(q.db, q.namespace+poisonSuffix, nil)
+	if err != nil {
+		return err
+	}
+	q.poison = poison
+	return nil
+}
+
+// quarantine moves the given items, whose stored form could not be decoded,
+// to the poison queue. Each item's stored form is kept as the value of the
+// quarantined item, for inspection. Items are put into the poison queue
+// before being removed, such that a failure duplicates rather than loses
+// them.
+func (q *Queue) quarantine(items []kv) error {
+	if len(items) == 0 {
+		return nil
+	}
+	txn := q.poison.Transaction()
+	for _, kv := range items {
+		r := &record{
+			value:   kv.v,
+			headers: map[string]string{PoisonReasonHeader: poisonCorrupt},
+		}
+		if err := txn.put(r, 0); err != nil {
+			return err
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	if err := q.enact(nil, items); err != nil {
+		return err
+	}
+	keys := make([][]byte, len(items))
+	for i, kv := range items {
+		keys[i] = kv.k
+	}
+	q.emit(EventDeadLetter, keys)
+	return nil
+}
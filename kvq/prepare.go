@@ -0,0 +1,382 @@
+package kvq
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+const (
+	// preparedPrefix prefixes the metadata keys recording a queue's prepared
+	// transactions.
+	preparedPrefix = "prepared/"
+)
+
+var (
+	// ErrNotPrepared is returned when committing or rolling back a prepared
+	// transaction that does not exist, or has already been resolved.
+	ErrNotPrepared = errors.New("no prepared transaction with token")
+	// ErrNotPreparable is returned when preparing a transaction that moves
+	// items or belongs to a MultiTxn, or is on a queue with consumer groups,
+	// none of which can be prepared.
+	ErrNotPreparable = errors.New("transaction cannot be prepared")
+)
+
+// Prepare performs the first phase of a two-phase commit, allowing the
+// transaction to be coordinated with an external system such as a database
+// transaction. Room is reserved for the items put, and the transaction's
+// intent is stored durably in the queue's metadata, such that it survives the
+// process restarting. The returned token is then given to
+// Queue.CommitPrepared or Queue.RollbackPrepared to complete the transaction,
+// which holds its taken items until then. The Txn itself is reset, and will
+// remain valid for further use. BeforeCommit hooks are called when the
+// transaction is prepared, and OnCommit or OnDiscard hooks once it completes.
+func (txn *Txn) Prepare() (string, error) {
+	if txn.multi != nil {
+		return "", ErrNotPreparable
+	}
+	if err := txn.beforeCommit(); err != nil {
+		return "", err
+	}
+
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+
+	if txn.timedOut {
+		txn.timedOut = false
+		txn.Reset()
+		return "", ErrTxnTimeout
+	}
+	if txn.move != nil || len(txn.queue.Groups()) > 0 {
+		return "", ErrNotPreparable
+	}
+	if err := txn.prepare(0, nil); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		txn.abort()
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	err := txn.queue.meta.Batch(func(b backend.Batch) error {
+		return b.Put([]byte(preparedPrefix+token), txn.encodePrepared())
+	})
+	if err != nil {
+		txn.abort()
+		return "", err
+	}
+
+	txn.queue.hold(token, txn.detach())
+	return token, nil
+}
+
+// CommitPrepared completes the transaction prepared with the given token,
+// writing it to storage. If it fails, the transaction remains prepared.
+func (q *Queue) CommitPrepared(token string) error {
+	start := time.Now()
+	txn, err := q.resolve(token)
+	if err != nil {
+		return err
+	}
+
+	txn.mutex.Lock()
+	if err := txn.checkConflicts(); err != nil {
+		txn.mutex.Unlock()
+		q.hold(token, txn)
+		return err
+	}
+	p := txn.pending()
+	err = q.recordProcessed(txn.takeValues, txn.takeRecords)
+	if err == nil {
+		err = q.enactPrepared(token, txn.putValues, txn.takeValues)
+	}
+	if err != nil {
+		txn.mutex.Unlock()
+		q.hold(token, txn)
+		q.countError()
+		return err
+	}
+	txn.finish()
+	txn.mutex.Unlock()
+
+	txn.committed(p, start)
+	return nil
+}
+
+// RollbackPrepared reverts the transaction prepared with the given token, as
+// if it had been closed: its taken items are returned to the queue and their
+// attempt count is incremented. If it fails, the transaction remains
+// prepared.
+func (q *Queue) RollbackPrepared(token string) error {
+	txn, err := q.resolve(token)
+	if err != nil {
+		return err
+	}
+
+	err = q.meta.Batch(func(b backend.Batch) error {
+		return b.Delete([]byte(preparedPrefix + token))
+	})
+	if err != nil {
+		q.hold(token, txn)
+		return err
+	}
+
+	txn.mutex.Lock()
+	p := txn.pending()
+	txn.abort()
+	err = txn.rollback(0)
+	txn.mutex.Unlock()
+
+	txn.discarded(p)
+	return err
+}
+
+// Prepared returns the tokens of the queue's prepared transactions, in order,
+// including those recovered when the queue was opened. A coordinator
+// recovering from a crash should commit or roll back each.
+func (q *Queue) Prepared() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	tokens := make([]string, 0, len(q.prepared))
+	for token := range q.prepared {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// hold records the prepared transaction under the given token.
+func (q *Queue) hold(token string, txn *Txn) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.prepared == nil {
+		q.prepared = map[string]*Txn{}
+	}
+	q.prepared[token] = txn
+}
+
+// resolve removes and returns the prepared transaction with the given token,
+// such that it can only be resolved once. It should be returned with hold if
+// it cannot be resolved.
+func (q *Queue) resolve(token string) (*Txn, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	txn, ok := q.prepared[token]
+	if !ok {
+		return nil, ErrNotPrepared
+	}
+	delete(q.prepared, token)
+	return txn, nil
+}
+
+// enactPrepared puts and takes the key values of a prepared transaction to
+// storage, removing its record from the queue's metadata. Where the backend
+// supports it, this is done in a single atomic batch; otherwise, the record
+// is removed last, such that a failure leaves the transaction prepared.
+func (q *Queue) enactPrepared(token string, puts, takes []kv) error {
+	k := []byte(preparedPrefix + token)
+	if mb, ok := q.bucket.(backend.MultiBatcher); ok {
+		others := []backend.Bucket{q.meta}
+		err := mb.BatchWith(others, func(b backend.Batch, o []backend.Batch) error {
+			for _, kv := range puts {
+				b.Put(kv.k, kv.v)
+			}
+			for _, kv := range takes {
+				b.Delete(kv.k)
+			}
+			return o[0].Delete(k)
+		})
+		if err != backend.ErrForeignBucket {
+			return err
+		}
+	}
+
+	if err := q.enact(puts, takes); err != nil {
+		return err
+	}
+	return q.meta.Batch(func(b backend.Batch) error {
+		return b.Delete(k)
+	})
+}
+
+// detach returns a new Txn holding the transaction's staged items, and resets
+// the transaction. The caller must hold the transaction mutex.
+func (txn *Txn) detach() *Txn {
+	held := &Txn{
+		queue:       txn.queue,
+		puts:        txn.puts,
+		takes:       txn.takes,
+		scheduled:   txn.scheduled,
+		expiring:    txn.expiring,
+		dedup:       txn.dedup,
+		msgGroups:   txn.msgGroups,
+		putValues:   txn.putValues,
+		takeValues:  txn.takeValues,
+		takeRecords: txn.takeRecords,
+		wait:        txn.wait,
+		move:        txn.move,
+		putBytes:    txn.putBytes,
+		hooks:       txn.hooks,
+		mutex:       &sync.Mutex{},
+	}
+	taken := make([]internal.Entry, len(held.takeValues))
+	for i, kv := range held.takeValues {
+		taken[i], _ = internal.KeyToEntry(kv.k)
+	}
+	txn.queue.own(held, taken)
+	txn.Reset()
+	return held
+}
+
+// encodePrepared returns the stored form of a prepared transaction, giving
+// the key and value of each item put, followed by the key of each item taken.
+// The caller must hold the transaction mutex.
+func (txn *Txn) encodePrepared() []byte {
+	b := binary.AppendUvarint(nil, uint64(len(txn.putValues)))
+	for _, kv := range txn.putValues {
+		b = binary.AppendUvarint(b, uint64(len(kv.k)))
+		b = append(b, kv.k...)
+		b = binary.AppendUvarint(b, uint64(len(kv.v)))
+		b = append(b, kv.v...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(txn.takeValues)))
+	for _, kv := range txn.takeValues {
+		b = binary.AppendUvarint(b, uint64(len(kv.k)))
+		b = append(b, kv.k...)
+	}
+	return b
+}
+
+// decodePrepared parses the items put, and the keys of the items taken, from
+// the stored form of a prepared transaction.
+func decodePrepared(b []byte) (puts []kv, takes [][]byte, err error) {
+	next := func() ([]byte, bool) {
+		n, i := binary.Uvarint(b)
+		if i <= 0 || uint64(len(b)-i) < n {
+			return nil, false
+		}
+		v := append([]byte{}, b[i:i+int(n)]...)
+		b = b[i+int(n):]
+		return v, true
+	}
+	count := func() (int, bool) {
+		n, i := binary.Uvarint(b)
+		if i <= 0 || n > uint64(len(b)) {
+			return 0, false
+		}
+		b = b[i:]
+		return int(n), true
+	}
+
+	n, ok := count()
+	if !ok {
+		return nil, nil, ErrCorruptRecord
+	}
+	for ; n > 0; n-- {
+		k, ok := next()
+		if !ok {
+			return nil, nil, ErrCorruptRecord
+		}
+		v, ok := next()
+		if !ok {
+			return nil, nil, ErrCorruptRecord
+		}
+		puts = append(puts, kv{k, v})
+	}
+	if n, ok = count(); !ok {
+		return nil, nil, ErrCorruptRecord
+	}
+	for ; n > 0; n-- {
+		k, ok := next()
+		if !ok {
+			return nil, nil, ErrCorruptRecord
+		}
+		takes = append(takes, k)
+	}
+	return puts, takes, nil
+}
+
+// initPrepared recovers the prepared transactions recorded in the queue's
+// metadata, holding the items they take and reserving room for the items they
+// put until they are committed or rolled back.
+func (q *Queue) initPrepared() error {
+	stored := map[string][]byte{}
+	err := q.meta.ForEach(func(k, v []byte) error {
+		if name := string(k); strings.HasPrefix(name, preparedPrefix) {
+			stored[strings.TrimPrefix(name, preparedPrefix)] = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for token, v := range stored {
+		puts, takes, err := decodePrepared(v)
+		if err != nil {
+			return err
+		}
+
+		txn := NewTxn(q)
+		txn.timeout = 0
+		for _, k := range takes {
+			v, err := q.bucket.Get(k)
+			if err == backend.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			e, err := internal.KeyToEntry(k)
+			if err != nil {
+				return err
+			}
+			r := record{value: v}
+			if !e.Legacy() {
+				if r, err = decodeRecord(v); err != nil {
+					return err
+				}
+			}
+			if !q.claim(e) && !q.unschedule(e) {
+				continue
+			}
+			txn.takes.PushEntry(e)
+			txn.takeValues = append(txn.takeValues, kv{k, r.value})
+			txn.takeRecords = append(txn.takeRecords, r)
+		}
+		for _, kv := range puts {
+			txn.stage(kv)
+		}
+
+		q.own(txn, *txn.takes)
+		q.reserve(txn.dedup)
+		if err := q.admit(txn.putValues, 0, nil); err != nil {
+			return err
+		}
+		q.hold(token, txn)
+	}
+	return nil
+}
+
+// unschedule removes the entry from the set of entries scheduled to become
+// available, returning false if it is not scheduled.
+func (q *Queue) unschedule(e internal.Entry) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.scheduled.Remove(e) {
+		return false
+	}
+	q.resetTimer()
+	q.signal()
+	return true
+}
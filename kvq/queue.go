@@ -1,11 +1,14 @@
 package kvq
 
 import (
+	"encoding/binary"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/johnsto/go-kvq/kvq/backend"
+	"github.com/johnsto/go-kvq/kvq/backend/compress"
 	"github.com/johnsto/go-kvq/kvq/internal"
 )
 
@@ -14,11 +17,156 @@ const (
 	DefaultMaxQueue int = 1e6
 )
 
+const (
+	// metaSuffix is appended to a queue's namespace to give the namespace in
+	// which the queue's metadata is stored.
+	metaSuffix = ".meta"
+	// seqKey is the metadata key holding the next unreserved sequence number.
+	seqKey = "seq"
+	// seqBlock is the number of sequence numbers reserved at a time, such
+	// that the metadata need not be written for every put.
+	seqBlock = 1000
+	// wherePoll is the interval at which TakeWhere looks for matching items
+	// while waiting.
+	wherePoll = 50 * time.Millisecond
+)
+
+// OverflowPolicy determines what happens when committing items to a queue
+// that is full.
+type OverflowPolicy int
+
+const (
+	// OverflowReject causes the commit to fail with ErrInsufficientCapacity.
+	OverflowReject OverflowPolicy = iota
+	// OverflowBlock causes the commit to wait until enough items have been
+	// taken from the queue to make room.
+	OverflowBlock
+	// OverflowDropOldest causes items waiting in the queue to be removed,
+	// next-to-be-taken first, until there is enough room.
+	OverflowDropOldest
+)
+
 // QueueOptions specifies the operational parameters of a queue
 type QueueOptions struct {
 	// MaxQueue is the capacity of the queue. Items will start to be rejected
 	// if the queue reaches this size.
 	MaxQueue int
+	// MaxBytes is the maximum total size of the items stored in the queue,
+	// including those that are in the process of being taken. If zero, the
+	// size is unbounded.
+	MaxBytes int64
+	// Overflow determines the behaviour when committing items to the queue
+	// would exceed MaxQueue or MaxBytes.
+	Overflow OverflowPolicy
+	// DeadLetter is the queue to which expired items, and items that have
+	// exceeded MaxAttempts, are moved. If nil, such items are discarded. The
+	// dead-letter queue should belong to the same DB.
+	DeadLetter *Queue
+	// MaxAttempts is the number of times an item may be taken and discarded
+	// (by closing the transaction without committing) before it is moved to
+	// the dead-letter queue. If zero, items may be retried indefinitely.
+	MaxAttempts int
+	// RetryDelay returns how long to wait before an item that has been
+	// discarded the given number of times becomes available again. If nil,
+	// discarded items are available immediately. See ExponentialBackoff.
+	RetryDelay func(attempts int) time.Duration
+	// RejectDuplicates causes puts with a deduplication key already held by
+	// an item in the queue to fail with ErrDuplicate, rather than being
+	// silently ignored.
+	RejectDuplicates bool
+	// FairDispatch causes takes that are waiting for items to be served in
+	// turn, such that a consumer taking items in a tight loop cannot starve
+	// others. Register consumers with Queue.Consumer to share items between
+	// consumers rather than between individual takes.
+	FairDispatch bool
+	// TakeRate is the maximum number of items that may be taken from the
+	// queue per second. Takes exceeding the rate wait until it allows them.
+	// If zero, takes are not limited.
+	TakeRate float64
+	// TakeBurst is the maximum number of items that may be taken at once
+	// while within TakeRate. If zero, it is TakeRate rounded up.
+	TakeBurst int
+	// PutRate is the maximum number of items that may be put to the queue
+	// per second. Commits exceeding the rate fail with ErrRateLimited, while
+	// PutWait waits for the rate to allow the put. If zero, puts are not
+	// limited.
+	PutRate float64
+	// PutBurst is the maximum number of items that may be put at once while
+	// within PutRate. If zero, it is PutRate rounded up.
+	PutBurst int
+	// LIFO causes the most recently put items to be taken first, rather than
+	// the oldest. Items of a higher priority are still taken before those of
+	// a lower priority.
+	LIFO bool
+	// CompactInterval is how often the queue checks whether its storage
+	// should be compacted in the background, where the backend supports
+	// compaction. If zero, storage is only compacted by Queue.Compact.
+	CompactInterval time.Duration
+	// CompactThreshold is the number of items that must have been removed
+	// since the queue was last compacted for a background compaction to take
+	// place. If zero, any removal suffices.
+	CompactThreshold int
+	// Idempotent causes each item taken and committed (or acknowledged) to be
+	// recorded as processed in a ledger stored alongside the queue. Items
+	// already recorded, such as those put again by a producer recovering from
+	// a crash, are skipped rather than taken, giving exactly-once processing.
+	// Items are identified by their deduplication key, if put with one, or
+	// otherwise by their ID. See Queue.PruneLedger.
+	Idempotent bool
+	// Quarantine causes items that cannot be decoded, and items that have
+	// exceeded MaxAttempts where no DeadLetter queue is given, to be moved
+	// to a poison queue rather than failing takes or being discarded. The
+	// poison queue is returned by Queue.Poison, and its items give the
+	// reason they were quarantined in their PoisonReasonHeader.
+	Quarantine bool
+	// TxnTimeout is the maximum time for which a transaction on the queue may
+	// hold taken items before it is discarded, returning them to the queue.
+	// If zero, transactions may hold items indefinitely. See Txn.SetTimeout.
+	TxnTimeout time.Duration
+	// TxnLimits bounds the number and size of the items staged by each
+	// transaction on the queue. See Txn.SetLimits.
+	TxnLimits TxnLimits
+	// JournalTakes causes the items taken by each transaction to be recorded
+	// in a journal until the transaction is committed or discarded. Items
+	// still taken when the process crashes are returned to the queue when it
+	// is reopened with an attempt counted against them, as if their
+	// transactions had been discarded, such that MaxAttempts and RetryDelay
+	// apply. This costs a further write for each take. See Queue.InFlight.
+	JournalTakes bool
+	// NoSync causes commits to return without waiting for them to be synced
+	// to disk, where the backend supports it, raising throughput at the risk
+	// of losing recent commits if the machine crashes. Individual commits may
+	// override this with Txn.CommitSync or Txn.CommitNoSync.
+	NoSync bool
+	// CommitWindow is how long a commit waits for others to be made
+	// concurrently, such that they are all written to storage in a single
+	// batch, sharing the cost of syncing it to disk. This raises throughput
+	// when many goroutines commit small transactions, at the expense of the
+	// latency of each. If zero, each commit is written on its own.
+	CommitWindow time.Duration
+	// Compression is the codec with which the values of items put to the
+	// queue are compressed, such as compress.Snappy or compress.Zstd. Each
+	// item records the codec used, so items put with another codec, or none,
+	// can still be taken. If nil, values are stored uncompressed.
+	Compression compress.Codec
+	// LazyLoad causes the items stored in the queue to be loaded in chunks
+	// as they are needed, rather than all at once when the queue is opened,
+	// such that queues holding many items open instantly. Until every item
+	// has been loaded, Len and Stats count only the items loaded, only loaded
+	// items are checked for duplicates or taken by TakeWhere, and items put
+	// since opening may be taken before older items that are yet to be
+	// loaded. Queues with prepared transactions, a Quota, or with
+	// JournalTakes or LIFO set, are loaded in full.
+	LazyLoad bool
+	// LoadChunk is the number of items loaded at a time by LazyLoad. If
+	// zero, DefaultLoadChunk is used.
+	LoadChunk int
+	// Quota limits the number and size of the items stored in the queue,
+	// with a policy deciding what happens to commits that would exceed it.
+	// Queues with a quota are loaded in full, even if LazyLoad is set, so
+	// that every stored item counts against it. If nil, the queue has no
+	// quota.
+	Quota *Quota
 }
 
 var (
@@ -29,8 +177,45 @@ var (
 	// ErrInsufficientCapacity is returned if the queue does not have enough
 	// space to add the requested item(s).
 	ErrInsufficientCapacity = errors.New("insufficient queue capacity")
+	// ErrReadOnly is returned when attempting to put or take items from a
+	// queue in a database opened with OpenReadOnly.
+	ErrReadOnly = backend.ErrReadOnly
+	// ErrDuplicate is returned when putting an item with a deduplication key
+	// that is already held by an item in a queue with RejectDuplicates set.
+	ErrDuplicate = errors.New("duplicate item")
+	// ErrPaused is returned when committing puts to a queue that has been
+	// paused with PauseAll.
+	ErrPaused = errors.New("queue paused")
+	// ErrDraining is returned when committing puts to a queue that is being
+	// drained.
+	ErrDraining = errors.New("queue draining")
+	// ErrRateLimited is returned when committing puts to a queue would exceed
+	// its PutRate.
+	ErrRateLimited = errors.New("queue rate limit exceeded")
+	// ErrMoveDestination is returned when moving items within a transaction
+	// to a different queue than items it has already moved.
+	ErrMoveDestination = errors.New("transaction moves items to another queue")
+	// ErrClosed is returned when putting, taking or committing items to a
+	// queue that has been closed.
+	ErrClosed = errors.New("queue closed")
 )
 
+// ExponentialBackoff returns a RetryDelay function for QueueOptions that
+// waits `initial` after the first attempt, doubling with each subsequent
+// attempt up to at most `max`.
+func ExponentialBackoff(initial, max time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		d := initial
+		for i := 1; i < attempts && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
 type kv struct {
 	k []byte
 	v []byte
@@ -38,10 +223,82 @@ type kv struct {
 
 // Queue encapsulates a namespaced queue held by a DB.
 type Queue struct {
+	db        backend.DB
+	owner     *DB // DB that opened the queue; nil if opened with NewQueue
+	namespace string
+	opts      QueueOptions // options the queue was opened with
+
 	bucket backend.Bucket
+	meta   backend.Bucket // queue metadata
+	ledger backend.Bucket // processed items; nil unless Idempotent
+	poison *Queue         // quarantined items; nil unless Quarantine
 	mutex  *sync.Mutex
-	ids    *internal.IDHeap // IDs in queue
+	cond   *sync.Cond       // signalled when capacity is freed
+	ids    internal.Entries // entries in queue
 	c      chan struct{}    // item availability channel
+
+	scheduled internal.ScheduleHeap // entries not yet available
+	timer     *time.Timer           // fires when next scheduled entry is due
+
+	expiring internal.ScheduleHeap // entries with an expiry time
+	sweeper  *time.Timer           // fires when next expiring entry is due
+
+	dedup  internal.DedupIndex // deduplication keys of items in queue
+	held   int                 // availability tokens held by batch takers
+	groups map[string]*Queue   // consumer groups, by name
+
+	msgGroups internal.MessageGroups // message groups of entries in queue
+
+	jobs      map[string]*job // recurring jobs, by name
+	cronTimer *time.Timer     // fires when next recurring job is due
+
+	listeners []func(Event) // registered by OnEvent
+
+	prepared map[string]*Txn         // prepared transactions, by token
+	holders  map[internal.Entry]*Txn // transaction holding each taken entry
+
+	asyncWrites  []func() // commits waiting to be written in the background
+	asyncWriting bool     // true while asyncWrites are being written
+
+	stats         Stats         // counts of transactions; latencies unset
+	commitTime    time.Duration // total time taken by commits
+	commitBuckets []int64       // commits by latency, per LatencyBuckets
+	putRate       meter         // rate of items put by commits
+	takeRate      meter         // rate of items taken by commits
+	commits       Histogram     // time taken by commits
+	takeWaits     Histogram     // time waited by takes that returned items
+	writes        Histogram     // time taken by backend writes
+
+	removals     int         // items removed since last compaction
+	compactTimer *time.Timer // fires when compaction is next considered
+
+	dispatcher *dispatcher       // orders waiting takes; nil unless FairDispatch
+	takeLimit  *internal.Limiter // limits take rate; nil if unlimited
+	putLimit   *internal.Limiter // limits put rate; nil if unlimited
+	committer  *committer        // coalesces commits; nil unless CommitWindow
+
+	seq      internal.ID // next sequence number
+	seqLimit internal.ID // sequence numbers below this are reserved
+
+	running    chan struct{} // closed when takes are paused
+	resumed    chan struct{} // closed when resumed; nil if not paused
+	putsPaused bool          // true if puts are paused
+	drained    chan struct{} // closed when drained; nil if not draining
+	closed     chan struct{} // closed when the queue is closed
+
+	pending int                    // entries admitted but not yet added
+	length  int                    // number of stored items
+	bytes   int64                  // size of stored items
+	sizes   map[internal.Entry]int // size of each stored item
+	loader  *loader                // loads items lazily, if LazyLoad
+
+	maxBytes         int64
+	overflow         OverflowPolicy
+	deadLetter       *Queue
+	maxAttempts      int
+	retryDelay       func(attempts int) time.Duration
+	rejectDuplicates bool
+	readOnly         bool
 }
 
 // NewQueue instantiates a new queue from the given database and namespace.
@@ -49,50 +306,501 @@ func NewQueue(db backend.DB, namespace string, opts *QueueOptions) (*Queue, erro
 	if opts == nil {
 		opts = &DefaultOptions
 	}
+	maxQueue := opts.MaxQueue
+	if maxQueue <= 0 {
+		maxQueue = DefaultMaxQueue
+	}
 
 	bucket, err := db.Bucket(namespace)
 	if err != nil {
 		return nil, err
 	}
+	meta, err := db.Bucket(namespace + metaSuffix)
+	if err != nil {
+		return nil, err
+	}
 
 	queue := &Queue{
+		db:        db,
+		namespace: namespace,
+		opts:      *opts,
+
 		bucket: bucket,
+		meta:   meta,
 		mutex:  &sync.Mutex{},
-		ids:    internal.NewIDHeap(),
-		c:      make(chan struct{}, opts.MaxQueue),
+		ids:    internal.NewEntryHeap(),
+		c:      make(chan struct{}, maxQueue),
+
+		running: make(chan struct{}),
+		closed:  make(chan struct{}),
+
+		maxBytes:    opts.MaxBytes,
+		overflow:    opts.Overflow,
+		deadLetter:  opts.DeadLetter,
+		maxAttempts: opts.MaxAttempts,
+		retryDelay:  opts.RetryDelay,
+
+		rejectDuplicates: opts.RejectDuplicates,
+		readOnly:         backend.IsReadOnly(db),
+	}
+	queue.cond = sync.NewCond(queue.mutex)
+	if queue.maxBytes > 0 || (opts.Quota != nil && opts.Quota.MaxBytes > 0) {
+		queue.sizes = map[internal.Entry]int{}
+	}
+	if opts.LIFO {
+		queue.ids = internal.NewStackHeap()
+	}
+	if opts.FairDispatch {
+		queue.dispatcher = &dispatcher{}
+	}
+	if opts.TakeRate > 0 {
+		queue.takeLimit = internal.NewLimiter(opts.TakeRate, opts.TakeBurst)
+	}
+	if opts.CommitWindow > 0 {
+		queue.committer = newCommitter(queue.bucket, opts.CommitWindow)
+	}
+	if opts.PutRate > 0 {
+		queue.putLimit = internal.NewLimiter(opts.PutRate, opts.PutBurst)
 	}
 	if err := queue.init(); err != nil {
 		return nil, err
 	}
+	if err := queue.initPrepared(); err != nil {
+		return nil, err
+	}
+	if err := queue.initInFlight(); err != nil {
+		return nil, err
+	}
+	queue.initCompaction()
 
 	return queue, nil
 }
 
-// init populates the queue with all the IDs from the saved database.
+// init populates the queue with the IDs from the saved database, or the
+// first of them if the queue loads lazily.
 func (q *Queue) init() error {
-	return q.bucket.ForEach(func(k, v []byte) error {
+	// Resume sequence from where it was last reserved
+	q.seq = 1
+	seqStored := false
+	v, err := q.meta.Get([]byte(seqKey))
+	if err == nil && len(v) == 8 {
+		q.seq = internal.ID(binary.BigEndian.Uint64(v))
+		seqStored = true
+	} else if err != nil && err != backend.ErrKeyNotFound {
+		return err
+	}
+
+	if err := q.initGroups(); err != nil {
+		return err
+	}
+	if err := q.initCron(); err != nil {
+		return err
+	}
+	if err := q.initLedger(); err != nil {
+		return err
+	}
+	if err := q.initPoison(); err != nil {
+		return err
+	}
+
+	if lazy, err := q.lazyLoads(seqStored); err != nil {
+		return err
+	} else if lazy {
+		if err := q.initLoader(); err != nil {
+			return err
+		}
+	} else if err := q.loadAll(); err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.seqLimit = q.seq
+	q.resetTimer()
+	q.resetSweeper()
+	if q.loader != nil {
+		go q.runLoader()
+	}
+	return nil
+}
+
+// loadAll populates the queue with all the items in the saved database.
+func (q *Queue) loadAll() error {
+	now := time.Now()
+	corrupt := []kv{}
+	err := q.bucket.ForEach(func(k, v []byte) error {
 		// Populate with read keys
-		id, err := internal.KeyToID(k)
+		e, err := internal.KeyToEntry(k)
 		if err != nil {
 			return err
 		}
 
-		q.ids.PushID(id)
-		q.c <- struct{}{}
+		// Ensure sequence follows existing items, including those put
+		// with time-based IDs by earlier versions.
+		if e.ID >= q.seq {
+			q.seq = e.ID + 1
+		}
+
+		if err := q.addStored(e, v, now); err == ErrCorruptRecord && q.poison != nil {
+			// Quarantined once the scan is complete
+			corrupt = append(corrupt, kv{
+				append([]byte{}, k...),
+				append([]byte{}, v...),
+			})
+			return nil
+		} else if err != nil {
+			return err
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return q.quarantine(corrupt)
+}
+
+// addStored adds an item read from the saved database, with the given stored
+// value, to the queue. Returns ErrCorruptRecord if the value cannot be
+// decoded, in which case the item is not added. Unless the queue is being
+// opened, the caller must hold the queue mutex.
+func (q *Queue) addStored(e internal.Entry, v []byte, now time.Time) error {
+	r := record{}
+	if !e.Legacy() {
+		var err error
+		if r, err = decodeRecord(v); err != nil {
+			return err
+		}
+	}
+
+	q.length++
+	if q.sizes != nil {
+		q.sizes[e] = len(v)
+		q.bytes += int64(len(v))
+	}
+
+	if !e.Legacy() {
+		if r.dedupKey != "" {
+			q.dedup.Add(r.dedupKey, e)
+		}
+		if r.group != "" {
+			q.msgGroups.Add(e, r.group)
+		}
+		if r.expiresAt != 0 {
+			q.expiring.PushScheduled(internal.Scheduled{
+				Entry: e,
+				At:    r.expiresAt,
+			})
+		}
+		if !r.available(now) {
+			q.scheduled.PushScheduled(internal.Scheduled{
+				Entry: e,
+				At:    r.availableAt,
+			})
+			return nil
+		}
+	}
+
+	q.push(e)
+	return nil
+}
+
+// nextID returns the next sequence number for an item in the queue, reserving
+// a further block of sequence numbers in the metadata when required.
+func (q *Queue) nextID() (internal.ID, error) {
+	return q.nextIDs(1)
+}
+
+// nextIDs reserves `n` consecutive sequence numbers, returning the first.
+func (q *Queue) nextIDs(n int) (internal.ID, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.isClosed() {
+		return internal.NilID, ErrClosed
+	}
+	if q.seq+internal.ID(n) > q.seqLimit {
+		limit := q.seq + seqBlock
+		if n > seqBlock {
+			limit = q.seq + internal.ID(n)
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(limit))
+		err := q.meta.Batch(func(b backend.Batch) error {
+			return b.Put([]byte(seqKey), v)
+		})
+		if err != nil {
+			return internal.NilID, err
+		}
+		q.seqLimit = limit
+	}
+
+	id := q.seq
+	q.seq += internal.ID(n)
+	return id, nil
 }
 
 // Size returns the number of keys currently available within the queue.
-// This does not include keys that are in the process of being put or taken.
-func (q Queue) Size() int {
-	return len(*q.ids)
+// This does not include keys that are in the process of being put or taken,
+// or those scheduled to become available in future.
+func (q *Queue) Size() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.ids.Len()
+}
+
+// Len returns the total number of items stored in the queue, including those
+// scheduled for the future and those in the process of being taken. The count
+// is kept in memory, not persisted: it is rebuilt from the stored items when
+// the queue is opened, so with LazyLoad it counts only the items loaded so far,
+// as do DB.Stats and the exporters built on it.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.length
+}
+
+// SizeBytes returns the approximate number of bytes of storage consumed by
+// the queue. Where the backend can estimate its size, the estimate is used;
+// otherwise, the sizes of all stored keys and values are summed.
+func (q *Queue) SizeBytes() (int64, error) {
+	if se, ok := q.bucket.(backend.SizeEstimator); ok {
+		return se.EstimateSize()
+	}
+	var n int64
+	err := q.bucket.ForEach(func(k, v []byte) error {
+		n += int64(len(k) + len(v))
+		return nil
+	})
+	return n, err
+}
+
+// Scheduled returns the number of keys within the queue that are scheduled to
+// become available in future, including those that are currently leased.
+func (q *Queue) Scheduled() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.scheduled)
 }
 
 // Clear removes all entries in the DB. Do not call if any transactions are in
-// progress.
+// progress. Where the backend supports range deletion, the entries are
+// removed in a single operation.
 func (q *Queue) Clear() error {
-	return q.bucket.Clear()
+	if q.readOnly {
+		return ErrReadOnly
+	}
+	if err := clearBucket(q.bucket); err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Drain available entries along with their availability tokens, such
+	// that the number of tokens continues to match the number of entries.
+	for {
+		select {
+		case <-q.c:
+			q.ids.PopEntry()
+			continue
+		default:
+		}
+		break
+	}
+	q.scheduled = internal.ScheduleHeap{}
+	q.expiring = internal.ScheduleHeap{}
+	q.resetTimer()
+	q.resetSweeper()
+
+	q.dedup.Reset()
+	q.msgGroups.Reset()
+	q.holders = nil
+	q.removals += q.length
+	q.length = 0
+	q.checkDrained()
+	if q.sizes != nil {
+		q.sizes = map[internal.Entry]int{}
+		q.bytes = 0
+	}
+	if q.loader != nil {
+		// Nothing remains to be loaded
+		q.loader.done = true
+		q.loader.gen++
+	}
+	q.signal()
+	return nil
+}
+
+// PurgeFunc removes all items available in the queue for which `fn` returns
+// true, given the item's key (as in Message.ID) and value, in a single batch.
+// It returns the number of items removed. Items that are scheduled for the
+// future, or are in the process of being taken, are not removed.
+func (q *Queue) PurgeFunc(fn func(k, v []byte) bool) (int, error) {
+	if q.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	// Find matching items
+	var matched []internal.Entry
+	err := q.bucket.ForEach(func(k, v []byte) error {
+		e, err := internal.KeyToEntry(k)
+		if err != nil {
+			return err
+		}
+		if !e.Legacy() {
+			r, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			v = r.value
+		}
+		if fn(k, v) {
+			matched = append(matched, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Claim each available item, along with its availability token
+	purged := []internal.Entry{}
+	for _, e := range matched {
+		select {
+		case <-q.c:
+			if q.ids.Remove(e) {
+				purged = append(purged, e)
+			} else {
+				q.c <- struct{}{}
+			}
+		default:
+			// All available entries are being claimed by takers
+		}
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+
+	err = q.bucket.Batch(func(b backend.Batch) error {
+		for _, e := range purged {
+			b.Delete(e.Key())
+		}
+		return nil
+	})
+	if err != nil {
+		// Return the items to the queue
+		for _, e := range purged {
+			q.ids.PushEntry(e)
+			q.c <- struct{}{}
+		}
+		return 0, err
+	}
+
+	for _, e := range purged {
+		q.removed(e)
+	}
+	q.signal()
+	return len(purged), nil
+}
+
+// Capabilities returns the optional features supported by the queue's
+// backend.
+func (q *Queue) Capabilities() backend.Capability {
+	return backend.Capabilities(q.bucket)
+}
+
+// ReadOnly returns true if items cannot be put or taken from the queue.
+func (q *Queue) ReadOnly() bool {
+	return q.readOnly
+}
+
+// Pause stops items being taken from the queue until Resume is called. Takes
+// that are waiting for items continue to wait until the queue is resumed or
+// they time out, while takes that do not wait return no items.
+func (q *Queue) Pause() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.resumed == nil {
+		q.resumed = make(chan struct{})
+		if q.running != nil {
+			close(q.running)
+		}
+	}
+}
+
+// PauseAll stops items being taken from the queue, as with Pause, and also
+// causes commits that put items to fail with ErrPaused, until Resume is
+// called.
+func (q *Queue) PauseAll() {
+	q.Pause()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.putsPaused = true
+}
+
+// Resume resumes taking and putting items after Pause or PauseAll.
+func (q *Queue) Resume() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.putsPaused = false
+	if q.resumed != nil {
+		close(q.resumed)
+		q.resumed = nil
+		q.running = make(chan struct{})
+	}
+}
+
+// Paused returns true if taking items from the queue is paused.
+func (q *Queue) Paused() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.resumed != nil
+}
+
+// Drain puts the queue into drain mode, in which commits that put items fail
+// with ErrDraining, while items continue to be taken as normal. The returned
+// channel is closed once every item has been removed from the queue, at which
+// point the queue can be safely retired. Drain mode cannot be cancelled.
+func (q *Queue) Drain() <-chan struct{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.drained == nil {
+		q.drained = make(chan struct{})
+		q.checkDrained()
+	}
+	return q.drained
+}
+
+// Draining returns true if the queue is in drain mode.
+func (q *Queue) Draining() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.drained != nil
+}
+
+// checkDrained signals that a draining queue has been drained if it is empty.
+// The caller must hold the queue mutex.
+func (q *Queue) checkDrained() {
+	if q.drained == nil || q.length > 0 || q.pending > 0 {
+		return
+	}
+	select {
+	case <-q.drained:
+	default:
+		close(q.drained)
+	}
+}
+
+// pauseState returns a channel that is closed when the queue is paused, and
+// a channel that is closed when the queue is resumed, or nil if the queue is
+// not paused.
+func (q *Queue) pauseState() (running, resumed <-chan struct{}) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.running, q.resumed
 }
 
 // Transaction starts a new transaction on the queue.
@@ -100,43 +808,541 @@ func (q *Queue) Transaction() *Txn {
 	return NewTxn(q)
 }
 
-// putKeys adds the ID(s) to the queue, indicating entries that are immediately
-// available for taking. Returns number of keys added successfully.
-func (q *Queue) putKey(ids ...internal.ID) (int, error) {
+// Update runs `fn` within a new transaction on the queue, committing the
+// transaction if `fn` returns nil. If `fn` returns an error or panics, or the
+// commit fails, the transaction is closed, returning any taken items to the
+// queue, and the error is returned or the panic resumed.
+func (q *Queue) Update(fn func(*Txn) error) error {
+	txn := q.Transaction()
+	defer func() {
+		if r := recover(); r != nil {
+			txn.Close()
+			panic(r)
+		}
+	}()
+
+	if err := fn(txn); err != nil {
+		txn.Close()
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		txn.Close()
+		return err
+	}
+	return nil
+}
+
+// putKeys adds the entries to the queue, indicating entries that are
+// immediately available for taking. Returns number of keys added successfully.
+func (q *Queue) putKey(ids ...internal.Entry) (int, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
 	// Fail immediately if there isn't enough room in the IDs channel
-	if cap(q.c)-len(q.c) < len(ids) {
+	if q.free() < len(ids) {
 		return 0, ErrInsufficientCapacity
 	}
 
 	// Add each item to the availability channel
-	n := 0
 	for _, id := range ids {
+		q.push(id)
+	}
+	return len(ids), nil
+}
+
+// schedule adds the entries to the queue, such that each becomes available for
+// taking at the scheduled time. Returns number of keys added successfully.
+func (q *Queue) schedule(entries ...internal.Scheduled) (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Scheduled entries count towards the capacity of the queue, ensuring
+	// there is room in the IDs channel when they become available.
+	if q.free() < len(entries) {
+		return 0, ErrInsufficientCapacity
+	}
+
+	for _, s := range entries {
+		q.scheduled.PushScheduled(s)
+	}
+	q.resetTimer()
+	return len(entries), nil
+}
+
+// free returns the remaining capacity of the queue. The caller must hold the
+// queue mutex.
+func (q *Queue) free() int {
+	return cap(q.c) - len(q.c) - len(q.scheduled) - q.pending - q.held -
+		q.msgGroups.Blocked()
+}
+
+// push makes the entry available for taking, unless it belongs to a message
+// group with another entry that is available or being taken, in which case it
+// waits for that entry to be removed. Capacity for the entry must have been
+// reserved. The caller must hold the queue mutex.
+func (q *Queue) push(e internal.Entry) {
+	if !q.msgGroups.Hold(e) {
+		return
+	}
+	q.c <- struct{}{}
+	q.ids.PushEntry(e)
+}
+
+// PutWait puts the data into the queue with the default (lowest) priority in
+// a transaction of its own, waiting at most `t` for the queue's PutRate to
+// allow it and for there to be room for it. This smooths bursts of puts
+// rather than failing with ErrRateLimited or ErrInsufficientCapacity.
+func (q *Queue) PutWait(v []byte, t time.Duration) error {
+	txn := q.Transaction()
+	defer txn.Close()
+	txn.wait = t
+	if err := txn.Put(v); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// limitPuts waits at most `t`, or until `done` is closed, for the queue's put
+// rate limit to allow `n` items to be put, returning ErrRateLimited if it does
+// not.
+func (q *Queue) limitPuts(n int, t time.Duration, done <-chan struct{}) error {
+	if q.putLimit == nil || n == 0 {
+		return nil
+	}
+	if q.putLimit.Wait(n, n, t, done) == 0 {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// admit reserves capacity for the given items to be put, applying the
+// queue's overflow policy if there is not enough room, then its quota. If
+// `wait` is positive, a queue that would otherwise reject the items waits at
+// most that long for room instead. Waiting for room stops if `done` is closed.
+func (q *Queue) admit(puts []kv, wait time.Duration, done <-chan struct{}) error {
+	size := int64(0)
+	for _, kv := range puts {
+		size += int64(len(kv.v))
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	expired := false
+	if wait > 0 {
+		timer := time.AfterFunc(wait, func() {
+			q.mutex.Lock()
+			defer q.mutex.Unlock()
+			expired = true
+			q.signal()
+		})
+		defer timer.Stop()
+	}
+	if done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				q.mutex.Lock()
+				defer q.mutex.Unlock()
+				expired = true
+				q.signal()
+			case <-stop:
+			}
+		}()
+	}
+
+	if q.isClosed() {
+		return ErrClosed
+	}
+	if len(puts) > 0 && q.drained != nil {
+		return ErrDraining
+	}
+	if len(puts) > 0 && q.putsPaused {
+		return ErrPaused
+	}
+
+	// Fail immediately if the items could never fit
+	if len(puts) > cap(q.c) || (q.maxBytes > 0 && size > q.maxBytes) {
+		return ErrInsufficientCapacity
+	}
+
+	for q.free() < len(puts) ||
+		(q.maxBytes > 0 && q.bytes+size > q.maxBytes) {
+		if q.isClosed() {
+			return ErrClosed
+		}
+		switch q.overflow {
+		case OverflowBlock:
+			if expired {
+				return ErrInsufficientCapacity
+			}
+			q.cond.Wait()
+		case OverflowDropOldest:
+			if err := q.evict(); err != nil {
+				return err
+			}
+		default:
+			if wait <= 0 || expired {
+				return ErrInsufficientCapacity
+			}
+			q.cond.Wait()
+		}
+	}
+	if err := q.checkQuota(puts, size); err != nil {
+		return err
+	}
+
+	q.pending += len(puts)
+	if q.sizes != nil {
+		for _, kv := range puts {
+			e, _ := internal.KeyToEntry(kv.k)
+			q.sizes[e] = len(kv.v)
+		}
+		q.bytes += size
+	}
+	return nil
+}
+
+// unadmit releases capacity reserved by admit for items that were not put.
+func (q *Queue) unadmit(puts []kv) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.pending -= len(puts)
+	for _, kv := range puts {
+		e, _ := internal.KeyToEntry(kv.k)
+		q.unsize(e)
+	}
+	q.checkDrained()
+	q.signal()
+}
+
+// evict removes the next available item from the queue to make room for
+// others. The caller must hold the queue mutex.
+func (q *Queue) evict() error {
+	select {
+	case <-q.c:
+	default:
+		// Nothing available to evict
+		return ErrInsufficientCapacity
+	}
+
+	e := q.ids.PopEntry()
+	k := e.Key()
+	err := q.bucket.Batch(func(b backend.Batch) error {
+		return b.Delete(k)
+	})
+	if err != nil {
+		// Return the item to the queue
+		q.ids.PushEntry(e)
+		q.c <- struct{}{}
+		return err
+	}
+	q.removed(e)
+	return nil
+}
+
+// unsize stops tracking the size of the given entry. The caller must hold the
+// queue mutex.
+func (q *Queue) unsize(e internal.Entry) {
+	if q.sizes == nil {
+		return
+	}
+	if n, ok := q.sizes[e]; ok {
+		q.bytes -= int64(n)
+		delete(q.sizes, e)
+	}
+}
+
+// add adds admitted entries to the queue, making them available for taking
+// either immediately or at their scheduled time. `groups` gives the message
+// group of any entries put with one.
+func (q *Queue) add(entries []internal.Entry, scheduled []internal.Scheduled, groups map[internal.Entry]string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Add entries in order, such that message groups are taken in order
+	entries = append([]internal.Entry{}, entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Before(entries[j])
+	})
+
+	q.pending -= len(entries) + len(scheduled)
+	q.length += len(entries) + len(scheduled)
+	for _, e := range entries {
+		if g, ok := groups[e]; ok {
+			q.msgGroups.Add(e, g)
+		}
+		// Capacity was reserved by admit, so this shouldn't block.
+		q.push(e)
+	}
+	for _, s := range scheduled {
+		if g, ok := groups[s.Entry]; ok {
+			q.msgGroups.Add(s.Entry, g)
+		}
+		q.scheduled.PushScheduled(s)
+	}
+	q.resetTimer()
+}
+
+// resetTimer arranges for release to be called when the next scheduled entry
+// becomes due. The caller must hold the queue mutex.
+func (q *Queue) resetTimer() {
+	if len(q.scheduled) == 0 || q.isClosed() {
+		if q.timer != nil {
+			q.timer.Stop()
+		}
+		return
+	}
+	d := time.Until(time.Unix(0, q.scheduled.Next().At))
+	if q.timer == nil {
+		q.timer = time.AfterFunc(d, q.release)
+	} else {
+		q.timer.Reset(d)
+	}
+}
+
+// release makes all scheduled entries that are now due available for taking.
+func (q *Queue) release() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	for len(q.scheduled) > 0 && q.scheduled.Next().At <= now {
+		s := q.scheduled.PopScheduled()
+		// Capacity was reserved when the entry was scheduled, so this
+		// shouldn't block.
+		q.push(s.Entry)
+	}
+	q.resetTimer()
+}
+
+// expireAt records the time at which each of the entries expires, such that
+// they are removed from the queue if not taken by then.
+func (q *Queue) expireAt(entries ...internal.Scheduled) {
+	if len(entries) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, s := range entries {
+		q.expiring.PushScheduled(s)
+	}
+	q.resetSweeper()
+}
+
+// resetSweeper arranges for sweep to be called when the next expiring entry
+// becomes due. The caller must hold the queue mutex.
+func (q *Queue) resetSweeper() {
+	if len(q.expiring) == 0 || q.isClosed() {
+		if q.sweeper != nil {
+			q.sweeper.Stop()
+		}
+		return
+	}
+	d := time.Until(time.Unix(0, q.expiring.Next().At))
+	if q.sweeper == nil {
+		q.sweeper = time.AfterFunc(d, q.sweep)
+	} else {
+		q.sweeper.Reset(d)
+	}
+}
+
+// sweep removes all expired entries that are waiting in the queue. Entries
+// that are currently held by a transaction are left alone; if they are
+// returned to the queue, they will be expired when next taken.
+func (q *Queue) sweep() {
+	q.mutex.Lock()
+	now := time.Now().UnixNano()
+	keys := [][]byte{}
+	for len(q.expiring) > 0 && q.expiring.Next().At <= now {
+		e := q.expiring.PopScheduled().Entry
+		if q.scheduled.Remove(e) {
+			keys = append(keys, e.Key())
+			continue
+		}
+		// Claim the entry's availability token before removing it, so that
+		// the number of tokens continues to match the number of entries.
 		select {
-		case q.c <- struct{}{}:
-			q.ids.PushID(id)
-			n++
+		case <-q.c:
+			if q.ids.Remove(e) {
+				keys = append(keys, e.Key())
+			} else {
+				q.c <- struct{}{}
+			}
 		default:
-			// This case shouldn't happen in practise, but better to catch
-			// than block.
-			return n, ErrInsufficientCapacity
+			// All available entries are being claimed by takers
+		}
+	}
+	q.resetSweeper()
+	q.mutex.Unlock()
+
+	// Expired items remain in storage if this fails, and will be expired
+	// when next taken, or when the queue is reopened.
+	q.retire(keys)
+}
+
+// retire removes the items with the given keys from storage, moving them to
+// the dead-letter queue if one is configured.
+func (q *Queue) retire(keys [][]byte) error {
+	if err := q.retireTo(keys, q.deadLetter, ""); err != nil {
+		return err
+	}
+	q.emit(EventExpire, keys)
+	if q.deadLetter != nil {
+		q.emit(EventDeadLetter, keys)
+	}
+	return nil
+}
+
+// retireTo removes the items with the given keys from storage, moving them to
+// queue `dst` if not nil. If `reason` is not empty, it is given in the
+// PoisonReasonHeader of the moved items.
+func (q *Queue) retireTo(keys [][]byte, dst *Queue, reason string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if dst != nil {
+		txn := dst.Transaction()
+		for _, k := range keys {
+			v, err := q.bucket.Get(k)
+			if err != nil {
+				return err
+			}
+			r, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			dead := &record{value: r.value, headers: r.headers}
+			if reason != "" {
+				dead.headers = map[string]string{PoisonReasonHeader: reason}
+				for name, v := range r.headers {
+					dead.headers[name] = v
+				}
+			}
+			if err := txn.put(dead, 0); err != nil {
+				return err
+			}
+		}
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+	}
+
+	err := q.bucket.Batch(func(b backend.Batch) error {
+		for _, k := range keys {
+			b.Delete(k)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entries := make([]internal.Entry, len(keys))
+	for i, k := range keys {
+		entries[i], _ = internal.KeyToEntry(k)
 	}
-	return n, nil
+	q.forget(entries...)
+	return nil
+}
+
+// hasDuplicate returns true if the deduplication key is held by an item in
+// the queue.
+func (q *Queue) hasDuplicate(key string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dedup.Has(key)
+}
+
+// reserve records the deduplication keys as being held by the given entries,
+// returning the entries whose keys are already held. If the queue rejects
+// duplicates, no keys are reserved unless all are available.
+func (q *Queue) reserve(keys map[string]internal.Entry) []internal.Entry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	dups := []internal.Entry{}
+	for k, e := range keys {
+		if q.dedup.Has(k) {
+			dups = append(dups, e)
+		}
+	}
+	if len(dups) > 0 && q.rejectDuplicates {
+		return dups
+	}
+	for k, e := range keys {
+		if !q.dedup.Has(k) {
+			q.dedup.Add(k, e)
+		}
+	}
+	return dups
+}
+
+// unreserve releases deduplication keys reserved for the given entries, which
+// were not put.
+func (q *Queue) unreserve(entries ...internal.Entry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, e := range entries {
+		q.dedup.Remove(e)
+	}
+}
+
+// forget releases any deduplication keys and capacity held by the given
+// entries, which have been removed from storage.
+func (q *Queue) forget(entries ...internal.Entry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, e := range entries {
+		q.removed(e)
+	}
+	q.signal()
+}
+
+// removed updates the queue's accounting for an entry that has been removed
+// from storage. The caller must hold the queue mutex.
+func (q *Queue) removed(e internal.Entry) {
+	if next, ok := q.msgGroups.Remove(e); ok {
+		// Capacity was reserved while the entry waited
+		q.c <- struct{}{}
+		q.ids.PushEntry(next)
+	}
+	q.dedup.Remove(e)
+	q.unsize(e)
+	q.length--
+	q.removals++
+	q.checkDrained()
+}
+
+// signal wakes any commits waiting for capacity. The caller must hold the
+// queue mutex.
+func (q *Queue) signal() {
+	if q.cond != nil {
+		q.cond.Broadcast()
+	}
+	q.wantLoad()
 }
 
 // getKeys returns upto `n` keys available for immediate taking, removing them
 // from the set of keys and returns them to the caller.
 func (q *Queue) getKeys(n int) [][]byte {
 	b := [][]byte{}
+	if _, resumed := q.pauseState(); resumed != nil {
+		return b
+	}
 	for {
 		select {
 		case <-q.c:
 			// Key became available, add to list of returned values
 			q.mutex.Lock()
-			k := q.ids.PopID().Key()
+			k := q.ids.PopEntry().Key()
+			q.signal()
 			q.mutex.Unlock()
 			b = append(b, k)
 			// Have we got enough values now?
@@ -152,8 +1358,9 @@ func (q *Queue) getKeys(n int) [][]byte {
 
 // awaitKeys returns `n` keys available for taking, removing them from the set
 // of keys and returns them to the caller, waiting at most the specified amount
-// of time forkeys to become available before before returning nil.
-func (q *Queue) awaitKeys(n int, t time.Duration) [][]byte {
+// of time forkeys to become available before before returning nil. Waiting
+// also stops if `done` is closed.
+func (q *Queue) awaitKeys(n int, t time.Duration, done <-chan struct{}) [][]byte {
 	if t == 0 {
 		// Special case - get keys directly without timeout if duration is zero
 		return q.getKeys(n)
@@ -168,11 +1375,28 @@ func (q *Queue) awaitKeys(n int, t time.Duration) [][]byte {
 	// Listen for available keys
 	b := [][]byte{}
 	for {
+		running, resumed := q.pauseState()
+		if resumed != nil {
+			// Wait for queue to be resumed
+			select {
+			case <-resumed:
+				continue
+			case <-cancel:
+				return b
+			case <-done:
+				return b
+			}
+		}
+
 		select {
+		case <-running:
+			// Queue was paused
+			continue
 		case <-q.c:
 			// Key became available, add to list of returned values
 			q.mutex.Lock()
-			k := q.ids.PopID().Key()
+			k := q.ids.PopEntry().Key()
+			q.signal()
 			q.mutex.Unlock()
 			b = append(b, k)
 			// Have we got enough values now?
@@ -182,41 +1406,438 @@ func (q *Queue) awaitKeys(n int, t time.Duration) [][]byte {
 		case <-cancel:
 			// Timed out; return whatever values we got in that time
 			return b
+		case <-done:
+			return b
+		}
+	}
+}
+
+// awaitBatch returns exactly `n` keys available for taking, removing them from
+// the set of keys and returning them to the caller, or nil if `n` keys do not
+// become available within `t`, or before `done` is closed.
+func (q *Queue) awaitBatch(n int, t time.Duration, done <-chan struct{}) [][]byte {
+	if n > cap(q.c) {
+		// Can never be satisfied
+		return nil
+	}
+
+	cancel := make(chan struct{}, 0)
+	timeout := time.AfterFunc(t, func() {
+		close(cancel)
+	})
+	defer timeout.Stop()
+
+	// Hold availability tokens until there are enough, counting them against
+	// the queue's capacity so that they can always be returned.
+	held := 0
+	unhold := func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		q.held -= held
+		for ; held > 0; held-- {
+			q.c <- struct{}{}
+		}
+	}
+	for held < n {
+		running, resumed := q.pauseState()
+		if resumed != nil {
+			// Return held tokens and wait for queue to be resumed
+			unhold()
+			select {
+			case <-resumed:
+				continue
+			case <-cancel:
+				return nil
+			case <-done:
+				return nil
+			}
+		}
+
+		select {
+		case <-running:
+			// Queue was paused
+			continue
+		case <-q.c:
+			q.mutex.Lock()
+			q.held++
+			q.mutex.Unlock()
+			held++
+		case <-cancel:
+			// Timed out; return held tokens
+			unhold()
+			return nil
+		case <-done:
+			unhold()
+			return nil
 		}
 	}
+
+	// Take keys for held tokens
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.held -= n
+	b := make([][]byte, n)
+	for i := range b {
+		b[i] = q.ids.PopEntry().Key()
+	}
+	q.signal()
+	return b
+}
+
+// limitTakes waits at most `t`, or until `done` is closed, for the queue's
+// take rate limit to allow at least `min` and at most `n` items to be taken,
+// returning the number allowed and the time remaining. Items that are allowed
+// but not taken should be returned with unlimitTakes.
+func (q *Queue) limitTakes(min, n int, t time.Duration, done <-chan struct{}) (int, time.Duration) {
+	if q.takeLimit == nil {
+		return n, t
+	}
+	start := time.Now()
+	n = q.takeLimit.Wait(min, n, t, done)
+	if t -= time.Since(start); t < 0 {
+		t = 0
+	}
+	return n, t
+}
+
+// unlimitTakes returns the allowance for `n` items that were allowed by
+// limitTakes but not taken.
+func (q *Queue) unlimitTakes(n int) {
+	if q.takeLimit != nil && n > 0 {
+		q.takeLimit.Return(n)
+	}
+}
+
+// take takes `n` elements from the queue, waiting at most `t`, or until `done`
+// is closed, to retrieve them.
+// Expired items are removed rather than returned, so fewer than `n` elements
+// may be returned even when more are available.
+func (q *Queue) take(n int, t time.Duration, done <-chan struct{}) (ids []internal.Entry, keys [][]byte, records []record, err error) {
+	start := time.Now()
+	taken := q.awaitKeys(n, t, done)
+	q.countTakeWait(len(taken), time.Since(start))
+	return q.load(taken)
+}
+
+// takeExactly takes exactly `n` elements from the queue, waiting at most `t`,
+// or until `done` is closed, for them all to become available, or returns no
+// elements. Expired items are
+// removed rather than returned, so fewer than `n` elements may be returned.
+func (q *Queue) takeExactly(n int, t time.Duration, done <-chan struct{}) (ids []internal.Entry, keys [][]byte, records []record, err error) {
+	start := time.Now()
+	taken := q.awaitBatch(n, t, done)
+	q.countTakeWait(len(taken), time.Since(start))
+	return q.load(taken)
+}
+
+// takeWhere takes the first available item whose headers satisfy `pred`,
+// waiting at most `t`, or until `done` is closed, for one to become available.
+func (q *Queue) takeWhere(pred func(headers map[string]string) bool, t time.Duration, done <-chan struct{}) (ids []internal.Entry, keys [][]byte, records []record, err error) {
+	start := time.Now()
+	deadline := start.Add(t)
+	for {
+		if _, resumed := q.pauseState(); resumed == nil {
+			matches, err := q.match(pred)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for _, e := range matches {
+				if !q.claim(e) {
+					continue
+				}
+				q.countTakeWait(1, time.Since(start))
+				ids, keys, records, err = q.load([][]byte{e.Key()})
+				if err != nil || len(ids) > 0 {
+					return ids, keys, records, err
+				}
+			}
+		}
+
+		// Nothing matched; wait for items to change
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, nil, nil, nil
+		}
+		if d > wherePoll {
+			d = wherePoll
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return nil, nil, nil, nil
+		}
+	}
+}
+
+// match returns the entries stored in the queue whose headers satisfy
+// `pred`, in the order in which they would be taken.
+func (q *Queue) match(pred func(headers map[string]string) bool) ([]internal.Entry, error) {
+	matches := []internal.Entry{}
+	err := q.bucket.ForEach(func(k, v []byte) error {
+		e, err := internal.KeyToEntry(k)
+		if err != nil {
+			return err
+		}
+		r := record{}
+		if !e.Legacy() {
+			if r, err = decodeRecord(v); err != nil {
+				// Left for take to handle
+				return nil
+			}
+		}
+		if pred(r.headers) {
+			matches = append(matches, e)
+		}
+		return nil
+	})
+	q.order(matches)
+	return matches, err
 }
 
-// take takes `n` elements from the queue, waiting at most `t` to retrieve them.
-func (q *Queue) take(n int, t time.Duration) (ids []internal.ID, keys [][]byte, values [][]byte, err error) {
-	// Fetch available keys
-	keys = q.awaitKeys(n, t)
+// claim removes the entry from the set of entries available for taking,
+// returning false if it is not available.
+func (q *Queue) claim(e internal.Entry) bool {
+	select {
+	case <-q.c:
+	default:
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.ids.Remove(e) {
+		// Not available; return the token
+		q.c <- struct{}{}
+		return false
+	}
+	q.signal()
+	return true
+}
 
+// load reads the items with the given keys, which have been taken from the
+// queue.
+func (q *Queue) load(taken [][]byte) (ids []internal.Entry, keys [][]byte, records []record, err error) {
 	// Setup return structures
-	n = len(keys)
-	ids = make([]internal.ID, n)
-	values = make([][]byte, n)
+	n := len(taken)
+	ids = make([]internal.Entry, 0, n)
+	keys = make([][]byte, 0, n)
+	records = make([]record, 0, n)
+	expired := [][]byte{}
+	skipped := [][]byte{}
+	corrupt := []kv{}
+	poisoned := []internal.Entry{}
 
 	// Populate return structures
-	for i, k := range keys {
-		values[i], err = q.bucket.Get(k)
+	now := time.Now()
+	for _, k := range taken {
+		id, err := internal.KeyToEntry(k)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		v, err := q.bucket.Get(k)
 		if err != nil {
 			return nil, nil, nil, err
 		}
-		ids[i], err = internal.KeyToID(k)
+		r := record{value: v}
+		if !id.Legacy() {
+			r, err = decodeRecord(v)
+			if err != nil && q.poison != nil {
+				corrupt = append(corrupt, kv{k, v})
+				poisoned = append(poisoned, id)
+				continue
+			} else if err != nil {
+				return nil, nil, nil, err
+			}
+			if r.expired(now) {
+				expired = append(expired, k)
+				continue
+			}
+		}
+		if done, err := q.processed(k, r); err != nil {
+			return nil, nil, nil, err
+		} else if done {
+			skipped = append(skipped, k)
+			continue
+		}
+		ids = append(ids, id)
+		keys = append(keys, k)
+		records = append(records, r)
+	}
+
+	if err := q.retire(expired); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := q.skip(skipped); err != nil {
+		return nil, nil, nil, err
 	}
+	if err := q.quarantine(corrupt); err != nil {
+		return nil, nil, nil, err
+	}
+	q.forget(poisoned...)
+	q.emitEntries(EventTake, ids)
 
-	return ids, keys, values, err
+	return ids, keys, records, nil
 }
 
-// enact puts and takes the given key values to the underlying storage.
-func (q *Queue) enact(puts, takes []kv) error {
-	return q.bucket.Batch(func(b backend.Batch) error {
-		for _, kv := range puts {
-			b.Put(kv.k, kv.v)
+// discard returns the taken entries to the queue, incrementing the number of
+// attempts recorded against each. Entries that have reached the maximum number
+// of attempts are retired instead. Entries become available again after
+// `delay`, or if zero, according to the queue's RetryDelay.
+func (q *Queue) discard(entries []internal.Entry, records []record, delay time.Duration) error {
+	q.disown(entries...)
+	requeue := make([]internal.Entry, 0, len(entries))
+	delayed := []internal.Scheduled{}
+	updates := make([]kv, 0, len(entries))
+	retired := [][]byte{}
+	now := time.Now()
+	for i, e := range entries {
+		if e.Legacy() {
+			// Legacy items have no record in which to count attempts or
+			// store the delay, so are only delayed until reopened.
+			if delay > 0 {
+				delayed = append(delayed, internal.Scheduled{
+					Entry: e,
+					At:    now.Add(delay).UnixNano(),
+				})
+			} else {
+				requeue = append(requeue, e)
+			}
+			continue
 		}
-		for _, kv := range takes {
-			b.Delete(kv.k)
+		r := records[i]
+		r.attempts++
+		if q.maxAttempts > 0 && r.attempts >= q.maxAttempts {
+			retired = append(retired, e.Key())
+			continue
 		}
-		return nil
-	})
+		d := delay
+		if d <= 0 && q.retryDelay != nil {
+			d = q.retryDelay(r.attempts)
+		}
+		if d > 0 {
+			r.availableAt = now.Add(d).UnixNano()
+			delayed = append(delayed, internal.Scheduled{
+				Entry: e,
+				At:    r.availableAt,
+			})
+		} else {
+			requeue = append(requeue, e)
+		}
+		updates = append(updates, kv{e.Key(), r.encode()})
+	}
+
+	// Ensure entries are always returned to the queue, even if updating
+	// them fails, so that they aren't lost until the queue is reopened.
+	err := q.enact(updates, nil)
+	if err == nil {
+		err = q.unjournal(entries...)
+	}
+	if err == nil {
+		dst, reason := q.deadLetter, ""
+		if dst == nil && q.poison != nil {
+			dst, reason = q.poison, poisonMaxAttempts
+		}
+		err = q.retireTo(retired, dst, reason)
+		if err == nil && dst != nil {
+			q.emit(EventDeadLetter, retired)
+		}
+	}
+	if err != nil {
+		for _, k := range retired {
+			e, _ := internal.KeyToEntry(k)
+			requeue = append(requeue, e)
+		}
+	}
+	if _, perr := q.putKey(requeue...); err == nil {
+		err = perr
+	}
+	if _, perr := q.schedule(delayed...); err == nil {
+		err = perr
+	}
+	return err
+}
+
+// MoveTo takes up to `n` items immediately available in the queue and puts
+// them into queue `dst`, returning the number of items moved. Items retain
+// their value, headers and priority. Where the backend supports it, the move
+// is made in a single atomic batch; otherwise items are put into `dst` before
+// being removed from this queue, so may be duplicated if the move fails. See
+// Txn.MoveTo to move items as part of a transaction.
+func (q *Queue) MoveTo(dst *Queue, n int) (int, error) {
+	txn := q.Transaction()
+	defer txn.Close()
+	moved, err := txn.MoveTo(dst, n, 0)
+	if moved == 0 {
+		return 0, err
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// enactMove puts and takes the given key values to the underlying storage,
+// while also putting `moves` into the storage of queue `dst`, atomically if
+// the backend supports it.
+func (q *Queue) enactMove(puts, takes []kv, dst *Queue, moves []kv) error {
+	if mb, ok := q.bucket.(backend.MultiBatcher); ok {
+		start := time.Now()
+		others := []backend.Bucket{dst.bucket}
+		err := mb.BatchWith(others, func(b backend.Batch, o []backend.Batch) error {
+			for _, kv := range puts {
+				b.Put(kv.k, kv.v)
+			}
+			for _, kv := range takes {
+				b.Delete(kv.k)
+			}
+			for _, kv := range moves {
+				o[0].Put(kv.k, kv.v)
+			}
+			return nil
+		})
+		if err == nil {
+			q.countWrite(time.Since(start))
+		}
+		if err != backend.ErrForeignBucket {
+			return err
+		}
+	}
+
+	// Put moved items first, such that a failure duplicates rather than
+	// loses them
+	if err := dst.enact(moves, nil); err != nil {
+		return err
+	}
+	return q.enact(puts, takes)
+}
+
+// enact puts and takes the given key values to the underlying storage, along
+// with those of concurrent commits if the queue has a CommitWindow.
+func (q *Queue) enact(puts, takes []kv) error {
+	return q.enactWith(puts, takes, !q.opts.NoSync)
+}
+
+// enactWith puts and takes the given key values as with enact, syncing them
+// to disk if `sync` is true.
+func (q *Queue) enactWith(puts, takes []kv, sync bool) error {
+	start := time.Now()
+	var err error
+	if q.committer != nil {
+		err = q.committer.write(puts, takes, sync)
+	} else {
+		err = batch(q.bucket, sync, func(b backend.Batch) error {
+			for _, kv := range puts {
+				b.Put(kv.k, kv.v)
+			}
+			for _, kv := range takes {
+				b.Delete(kv.k)
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		q.countWrite(time.Since(start))
+	}
+	return err
 }
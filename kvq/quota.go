@@ -0,0 +1,107 @@
+package kvq
+
+import (
+	"errors"
+)
+
+var (
+	// ErrQuotaExceeded is returned when committing items to a queue would
+	// exceed its Quota, and the quota's policy rejects them.
+	ErrQuotaExceeded = errors.New("queue quota exceeded")
+)
+
+// QuotaAction is the action taken when a commit would exceed a queue's Quota.
+type QuotaAction int
+
+const (
+	// QuotaReject causes the commit to fail with ErrQuotaExceeded.
+	QuotaReject QuotaAction = iota
+	// QuotaEvictOldest causes items waiting in the queue to be removed,
+	// next-to-be-taken first, until the commit is within the quota. If the
+	// commit alone exceeds the quota, it fails with ErrQuotaExceeded.
+	QuotaEvictOldest
+	// QuotaAllow allows the commit to exceed the quota, such as where the
+	// breach is only to be reported.
+	QuotaAllow
+)
+
+// Quota limits the number and total size of the items stored in a queue,
+// isolating the queues of different tenants from one another. Unlike
+// MaxQueue and MaxBytes, which bound the queue's capacity, a quota leaves the
+// action taken when it is exceeded to a policy.
+type Quota struct {
+	// MaxItems is the maximum number of items stored in the queue, including
+	// those being taken. If zero, the number of items is not limited.
+	MaxItems int
+	// MaxBytes is the maximum total size of the items stored in the queue,
+	// including those being taken. If zero, the size is not limited.
+	MaxBytes int64
+	// OnBreach is called when a commit would exceed the quota, and returns
+	// the action to take. It is called with the queue locked, so must not use
+	// the queue, and should return promptly. If nil, such commits are
+	// rejected.
+	OnBreach func(QuotaBreach) QuotaAction
+}
+
+// QuotaBreach describes a commit that would exceed a queue's Quota.
+type QuotaBreach struct {
+	// Queue is the namespace of the queue.
+	Queue string
+	// Quota is the quota that would be exceeded.
+	Quota Quota
+	// Puts is the number of items being committed.
+	Puts int
+	// Items is the number of items the queue would store after the commit.
+	Items int
+	// Bytes is the total size of the items the queue would store after the
+	// commit, if the quota limits the size.
+	Bytes int64
+}
+
+// checkQuota applies the queue's quota to a commit of the given items, of
+// total size `size`, taking the action chosen by its policy if they would
+// exceed it. The caller must hold the queue mutex.
+func (q *Queue) checkQuota(puts []kv, size int64) error {
+	quota := q.opts.Quota
+	if quota == nil {
+		return nil
+	}
+	over := func() bool {
+		return (quota.MaxItems > 0 && q.length+q.pending+len(puts) > quota.MaxItems) ||
+			(quota.MaxBytes > 0 && q.bytes+size > quota.MaxBytes)
+	}
+	if !over() {
+		return nil
+	}
+
+	action := QuotaReject
+	if quota.OnBreach != nil {
+		action = quota.OnBreach(QuotaBreach{
+			Queue: q.namespace,
+			Quota: *quota,
+			Puts:  len(puts),
+			Items: q.length + q.pending + len(puts),
+			Bytes: q.bytes + size,
+		})
+	}
+	switch action {
+	case QuotaAllow:
+		return nil
+	case QuotaEvictOldest:
+		if (quota.MaxItems > 0 && len(puts) > quota.MaxItems) ||
+			(quota.MaxBytes > 0 && size > quota.MaxBytes) {
+			// Could never fit
+			return ErrQuotaExceeded
+		}
+		for over() {
+			if err := q.evict(); err == ErrInsufficientCapacity {
+				return ErrQuotaExceeded
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return ErrQuotaExceeded
+	}
+}
@@ -0,0 +1,80 @@
+package kvq
+
+import (
+	"math"
+	"time"
+)
+
+// rateInterval is the interval over which items are counted before being
+// folded into the moving averages of a meter.
+const rateInterval = 5 * time.Second
+
+// Rates gives the rate at which items are processed, in items per second, as
+// exponentially weighted moving averages over one, five and fifteen minutes,
+// in the manner of Unix load averages.
+type Rates struct {
+	M1  float64
+	M5  float64
+	M15 float64
+}
+
+// meter measures the rate of events as moving averages, updated each
+// rateInterval. Intervals are accounted for when the meter is next marked or
+// read, so no goroutine is needed to tick it.
+type meter struct {
+	start   time.Time // start of the current interval
+	count   int64     // events in the current interval
+	rates   Rates
+	started bool // true once an interval has been folded in
+}
+
+// mark counts `n` events happening at time `now`.
+func (m *meter) mark(n int64, now time.Time) {
+	m.tick(now)
+	m.count += n
+}
+
+// read returns the rates at time `now`.
+func (m *meter) read(now time.Time) Rates {
+	m.tick(now)
+	return m.rates
+}
+
+// tick folds each interval that has ended by time `now` into the averages.
+func (m *meter) tick(now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+		return
+	}
+	n := int64(now.Sub(m.start) / rateInterval)
+	if n <= 0 {
+		return
+	}
+
+	// Only the first interval that ended has events counted in it; the rest
+	// were idle, so decay the averages towards zero.
+	rate := float64(m.count) / rateInterval.Seconds()
+	fold := func(avg *float64, window time.Duration) {
+		alpha := 1 - math.Exp(-rateInterval.Seconds()/window.Seconds())
+		if m.started {
+			*avg += alpha * (rate - *avg)
+		} else {
+			*avg = rate
+		}
+		*avg *= math.Pow(1-alpha, float64(n-1))
+	}
+	fold(&m.rates.M1, time.Minute)
+	fold(&m.rates.M5, 5*time.Minute)
+	fold(&m.rates.M15, 15*time.Minute)
+
+	m.started = true
+	m.count = 0
+	m.start = m.start.Add(time.Duration(n) * rateInterval)
+}
+
+// add adds the rates of another meter.
+func (r *Rates) add(o Rates) {
+	r.M1 += o.M1
+	r.M5 += o.M5
+	r.M15 += o.M15
+}
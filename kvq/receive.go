@@ -0,0 +1,79 @@
+package kvq
+
+import (
+	"context"
+	"time"
+)
+
+// Delivery is an item received with Queue.Receive. The item is held by the
+// receiver until it is acknowledged with Ack, or returned with Nack.
+type Delivery struct {
+	Message
+
+	txn *Txn
+}
+
+// Receive takes a single item from the queue, waiting until one becomes
+// available or `ctx` is done, in which case the context's error is returned.
+// The item remains hidden from other takers until Ack or Nack is called on the
+// returned delivery. This offers at-least-once processing of individual items
+// without managing transactions directly; use a Txn to take or put several
+// items atomically.
+func (q *Queue) Receive(ctx context.Context) (*Delivery, error) {
+	txn := q.Transaction()
+	for {
+		m, err := txn.TakeMessagesContext(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			return &Delivery{Message: *m[0], txn: txn}, nil
+		}
+		// Taken items had expired; try again
+	}
+}
+
+// Chan returns a channel onto which items taken from the queue are delivered,
+// allowing consumption to be combined with other channels in a select
+// statement. Each delivery must be acknowledged with Ack or returned with
+// Nack, as with Receive. The channel is closed once `ctx` is done, or if
+// taking an item fails; an item taken but not yet delivered at that time is
+// returned to the queue without counting an attempt.
+func (q *Queue) Chan(ctx context.Context) <-chan *Delivery {
+	c := make(chan *Delivery)
+	go func() {
+		defer close(c)
+		for {
+			d, err := q.Receive(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case c <- d:
+			case <-ctx.Done():
+				d.txn.untake()
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// Ack acknowledges that the item has been processed, removing it from the
+// queue.
+func (d *Delivery) Ack() error {
+	return d.txn.Commit()
+}
+
+// Nack returns the item to the queue, incrementing its attempt count as if a
+// transaction holding it had been closed. The queue's RetryDelay and
+// MaxAttempts apply as usual.
+func (d *Delivery) Nack() error {
+	return d.txn.Close()
+}
+
+// NackDelay returns the item to the queue as with Nack, but the item only
+// becomes available again once `delay` has elapsed.
+func (d *Delivery) NackDelay(delay time.Duration) error {
+	return d.txn.DiscardDelay(delay)
+}
@@ -0,0 +1,220 @@
+package kvq
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend/compress"
+)
+
+// Values of items put using prioritised keys are stored as records,
+// allowing metadata to be stored alongside the value. A record consists of a
+// version byte followed by a series of fields, each of which is a tag byte,
+// a uvarint length and the field data. Unknown fields are ignored when
+// decoding, so that fields can be added without breaking older readers.
+const recordVersion byte = 1
+
+// Record field tags.
+const (
+	tagValue       byte = 0 // item value
+	tagAvailableAt byte = 1 // time item becomes available, in Unix nanoseconds
+	tagExpiresAt   byte = 2 // time item expires, in Unix nanoseconds
+	tagAttempts    byte = 3 // number of times item has been discarded, uvarint
+	tagDedupKey    byte = 4 // deduplication key
+	tagHeaders     byte = 5 // user headers, as length-prefixed name/value pairs
+	tagGroup       byte = 6 // message group
+	tagSchema      byte = 7 // application-defined schema version, one byte
+	tagCodec       byte = 8 // ID of codec value is compressed with, one byte
+)
+
+var (
+	// ErrCorruptRecord is returned when a stored item cannot be decoded.
+	ErrCorruptRecord = errors.New("corrupt record")
+)
+
+// record is an item value and its metadata, as stored in the backend.
+type record struct {
+	value       []byte
+	availableAt int64  // Unix nanoseconds, or 0 if available immediately
+	expiresAt   int64  // Unix nanoseconds, or 0 if item never expires
+	attempts    int    // number of times item has been taken and discarded
+	dedupKey    string // deduplication key, or empty if none
+	headers     map[string]string
+	group       string         // message group, or empty if none
+	schema      uint8          // schema version of value, or 0 if unset
+	codec       compress.Codec // compresses value when stored, if not nil
+}
+
+// available returns true if the record may be taken at time `now`.
+func (r *record) available(now time.Time) bool {
+	return r.availableAt == 0 || r.availableAt <= now.UnixNano()
+}
+
+// expired returns true if the record has expired at time `now`.
+func (r *record) expired(now time.Time) bool {
+	return r.expiresAt != 0 && r.expiresAt <= now.UnixNano()
+}
+
+// encode returns the stored form of the record.
+func (r *record) encode() []byte {
+	b := make([]byte, 0, 64+len(r.dedupKey)+len(r.value))
+	b = append(b, recordVersion)
+	if r.availableAt != 0 {
+		b = appendField(b, tagAvailableAt,
+			binary.BigEndian.AppendUint64(nil, uint64(r.availableAt)))
+	}
+	if r.expiresAt != 0 {
+		b = appendField(b, tagExpiresAt,
+			binary.BigEndian.AppendUint64(nil, uint64(r.expiresAt)))
+	}
+	if r.attempts != 0 {
+		b = appendField(b, tagAttempts,
+			binary.AppendUvarint(nil, uint64(r.attempts)))
+	}
+	if r.dedupKey != "" {
+		b = appendField(b, tagDedupKey, []byte(r.dedupKey))
+	}
+	if len(r.headers) > 0 {
+		b = appendField(b, tagHeaders, encodeHeaders(r.headers))
+	}
+	if r.group != "" {
+		b = appendField(b, tagGroup, []byte(r.group))
+	}
+	if r.schema != 0 {
+		b = appendField(b, tagSchema, []byte{r.schema})
+	}
+	if r.codec != nil && r.codec != compress.None {
+		// Values that don't shrink are stored uncompressed
+		v, err := r.codec.Encode(nil, r.value)
+		if err == nil && len(v) < len(r.value) {
+			b = appendField(b, tagCodec, []byte{r.codec.ID()})
+			return appendField(b, tagValue, v)
+		}
+	}
+	return appendField(b, tagValue, r.value)
+}
+
+// appendField appends a field with the given tag and data to `b`.
+func appendField(b []byte, tag byte, data []byte) []byte {
+	b = append(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// decodeRecord parses a record from its stored form.
+func decodeRecord(b []byte) (record, error) {
+	r := record{}
+	if len(b) == 0 || b[0] != recordVersion {
+		return r, ErrCorruptRecord
+	}
+	b = b[1:]
+	for len(b) > 0 {
+		tag := b[0]
+		n, m := binary.Uvarint(b[1:])
+		if m <= 0 || uint64(len(b)-1-m) < n {
+			return r, ErrCorruptRecord
+		}
+		data := b[1+m : 1+m+int(n)]
+		b = b[1+m+int(n):]
+
+		switch tag {
+		case tagValue:
+			r.value = data
+		case tagAvailableAt:
+			if len(data) != 8 {
+				return r, ErrCorruptRecord
+			}
+			r.availableAt = int64(binary.BigEndian.Uint64(data))
+		case tagExpiresAt:
+			if len(data) != 8 {
+				return r, ErrCorruptRecord
+			}
+			r.expiresAt = int64(binary.BigEndian.Uint64(data))
+		case tagAttempts:
+			n, m := binary.Uvarint(data)
+			if m != len(data) {
+				return r, ErrCorruptRecord
+			}
+			r.attempts = int(n)
+		case tagDedupKey:
+			r.dedupKey = string(data)
+		case tagHeaders:
+			h, err := decodeHeaders(data)
+			if err != nil {
+				return r, err
+			}
+			r.headers = h
+		case tagGroup:
+			r.group = string(data)
+		case tagSchema:
+			if len(data) != 1 {
+				return r, ErrCorruptRecord
+			}
+			r.schema = data[0]
+		case tagCodec:
+			if len(data) != 1 {
+				return r, ErrCorruptRecord
+			}
+			codec, err := compress.CodecByID(data[0])
+			if err != nil {
+				return r, ErrCorruptRecord
+			}
+			r.codec = codec
+		}
+	}
+	if r.codec != nil {
+		v, err := r.codec.Decode(nil, r.value)
+		if err != nil {
+			return r, ErrCorruptRecord
+		}
+		r.value = v
+	}
+	return r, nil
+}
+
+// encodeHeaders returns the stored form of the headers, as a series of
+// length-prefixed names and values, sorted by name.
+func encodeHeaders(h map[string]string) []byte {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := []byte{}
+	for _, name := range names {
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+		b = binary.AppendUvarint(b, uint64(len(h[name])))
+		b = append(b, h[name]...)
+	}
+	return b
+}
+
+// decodeHeaders parses headers from their stored form.
+func decodeHeaders(b []byte) (map[string]string, error) {
+	h := map[string]string{}
+	next := func() (string, bool) {
+		n, m := binary.Uvarint(b)
+		if m <= 0 || uint64(len(b)-m) < n {
+			return "", false
+		}
+		s := string(b[m : m+int(n)])
+		b = b[m+int(n):]
+		return s, true
+	}
+	for len(b) > 0 {
+		name, ok := next()
+		if !ok {
+			return nil, ErrCorruptRecord
+		}
+		value, ok := next()
+		if !ok {
+			return nil, ErrCorruptRecord
+		}
+		h[name] = value
+	}
+	return h, nil
+}
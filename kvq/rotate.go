@@ -0,0 +1,51 @@
+package kvq
+
+import (
+	"errors"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// ErrNotEncrypted is returned by DB.Rotate when the backend does not encrypt
+// the data written to it; see backend.KeyRotator.
+var ErrNotEncrypted = errors.New("backend does not support key rotation")
+
+// Rotate changes the key with which the database's backend encrypts data to
+// `key`, then re-encrypts the data of every queue listed by Queues, including
+// their metadata, ledgers, poison queues and consumer groups, with the new
+// key. Queues remain in use throughout, as data written with the previous key
+// can still be read until it is re-encrypted. If re-encrypting fails part way
+// through, Rotate can be called again with the same key to finish it; until
+// then, the previous key must continue to be supplied to the backend, such as
+// with encrypt.Options.OldKeys.
+func (db *DB) Rotate(key []byte) error {
+	if backend.IsReadOnly(db.DB) {
+		return ErrReadOnly
+	}
+	r, ok := db.DB.(backend.KeyRotator)
+	if !ok {
+		return ErrNotEncrypted
+	}
+	if err := r.Rotate(key); err != nil {
+		return err
+	}
+
+	namespaces, err := db.Queues()
+	if err != nil {
+		return err
+	}
+	names := []string{queuesBucket}
+	for _, namespace := range namespaces {
+		qnames, err := namespaceBuckets(liveBuckets(db.DB), namespace)
+		if err != nil {
+			return err
+		}
+		names = append(names, qnames...)
+	}
+	for _, name := range names {
+		if err := r.Reencrypt(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package kvq
+
+import (
+	"errors"
+
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+var (
+	// ErrInvalidSavepoint is returned when rolling back to a savepoint that
+	// was not made on the transaction since it was last committed, closed or
+	// reset, or that was made after a savepoint already rolled back to.
+	ErrInvalidSavepoint = errors.New("invalid savepoint")
+)
+
+// Savepoint marks the state of a transaction, such that the changes made
+// since can be rolled back with Txn.RollbackTo.
+type Savepoint struct {
+	lastPut  internal.ID     // last item put before the savepoint
+	lastMove internal.ID     // last item moved before the savepoint
+	taken    map[string]bool // keys of items taken before the savepoint
+}
+
+// Savepoint marks the current state of the transaction, such that changes
+// made after it can be rolled back with RollbackTo without discarding the
+// whole transaction, e.g. when one item of a batch fails to be processed.
+func (txn *Txn) Savepoint() *Savepoint {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+
+	sp := &Savepoint{
+		lastPut: lastPut(txn.putValues),
+		taken:   make(map[string]bool, len(txn.takeValues)),
+	}
+	if txn.move != nil {
+		txn.move.mutex.Lock()
+		sp.lastMove = lastPut(txn.move.putValues)
+		txn.move.mutex.Unlock()
+	}
+	for _, kv := range txn.takeValues {
+		sp.taken[string(kv.k)] = true
+	}
+	for _, kv := range txn.consumed {
+		sp.taken[string(kv.k)] = true
+	}
+	txn.savepoints = append(txn.savepoints, sp)
+	return sp
+}
+
+// RollbackTo reverts the changes made to the transaction since savepoint
+// `sp`. Items put or moved since are discarded, while items taken since are
+// returned to the queue as if the transaction had been closed, incrementing
+// their attempt count. The savepoint remains valid, while those made after it
+// do not. Items moved within a MultiTxn are put by the destination queue's
+// part of the transaction, so are rolled back by its savepoints instead.
+func (txn *Txn) RollbackTo(sp *Savepoint) error {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+
+	i := -1
+	for j, s := range txn.savepoints {
+		if s == sp {
+			i = j
+		}
+	}
+	if i < 0 {
+		return ErrInvalidSavepoint
+	}
+	txn.savepoints = txn.savepoints[:i+1]
+
+	// Return puts taken by the transaction itself since the savepoint, such
+	// that those put before it are restored
+	restaged := []kv{}
+	for _, kv := range txn.consumed {
+		if !sp.taken[string(kv.k)] {
+			restaged = append(restaged, kv)
+		}
+	}
+	txn.unconsume(restaged)
+	txn.drop(putsAfter(txn.putValues, sp.lastPut))
+	if txn.move != nil {
+		txn.move.mutex.Lock()
+		txn.move.drop(putsAfter(txn.move.putValues, sp.lastMove))
+		moved := len(txn.move.putValues)
+		txn.move.mutex.Unlock()
+		if moved == 0 {
+			txn.move = nil
+		}
+	}
+
+	ids := []MessageID{}
+	for _, kv := range txn.takeValues {
+		if !sp.taken[string(kv.k)] {
+			ids = append(ids, MessageID(kv.k))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	entries, _, records, err := txn.release(ids)
+	if err != nil {
+		return err
+	}
+	entries, records = txn.queue.heldBy(txn, entries, records)
+	return txn.queue.discard(entries, records, 0)
+}
+
+// lastPut returns the ID of the last of the given items to be put, which is
+// the highest, as IDs are allocated in sequence.
+func lastPut(puts []kv) internal.ID {
+	last := internal.NilID
+	for _, kv := range puts {
+		if e, _ := internal.KeyToEntry(kv.k); e.ID > last {
+			last = e.ID
+		}
+	}
+	return last
+}
+
+// putsAfter returns the entries of the given items that were put after the
+// item with ID `last`.
+func putsAfter(puts []kv, last internal.ID) []internal.Entry {
+	entries := []internal.Entry{}
+	for _, kv := range puts {
+		if e, _ := internal.KeyToEntry(kv.k); e.ID > last {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,136 @@
+package kvq
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// shardPoll is the interval at which ShardedQueue.Take looks for items
+	// in each shard while waiting.
+	shardPoll = 50 * time.Millisecond
+)
+
+var (
+	// ErrNoShards is returned by OpenSharded when given no DBs.
+	ErrNoShards = errors.New("no shards given")
+)
+
+// ShardedQueue is a single logical queue split across queues of the same
+// namespace on several DBs, such that puts are spread over the DBs and
+// throughput is not limited by the write and compaction bandwidth of one of
+// them. Items are ordered within each shard, but not across shards.
+type ShardedQueue struct {
+	shards []*Queue
+
+	mutex sync.Mutex
+	put   int // shard to put the next item to
+	take  int // shard to take the next item from
+}
+
+// OpenSharded opens the queue with the given namespace and options on each of
+// the DBs, returning a ShardedQueue spanning them. The DBs should be given in
+// the same order whenever the queue is opened, so that PutKey sends each key
+// to the same shard.
+func OpenSharded(dbs []*DB, namespace string, opts *QueueOptions) (*ShardedQueue, error) {
+	if len(dbs) == 0 {
+		return nil, ErrNoShards
+	}
+	sq := &ShardedQueue{}
+	for _, db := range dbs {
+		q, err := db.QueueWithOptions(namespace, opts)
+		if err != nil {
+			sq.Close()
+			return nil, err
+		}
+		sq.shards = append(sq.shards, q)
+	}
+	return sq, nil
+}
+
+// Shards returns the queue of each shard, in the order of the DBs given to
+// OpenSharded. Items can be put and taken with transactions on a shard's
+// queue directly.
+func (sq *ShardedQueue) Shards() []*Queue {
+	return append([]*Queue{}, sq.shards...)
+}
+
+// Put puts the item to the next shard in turn, committing it immediately as
+// with Queue.Put. If the shard is full, the item is put to the next shard
+// with room instead.
+func (sq *ShardedQueue) Put(v []byte) error {
+	sq.mutex.Lock()
+	i := sq.put
+	sq.put = (sq.put + 1) % len(sq.shards)
+	sq.mutex.Unlock()
+
+	var err error
+	for n := 0; n < len(sq.shards); n++ {
+		err = sq.shards[(i+n)%len(sq.shards)].Put(v)
+		if err != ErrInsufficientCapacity {
+			return err
+		}
+	}
+	return err
+}
+
+// PutKey puts the item to the shard chosen by hashing `key`, committing it
+// immediately as with Queue.Put. Items put with the same key go to the same
+// shard, so are taken in the order they were put.
+func (sq *ShardedQueue) PutKey(key, v []byte) error {
+	h := fnv.New32a()
+	h.Write(key)
+	return sq.shards[h.Sum32()%uint32(len(sq.shards))].Put(v)
+}
+
+// Take takes an item from one of the shards, waiting at most `t` for one to
+// become available, and removes it from storage immediately, as with
+// Queue.Take. Shards are taken from in turn, so that no shard is starved.
+// Returns nil if no item became available.
+func (sq *ShardedQueue) Take(t time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(t)
+	for {
+		sq.mutex.Lock()
+		i := sq.take
+		sq.take = (sq.take + 1) % len(sq.shards)
+		sq.mutex.Unlock()
+
+		for n := 0; n < len(sq.shards); n++ {
+			v, err := sq.shards[(i+n)%len(sq.shards)].Take(0)
+			if v != nil || err != nil {
+				return v, err
+			}
+		}
+
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, nil
+		}
+		if d > shardPoll {
+			d = shardPoll
+		}
+		time.Sleep(d)
+	}
+}
+
+// Len returns the number of items stored across every shard.
+func (sq *ShardedQueue) Len() int {
+	n := 0
+	for _, q := range sq.shards {
+		n += q.Len()
+	}
+	return n
+}
+
+// Close closes the queue of every shard.
+func (sq *ShardedQueue) Close() error {
+	var err error
+	for _, q := range sq.shards {
+		if cerr := q.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
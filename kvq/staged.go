@@ -0,0 +1,136 @@
+package kvq
+
+import (
+	"github.com/johnsto/go-kvq/kvq/internal"
+)
+
+// SetReadYourWrites sets whether takes from the transaction see the items put
+// earlier in the same transaction. When enabled, items put by the transaction
+// that are available immediately are taken first, in the order they would be
+// taken from the queue, before any items are taken from the queue itself.
+// Such items are never written to storage: committing the transaction neither
+// puts nor takes them, while closing it discards them. This allows a handler
+// to stage work items and consume them in one atomic unit. It does not apply
+// to TakeWhere, and items taken this way cannot be acknowledged with Ack or
+// Nack.
+func (txn *Txn) SetReadYourWrites(enabled bool) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	txn.readWrites = enabled
+}
+
+// takeStagedFirst takes up to `n` items put earlier in the transaction, if it
+// reads its own writes, then any remaining items from the queue using `take`,
+// which is given the number of items remaining and the minimum to take. If
+// `exact` is true, staged items are returned to the transaction unless all
+// `n` items are taken.
+func (txn *Txn) takeStagedFirst(n int, exact bool, take func(n, min int) ([]*Message, error)) ([]*Message, error) {
+	staged, msgs := txn.takeStaged(n)
+	if len(msgs) == 0 {
+		min := 1
+		if exact {
+			min = n
+		}
+		return take(n, min)
+	}
+	if len(msgs) == n {
+		return msgs, nil
+	}
+
+	min := 1
+	if exact {
+		min = n - len(msgs)
+	}
+	taken, err := take(n-len(msgs), min)
+	if err != nil || (exact && taken == nil) {
+		txn.restage(staged)
+		return nil, err
+	}
+	return append(msgs, taken...), nil
+}
+
+// takeStaged takes up to `n` items put earlier in the transaction, if it
+// reads its own writes, returning their key values and messages.
+func (txn *Txn) takeStaged(n int) ([]kv, []*Message) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+
+	if !txn.readWrites || txn.puts.Len() == 0 {
+		return nil, nil
+	}
+
+	entries := []internal.Entry{}
+	for len(entries) < n && txn.puts.Len() > 0 {
+		entries = append(entries, txn.puts.PopEntry())
+	}
+	values := make(map[internal.Entry][]byte, len(txn.putValues))
+	for _, kv := range txn.putValues {
+		e, _ := internal.KeyToEntry(kv.k)
+		values[e] = kv.v
+	}
+
+	staged := make([]kv, len(entries))
+	msgs := make([]*Message, len(entries))
+	for i, e := range entries {
+		staged[i] = kv{e.Key(), values[e]}
+		r, _ := decodeRecord(values[e])
+		msgs[i] = newMessage(e, r)
+	}
+	txn.drop(entries)
+	txn.consumed = append(txn.consumed, staged...)
+	return staged, msgs
+}
+
+// restage returns items taken by takeStaged to the set of items to put.
+func (txn *Txn) restage(staged []kv) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	txn.unconsume(staged)
+}
+
+// unconsume returns items taken by takeStaged to the set of items to put. The
+// caller must hold the transaction mutex.
+func (txn *Txn) unconsume(staged []kv) {
+	restaged := map[string]bool{}
+	for _, kv := range staged {
+		restaged[string(kv.k)] = true
+		txn.stage(kv)
+	}
+
+	consumed := txn.consumed[:0]
+	for _, kv := range txn.consumed {
+		if !restaged[string(kv.k)] {
+			consumed = append(consumed, kv)
+		}
+	}
+	txn.consumed = consumed
+}
+
+// stage adds an item, in its stored form, to the set of items to put. The
+// caller must hold the transaction mutex.
+func (txn *Txn) stage(item kv) {
+	e, _ := internal.KeyToEntry(item.k)
+	r, _ := decodeRecord(item.v)
+	txn.putValues = append(txn.putValues, item)
+	txn.putBytes += int64(len(item.v))
+	if r.availableAt != 0 {
+		txn.scheduled = append(txn.scheduled, internal.Scheduled{
+			Entry: e,
+			At:    r.availableAt,
+		})
+	} else {
+		txn.puts.PushEntry(e)
+	}
+	if r.expiresAt != 0 {
+		txn.expiring = append(txn.expiring, internal.Scheduled{
+			Entry: e,
+			At:    r.expiresAt,
+		})
+	}
+	if r.dedupKey != "" {
+		txn.dedup[r.dedupKey] = e
+	}
+	if r.group != "" {
+		txn.msgGroups[e] = r.group
+	}
+}
@@ -0,0 +1,276 @@
+package kvq
+
+import (
+	"sort"
+	"time"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+// LatencyBuckets are the upper bounds of the buckets in which commit latencies
+// are counted by Stats.CommitBuckets, in ascending order.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// Stats gives counts of the work done by transactions on a queue since it was
+// opened, for observability. Only transactions that put or take items are
+// counted.
+type Stats struct {
+	// Committed is the number of transactions committed.
+	Committed int64
+	// Discarded is the number of transactions closed or discarded without
+	// being committed, including those that timed out.
+	Discarded int64
+	// PutsStaged is the number of items put by transactions, whether or not
+	// they were committed.
+	PutsStaged int64
+	// TakesStaged is the number of items taken by transactions, whether or
+	// not they were committed.
+	TakesStaged int64
+	// PutsCommitted is the number of items put by committed transactions.
+	PutsCommitted int64
+	// TakesCommitted is the number of items taken by committed transactions.
+	TakesCommitted int64
+	// CommitErrors is the number of commits that failed, including those
+	// rejected because the queue was full.
+	CommitErrors int64
+	// CommitLatency is the average time taken to commit a transaction.
+	CommitLatency time.Duration
+	// CommitTime is the total time taken to commit transactions.
+	CommitTime time.Duration
+	// CommitBuckets counts the transactions committed by the time taken to
+	// commit them. Element i counts those taking longer than
+	// LatencyBuckets[i-1] but no longer than LatencyBuckets[i], and the last
+	// element counts those taking longer than every bucket.
+	CommitBuckets []int64
+	// PutRate is the rate at which items have been put by committed
+	// transactions recently.
+	PutRate Rates
+	// TakeRate is the rate at which items have been taken by committed
+	// transactions recently.
+	TakeRate Rates
+	// Commits gives the distribution of the time taken to commit
+	// transactions, from which percentiles can be read.
+	Commits Histogram
+	// TakeWaits gives the distribution of the time takers waited for items
+	// to become available, counting only takes that returned items.
+	TakeWaits Histogram
+	// Writes gives the distribution of the time taken to write batches of
+	// items put and taken to the backend, including any wait for a
+	// CommitWindow.
+	Writes Histogram
+}
+
+// Stats returns counts of the work done by transactions on the queue. Items
+// put and taken with Queue.Put and Queue.Take are counted as transactions of
+// their own.
+func (q *Queue) Stats() Stats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	s := q.stats
+	s.CommitTime = q.commitTime
+	if s.Committed > 0 {
+		s.CommitLatency = q.commitTime / time.Duration(s.Committed)
+	}
+	s.CommitBuckets = append([]int64{}, q.commitBuckets...)
+	now := time.Now()
+	s.PutRate = q.putRate.read(now)
+	s.TakeRate = q.takeRate.read(now)
+	s.Commits = q.commits.clone()
+	s.TakeWaits = q.takeWaits.clone()
+	s.Writes = q.writes.clone()
+	return s
+}
+
+// staged counts items put or taken by a transaction.
+func (q *Queue) staged(puts, takes int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stats.PutsStaged += int64(puts)
+	q.stats.TakesStaged += int64(takes)
+}
+
+// countCommit counts a transaction committed with the given items, which took
+// `d` to commit.
+func (q *Queue) countCommit(p Pending, d time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stats.Committed++
+	q.stats.PutsCommitted += int64(p.Puts)
+	q.stats.TakesCommitted += int64(p.Takes)
+	now := time.Now()
+	q.putRate.mark(int64(p.Puts), now)
+	q.takeRate.mark(int64(p.Takes), now)
+	q.commitTime += d
+	q.commits.record(d)
+	if q.commitBuckets == nil {
+		q.commitBuckets = make([]int64, len(LatencyBuckets)+1)
+	}
+	q.commitBuckets[sort.Search(len(LatencyBuckets), func(i int) bool {
+		return d <= LatencyBuckets[i]
+	})]++
+}
+
+// countTakeWait counts a take that waited `d` for `n` items, if any were
+// returned.
+func (q *Queue) countTakeWait(n int, d time.Duration) {
+	if n == 0 {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.takeWaits.record(d)
+}
+
+// countWrite counts a batch written to the backend in `d`.
+func (q *Queue) countWrite(d time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.writes.record(d)
+}
+
+// countError counts a commit that failed.
+func (q *Queue) countError() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stats.CommitErrors++
+}
+
+// countDiscard counts a transaction discarded without being committed.
+func (q *Queue) countDiscard() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stats.Discarded++
+}
+
+// DBStats describes the state of a DB and the queues open on it, for logging
+// and exporting to monitoring systems.
+type DBStats struct {
+	// Queues gives the state of each queue open on the DB, by namespace.
+	Queues map[string]QueueStats
+	// Keys is the total number of items stored in the open queues.
+	Keys int64
+	// SizeBytes is the approximate total storage consumed by the open
+	// queues, as given by Queue.SizeBytes.
+	SizeBytes int64
+	// OpenTxns is the total number of transactions holding items taken
+	// from the open queues.
+	OpenTxns int
+	// Backend gives metrics specific to the backend, by name, where the
+	// backend reports them.
+	Backend map[string]int64
+}
+
+// QueueStats describes the state of a queue, along with counts of the work
+// done by its transactions.
+type QueueStats struct {
+	Stats
+	// Len is the number of items stored in the queue, as given by Queue.Len.
+	Len int
+	// Available is the number of items available to be taken, as given by
+	// Queue.Size.
+	Available int
+	// Scheduled is the number of items scheduled to become available, as
+	// given by Queue.Scheduled.
+	Scheduled int
+	// SizeBytes is the approximate storage consumed by the queue, as given by
+	// Queue.SizeBytes.
+	SizeBytes int64
+	// OpenTxns is the number of transactions holding items taken from the
+	// queue.
+	OpenTxns int
+}
+
+// Stats returns the state of the DB and the queues open on it. Where a queue
+// is open more than once, the work done by each instance is counted together.
+func (db *DB) Stats() (DBStats, error) {
+	db.mutex.Lock()
+	queues := make([]*Queue, 0, len(db.queues))
+	for q := range db.queues {
+		queues = append(queues, q)
+	}
+	db.mutex.Unlock()
+
+	s := DBStats{Queues: map[string]QueueStats{}}
+	for _, q := range queues {
+		qs := q.state()
+		s.OpenTxns += qs.OpenTxns
+		if prev, ok := s.Queues[q.namespace]; ok {
+			// Another instance of the same queue, sharing its storage
+			prev.add(qs)
+			s.Queues[q.namespace] = prev
+			continue
+		}
+
+		size, err := q.SizeBytes()
+		if err != nil {
+			return DBStats{}, err
+		}
+		qs.SizeBytes = size
+		s.Queues[q.namespace] = qs
+		s.Keys += int64(qs.Len)
+		s.SizeBytes += size
+	}
+
+	if mr, ok := db.DB.(backend.MetricsReporter); ok {
+		m, err := mr.Metrics()
+		if err != nil {
+			return DBStats{}, err
+		}
+		s.Backend = m
+	}
+	return s, nil
+}
+
+// state returns the state of the queue, apart from the storage it consumes.
+func (q *Queue) state() QueueStats {
+	s := QueueStats{Stats: q.Stats()}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	s.Len = q.length
+	s.Available = q.ids.Len()
+	s.Scheduled = len(q.scheduled)
+	txns := map[*Txn]bool{}
+	for _, txn := range q.holders {
+		txns[txn] = true
+	}
+	s.OpenTxns = len(txns)
+	return s
+}
+
+// add adds the counts of the work done by the transactions of another
+// instance of the same queue.
+func (s *QueueStats) add(o QueueStats) {
+	committed := s.Committed + o.Committed
+	if committed > 0 {
+		s.CommitLatency = (s.CommitLatency*time.Duration(s.Committed) +
+			o.CommitLatency*time.Duration(o.Committed)) / time.Duration(committed)
+	}
+	s.Committed = committed
+	s.CommitTime += o.CommitTime
+	s.CommitErrors += o.CommitErrors
+	if s.CommitBuckets == nil {
+		s.CommitBuckets = make([]int64, len(LatencyBuckets)+1)
+	}
+	for i, n := range o.CommitBuckets {
+		s.CommitBuckets[i] += n
+	}
+	s.Commits.merge(o.Commits)
+	s.TakeWaits.merge(o.TakeWaits)
+	s.Writes.merge(o.Writes)
+	s.PutRate.add(o.PutRate)
+	s.TakeRate.add(o.TakeRate)
+	s.Discarded += o.Discarded
+	s.PutsStaged += o.PutsStaged
+	s.TakesStaged += o.TakesStaged
+	s.PutsCommitted += o.PutsCommitted
+	s.TakesCommitted += o.TakesCommitted
+	s.OpenTxns += o.OpenTxns
+}
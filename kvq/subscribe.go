@@ -0,0 +1,77 @@
+package kvq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SubscribeOptions specifies how Queue.Subscribe consumes items.
+type SubscribeOptions struct {
+	// Concurrency is the number of items handled at once, each by its own
+	// goroutine. If zero, items are handled one at a time.
+	Concurrency int
+	// RetryDelay is how long an item whose handler failed waits before it
+	// may be taken again. If zero, the queue's RetryDelay applies.
+	RetryDelay time.Duration
+}
+
+// Subscribe runs a consumer loop, calling `handler` with each item taken from
+// the queue until `ctx` is done. Items for which the handler returns nil are
+// acknowledged and removed from the queue, while those for which it returns an
+// error are returned to the queue to be retried, counting an attempt as with
+// Delivery.Nack. When `ctx` is done, handlers already running are allowed to
+// finish and Subscribe returns nil. If the queue fails to take, acknowledge or
+// return an item, Subscribe stops and returns the error. If `opts` is nil,
+// the defaults are used.
+func (q *Queue) Subscribe(ctx context.Context, handler func(m *Message) error, opts *SubscribeOptions) error {
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			cancel()
+		})
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				d, err := q.Receive(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						fail(err)
+					}
+					return
+				}
+				if err := handler(&d.Message); err != nil {
+					err = d.NackDelay(opts.RetryDelay)
+				} else {
+					err = d.Ack()
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}
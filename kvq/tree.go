@@ -0,0 +1,86 @@
+package kvq
+
+import (
+	"strings"
+
+	"github.com/johnsto/go-kvq/kvq/backend"
+)
+
+const (
+	// PathSeparator separates the segments of hierarchical queue names, such
+	// as "emails/outbound/high", which are otherwise opened and stored as any
+	// other queue.
+	PathSeparator = "/"
+)
+
+// QueuesUnder returns the names of the queues listed by Queues that are at
+// or below `path` in the hierarchy of queue names, in order. For example,
+// the path "emails" gives "emails" and "emails/outbound", but not
+// "emailsarchive".
+func (db *DB) QueuesUnder(path string) ([]string, error) {
+	names, err := db.Queues()
+	if err != nil {
+		return nil, err
+	}
+	under := []string{}
+	for _, name := range names {
+		if isUnder(name, path) {
+			under = append(under, name)
+		}
+	}
+	return under, nil
+}
+
+// ClearTree removes all items from the queues at or below `path`, as with
+// Queue.Clear. Queues open on this DB are cleared through each instance, such
+// that their lengths are updated.
+func (db *DB) ClearTree(path string) error {
+	if backend.IsReadOnly(db.DB) {
+		return ErrReadOnly
+	}
+	names, err := db.QueuesUnder(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		open := db.openQueues(name)
+		for _, q := range open {
+			if err := q.Clear(); err != nil {
+				return err
+			}
+		}
+		if len(open) > 0 {
+			continue
+		}
+		bucket, err := db.DB.Bucket(name)
+		if err != nil {
+			return err
+		}
+		if err := clearBucket(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTree removes the queues at or below `path`, as with DeleteQueue.
+func (db *DB) DeleteTree(path string) error {
+	names, err := db.QueuesUnder(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := db.DeleteQueue(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUnder returns true if the queue name is `path`, or is below it in the
+// hierarchy of queue names.
+func isUnder(name, path string) bool {
+	path = strings.TrimSuffix(path, PathSeparator)
+	return path == "" || name == path ||
+		strings.HasPrefix(name, path+PathSeparator)
+}
@@ -1,27 +1,63 @@
 package kvq
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/johnsto/go-kvq/kvq/internal"
 )
 
+// maxWait is the time waited on behalf of contexts without a deadline, which
+// is effectively forever.
+const maxWait = 100 * 365 * 24 * time.Hour
+
+var (
+	// ErrNotTaken is returned when acknowledging an item that is not held by
+	// the transaction.
+	ErrNotTaken = errors.New("item not taken by transaction")
+	// ErrTxnTimeout is returned when committing a transaction that was
+	// discarded because it held taken items for longer than its timeout.
+	ErrTxnTimeout = errors.New("transaction timed out")
+)
+
 // Txn represents a transaction on a Queue
 type Txn struct {
-	queue      *Queue
-	puts       *internal.IDHeap // IDs to put
-	takes      *internal.IDHeap // IDs being taken
-	putValues  []kv
-	takeValues []kv
-	mutex      *sync.Mutex
+	queue       *Queue
+	puts        *internal.EntryHeap       // entries to put
+	takes       *internal.EntryHeap       // entries being taken
+	scheduled   []internal.Scheduled      // entries to put with a delay
+	expiring    []internal.Scheduled      // entries to put with a TTL
+	dedup       map[string]internal.Entry // deduplication keys of puts
+	msgGroups   map[internal.Entry]string // message groups of puts
+	putValues   []kv
+	takeValues  []kv
+	takeRecords []record      // records of taken entries, in order taken
+	consumer    *Consumer     // consumer taking items; nil if unregistered
+	wait        time.Duration // time to wait for the queue to accept puts
+	move        *Txn          // puts to the destination of MoveTo, if any
+	multi       *MultiTxn     // transaction spanning queues; nil if none
+	savepoints  []*Savepoint  // savepoints, in the order made
+	timeout     time.Duration // time taken items may be held; zero if unlimited
+	timer       *time.Timer   // fires when the transaction times out
+	timerGen    int           // identifies the current timer
+	timedOut    bool          // true if discarded by timeout since last used
+	readWrites  bool          // true if takes see the transaction's own puts
+	consumed    []kv          // puts taken by the transaction itself
+	putBytes    int64         // total size of putValues
+	limits      TxnLimits     // limits on the size of the transaction
+	hooks       txnHooks      // callbacks on commit and discard
+	mutex       *sync.Mutex
 }
 
 // NewTxn returns a new Txn that operates on the given Queue.
 func NewTxn(q *Queue) *Txn {
 	txn := &Txn{
-		queue: q,
-		mutex: &sync.Mutex{},
+		queue:   q,
+		timeout: q.opts.TxnTimeout,
+		limits:  q.opts.TxnLimits,
+		mutex:   &sync.Mutex{},
 	}
 	txn.Reset()
 	return txn
@@ -29,32 +65,206 @@ func NewTxn(q *Queue) *Txn {
 
 // Reset empties the transaction and resets it to an empty (default) state.
 func (txn *Txn) Reset() {
-	txn.puts = internal.NewIDHeap()
-	txn.takes = internal.NewIDHeap()
+	txn.puts = internal.NewEntryHeap()
+	txn.takes = internal.NewEntryHeap()
+	txn.scheduled = nil
+	txn.expiring = nil
+	txn.dedup = map[string]internal.Entry{}
+	txn.msgGroups = map[internal.Entry]string{}
 	txn.putValues = make([]kv, 0)
+	txn.putBytes = 0
 	txn.takeValues = make([]kv, 0)
+	txn.takeRecords = make([]record, 0)
+	txn.move = nil
+	txn.savepoints = nil
+	txn.consumed = nil
+	if txn.timer != nil {
+		txn.timer.Stop()
+		txn.timer = nil
+	}
 }
 
-// Put inserts the data into the queue.
+// Put inserts the data into the queue with the default (lowest) priority.
 func (txn *Txn) Put(v []byte) error {
-	if v == nil {
-		return nil
+	return txn.PutPriority(v, 0)
+}
+
+// PutPriority inserts the data into the queue with the given priority. Items
+// with a higher priority are taken before those with a lower priority, and
+// items of equal priority are taken in the order they were put.
+func (txn *Txn) PutPriority(v []byte, priority uint8) error {
+	return txn.put(&record{value: v}, priority)
+}
+
+// PutMessage inserts the message's value into the queue along with its
+// headers and schema version, with the default (lowest) priority. Other
+// fields of the message are assigned by the queue, and are ignored.
+func (txn *Txn) PutMessage(m *Message) error {
+	return txn.put(&record{
+		value:   m.Value,
+		headers: m.Headers,
+		schema:  m.Schema,
+	}, 0)
+}
+
+// PutSchema inserts the data into the queue tagged with the given
+// application-defined schema version, which is returned as Message.Schema
+// when the item is taken.
+func (txn *Txn) PutSchema(v []byte, schema uint8) error {
+	return txn.put(&record{value: v, schema: schema}, 0)
+}
+
+// PutDelay inserts the data into the queue such that it only becomes
+// available for taking once the given delay has elapsed.
+func (txn *Txn) PutDelay(v []byte, delay time.Duration) error {
+	return txn.PutAt(v, time.Now().Add(delay))
+}
+
+// PutAt inserts the data into the queue such that it only becomes available
+// for taking at the given time. Items scheduled for a time in the past are
+// available as soon as the transaction is committed.
+func (txn *Txn) PutAt(v []byte, t time.Time) error {
+	return txn.put(&record{value: v, availableAt: t.UnixNano()}, 0)
+}
+
+// PutTTL inserts the data into the queue such that it expires if not taken
+// within the given duration. Expired items are moved to the queue's
+// dead-letter queue, if configured, or otherwise discarded. A TTL of zero or
+// less means the item never expires.
+func (txn *Txn) PutTTL(v []byte, ttl time.Duration) error {
+	r := &record{value: v}
+	if ttl > 0 {
+		r.expiresAt = time.Now().Add(ttl).UnixNano()
 	}
+	return txn.put(r, 0)
+}
+
+// PutUntil inserts the data into the queue such that it expires if not taken
+// before the given deadline, as with PutTTL. This suits time-sensitive items
+// that are worthless once stale. A zero deadline means the item never
+// expires, while an item whose deadline has already passed expires as soon as
+// the transaction is committed.
+func (txn *Txn) PutUntil(v []byte, deadline time.Time) error {
+	r := &record{value: v}
+	if !deadline.IsZero() {
+		r.expiresAt = deadline.UnixNano()
+	}
+	return txn.put(r, 0)
+}
+
+// PutDedup inserts the data into the queue with the given deduplication key.
+// If an item with the same key is already in the queue, or has already been
+// put in this transaction, the put is ignored, or fails with ErrDuplicate if
+// the queue was opened with RejectDuplicates. Keys are released once the item
+// holding them has been taken and committed.
+func (txn *Txn) PutDedup(v []byte, key string) error {
+	return txn.put(&record{value: v, dedupKey: key}, 0)
+}
+
+// PutGroup inserts the data into the queue as part of the given message
+// group. Items of the same group are taken strictly in order, one at a time:
+// once an item has been taken, no other item of its group is available until
+// that item has been committed and removed from the queue. Items of different
+// groups may be taken in parallel.
+func (txn *Txn) PutGroup(v []byte, group string) error {
+	return txn.put(&record{value: v, group: group}, 0)
+}
 
-	// get entry ID and key
-	id := internal.NewID()
-	k := id.Key()
+// put stages the record for insertion into the queue with the given priority.
+func (txn *Txn) put(r *record, priority uint8) error {
+	_, err := txn.putRecords([]*record{r}, []uint8{priority})
+	return err
+}
+
+// putRecords stages the records for insertion into the queue, each with the
+// priority of the same index, returning the ID of each record staged. The IDs
+// of nil values and ignored duplicates are empty. Either all records are
+// staged, or none are.
+func (txn *Txn) putRecords(rs []*record, priorities []uint8) ([]MessageID, error) {
+	if txn.queue.readOnly {
+		return nil, ErrReadOnly
+	}
+	now := time.Now()
+	n := 0
+	for _, r := range rs {
+		if r.value == nil {
+			continue
+		}
+		if r.available(now) {
+			r.availableAt = 0
+		}
+		n++
+	}
+	ids := make([]MessageID, len(rs))
+	if n == 0 {
+		return ids, nil
+	}
 
+	// get entry IDs
+	id, err := txn.queue.nextIDs(n)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]internal.Entry, len(rs))
+	for i, r := range rs {
+		if r.value == nil {
+			continue
+		}
+		entries[i] = internal.Entry{
+			ID:       id,
+			Priority: priorities[i],
+		}
+		id++
+	}
+	return txn.putEntries(entries, rs)
+}
+
+// putEntries stages the records to be put with the given entries, returning
+// the IDs of the items put, as with putRecords. Records with nil values are
+// skipped.
+func (txn *Txn) putEntries(entries []internal.Entry, rs []*record) ([]MessageID, error) {
 	txn.mutex.Lock()
 	defer txn.mutex.Unlock()
 
-	// Add put value onto put queue
-	txn.putValues = append(txn.putValues, kv{k, v})
+	ids := make([]MessageID, len(rs))
+	staged := make([]internal.Entry, 0, len(rs))
+	for i, r := range rs {
+		if r.value == nil {
+			continue
+		}
+		e := entries[i]
 
-	// Mark this ID as being put
-	txn.puts.Push(id)
+		// Ignore or reject duplicates
+		if r.dedupKey != "" {
+			_, dup := txn.dedup[r.dedupKey]
+			if dup || txn.queue.hasDuplicate(r.dedupKey) {
+				if txn.queue.rejectDuplicates {
+					txn.drop(staged)
+					return nil, ErrDuplicate
+				}
+				continue
+			}
+		}
 
-	return nil
+		// Enforce the transaction's size limits
+		if r.codec == nil {
+			r.codec = txn.queue.opts.Compression
+		}
+		v := r.encode()
+		if err := txn.checkPut(len(v)); err != nil {
+			txn.drop(staged)
+			return nil, err
+		}
+
+		// Add put value onto put queue, marking this entry as being put, or
+		// scheduled to be put
+		txn.stage(kv{e.Key(), v})
+		staged = append(staged, e)
+		ids[i] = MessageID(e.Key())
+	}
+	txn.queue.staged(len(staged), 0)
+
+	return ids, nil
 }
 
 // Take gets an item from the queue, returning nil if no items are available.
@@ -69,15 +279,187 @@ func (txn *Txn) Take() ([]byte, error) {
 // TakeN gets `n` items from the queue, waiting at most `t` for them to all
 // become available. If no items are available, nil is returned.
 func (txn *Txn) TakeN(n int, t time.Duration) ([][]byte, error) {
-	// Retrieve available values from storage
-	ids, keys, values, err := txn.queue.take(n, t)
+	msgs, err := txn.TakeMessages(n, t)
+	if msgs == nil {
+		return nil, err
+	}
+	values := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		values[i] = m.Value
+	}
+	return values, nil
+}
+
+// TakeMessage gets an item and its metadata from the queue, returning nil if
+// no items are available.
+func (txn *Txn) TakeMessage() (*Message, error) {
+	msgs, err := txn.TakeMessages(1, 0)
+	if msgs == nil {
+		return nil, err
+	}
+	return msgs[0], nil
+}
+
+// TakeMessages gets `n` items and their metadata from the queue, waiting at
+// most `t` for them to all become available. If no items are available, nil
+// is returned.
+func (txn *Txn) TakeMessages(n int, t time.Duration) ([]*Message, error) {
+	return txn.takeMessages(n, t, false)
+}
+
+// TakeExactly gets exactly `n` items from the queue, waiting at most `t` for
+// them to all become available. Unlike TakeN, no items are taken unless all
+// `n` become available in that time, in which case nil is returned. Fewer
+// than `n` items may still be returned if some have expired.
+func (txn *Txn) TakeExactly(n int, t time.Duration) ([][]byte, error) {
+	msgs, err := txn.takeMessages(n, t, true)
+	if msgs == nil {
+		return nil, err
+	}
+	values := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		values[i] = m.Value
+	}
+	return values, nil
+}
+
+// TakeWhere gets the first item from the queue whose headers satisfy `pred`,
+// waiting at most `t` for one to become available, and returns nil if none
+// does. Items that don't match are left in the queue for other takers, in
+// their original order. Matching requires the headers of every item in the
+// queue to be read, so TakeWhere is considerably slower than other takes on
+// large queues.
+func (txn *Txn) TakeWhere(pred func(headers map[string]string) bool, t time.Duration) (*Message, error) {
+	take := func(n int, t time.Duration, done <-chan struct{}) ([]internal.Entry, [][]byte, []record, error) {
+		return txn.queue.takeWhere(pred, t, done)
+	}
+	msgs, err := txn.takeWith(1, 1, t, nil, take)
+	if msgs == nil {
+		return nil, err
+	}
+	return msgs[0], nil
+}
+
+// TakeNContext gets `n` items from the queue, waiting until they all become
+// available or `ctx` is done. Items that became available before `ctx` was
+// done are returned; if there were none, the context's error is returned.
+func (txn *Txn) TakeNContext(ctx context.Context, n int) ([][]byte, error) {
+	msgs, err := txn.TakeMessagesContext(ctx, n)
+	if msgs == nil {
+		return nil, err
+	}
+	values := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		values[i] = m.Value
+	}
+	return values, nil
+}
+
+// TakeMessagesContext gets `n` items and their metadata from the queue,
+// waiting until they all become available or `ctx` is done, as with
+// TakeNContext.
+func (txn *Txn) TakeMessagesContext(ctx context.Context, n int) ([]*Message, error) {
+	return txn.takeContext(ctx, n, false)
+}
+
+// TakeExactlyContext gets exactly `n` items from the queue, waiting until they
+// all become available or `ctx` is done, in which case no items are taken and
+// the context's error is returned. See TakeExactly.
+func (txn *Txn) TakeExactlyContext(ctx context.Context, n int) ([][]byte, error) {
+	msgs, err := txn.takeContext(ctx, n, true)
+	if msgs == nil {
+		return nil, err
+	}
+	values := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		values[i] = m.Value
+	}
+	return values, nil
+}
+
+// takeMessages takes up to `n` items from the queue, or exactly `n` items if
+// `exact` is true, waiting at most `t`.
+func (txn *Txn) takeMessages(n int, t time.Duration, exact bool) ([]*Message, error) {
+	take := txn.queue.take
+	if exact {
+		take = txn.queue.takeExactly
+	}
+	return txn.takeStagedFirst(n, exact, func(n, min int) ([]*Message, error) {
+		return txn.takeWith(n, min, t, nil, take)
+	})
+}
+
+// takeContext takes up to `n` items from the queue, or exactly `n` items if
+// `exact` is true, waiting until `ctx` is done.
+func (txn *Txn) takeContext(ctx context.Context, n int, exact bool) ([]*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	take := txn.queue.take
+	if exact {
+		take = txn.queue.takeExactly
+	}
+	msgs, err := txn.takeStagedFirst(n, exact, func(n, min int) ([]*Message, error) {
+		return txn.takeWith(n, min, contextWait(ctx), ctx.Done(), take)
+	})
+	if msgs == nil && err == nil {
+		err = contextErr(ctx)
+	}
+	return msgs, err
+}
+
+// takeFunc takes up to `n` items from a queue, waiting at most `t`, or until
+// `done` is closed.
+type takeFunc func(n int, t time.Duration, done <-chan struct{}) ([]internal.Entry, [][]byte, []record, error)
+
+// takeWith takes at least `min` and up to `n` items from the queue using the
+// given take function, waiting at most `t`, or until `done` is closed.
+func (txn *Txn) takeWith(n, min int, t time.Duration, done <-chan struct{}, take takeFunc) ([]*Message, error) {
+	if txn.queue.readOnly {
+		return nil, ErrReadOnly
+	}
+	if txn.queue.isClosed() {
+		return nil, ErrClosed
+	}
+	n, err := txn.capTakes(n, min)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop waiting if the queue is closed
+	done, stop := txn.queue.closing(done)
+	defer stop()
+
+	// Wait for this consumer's turn to take
+	if d := txn.queue.dispatcher; d != nil {
+		var ok bool
+		if t, ok = d.acquire(txn.consumer, t, done); !ok {
+			return nil, txn.queue.closedErr()
+		}
+		defer d.release(txn.consumer)
+	}
+
+	// Wait for the rate limit to allow items to be taken
+	if n, t = txn.queue.limitTakes(min, n, t, done); n == 0 {
+		return nil, txn.queue.closedErr()
+	}
+
+	// Retrieve available values from storage, journalling them as taken
+	ids, keys, records, err := take(n, t, done)
+	txn.queue.unlimitTakes(n - len(ids))
 	if err != nil {
 		return nil, err
 	}
+	if err := txn.queue.journal(keys); err != nil {
+		txn.queue.putKey(ids...)
+		return nil, err
+	}
+	txn.queue.staged(0, len(ids))
+	txn.queue.own(txn, ids)
 
-	// No items available? Return without failure
+	// No items available? Return without failure, unless the queue closed
 	if len(ids) == 0 {
-		return nil, nil
+		return nil, txn.queue.closedErr()
 	}
 
 	txn.mutex.Lock()
@@ -85,53 +467,586 @@ func (txn *Txn) TakeN(n int, t time.Duration) ([][]byte, error) {
 
 	// Push taken items onto reserved queue
 	n = len(ids)
+	msgs := make([]*Message, n)
 	for i := 0; i < n; i++ {
-		txn.takes.Push(ids[i])
-		txn.takeValues = append(txn.takeValues, kv{keys[i], values[i]})
+		msgs[i] = newMessage(ids[i], records[i])
+		txn.takes.PushEntry(ids[i])
+		txn.takeValues = append(txn.takeValues, kv{keys[i], records[i].value})
+		txn.takeRecords = append(txn.takeRecords, records[i])
 	}
+	txn.arm()
 
-	return values, err
+	return msgs, nil
+}
+
+// MoveTo takes up to `n` items from the queue, waiting at most `t` for them to
+// become available, and stages them to be put into queue `dst` when the
+// transaction is committed, returning the number of items staged. The items
+// are removed from this queue and put into `dst` in a single atomic batch
+// where the backend supports it. A transaction may only move items to one
+// queue, and moving items to another returns ErrMoveDestination, unless it
+// belongs to a MultiTxn.
+func (txn *Txn) MoveTo(dst *Queue, n int, t time.Duration) (int, error) {
+	txn.mutex.Lock()
+	other := txn.move != nil && txn.move.queue != dst
+	txn.mutex.Unlock()
+	if other {
+		return 0, ErrMoveDestination
+	}
+
+	msgs, err := txn.TakeMessages(n, t)
+	if msgs == nil {
+		return 0, err
+	}
+
+	// Stage puts in the destination's part of a multi-queue transaction
+	if txn.multi != nil {
+		dtxn := txn.multi.Queue(dst)
+		for i, m := range msgs {
+			r := &record{value: m.Value, headers: m.Headers}
+			if err := dtxn.put(r, m.Priority); err != nil {
+				return i, err
+			}
+		}
+		return len(msgs), nil
+	}
+
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	if txn.move == nil {
+		txn.move = dst.Transaction()
+	}
+	for i, m := range msgs {
+		r := &record{value: m.Value, headers: m.Headers}
+		if err := txn.move.put(r, m.Priority); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
 }
 
 // Commit writes transaction to storage. The Txn will remain valid for further
 // use.
 func (txn *Txn) Commit() error {
+	return txn.commit(txn.wait, nil, !txn.queue.opts.NoSync)
+}
+
+// CommitContext writes the transaction to storage as with Commit, but waits
+// until `ctx` is done for the queue to have room for the items put, and for
+// its put rate to allow them, as with Queue.PutWait. If `ctx` is done first,
+// the context's error is returned and nothing is written.
+func (txn *Txn) CommitContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := txn.commit(contextWait(ctx), ctx.Done(), !txn.queue.opts.NoSync)
+	if err == ErrInsufficientCapacity || err == ErrRateLimited {
+		if cerr := contextErr(ctx); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
+
+// commit writes the transaction to storage, waiting at most `wait`, or until
+// `done` is closed, for the queue to accept the items put. The write is synced
+// to disk if `sync` is true.
+func (txn *Txn) commit(wait time.Duration, done <-chan struct{}, sync bool) error {
+	if txn.multi != nil {
+		return txn.multi.Commit()
+	}
+	start := time.Now()
+	if err := txn.beforeCommit(); err != nil {
+		return err
+	}
+	p, err := txn.write(wait, done, sync)
+	if p != nil {
+		txn.committed(*p, start)
+	}
+	if err != nil {
+		txn.queue.countError()
+	}
+	return err
+}
+
+// write writes the transaction to storage as with commit, returning the items
+// written, or nil if nothing was written.
+func (txn *Txn) write(wait time.Duration, done <-chan struct{}, sync bool) (*Pending, error) {
 	txn.mutex.Lock()
 	defer txn.mutex.Unlock()
 
+	if txn.timedOut {
+		txn.timedOut = false
+		txn.Reset()
+		return nil, ErrTxnTimeout
+	}
+
 	// Do nothing if there's nothing to do
-	if len(*txn.puts) == 0 && len(*txn.takes) == 0 {
-		return nil
+	if txn.empty() {
+		return nil, nil
+	}
+	if err := txn.checkConflicts(); err != nil {
+		return nil, err
+	}
+	p := txn.pending()
+	if err := txn.prepare(wait, done); err != nil {
+		return nil, err
+	}
+	if txn.empty() {
+		// All puts were delivered to consumer groups
+		txn.Reset()
+		return &p, nil
+	}
+	var moves []kv
+	if txn.move != nil {
+		moves = txn.move.putValues
+		if err := txn.move.queue.admit(moves, 0, nil); err != nil {
+			txn.abort()
+			return nil, err
+		}
 	}
 
-	// Put/take keys from backend storage
-	if err := txn.queue.enact(txn.putValues, txn.takeValues); err != nil {
-		return err
+	// Put/take keys from backend storage, recording taken items as
+	// processed first
+	err := txn.queue.recordProcessed(txn.takeValues, txn.takeRecords)
+	if err == nil {
+		if txn.move != nil {
+			err = txn.queue.enactMove(txn.putValues, txn.takeValues,
+				txn.move.queue, moves)
+		} else {
+			err = txn.queue.enactWith(txn.putValues, txn.takeValues, sync)
+		}
+	}
+	if err != nil {
+		if txn.move != nil {
+			txn.move.queue.unadmit(moves)
+		}
+		txn.abort()
+		return nil, err
+	}
+	if txn.move != nil {
+		txn.move.queue.add(*txn.move.puts, nil, nil)
+	}
+	txn.finish()
+	return &p, nil
+}
+
+// prepare readies the transaction to be written to storage, waiting at most
+// `wait`, or until `done` is closed, for the queue to accept the items put.
+// Puts are delivered to the queue's consumer groups, if any, and otherwise
+// have room and deduplication keys reserved for them, which must be released
+// with abort if the transaction is not written. The caller must hold the
+// transaction mutex.
+func (txn *Txn) prepare(wait time.Duration, done <-chan struct{}) error {
+	if txn.queue.isClosed() {
+		return ErrClosed
 	}
 
-	// Add keys to availability queue
-	_, err := txn.queue.putKey(*txn.puts...)
+	// Ensure the puts are within the queue's rate limit, which stops waiting
+	// if the queue is closed. Admission checks for closure itself.
+	closing, stop := txn.queue.closing(done)
+	err := txn.queue.limitPuts(len(txn.putValues), wait, closing)
+	stop()
 	if err != nil {
+		if cerr := txn.queue.closedErr(); cerr != nil {
+			return cerr
+		}
 		return err
 	}
 
-	txn.Reset()
+	// Deliver puts to the queue's consumer groups, if any, in place of the
+	// queue itself
+	if ok, err := txn.queue.deliver(txn.putValues); err != nil {
+		return err
+	} else if ok {
+		delivered := make([]internal.Entry, len(txn.putValues))
+		for i, kv := range txn.putValues {
+			delivered[i], _ = internal.KeyToEntry(kv.k)
+		}
+		txn.drop(delivered)
+		if txn.empty() {
+			return nil
+		}
+	}
+
+	// Reserve deduplication keys, in case another transaction put items with
+	// the same keys since they were checked
+	if dups := txn.queue.reserve(txn.dedup); len(dups) > 0 {
+		if txn.queue.rejectDuplicates {
+			return ErrDuplicate
+		}
+		txn.drop(dups)
+	}
+
+	// Ensure there is room for the new items
+	if err := txn.queue.admit(txn.putValues, wait, done); err != nil {
+		txn.queue.unreserve(txn.dedupEntries()...)
+		return err
+	}
 	return nil
 }
 
+// abort releases the room and deduplication keys reserved by prepare. The
+// caller must hold the transaction mutex.
+func (txn *Txn) abort() {
+	txn.queue.unadmit(txn.putValues)
+	txn.queue.unreserve(txn.dedupEntries()...)
+}
+
+// finish updates the queue once the prepared transaction has been written to
+// storage, making the items put available and forgetting those taken, then
+// resets the transaction. The caller must hold the transaction mutex.
+func (txn *Txn) finish() {
+	taken := make([]internal.Entry, len(txn.takeValues))
+	for i, kv := range txn.takeValues {
+		taken[i], _ = internal.KeyToEntry(kv.k)
+	}
+	txn.queue.forget(taken...)
+	txn.queue.disown(taken...)
+	txn.queue.unjournal(taken...)
+
+	// Add keys to availability queue
+	txn.queue.add(*txn.puts, txn.scheduled, txn.msgGroups)
+	txn.queue.expireAt(txn.expiring...)
+	txn.Reset()
+}
+
 // Close reverts all changes from the transaction and releases any held
-// resources. The Txn will remain valid for further use.
+// resources. Taken items are returned to the queue and their attempt count is
+// incremented; items that reach the queue's MaxAttempts are moved to its
+// dead-letter queue instead. The Txn will remain valid for further use.
 func (txn *Txn) Close() error {
-	if len(*txn.puts) == 0 && len(*txn.takes) == 0 {
+	return txn.DiscardDelay(0)
+}
+
+// DiscardDelay reverts all changes from the transaction as with Close, but
+// taken items only become available again once `delay` has elapsed, avoiding
+// immediate redelivery to a consumer that is failing. A delay of zero applies
+// the queue's RetryDelay, if any.
+func (txn *Txn) DiscardDelay(delay time.Duration) error {
+	if txn.multi != nil {
+		return txn.multi.DiscardDelay(delay)
+	}
+	return txn.revert(delay)
+}
+
+// revert reverts all changes from the transaction, returning taken items to
+// the queue after `delay`.
+func (txn *Txn) revert(delay time.Duration) error {
+	txn.mutex.Lock()
+	txn.timedOut = false
+	p, discarded := txn.pending(), !txn.empty()
+	err := txn.rollback(delay)
+	txn.mutex.Unlock()
+
+	if discarded {
+		txn.discarded(p)
+	}
+	return err
+}
+
+// rollback reverts all changes from the transaction, returning taken items to
+// the queue after `delay`. The caller must hold the transaction mutex.
+func (txn *Txn) rollback(delay time.Duration) error {
+	if txn.empty() {
 		return nil
 	}
 
+	// Return taken ids to the queue
+	entries := make([]internal.Entry, len(txn.takeValues))
+	for i, kv := range txn.takeValues {
+		entries[i], _ = internal.KeyToEntry(kv.k)
+	}
+	entries, records := txn.queue.heldBy(txn, entries, txn.takeRecords)
+	err := txn.queue.discard(entries, records, delay)
+
+	txn.Reset()
+	return err
+}
+
+// SetTimeout sets the maximum time for which the transaction may hold taken
+// items, overriding the queue's TxnTimeout. If the transaction is not
+// committed or closed within `d` of first taking an item, it is discarded as
+// if closed, returning its items to the queue, and its next Commit returns
+// ErrTxnTimeout. This ensures items are not lost until the process restarts
+// when the goroutine holding a transaction crashes or becomes stuck. A
+// timeout of zero disables it.
+func (txn *Txn) SetTimeout(d time.Duration) {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	txn.timeout = d
+	if txn.timer != nil {
+		txn.timer.Stop()
+		txn.timer = nil
+		txn.arm()
+	}
+}
+
+// arm starts the transaction's timeout, if it has one and it is not already
+// running. The caller must hold the transaction mutex.
+func (txn *Txn) arm() {
+	if txn.timeout <= 0 || txn.timer != nil {
+		return
+	}
+	txn.timerGen++
+	gen := txn.timerGen
+	txn.timer = time.AfterFunc(txn.timeout, func() {
+		txn.expire(gen)
+	})
+}
+
+// expire discards the transaction when the timer identified by `gen` fires,
+// unless it has since been stopped.
+func (txn *Txn) expire(gen int) {
+	txn.mutex.Lock()
+	if txn.timer == nil || gen != txn.timerGen {
+		txn.mutex.Unlock()
+		return
+	}
+	txn.timer = nil
+	p := txn.pending()
+	txn.rollback(0)
+	txn.timedOut = true
+	txn.mutex.Unlock()
+
+	txn.discarded(p)
+}
+
+// Ack acknowledges that the taken items with the given IDs have been
+// processed, removing them from the queue immediately, while the
+// transaction's other items remain held until it is committed or closed. This
+// allows a batch of items to be taken together but processed individually.
+// Returns ErrNotTaken, acknowledging nothing, if any of the items are not held
+// by the transaction. Items moved with MoveTo should not be acknowledged.
+func (txn *Txn) Ack(ids ...MessageID) error {
 	txn.mutex.Lock()
 	defer txn.mutex.Unlock()
 
-	// Return taken ids to the queue
-	txn.queue.putKey(*txn.takes...)
+	if err := txn.checkConflicts(); err != nil {
+		return err
+	}
+	entries, takes, records, err := txn.release(ids)
+	if err != nil {
+		return err
+	}
+	if err := txn.queue.recordProcessed(takes, records); err != nil {
+		txn.hold(entries, takes, records)
+		return err
+	}
+	if err := txn.queue.enact(nil, takes); err != nil {
+		txn.hold(entries, takes, records)
+		return err
+	}
+	txn.queue.forget(entries...)
+	txn.queue.disown(entries...)
+	return txn.queue.unjournal(entries...)
+}
+
+// Nack returns the taken items with the given IDs to the queue immediately,
+// incrementing their attempt count as if the transaction had been closed,
+// while the transaction's other items remain held. Returns ErrNotTaken,
+// returning nothing, if any of the items are not held by the transaction.
+func (txn *Txn) Nack(ids ...MessageID) error {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+
+	entries, _, records, err := txn.release(ids)
+	if err != nil {
+		return err
+	}
+	entries, records = txn.queue.heldBy(txn, entries, records)
+	return txn.queue.discard(entries, records, 0)
+}
+
+// release removes the taken items with the given IDs from the transaction,
+// returning their entries, key values and records. The caller must hold the
+// transaction mutex.
+func (txn *Txn) release(ids []MessageID) ([]internal.Entry, []kv, []record, error) {
+	index := make(map[string]int, len(txn.takeValues))
+	for i, kv := range txn.takeValues {
+		index[string(kv.k)] = i
+	}
+	released := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		i, ok := index[string(id)]
+		if !ok {
+			return nil, nil, nil, ErrNotTaken
+		}
+		released[i] = true
+	}
+
+	entries := make([]internal.Entry, 0, len(released))
+	takes := make([]kv, 0, len(released))
+	records := make([]record, 0, len(released))
+	takeValues := txn.takeValues[:0]
+	takeRecords := txn.takeRecords[:0]
+	for i, kv := range txn.takeValues {
+		r := txn.takeRecords[i]
+		if !released[i] {
+			takeValues = append(takeValues, kv)
+			takeRecords = append(takeRecords, r)
+			continue
+		}
+		e, _ := internal.KeyToEntry(kv.k)
+		txn.takes.Remove(e)
+		entries = append(entries, e)
+		takes = append(takes, kv)
+		records = append(records, r)
+	}
+	txn.takeValues = takeValues
+	txn.takeRecords = takeRecords
+	return entries, takes, records, nil
+}
+
+// hold returns released items to the transaction. The caller must hold the
+// transaction mutex.
+func (txn *Txn) hold(entries []internal.Entry, takes []kv, records []record) {
+	for i, e := range entries {
+		txn.takes.PushEntry(e)
+		txn.takeValues = append(txn.takeValues, takes[i])
+		txn.takeRecords = append(txn.takeRecords, records[i])
+	}
+}
 
+// untake returns the transaction's taken items to the queue as they were,
+// without counting an attempt, and resets the transaction.
+func (txn *Txn) untake() error {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+
+	entries := make([]internal.Entry, len(txn.takeValues))
+	for i, kv := range txn.takeValues {
+		entries[i], _ = internal.KeyToEntry(kv.k)
+	}
+	txn.queue.disown(entries...)
+	_, err := txn.queue.putKey(entries...)
+	if jerr := txn.queue.unjournal(entries...); err == nil {
+		err = jerr
+	}
 	txn.Reset()
-	return nil
+	return err
+}
+
+// Pending describes the items staged by a transaction.
+type Pending struct {
+	// Puts is the number of items to be put, including delayed items.
+	Puts int
+	// Takes is the number of items taken, including those being moved.
+	Takes int
+	// Bytes is the total size of the items to be put, as stored.
+	Bytes int64
+	// PutIDs gives the IDs of the items to be put, in the order put.
+	PutIDs []MessageID
+	// TakeIDs gives the IDs of the items taken, in the order taken.
+	TakeIDs []MessageID
+}
+
+// Pending returns the items staged by the transaction, to be written when it
+// is committed.
+func (txn *Txn) Pending() Pending {
+	txn.mutex.Lock()
+	defer txn.mutex.Unlock()
+	return txn.pending()
+}
+
+// pending returns the items staged by the transaction. The caller must hold
+// the transaction mutex.
+func (txn *Txn) pending() Pending {
+	p := Pending{
+		Puts:    len(txn.putValues),
+		Takes:   len(txn.takeValues),
+		Bytes:   txn.putBytes,
+		PutIDs:  make([]MessageID, len(txn.putValues)),
+		TakeIDs: make([]MessageID, len(txn.takeValues)),
+	}
+	for i, kv := range txn.putValues {
+		p.PutIDs[i] = MessageID(kv.k)
+	}
+	for i, kv := range txn.takeValues {
+		p.TakeIDs[i] = MessageID(kv.k)
+	}
+	return p
+}
+
+// empty returns true if the transaction has nothing to commit. The caller
+// must hold the transaction mutex.
+func (txn *Txn) empty() bool {
+	return len(*txn.puts) == 0 && len(*txn.takes) == 0 &&
+		len(txn.scheduled) == 0
+}
+
+// dedupEntries returns the entries put with deduplication keys. The caller
+// must hold the transaction mutex.
+func (txn *Txn) dedupEntries() []internal.Entry {
+	entries := make([]internal.Entry, 0, len(txn.dedup))
+	for _, e := range txn.dedup {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// drop removes the given entries from the set of entries to put. The caller
+// must hold the transaction mutex.
+func (txn *Txn) drop(entries []internal.Entry) {
+	dropped := map[internal.Entry]bool{}
+	for _, e := range entries {
+		dropped[e] = true
+	}
+	for k, e := range txn.dedup {
+		if dropped[e] {
+			delete(txn.dedup, k)
+		}
+	}
+
+	putValues := txn.putValues[:0]
+	for _, kv := range txn.putValues {
+		if e, _ := internal.KeyToEntry(kv.k); !dropped[e] {
+			putValues = append(putValues, kv)
+		} else {
+			txn.putBytes -= int64(len(kv.v))
+		}
+	}
+	txn.putValues = putValues
+
+	puts := internal.NewEntryHeap()
+	for _, e := range *txn.puts {
+		if !dropped[e] {
+			puts.PushEntry(e)
+		}
+	}
+	txn.puts = puts
+
+	txn.scheduled = dropScheduled(txn.scheduled, dropped)
+	txn.expiring = dropScheduled(txn.expiring, dropped)
+}
+
+// dropScheduled returns `s` without the dropped entries.
+func dropScheduled(s []internal.Scheduled, dropped map[internal.Entry]bool) []internal.Scheduled {
+	kept := s[:0]
+	for _, e := range s {
+		if !dropped[e.Entry] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// contextWait returns the time remaining until the context's deadline, or
+// maxWait if it has none.
+func contextWait(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return maxWait
+}
+
+// contextErr returns the error of a context that a wait has ended on behalf
+// of, or nil if the context is not done. A wait that timed out at the
+// context's deadline may end just before the context does, so this waits for
+// the context to catch up.
+func contextErr(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		<-ctx.Done()
+	}
+	return ctx.Err()
 }
@@ -1,6 +1,7 @@
 package kvq
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -93,7 +94,7 @@ func Test_Queue_Internals(t *testing.T) {
 	queue := &Queue{
 		bucket: bucket,
 		mutex:  &sync.Mutex{},
-		ids:    internal.NewIDHeap(),
+		ids:    internal.NewEntryHeap(),
 		c:      make(chan struct{}, 3),
 	}
 
@@ -101,9 +102,9 @@ func Test_Queue_Internals(t *testing.T) {
 	assert.Equal(t, 0, queue.Size(), "queue should be empty")
 	assert.Empty(t, queue.getKeys(1),
 		"queue should not immediately return any keys")
-	assert.Empty(t, queue.awaitKeys(1, 0),
+	assert.Empty(t, queue.awaitKeys(1, 0, nil),
 		"queue should not eventually return any keys")
-	assert.Empty(t, queue.awaitKeys(1, 50*time.Millisecond),
+	assert.Empty(t, queue.awaitKeys(1, 50*time.Millisecond, nil),
 		"queue should not eventually return any keys")
 
 	// Clear and check still empty
@@ -111,45 +112,45 @@ func Test_Queue_Internals(t *testing.T) {
 	assert.Equal(t, 0, queue.Size(), "queue should be empty after clear")
 	assert.Empty(t, queue.getKeys(1),
 		"queue should not immediately return any keys after clear")
-	assert.Empty(t, queue.awaitKeys(1, 50*time.Millisecond),
+	assert.Empty(t, queue.awaitKeys(1, 50*time.Millisecond, nil),
 		"queue should not eventually return any keys after clear")
 
 	// Put an ID on the queue, check it becomes available
-	n, err := queue.putKey(internal.ID(1))
+	n, err := queue.putKey(internal.Entry{ID: 1})
 	assert.Equal(t, 1, n)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, queue.Size(), "queue should be of size 1")
 	assert.Len(t, queue.getKeys(1), 1,
 		"queue should immediately return 1 of requested 1 key")
-	n, err = queue.putKey(internal.ID(1))
+	n, err = queue.putKey(internal.Entry{ID: 1})
 	assert.Equal(t, 1, n)
 	assert.NoError(t, err)
-	assert.Len(t, queue.awaitKeys(1, 50*time.Millisecond), 1,
+	assert.Len(t, queue.awaitKeys(1, 50*time.Millisecond, nil), 1,
 		"queue should not eventually return 1 of requested 1 key")
 
 	// Take more keys than actually available
-	n, err = queue.putKey(internal.ID(1))
+	n, err = queue.putKey(internal.Entry{ID: 1})
 	assert.Equal(t, 1, n)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, queue.Size(), "queue should be of size 1")
 	assert.Len(t, queue.getKeys(2), 1,
 		"queue should immediately return 1 of requested 2 keys")
-	n, err = queue.putKey(internal.ID(1))
+	n, err = queue.putKey(internal.Entry{ID: 1})
 	assert.Equal(t, 1, n)
 	assert.NoError(t, err)
-	assert.Len(t, queue.awaitKeys(2, 50*time.Millisecond), 1,
+	assert.Len(t, queue.awaitKeys(2, 50*time.Millisecond, nil), 1,
 		"queue should not eventually return 1 of requested 2 keys")
 
 	// Put more keys than there is room available for
-	n, err = queue.putKey(internal.ID(1))
+	n, err = queue.putKey(internal.Entry{ID: 1})
 	assert.Equal(t, 1, n)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, queue.Size(), "queue should contain 1 key")
-	n, err = queue.putKey(internal.ID(2), internal.ID(3))
+	n, err = queue.putKey(internal.Entry{ID: 2}, internal.Entry{ID: 3})
 	assert.Equal(t, 2, n)
 	assert.NoError(t, err)
 	assert.Equal(t, 3, queue.Size(), "queue should contain 3 keys")
-	n, err = queue.putKey(internal.ID(2), internal.ID(3))
+	n, err = queue.putKey(internal.Entry{ID: 2}, internal.Entry{ID: 3})
 	assert.Equal(t, 0, n, "4th key should be rejected")
 	assert.Equal(t, err, ErrInsufficientCapacity,
 		"4th key should return capacity error")
@@ -173,29 +174,33 @@ func Test_Queue_Internals(t *testing.T) {
 	assert.Nil(t, bucket.data["k3"], "bucket should no longer contain kv3")
 
 	// Take keys
-	kv1 = kv{internal.ID(1).Key(), []byte("v1")}
-	kv2 = kv{internal.ID(2).Key(), []byte("v2")}
-	kv3 = kv{internal.ID(3).Key(), []byte("v3")}
+	r1 := &record{value: []byte("v1")}
+	r2 := &record{value: []byte("v2")}
+	r3 := &record{value: []byte("v3")}
+	kv1 = kv{internal.Entry{ID: 1}.Key(), r1.encode()}
+	kv2 = kv{internal.Entry{ID: 2}.Key(), r2.encode()}
+	kv3 = kv{internal.Entry{ID: 3}.Key(), r3.encode()}
 	assert.NoError(t, queue.enact([]kv{kv1, kv2}, nil),
 		"queue should enact puts without error")
-	n, err = queue.putKey(internal.ID(1), internal.ID(2), internal.ID(3))
+	n, err = queue.putKey(internal.Entry{ID: 1}, internal.Entry{ID: 2}, internal.Entry{ID: 3})
 	assert.Equal(t, 3, n, "3 keys should be accepted")
 	assert.NoError(t, err)
-	n, err = queue.putKey(internal.ID(4))
+	n, err = queue.putKey(internal.Entry{ID: 4})
 	assert.Equal(t, 0, n, "4th key should be rejected")
-	ids, keys, values, err := queue.take(2, 0)
+	ids, keys, records, err := queue.take(2, 0, nil)
 	assert.NoError(t, err, "take should not error")
-	assert.Equal(t, []internal.ID{internal.ID(1), internal.ID(2)}, ids)
-	assert.Equal(t, [][]byte{internal.ID(1).Key(), internal.ID(2).Key()}, keys)
-	assert.Equal(t, [][]byte{kv1.v, kv2.v}, values)
+	assert.Equal(t, []internal.Entry{{ID: 1}, {ID: 2}}, ids)
+	assert.Equal(t, [][]byte{internal.Entry{ID: 1}.Key(), internal.Entry{ID: 2}.Key()}, keys)
+	assert.Equal(t, []record{*r1, *r2}, records)
 }
 
 func Test_Queue_Transaction(t *testing.T) {
 	bucket := NewMockBucket()
 	queue := &Queue{
 		bucket: bucket,
+		meta:   NewMockBucket(),
 		mutex:  &sync.Mutex{},
-		ids:    internal.NewIDHeap(),
+		ids:    internal.NewEntryHeap(),
 		c:      make(chan struct{}, 3),
 	}
 
@@ -260,3 +265,37 @@ func Test_Queue_Transaction(t *testing.T) {
 	assert.EqualError(t, txn.Commit(), "insufficient queue capacity",
 		"txn put should fail with insufficient capacity")
 }
+
+type CountingBucket struct {
+	*MockBucket
+	batches int
+}
+
+func (b *CountingBucket) Batch(fn func(backend.Batch) error) error {
+	b.batches++
+	return b.MockBucket.Batch(fn)
+}
+
+func Test_Committer(t *testing.T) {
+	bucket := &CountingBucket{MockBucket: NewMockBucket()}
+	c := newCommitter(bucket, 50*time.Millisecond)
+
+	// Concurrent writes are coalesced into one batch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k := []byte(strconv.Itoa(i))
+			assert.NoError(t, c.write([]kv{{k, k}}, nil, true))
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, bucket.data, 10, "bucket should contain 10 items")
+	assert.Equal(t, 1, bucket.batches, "writes should share one batch")
+
+	// Later writes are written in a batch of their own
+	assert.NoError(t, c.write(nil, []kv{{[]byte("0"), nil}}, true))
+	assert.Len(t, bucket.data, 9, "bucket should contain 9 items")
+	assert.Equal(t, 2, bucket.batches, "write should have its own batch")
+}